@@ -116,7 +116,7 @@ func (m *MemoryCache) del(key string) {
 
 	delete(m.data, key)
 
-	if !v.timer.Stop() {
+	if v.timer != nil && !v.timer.Stop() {
 		v.deleted = true
 	}
 }
@@ -19,6 +19,14 @@ const (
 	AM  = "[=]"
 	// $exists
 	EX = "?"
+	// $near, sorted by distance
+	NEAR = "<@>"
+	// $geoWithin a radius
+	WR = "@<"
+	// $geoWithin a polygon
+	WP = "@[]"
+	// $text
+	TXT = "@@"
 	// $or
 	OR   = "OR"
 	AND  = "AND"
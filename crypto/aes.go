@@ -4,9 +4,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 )
 
+// ErrCiphertextTooShort is returned when the data to decrypt is shorter than
+// its nonce
+var ErrCiphertextTooShort = errors.New("ciphertext too short")
+
 // AESEncrypt encrypt message with AES
 func AESEncrypt(msg, key []byte) ([]byte, error) {
 	//Create a new Cipher Block from the key
@@ -46,6 +51,9 @@ func AESDecrypt(enc, key []byte) ([]byte, error) {
 	}
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return nil, ErrCiphertextTooShort
+	}
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
 	//Decrypt the data
@@ -19,3 +19,9 @@ func TestAES(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, msg, string(d))
 }
+
+func TestAESDecrypt_Short(t *testing.T) {
+	h := sha256.Sum256([]byte("pwd"))
+	_, err := AESDecrypt([]byte("A"), h[:])
+	assert.Equal(t, ErrCiphertextTooShort, err)
+}
@@ -0,0 +1,214 @@
+package docstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+const (
+	AggCount = "count"
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+)
+
+// Accumulator computes Op over Field of the documents of a group and stores
+// the result as Name. Field is not used by count.
+type Accumulator struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Field string `json:"field,omitempty"`
+}
+
+// AggregateOpt groups the documents matching Filter by the GroupBy fields and
+// computes the accumulators of every group. Having filters the resulting rows,
+// which hold the group fields and the accumulator names. Rows are ordered by
+// the group fields.
+type AggregateOpt struct {
+	Filter       []FilterOpt   `json:"filter"`
+	GroupBy      []string      `json:"group_by"`
+	Accumulators []Accumulator `json:"accumulators"`
+	Having       []FilterOpt   `json:"having"`
+}
+
+// Validate checks the accumulators are known and the row fields are unique
+func (a *AggregateOpt) Validate() error {
+	if a == nil {
+		return errors.New("[docstore] missing aggregate option")
+	}
+
+	names := make(map[string]struct{})
+	for _, g := range a.GroupBy {
+		if g == "" {
+			return errors.New("[docstore] empty group by field")
+		}
+		if _, ok := names[g]; ok {
+			return fmt.Errorf("[docstore] duplicate aggregate field %s", g)
+		}
+		names[g] = struct{}{}
+	}
+
+	for _, acc := range a.Accumulators {
+		if acc.Name == "" {
+			return errors.New("[docstore] missing accumulator name")
+		}
+		if _, ok := names[acc.Name]; ok {
+			return fmt.Errorf("[docstore] duplicate aggregate field %s", acc.Name)
+		}
+		names[acc.Name] = struct{}{}
+
+		switch acc.Op {
+		case AggCount:
+		case AggSum, AggAvg, AggMin, AggMax:
+			if acc.Field == "" {
+				return fmt.Errorf("[docstore] accumulator %s needs a field", acc.Name)
+			}
+		default:
+			return fmt.Errorf("[docstore] unknown accumulator %s", acc.Op)
+		}
+	}
+
+	return nil
+}
+
+type aggGroup struct {
+	keys []interface{}
+	docs []map[string]interface{}
+}
+
+// AggregateDocs evaluates agg over docs the way the mongo driver does, sum and
+// avg ignore values that are not numbers, min and max ignore missing values.
+func AggregateDocs(docs []map[string]interface{}, agg *AggregateOpt) ([]map[string]interface{}, error) {
+	if err := agg.Validate(); err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	groups := make([]*aggGroup, 0)
+	for _, d := range docs {
+		if !Match(d, agg.Filter) {
+			continue
+		}
+
+		keys := make([]interface{}, len(agg.GroupBy))
+		for i, g := range agg.GroupBy {
+			keys[i], _ = getPath(d, g)
+		}
+
+		k := groupKey(keys)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, &aggGroup{keys: keys})
+		}
+		groups[i].docs = append(groups[i].docs, d)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		for k := range agg.GroupBy {
+			if c := sortValue(groups[i].keys[k], groups[j].keys[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	out := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		row := make(map[string]interface{})
+		for i, f := range agg.GroupBy {
+			setPath(row, f, g.keys[i])
+		}
+		for _, acc := range agg.Accumulators {
+			row[acc.Name] = accumulate(acc, g.docs)
+		}
+
+		if Match(row, agg.Having) {
+			out = append(out, row)
+		}
+	}
+
+	return out, nil
+}
+
+func groupKey(keys []interface{}) string {
+	norm := make([]interface{}, len(keys))
+	for i, k := range keys {
+		norm[i] = normalizeValue(k)
+	}
+	return fmt.Sprintf("%#v", norm)
+}
+
+func accumulate(acc Accumulator, docs []map[string]interface{}) interface{} {
+	if acc.Op == AggCount {
+		return int64(len(docs))
+	}
+
+	var result interface{}
+	var isum int64
+	var fsum float64
+	isFloat := false
+	n := 0
+
+	for _, d := range docs {
+		v, ok := getPath(d, acc.Field)
+		if !ok || v == nil {
+			continue
+		}
+
+		switch acc.Op {
+		case AggMin, AggMax:
+			c := sortValue(v, result)
+			if result == nil || (acc.Op == AggMin && c < 0) || (acc.Op == AggMax && c > 0) {
+				result = v
+			}
+		case AggSum, AggAvg:
+			rv := reflect.ValueOf(normalizeValue(v))
+			if rv.Kind() != reflect.Float64 {
+				continue
+			}
+			if i, ok := asInt(v); ok && !isFloat {
+				isum += i
+			} else {
+				isFloat = true
+			}
+			fsum += rv.Float()
+			n++
+		}
+	}
+
+	switch acc.Op {
+	case AggSum:
+		if isFloat {
+			return fsum
+		}
+		return isum
+	case AggAvg:
+		if n == 0 {
+			return nil
+		}
+		return fsum / float64(n)
+	}
+
+	return result
+}
+
+func asInt(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,319 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/domain/principal"
+	"github.com/bondhan/golib/util"
+)
+
+const defaultHistorySuffix = "_history"
+
+// HistoryEntry is a write of a document recorded by the audit mode
+type HistoryEntry struct {
+	ID    string      `json:"id"`
+	DocID interface{} `json:"doc_id"`
+	// Type is the change made, ChangeInsert, ChangeUpdate or ChangeDelete
+	Type string `json:"type"`
+	// Actor and User are the ID and user of the principal of the write
+	Actor string `json:"actor,omitempty"`
+	User  string `json:"user,omitempty"`
+	// Tenant is the tenant of the write when the store is scoped by tenant
+	Tenant string    `json:"tenant,omitempty"`
+	Time   time.Time `json:"time"`
+	// Seq orders the entries, it is the time in nanoseconds
+	Seq     int64         `json:"seq"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// FieldChange is the change of a dotted field path of a document, Added is
+// set when the field did not exist before the write and Removed when it does
+// not exist after it
+type FieldChange struct {
+	Field   string      `json:"field"`
+	Old     interface{} `json:"old,omitempty"`
+	New     interface{} `json:"new,omitempty"`
+	Added   bool        `json:"added,omitempty"`
+	Removed bool        `json:"removed,omitempty"`
+}
+
+// auditDoc is a document written, as stored before the write
+type auditDoc struct {
+	id     interface{}
+	before map[string]interface{}
+}
+
+func (c *Config) historyCollection() string {
+	if c.HistoryCollection != "" {
+		return c.HistoryCollection
+	}
+	return c.Collection + defaultHistorySuffix
+}
+
+// historyConfig returns the config of the history collection of c
+func (c *Config) historyConfig() *Config {
+	h := *c
+	h.Collection = c.historyCollection()
+	h.IDField = defaultID
+	h.Indexes = nil
+	h.VersionField = ""
+	h.Audit = false
+	return &h
+}
+
+// SetHistory sets the store of the history collection, New opens it with
+// the driver of the config
+func (s *CachedStore) SetHistory(history Driver) {
+	s.history = history
+}
+
+// audit reads the documents before the writes of the store, after records
+// their changes in the history collection
+func (s *CachedStore) audit() {
+	for _, p := range []HookPoint{BeforeCreate, BeforeUpdate, BeforeDelete} {
+		s.AddHook(p, s.auditBefore)
+	}
+}
+
+// auditBefore reads the documents of the write as they are stored
+func (s *CachedStore) auditBefore(ctx context.Context, event *HookEvent) error {
+	if s.history == nil {
+		return errors.New("[docstore] audit history store is not set")
+	}
+
+	if event.ID != nil {
+		d, err := s.rawDoc(ctx, event.ID)
+		if err != nil {
+			return err
+		}
+		event.audit = []auditDoc{{id: event.ID, before: d}}
+		return nil
+	}
+
+	filters, err := s.blindFilters(event.Filter)
+	if err != nil {
+		return err
+	}
+
+	var docs []map[string]interface{}
+	if err := s.storage.Find(ctx, &QueryOpt{Filter: filters}, &docs); err != nil {
+		return err
+	}
+
+	event.audit = make([]auditDoc, 0, len(docs))
+	for _, d := range docs {
+		id, _ := getPath(d, s.IDField)
+		event.audit = append(event.audit, auditDoc{id: id, before: copyDoc(d)})
+	}
+	return nil
+}
+
+// auditAfter records the changes of the documents of the write
+func (s *CachedStore) auditAfter(ctx context.Context, event *HookEvent) error {
+	var actor, user string
+	if p, err := principal.GetPrincipalFromContext(ctx); err == nil {
+		actor, user = p.ID, p.User
+	}
+
+	for _, a := range event.audit {
+		after, err := s.rawDoc(ctx, a.id)
+		if err != nil {
+			return err
+		}
+
+		changes := diffDocs("", a.before, after)
+		if len(changes) == 0 {
+			continue
+		}
+
+		// the rewrites of the migrations run over every tenant, so the
+		// tenant is the one of the document
+		var tenant string
+		if s.tenancy() {
+			tenant = docTenant(s.tenantField(), a.before, after)
+		}
+
+		now := time.Now()
+		entry := &HistoryEntry{
+			DocID:   a.id,
+			Type:    ChangeUpdate,
+			Actor:   actor,
+			User:    user,
+			Tenant:  tenant,
+			Time:    now,
+			Seq:     now.UnixNano(),
+			Changes: changes,
+		}
+		switch {
+		case a.before == nil:
+			entry.Type = ChangeInsert
+		case after == nil:
+			entry.Type = ChangeDelete
+		}
+		entry.ID = fmt.Sprintf("%v", s.IDGenerator(reflect.TypeOf(""), entry))
+
+		if err := s.history.Create(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// docTenant returns the tenant of the document written, deleted documents
+// only have one before the write
+func docTenant(field string, before, after map[string]interface{}) string {
+	for _, d := range []map[string]interface{}{after, before} {
+		if v, ok := getPath(d, field); ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return ""
+}
+
+// rawDoc returns a copy of the document of id as stored, nil when it does
+// not exist. Drivers may share nested documents with their storage.
+func (s *CachedStore) rawDoc(ctx context.Context, id interface{}) (map[string]interface{}, error) {
+	d := make(map[string]interface{})
+	if err := s.storage.Get(ctx, id, &d); err != nil {
+		if err == NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return copyDoc(d), nil
+}
+
+// History returns the recorded writes of the document of id, oldest first
+func (s *CachedStore) History(ctx context.Context, id interface{}) ([]HistoryEntry, error) {
+	if s.history == nil {
+		return nil, errors.New("[docstore] audit history store is not set")
+	}
+
+	filters := []FilterOpt{{Field: "doc_id", Ops: constant.EQ, Value: id}}
+	if s.tenancy() {
+		tenant, err := s.tenantOf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, FilterOpt{Field: "tenant", Ops: constant.EQ, Value: tenant})
+	}
+
+	var entries []HistoryEntry
+	err := s.history.Find(ctx, &QueryOpt{
+		Filter:   filters,
+		OrderBy:  "seq",
+		IsAscend: true,
+	}, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+// AsOf decodes into doc the document of id as it was at t, undoing the
+// recorded writes made after t on the stored document. It returns NotFound
+// when the document did not exist or was deleted at t.
+func (s *CachedStore) AsOf(ctx context.Context, id interface{}, t time.Time, doc interface{}) error {
+	entries, err := s.History(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	d, err := s.rawDoc(ctx, id)
+	if err != nil {
+		return err
+	}
+	exists := d != nil
+	if d == nil {
+		d = make(map[string]interface{})
+	}
+
+	for i := len(entries) - 1; i >= 0 && entries[i].Seq > t.UnixNano(); i-- {
+		e := entries[i]
+		for _, c := range e.Changes {
+			if c.Added {
+				unsetPath(d, c.Field)
+				continue
+			}
+			setPath(d, c.Field, c.Old)
+		}
+
+		switch e.Type {
+		case ChangeInsert:
+			exists = false
+		case ChangeDelete:
+			exists = true
+		}
+	}
+
+	if !exists || (s.SoftDelete && s.isDeleted(d)) {
+		return NotFound
+	}
+	if s.tenancy() {
+		if err := s.ownDoc(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	if err := s.decryptDoc(d); err != nil {
+		return err
+	}
+	// past versions are upgraded but never saved
+	if s.migrating() {
+		if _, err := s.upgrade(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	return util.DecodeJSON(d, doc)
+}
+
+// diffDocs returns the changes of the fields under prefix from before to
+// after, documents are compared field by field
+func diffDocs(prefix string, before, after map[string]interface{}) []FieldChange {
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := make([]FieldChange, 0)
+	for _, k := range keys {
+		field := prefix + k
+		b, bok := before[k]
+		a, aok := after[k]
+
+		switch {
+		case !bok:
+			changes = append(changes, FieldChange{Field: field, New: a, Added: true})
+		case !aok:
+			changes = append(changes, FieldChange{Field: field, Old: b, Removed: true})
+		default:
+			bm, bIsDoc := b.(map[string]interface{})
+			am, aIsDoc := a.(map[string]interface{})
+			if bIsDoc && aIsDoc {
+				changes = append(changes, diffDocs(field+".", bm, am)...)
+				continue
+			}
+			if !equalValue(b, a) {
+				changes = append(changes, FieldChange{Field: field, Old: b, New: a})
+			}
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,898 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/imdario/mergo"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bondhan/golib/util"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+const (
+	maxTxRetry    = 10
+	bulkBatchSize = 1000
+)
+
+// BadgerStore persists the documents of a collection in a Badger database.
+// Documents are stored as JSON under their ID, several collections can share
+// a database. Secondary indexes declared in Config.Indexes narrow the
+// documents read for equality filters.
+type BadgerStore struct {
+	db         *badger.DB
+	owned      bool
+	idField    string
+	collection string
+	indexes    []index
+	mux        *sync.Mutex
+	watchers   map[*docstore.ChangeQueue]struct{}
+}
+
+// Connection is the map form of the badger connection
+type Connection struct {
+	Path     string `json:"path"`
+	InMemory bool   `json:"in_memory"`
+}
+
+func init() {
+	docstore.RegisterDriver("badger", BadgerStoreFactory)
+	docstore.RegisterErrorClassifier("badger", IsTransient)
+}
+
+// IsTransient reports the conflicts of transactions still conflicting after
+// the retries of the store
+func IsTransient(err error) bool {
+	return errors.Is(err, badger.ErrConflict)
+}
+
+func BadgerStoreFactory(config *docstore.Config) (docstore.Driver, error) {
+	return NewBadgerStore(config)
+}
+
+// NewBadgerStore opens the store of the config collection, the connection is
+// a *badger.DB, the database directory or a Connection map
+func NewBadgerStore(config *docstore.Config) (*BadgerStore, error) {
+	var con Connection
+	switch v := config.Connection.(type) {
+	case *badger.DB:
+		return NewBadgerstore(v, config.Collection, config.IDField, config.Indexes)
+	case string:
+		con.Path = v
+	case Connection:
+		con = v
+	case *Connection:
+		con = *v
+	case map[string]interface{}:
+		if err := util.DecodeJSON(v, &con); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("[docstore/badger] unsupported connection type")
+	}
+
+	if con.Path == "" && !con.InMemory {
+		return nil, errors.New("[docstore/badger] missing database path")
+	}
+
+	opts := badger.DefaultOptions(con.Path).WithInMemory(con.InMemory).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewBadgerstore(db, config.Collection, config.IDField, config.Indexes)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.owned = true
+
+	return s, nil
+}
+
+// NewBadgerstore returns the store of a collection in db and builds the
+// indexes that are new or changed since the last run
+func NewBadgerstore(db *badger.DB, collection, idField string, indexes []map[string]map[string]interface{}) (*BadgerStore, error) {
+	if idField == "" {
+		return nil, errors.New("[docstore/badger] missing id field param")
+	}
+
+	s := &BadgerStore{
+		db:         db,
+		idField:    idField,
+		collection: collection,
+		mux:        &sync.Mutex{},
+		watchers:   make(map[*docstore.ChangeQueue]struct{}),
+	}
+
+	if err := s.setIndexes(indexes); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// update runs fn in a write transaction, retried on conflicts, and notifies
+// the watchers once it commits
+func (s *BadgerStore) update(fn func(w *writer) error) error {
+	for i := 0; ; i++ {
+		w := &writer{store: s}
+		err := s.db.Update(func(txn *badger.Txn) error {
+			w.txn = txn
+			return fn(w)
+		})
+		if err == badger.ErrConflict && i < maxTxRetry {
+			continue
+		}
+		if err == nil {
+			s.notify(w.events)
+		}
+		return err
+	}
+}
+
+func (s *BadgerStore) docID(doc interface{}) (interface{}, map[string]interface{}, error) {
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return nil, nil, err
+	}
+
+	id, ok := d[s.idField]
+	if !ok || id == nil {
+		return nil, nil, errors.New("[docstore/badger] missing document ID")
+	}
+
+	return id, d, nil
+}
+
+func (s *BadgerStore) Create(ctx context.Context, doc interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Create")
+	defer span.End()
+
+	id, d, err := s.docID(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(w *writer) error {
+		return w.create(id, d)
+	})
+}
+
+func (s *BadgerStore) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Update")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		return w.update(ctx, id, doc, replace)
+	})
+}
+
+// UpdateMany sets the fields of the documents matching the filters
+func (s *BadgerStore) UpdateMany(ctx context.Context, filters []docstore.FilterOpt, fields map[string]interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "UpdateMany")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		entries, err := s.match(w.txn, filters, true, 0)
+		if err != nil {
+			return err
+		}
+
+		modified := 0
+		for _, e := range entries {
+			before, err := decodeDoc(e.raw)
+			if err != nil {
+				return err
+			}
+
+			for k, v := range fields {
+				docstore.SetPath(e.doc, k, v)
+			}
+
+			raw, err := encodeDoc(e.doc)
+			if err != nil {
+				return err
+			}
+			if string(raw) == string(e.raw) {
+				continue
+			}
+			if err := docstore.NextVersion(ctx, before, e.doc); err != nil {
+				return err
+			}
+
+			modified++
+			if err := w.put(e.doc[s.idField], before, e.doc); err != nil {
+				return err
+			}
+		}
+
+		if modified == 0 {
+			if len(entries) == 0 {
+				return docstore.NotFound
+			}
+			return docstore.NothingUpdated
+		}
+
+		return nil
+	})
+}
+
+func (s *BadgerStore) Upsert(ctx context.Context, id, doc interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Upsert")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		_, ok, err := w.get(id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return w.update(ctx, id, doc, false)
+		}
+
+		d := make(map[string]interface{})
+		if err := util.DecodeJSON(doc, &d); err != nil {
+			return err
+		}
+		d[s.idField] = id
+		if err := docstore.NextVersion(ctx, nil, d); err != nil {
+			return err
+		}
+		return w.put(id, nil, d)
+	})
+}
+
+// UpdateField applies the field updates on the document of id, an UpdateOpt
+// option may upsert it
+func (s *BadgerStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "UpdateField")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		before, ok, err := w.get(id)
+		if err != nil {
+			return err
+		}
+		if !ok && !docstore.GetUpdateOpt(opts...).Upsert {
+			return docstore.NotFound
+		}
+
+		d := map[string]interface{}{s.idField: id}
+		if ok {
+			d = docstore.CopyDoc(before)
+		}
+		if err := docstore.ApplyUpdates(d, fields, !ok); err != nil {
+			return err
+		}
+
+		if err := docstore.NextVersion(ctx, before, d); err != nil {
+			return err
+		}
+
+		return w.put(id, before, d)
+	})
+}
+
+// Increment adds value to the field, a missing document or field is created
+// with the value
+func (s *BadgerStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Increment")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		before, ok, err := w.get(id)
+		if err != nil {
+			return err
+		}
+
+		stored := before
+		if !ok {
+			stored = map[string]interface{}{s.idField: id}
+		}
+
+		d := docstore.CopyDoc(stored)
+		switch v := fieldValue(d, key).(type) {
+		case nil:
+			docstore.SetPath(d, key, int64(value))
+		case int64:
+			docstore.SetPath(d, key, v+int64(value))
+		case float64:
+			docstore.SetPath(d, key, v+float64(value))
+		default:
+			return errors.New("[docstore/badger] destination type is not a number")
+		}
+
+		if err := docstore.NextVersion(ctx, stored, d); err != nil {
+			return err
+		}
+
+		return w.put(id, before, d)
+	})
+}
+
+func fieldValue(doc map[string]interface{}, key string) interface{} {
+	v, _ := docstore.GetPath(doc, key)
+	return v
+}
+
+func (s *BadgerStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
+	if err := s.Increment(ctx, id, key, value); err != nil {
+		return err
+	}
+	return s.Get(ctx, id, doc)
+}
+
+func (s *BadgerStore) Delete(ctx context.Context, id interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Delete")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		return w.delete(id)
+	})
+}
+
+func (s *BadgerStore) DeleteMany(ctx context.Context, query *docstore.QueryOpt) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "DeleteMany")
+	defer span.End()
+
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	return s.update(func(w *writer) error {
+		entries, err := s.match(w.txn, filters, true, 0)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			return docstore.NotFound
+		}
+
+		for _, e := range entries {
+			if err := w.remove(e.doc[s.idField], e.doc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Get reads the document of id, a docstore.Projection option selects its
+// fields
+func (s *BadgerStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Get")
+	defer span.End()
+
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	return s.db.View(func(txn *badger.Txn) error {
+		return s.get(txn, id, doc, p)
+	})
+}
+
+func (s *BadgerStore) get(txn *badger.Txn, id interface{}, doc interface{}, p docstore.Projection) error {
+	d, ok, err := s.read(txn, s.docKey(encodeValue(nil, id)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return docstore.NotFound
+	}
+
+	return util.DecodeJSON(docstore.ProjectDoc(d, p, s.idField), doc)
+}
+
+// Count counts the documents matching the query filters, skip and limit are
+// ignored like the mongo driver does.
+func (s *BadgerStore) Count(ctx context.Context, query *docstore.QueryOpt) (int64, error) {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Count")
+	defer span.End()
+
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	var count int64
+	err := s.db.View(func(txn *badger.Txn) error {
+		entries, err := s.match(txn, filters, true, 0)
+		count = int64(len(entries))
+		return err
+	})
+
+	return count, err
+}
+
+func (s *BadgerStore) Find(ctx context.Context, query *docstore.QueryOpt, docs interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Find")
+	defer span.End()
+
+	var out []map[string]interface{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		out, err = s.find(txn, query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+func (s *BadgerStore) FindOne(ctx context.Context, query *docstore.QueryOpt, doc interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "FindOne")
+	defer span.End()
+
+	q := &docstore.QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+	q.Limit = 1
+
+	var out []map[string]interface{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		out, err = s.find(txn, q)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(out) == 0 {
+		return docstore.NotFound
+	}
+
+	return util.DecodeJSON(out[0], doc)
+}
+
+// BulkCreate creates the documents in transactions of bulkBatchSize
+// documents, a failing batch is not written but the previous ones are
+func (s *BadgerStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "BulkCreate")
+	defer span.End()
+
+	for start := 0; start < len(docs); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		err := s.update(func(w *writer) error {
+			for _, doc := range docs[start:end] {
+				id, d, err := s.docID(doc)
+				if err != nil {
+					return err
+				}
+				if err := w.create(id, d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BulkGet returns the documents found in the order of ids, missing IDs are
+// skipped like the mongo driver does.
+func (s *BadgerStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "BulkGet")
+	defer span.End()
+
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	out := make([]map[string]interface{}, 0, len(ids))
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			d, ok, err := s.read(txn, s.docKey(encodeValue(nil, id)))
+			if err != nil {
+				return err
+			}
+			if ok {
+				out = append(out, docstore.ProjectDoc(d, p, s.idField))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+// Migrate rebuilds the indexes of a *docstore.Config
+func (s *BadgerStore) Migrate(ctx context.Context, config interface{}) error {
+	switch v := config.(type) {
+	case *docstore.Config:
+		return s.setIndexes(v.Indexes)
+	case docstore.Config:
+		return s.setIndexes(v.Indexes)
+	}
+	return nil
+}
+
+func (s *BadgerStore) As(i interface{}) bool {
+	p, ok := i.(**badger.DB)
+	if !ok {
+		return false
+	}
+	*p = s.db
+	return true
+}
+
+func (s *BadgerStore) Ping(ctx context.Context) error {
+	if s.db.IsClosed() {
+		return errors.New("[docstore/badger] database is closed")
+	}
+	return nil
+}
+
+// Disconnect closes the database opened by NewBadgerStore, a database passed
+// as connection is left to its owner
+func (s *BadgerStore) Disconnect(ctx context.Context) error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Pull removes the array elements matching removeCondition from the first
+// document matching condition, the same way as the mongo driver.
+func (s *BadgerStore) Pull(ctx context.Context, condition, removeCondition docstore.Field) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Pull")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		entries, err := s.match(w.txn, []docstore.FilterOpt{docstore.FieldFilter(condition)}, true, 1)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return docstore.NotFound
+		}
+
+		before := docstore.CopyDoc(entries[0].doc)
+		d := entries[0].doc
+		kept, removed := docstore.PullValues(fieldValue(d, removeCondition.Name), removeCondition.Value)
+		if removed == 0 {
+			return docstore.NothingUpdated
+		}
+
+		docstore.SetPath(d, removeCondition.Name, kept)
+		return w.put(d[s.idField], before, d)
+	})
+}
+
+// Distinct returns the distinct values of fieldName. The filter can be nil,
+// a *QueryOpt, a FilterOpt slice or a map of field equality.
+func (s *BadgerStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Distinct")
+	defer span.End()
+
+	filters, err := docstore.ToFilters(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []map[string]interface{}
+	err = s.db.View(func(txn *badger.Txn) error {
+		entries, err := s.match(txn, filters, true, 0)
+		docs = entryDocs(entries)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return docstore.DistinctValues(docs, fieldName), nil
+}
+
+// Aggregate evaluates agg over the stored documents
+func (s *BadgerStore) Aggregate(ctx context.Context, agg *docstore.AggregateOpt, docs interface{}) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Aggregate")
+	defer span.End()
+
+	if err := agg.Validate(); err != nil {
+		return err
+	}
+
+	var all []map[string]interface{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		entries, err := s.match(txn, agg.Filter, true, 0)
+		all = entryDocs(entries)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err := docstore.AggregateDocs(all, agg)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(rows, docs)
+}
+
+// BulkWrite runs the writes one by one, each in its own transaction
+func (s *BadgerStore) BulkWrite(ctx context.Context, ops []docstore.WriteOp, opts ...interface{}) ([]docstore.WriteResult, error) {
+	tracer := otel.Tracer("docstore/badger")
+	ctx, span := tracer.Start(ctx, "BulkWrite")
+	defer span.End()
+
+	return docstore.WriteEach(ctx, s, s.idField, ops, opts...)
+}
+
+// RunInTransaction runs fn in a badger transaction, fn is run again when the
+// transaction conflicts with a concurrent write
+func (s *BadgerStore) RunInTransaction(ctx context.Context, fn func(tx docstore.Tx) error) error {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "RunInTransaction")
+	defer span.End()
+
+	return s.update(func(w *writer) error {
+		return fn(&badgerTx{w: w})
+	})
+}
+
+type badgerTx struct {
+	w *writer
+}
+
+func (t *badgerTx) Create(ctx context.Context, doc interface{}) error {
+	id, d, err := t.w.store.docID(doc)
+	if err != nil {
+		return err
+	}
+	return t.w.create(id, d)
+}
+
+func (t *badgerTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	return t.w.update(ctx, id, doc, replace)
+}
+
+func (t *badgerTx) Delete(ctx context.Context, id interface{}) error {
+	return t.w.delete(id)
+}
+
+func (t *badgerTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	return t.w.store.get(t.w.txn, id, doc, docstore.Projection{})
+}
+
+// Watch streams the changes made through the store to the documents matching
+// the query filter. The stream is buffered so it never blocks writers.
+func (s *BadgerStore) Watch(ctx context.Context, query *docstore.QueryOpt) (docstore.ChangeStream, error) {
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var q *docstore.ChangeQueue
+	q = docstore.NewChangeQueue(filters, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		delete(s.watchers, q)
+	})
+	s.watchers[q] = struct{}{}
+
+	return q, nil
+}
+
+func (s *BadgerStore) notify(events []docstore.ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for q := range s.watchers {
+		for _, event := range events {
+			ev := event
+			if ev.Before != nil {
+				ev.Before = docstore.CopyDoc(ev.Before)
+			}
+			if ev.After != nil {
+				ev.After = docstore.CopyDoc(ev.After)
+			}
+			q.Push(ev)
+		}
+	}
+}
+
+// writer applies the writes of a transaction and keeps their change events
+type writer struct {
+	store  *BadgerStore
+	txn    *badger.Txn
+	events []docstore.ChangeEvent
+}
+
+func (w *writer) get(id interface{}) (map[string]interface{}, bool, error) {
+	return w.store.read(w.txn, w.store.docKey(encodeValue(nil, id)))
+}
+
+func (w *writer) create(id interface{}, d map[string]interface{}) error {
+	_, ok, err := w.get(id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errors.New("[docstore/badger] document ID is already exist")
+	}
+
+	return w.put(id, nil, d)
+}
+
+func (w *writer) update(ctx context.Context, id, doc interface{}, replace bool) error {
+	before, ok, err := w.get(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return docstore.NotFound
+	}
+
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return err
+	}
+
+	if !replace {
+		cd := docstore.CopyDoc(before)
+		if err := mergo.MergeWithOverwrite(&cd, d); err != nil {
+			return err
+		}
+		d = cd
+	}
+
+	if err := docstore.NextVersion(ctx, before, d); err != nil {
+		return err
+	}
+
+	return w.put(id, before, d)
+}
+
+func (w *writer) delete(id interface{}) error {
+	before, ok, err := w.get(id)
+	if err != nil || !ok {
+		return err
+	}
+	return w.remove(id, before)
+}
+
+// put writes the document of id and its index entries, before is the stored
+// document or nil
+func (w *writer) put(id interface{}, before, after map[string]interface{}) error {
+	s := w.store
+	if _, ok := after[s.idField]; !ok {
+		after[s.idField] = id
+	}
+
+	idKey := encodeValue(nil, id)
+	if before != nil {
+		if err := w.unindex(idKey, before); err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range s.indexes {
+		for _, vals := range idx.entries(after) {
+			if idx.unique {
+				if err := w.checkUnique(idx, vals, idKey); err != nil {
+					return err
+				}
+			}
+			if err := w.txn.Set(s.indexKey(idx, vals, idKey), nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	raw, err := encodeDoc(after)
+	if err != nil {
+		return err
+	}
+	if err := w.txn.Set(s.docKey(idKey), raw); err != nil {
+		return err
+	}
+
+	// the event documents are decoded again so they hold the stored types
+	ev := docstore.ChangeEvent{Type: docstore.ChangeInsert, ID: id}
+	if ev.After, err = decodeDoc(raw); err != nil {
+		return err
+	}
+	if before != nil {
+		ev.Type = docstore.ChangeUpdate
+		ev.Before = before
+	}
+	w.events = append(w.events, ev)
+
+	return nil
+}
+
+func (w *writer) remove(id interface{}, before map[string]interface{}) error {
+	idKey := encodeValue(nil, id)
+	if err := w.unindex(idKey, before); err != nil {
+		return err
+	}
+
+	if err := w.txn.Delete(w.store.docKey(idKey)); err != nil {
+		return err
+	}
+
+	w.events = append(w.events, docstore.ChangeEvent{Type: docstore.ChangeDelete, ID: id, Before: before})
+	return nil
+}
+
+func (w *writer) unindex(idKey []byte, doc map[string]interface{}) error {
+	for _, idx := range w.store.indexes {
+		for _, vals := range idx.entries(doc) {
+			if err := w.txn.Delete(w.store.indexKey(idx, vals, idKey)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkUnique fails when another document holds the values of a unique index
+func (w *writer) checkUnique(idx index, vals []interface{}, idKey []byte) error {
+	prefix := w.store.indexKey(idx, vals, nil)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := w.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if string(it.Item().Key()[len(prefix):]) != string(idKey) {
+			return fmt.Errorf("[docstore/badger] duplicate key on index %s", idx.name)
+		}
+	}
+
+	return nil
+}
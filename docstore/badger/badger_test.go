@@ -0,0 +1,124 @@
+package badger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bondhan/golib/constant"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+func openDB(t *testing.T) *badger.DB {
+	t.Helper()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestBadgerStore(t *testing.T) {
+	bs, err := NewBadgerstore(openDB(t), "test", "id", []map[string]map[string]interface{}{
+		{"keys": {"group": 1}},
+		{"keys": {"name": 1}},
+	})
+	require.Nil(t, err)
+
+	docstore.DriverConformanceTest(bs, t)
+}
+
+func TestBadgerStore_Index(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	indexes := []map[string]map[string]interface{}{
+		{"keys": {"email": 1}, "options": {"unique": true, "sparse": true}},
+		{"keys": {"tags": 1}},
+	}
+
+	bs, err := NewBadgerstore(db, "users", "id", indexes)
+	require.Nil(t, err)
+
+	docs := []interface{}{
+		map[string]interface{}{"id": 1, "email": "a@mail.com", "tags": []string{"x", "y"}, "age": 20},
+		map[string]interface{}{"id": 2, "email": "b@mail.com", "tags": []string{"y"}, "age": 30},
+		map[string]interface{}{"id": 3, "tags": []string{"z"}, "age": 40},
+		map[string]interface{}{"id": 4, "age": 50},
+	}
+	require.Nil(t, bs.BulkCreate(ctx, docs))
+
+	err = bs.Create(ctx, map[string]interface{}{"id": 5, "email": "a@mail.com"})
+	assert.NotNil(t, err, "unique index")
+	assert.Nil(t, bs.Create(ctx, map[string]interface{}{"id": 6}), "sparse index")
+
+	var out []map[string]interface{}
+	require.Nil(t, bs.Find(ctx, &docstore.QueryOpt{
+		Filter: []docstore.FilterOpt{{Field: "tags", Ops: constant.EQ, Value: "y"}},
+	}, &out))
+	require.Len(t, out, 2)
+	assert.EqualValues(t, 1, out[0]["id"])
+	assert.EqualValues(t, 2, out[1]["id"])
+
+	out = nil
+	require.Nil(t, bs.Find(ctx, &docstore.QueryOpt{
+		Filter: []docstore.FilterOpt{
+			{Field: "tags", Ops: constant.IN, Value: []string{"x", "z"}},
+			{Field: "age", Ops: constant.GT, Value: 20},
+		},
+	}, &out))
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 3, out[0]["id"])
+
+	require.Nil(t, bs.Update(ctx, 2, map[string]interface{}{"email": "c@mail.com"}, false))
+	assert.Nil(t, bs.Create(ctx, map[string]interface{}{"id": 7, "email": "b@mail.com"}), "released unique value")
+
+	n, err := bs.Count(ctx, &docstore.QueryOpt{Filter: []docstore.FilterOpt{{Field: "email", Ops: constant.EQ, Value: "c@mail.com"}}})
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, n)
+
+	// a changed index definition is rebuilt from the stored documents
+	indexes = append(indexes, map[string]map[string]interface{}{"keys": {"age": 1}})
+	require.Nil(t, bs.Migrate(ctx, &docstore.Config{Indexes: indexes}))
+
+	out = nil
+	require.Nil(t, bs.Find(ctx, &docstore.QueryOpt{
+		Filter: []docstore.FilterOpt{{Field: "age", Ops: constant.EQ, Value: 40.0}},
+	}, &out))
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 3, out[0]["id"])
+
+	indexes = append(indexes, map[string]map[string]interface{}{"keys": {"age": 1}, "options": {"name": "age_unique", "unique": true}})
+	require.Nil(t, bs.Update(ctx, 4, map[string]interface{}{"age": 40}, false))
+	assert.NotNil(t, bs.Migrate(ctx, &docstore.Config{Indexes: indexes}), "duplicate values of a new unique index")
+}
+
+func TestBadgerStore_Persistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	config := &docstore.Config{
+		Driver:     "badger",
+		Collection: "test",
+		IDField:    "id",
+		Connection: dir,
+	}
+
+	d, err := docstore.GetDriver(config)
+	require.Nil(t, err)
+	require.Nil(t, d.Create(ctx, map[string]interface{}{"id": "1", "name": "test"}))
+	require.Nil(t, d.Disconnect(ctx))
+
+	d, err = docstore.GetDriver(config)
+	require.Nil(t, err)
+	defer d.Disconnect(ctx)
+
+	var doc map[string]interface{}
+	require.Nil(t, d.Get(ctx, "1", &doc))
+	assert.Equal(t, "test", doc["name"])
+}
@@ -0,0 +1,265 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"time"
+)
+
+// value tags of the key encoding, ordered the way docstore sorts values of
+// different types
+const (
+	tagNil    = 0x00
+	tagNumber = 0x10
+	tagString = 0x20
+	tagOther  = 0x30
+	tagBool   = 0x40
+	tagTime   = 0x50
+)
+
+const dateField = "$date"
+
+var errInvalidKey = errors.New("[docstore/badger] invalid index key")
+
+// encodeValue appends the key encoding of v to b. The encoding sorts like the
+// values and is self delimiting, so values can be concatenated in keys.
+// Numbers are encoded as their float64 value followed by the exact integer,
+// so integers and floats of the same value are equal.
+func encodeValue(b []byte, v interface{}) []byte {
+	switch x := plainValue(v).(type) {
+	case nil:
+		return append(b, tagNil)
+	case int64:
+		return appendNumber(b, float64(x), x)
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < math.MaxInt64 {
+			return appendNumber(b, x, int64(x))
+		}
+		return appendNumber(b, x, 0)
+	case string:
+		return appendString(append(b, tagString), x)
+	case bool:
+		if x {
+			return append(b, tagBool, 1)
+		}
+		return append(b, tagBool, 0)
+	case time.Time:
+		return binary.BigEndian.AppendUint64(append(b, tagTime), uint64(x.UnixNano())^(1<<63))
+	default:
+		raw, err := json.Marshal(x)
+		if err != nil {
+			raw = []byte(reflect.ValueOf(x).String())
+		}
+		return appendString(append(b, tagOther), string(raw))
+	}
+}
+
+// encodeScanValue returns the key prefix of the values equal to v, which
+// leaves out the exact integer of numbers
+func encodeScanValue(b []byte, v interface{}) []byte {
+	start := len(b)
+	b = encodeValue(b, v)
+	if b[start] == tagNumber {
+		return b[:len(b)-8]
+	}
+	return b
+}
+
+func appendNumber(b []byte, f float64, i int64) []byte {
+	if f == 0 {
+		f = 0 // drops the sign of -0
+	}
+
+	bits := math.Float64bits(f)
+	if f < 0 {
+		bits = ^bits
+	} else {
+		bits ^= 1 << 63
+	}
+
+	b = binary.BigEndian.AppendUint64(append(b, tagNumber), bits)
+	return binary.BigEndian.AppendUint64(b, uint64(i)^(1<<63))
+}
+
+// appendString escapes the 0x00 bytes of s and terminates it with 0x00 0x01
+func appendString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			b = append(b, 0, 0xff)
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return append(b, 0, 1)
+}
+
+// plainValue converts v to nil, int64, float64, string, bool or time.Time
+// when it is one of their kinds
+func plainValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, string, bool, int64, float64, time.Time:
+		return x
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+		return x.String()
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return float64(u)
+		}
+		return int64(u)
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+
+	if t, ok := rv.Interface().(time.Time); ok {
+		return t
+	}
+
+	return rv.Interface()
+}
+
+// isScalar reports whether v is a number, string or bool, the values the
+// indexes are looked up with
+func isScalar(v interface{}) bool {
+	switch plainValue(v).(type) {
+	case int64, float64, string, bool:
+		return true
+	}
+	return false
+}
+
+// encodeDoc returns the stored form of a document, JSON with the time values
+// kept as {"$date": RFC3339Nano} so they are read back as time.Time
+func encodeDoc(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(wrapTimes(doc))
+}
+
+func wrapTimes(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			out[k] = wrapTimes(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = wrapTimes(e)
+		}
+		return out
+	case time.Time:
+		return map[string]interface{}{dateField: x.Format(time.RFC3339Nano)}
+	case *time.Time:
+		if x == nil {
+			return nil
+		}
+		return map[string]interface{}{dateField: x.Format(time.RFC3339Nano)}
+	}
+	return v
+}
+
+// decodeDoc reads a stored document, integral numbers are read as int64 and
+// the other numbers as float64
+func decodeDoc(raw []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	for k, v := range doc {
+		doc[k] = unwrapValue(v)
+	}
+	return doc, nil
+}
+
+func unwrapValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		return plainValue(x)
+	case []interface{}:
+		for i, e := range x {
+			x[i] = unwrapValue(e)
+		}
+		return x
+	case map[string]interface{}:
+		if s, ok := x[dateField].(string); ok && len(x) == 1 {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+		for k, e := range x {
+			x[k] = unwrapValue(e)
+		}
+		return x
+	}
+	return v
+}
+
+// skipValues returns b without its first n encoded values
+func skipValues(b []byte, n int) ([]byte, error) {
+	for ; n > 0; n-- {
+		if len(b) == 0 {
+			return nil, errInvalidKey
+		}
+
+		size := 0
+		switch b[0] {
+		case tagNil:
+			size = 1
+		case tagNumber:
+			size = 17
+		case tagBool:
+			size = 2
+		case tagTime:
+			size = 9
+		case tagString, tagOther:
+			size = -1
+			for i := 1; i+1 < len(b); i++ {
+				if b[i] != 0 {
+					continue
+				}
+				if b[i+1] == 1 {
+					size = i + 2
+					break
+				}
+				i++ // escaped 0x00
+			}
+		}
+
+		if size <= 0 || size > len(b) {
+			return nil, errInvalidKey
+		}
+		b = b[size:]
+	}
+	return b, nil
+}
@@ -0,0 +1,287 @@
+package badger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+const (
+	kindDoc   = 'd'
+	kindIndex = 'i'
+	kindMeta  = 'm'
+)
+
+// index is a secondary index, it keeps a key per document and combination
+// of the field values, array fields adding a key per element
+type index struct {
+	name   string
+	fields []string
+	unique bool
+	sparse bool
+}
+
+// indexMeta is the stored definition of an index, a changed definition makes
+// the index rebuilt
+type indexMeta struct {
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique"`
+	Sparse bool     `json:"sparse"`
+}
+
+// parseIndex reads an index of Config.Indexes, the mongo driver format
+// {"keys": {field: 1}, "options": {"name": ..., "unique": ..., "sparse": ...}}
+func parseIndex(conf map[string]map[string]interface{}) (index, error) {
+	var idx index
+
+	keys := make([]string, 0, len(conf["keys"]))
+	for k := range conf["keys"] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch v := conf["keys"][k].(type) {
+		case []interface{}:
+			// compound keys keep the order of the list
+			for _, e := range v {
+				m, ok := e.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				fields := make([]string, 0, len(m))
+				for f := range m {
+					fields = append(fields, f)
+				}
+				sort.Strings(fields)
+				idx.fields = append(idx.fields, fields...)
+			}
+		default:
+			idx.fields = append(idx.fields, k)
+		}
+	}
+
+	if len(idx.fields) == 0 {
+		return idx, errors.New("[docstore/badger] index has no keys")
+	}
+
+	opts := conf["options"]
+	idx.name, _ = opts["name"].(string)
+	idx.unique, _ = opts["unique"].(bool)
+	idx.sparse, _ = opts["sparse"].(bool)
+
+	if idx.name == "" {
+		idx.name = strings.Join(idx.fields, "_1_") + "_1"
+	}
+	if strings.IndexByte(idx.name, 0) >= 0 {
+		return idx, fmt.Errorf("[docstore/badger] invalid index name %q", idx.name)
+	}
+
+	return idx, nil
+}
+
+// entries returns the field values of the index keys of doc
+func (idx index) entries(doc map[string]interface{}) [][]interface{} {
+	docs := []map[string]interface{}{doc}
+	out := [][]interface{}{{}}
+	missing := 0
+
+	for _, f := range idx.fields {
+		vals := docstore.DistinctValues(docs, f)
+		if len(vals) == 0 {
+			missing++
+			vals = []interface{}{nil}
+		}
+
+		next := make([][]interface{}, 0, len(out)*len(vals))
+		for _, e := range out {
+			for _, v := range vals {
+				next = append(next, append(append([]interface{}{}, e...), v))
+			}
+		}
+		out = next
+	}
+
+	if idx.sparse && missing == len(idx.fields) {
+		return nil
+	}
+
+	return out
+}
+
+func (s *BadgerStore) prefix(kind byte) []byte {
+	return append([]byte(s.collection), 0, kind)
+}
+
+func (s *BadgerStore) docKey(idKey []byte) []byte {
+	return append(s.prefix(kindDoc), idKey...)
+}
+
+func (s *BadgerStore) indexPrefix(idx index) []byte {
+	return append(append(s.prefix(kindIndex), idx.name...), 0)
+}
+
+// indexKey returns the key of an index entry, or the prefix of the entries of
+// vals when idKey is nil
+func (s *BadgerStore) indexKey(idx index, vals []interface{}, idKey []byte) []byte {
+	k := s.indexPrefix(idx)
+	for _, v := range vals {
+		k = encodeValue(k, v)
+	}
+	return append(k, idKey...)
+}
+
+func (s *BadgerStore) metaKey(name string) []byte {
+	return append(s.prefix(kindMeta), name...)
+}
+
+// setIndexes makes the store use the indexes of conf. Indexes that are new or
+// whose definition changed are rebuilt and the stored indexes missing from
+// conf are dropped. It should not run along writes of the collection.
+func (s *BadgerStore) setIndexes(conf []map[string]map[string]interface{}) error {
+	indexes := make([]index, 0, len(conf))
+	names := make(map[string]struct{})
+	for _, c := range conf {
+		idx, err := parseIndex(c)
+		if err != nil {
+			return err
+		}
+		if _, ok := names[idx.name]; ok {
+			return fmt.Errorf("[docstore/badger] duplicate index %s", idx.name)
+		}
+		names[idx.name] = struct{}{}
+		indexes = append(indexes, idx)
+	}
+
+	stored, err := s.storedIndexes()
+	if err != nil {
+		return err
+	}
+
+	for name := range stored {
+		if _, ok := names[name]; ok {
+			continue
+		}
+		if err := s.dropIndex(index{name: name}); err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range indexes {
+		meta := indexMeta{Fields: idx.fields, Unique: idx.unique, Sparse: idx.sparse}
+		if m, ok := stored[idx.name]; ok && reflect.DeepEqual(m, meta) {
+			continue
+		}
+		if err := s.buildIndex(idx, meta); err != nil {
+			return err
+		}
+	}
+
+	s.indexes = indexes
+	return nil
+}
+
+func (s *BadgerStore) storedIndexes() (map[string]indexMeta, error) {
+	out := make(map[string]indexMeta)
+	prefix := s.prefix(kindMeta)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var m indexMeta
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &m)
+			})
+			if err != nil {
+				return err
+			}
+			out[string(it.Item().Key()[len(prefix):])] = m
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func (s *BadgerStore) dropIndex(idx index) error {
+	if err := s.db.DropPrefix(s.indexPrefix(idx)); err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(s.metaKey(idx.name))
+	})
+}
+
+// buildIndex writes the entries of idx for the stored documents, the
+// definition is saved once every entry is written
+func (s *BadgerStore) buildIndex(idx index, meta indexMeta) error {
+	if err := s.dropIndex(idx); err != nil {
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+
+	seen := make(map[string]struct{})
+	prefix := s.prefix(kindDoc)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			idKey := it.Item().KeyCopy(nil)[len(prefix):]
+			raw, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			doc, err := decodeDoc(raw)
+			if err != nil {
+				return err
+			}
+
+			for _, vals := range idx.entries(doc) {
+				if idx.unique {
+					k := string(s.indexKey(idx, vals, nil))
+					if _, ok := seen[k]; ok {
+						return fmt.Errorf("[docstore/badger] duplicate key on index %s", idx.name)
+					}
+					seen[k] = struct{}{}
+				}
+				if err := wb.Set(s.indexKey(idx, vals, idKey), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		wb.Cancel()
+		return err
+	}
+
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(s.metaKey(idx.name), raw)
+	})
+}
@@ -0,0 +1,411 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/util"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+// entry is a stored document and its raw value
+type entry struct {
+	raw []byte
+	doc map[string]interface{}
+}
+
+func entryDocs(entries []entry) []map[string]interface{} {
+	docs := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		docs[i] = e.doc
+	}
+	return docs
+}
+
+// read returns the document stored at key
+func (s *BadgerStore) read(txn *badger.Txn, key []byte) (map[string]interface{}, bool, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	raw, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	doc, err := decodeDoc(raw)
+	return doc, err == nil, err
+}
+
+// match returns the documents matching filters in ID order, up to limit
+// documents when limit is set
+func (s *BadgerStore) match(txn *badger.Txn, filters []docstore.FilterOpt, asc bool, limit int) ([]entry, error) {
+	out := make([]entry, 0)
+	err := s.scan(txn, filters, asc, func(e entry) bool {
+		if !docstore.Match(e.doc, filters) {
+			return true
+		}
+		out = append(out, e)
+		return limit <= 0 || len(out) < limit
+	})
+	return out, err
+}
+
+// scan calls fn with the candidate documents of filters in ID order until fn
+// returns false. The candidates are read from the IDs or from an index when
+// a filter allows it, from the whole collection otherwise.
+func (s *BadgerStore) scan(txn *badger.Txn, filters []docstore.FilterOpt, asc bool, fn func(e entry) bool) error {
+	idKeys, planned, err := s.plan(txn, filters)
+	if err != nil {
+		return err
+	}
+
+	if planned {
+		sort.Slice(idKeys, func(i, j int) bool {
+			return (bytes.Compare(idKeys[i], idKeys[j]) < 0) == asc
+		})
+		for _, k := range idKeys {
+			item, err := txn.Get(s.docKey(k))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e, err := readEntry(item)
+			if err != nil {
+				return err
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	it := s.docIterator(txn, asc)
+	defer it.Close()
+
+	for ; it.Valid(); it.Next() {
+		e, err := readEntry(it.Item())
+		if err != nil {
+			return err
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func readEntry(item *badger.Item) (entry, error) {
+	raw, err := item.ValueCopy(nil)
+	if err != nil {
+		return entry{}, err
+	}
+	doc, err := decodeDoc(raw)
+	return entry{raw: raw, doc: doc}, err
+}
+
+// docIterator returns an iterator positioned on the first document in the
+// order asked
+func (s *BadgerStore) docIterator(txn *badger.Txn, asc bool) *badger.Iterator {
+	prefix := s.prefix(kindDoc)
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.Reverse = !asc
+	it := txn.NewIterator(opts)
+
+	if asc {
+		it.Seek(prefix)
+	} else {
+		it.Seek(append(append([]byte{}, prefix...), 0xff))
+	}
+
+	return it
+}
+
+// plan returns the ID keys of the documents that may match filters, from an
+// equality filter on the ID or on the first field of an index. planned is
+// false when no filter can be looked up.
+func (s *BadgerStore) plan(txn *badger.Txn, filters []docstore.FilterOpt) (idKeys [][]byte, planned bool, err error) {
+	for _, f := range filters {
+		vals, ok := lookupValues(f)
+		if !ok {
+			continue
+		}
+
+		if f.Field == s.idField {
+			seen := make(map[string]struct{})
+			for _, v := range vals {
+				k := encodeValue(nil, v)
+				if _, ok := seen[string(k)]; !ok {
+					seen[string(k)] = struct{}{}
+					idKeys = append(idKeys, k)
+				}
+			}
+			return idKeys, true, nil
+		}
+
+		for _, idx := range s.indexes {
+			if idx.fields[0] == f.Field {
+				idKeys, err = s.indexLookup(txn, idx, vals)
+				return idKeys, true, err
+			}
+		}
+	}
+
+	return nil, false, nil
+}
+
+// lookupValues returns the values of an equality or in filter whose values
+// are all scalars
+func lookupValues(f docstore.FilterOpt) ([]interface{}, bool) {
+	var vals []interface{}
+	switch f.Ops {
+	case constant.EQ, constant.SE:
+		vals = []interface{}{f.Value}
+	case constant.IN:
+		rv := reflect.ValueOf(f.Value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, false
+		}
+		for i := 0; i < rv.Len(); i++ {
+			vals = append(vals, rv.Index(i).Interface())
+		}
+	default:
+		return nil, false
+	}
+
+	for _, v := range vals {
+		if !isScalar(v) {
+			return nil, false
+		}
+	}
+
+	return vals, true
+}
+
+// indexLookup returns the ID keys of the index entries whose first field
+// holds one of vals
+func (s *BadgerStore) indexLookup(txn *badger.Txn, idx index, vals []interface{}) ([][]byte, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	seen := make(map[string]struct{})
+	out := make([][]byte, 0)
+	for _, v := range vals {
+		prefix := encodeScanValue(s.indexPrefix(idx), v)
+		// the scan prefix of numbers leaves out their exact integer
+		trailer := len(encodeValue(nil, v)) - len(encodeScanValue(nil, v))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			rest := it.Item().Key()[len(prefix)+trailer:]
+			idKey, err := skipValues(rest, len(idx.fields)-1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := seen[string(idKey)]; !ok {
+				seen[string(idKey)] = struct{}{}
+				out = append(out, append([]byte{}, idKey...))
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (s *BadgerStore) Query(ctx context.Context, query *docstore.QueryOpt) (docstore.Iterator, error) {
+	tracer := otel.Tracer("docstore/badger")
+	_, span := tracer.Start(ctx, "Query")
+	defer span.End()
+
+	txn := s.db.NewTransaction(false)
+	q, err := docstore.CursorQuery(query, s.idField)
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	if q == nil {
+		q = &docstore.QueryOpt{}
+	}
+
+	asc, ordered := s.idOrder(q)
+	if _, planned, err := s.plan(txn, q.Filter); err != nil || planned || !ordered {
+		defer txn.Discard()
+		if err != nil {
+			return nil, err
+		}
+
+		docs, err := s.find(txn, query)
+		if err != nil {
+			return nil, err
+		}
+		return &sliceIterator{docs: docs}, nil
+	}
+
+	p := q.Projection()
+	if err := p.Validate(); err != nil {
+		txn.Discard()
+		return nil, err
+	}
+
+	// queries in ID order over the whole collection stream the documents
+	return &docIterator{
+		txn:        txn,
+		it:         s.docIterator(txn, asc),
+		filters:    q.Filter,
+		skip:       skipOf(q),
+		limit:      q.Limit,
+		projection: p,
+		idField:    s.idField,
+	}, nil
+}
+
+// idOrder reports whether the query is sorted by ID, and in which direction
+func (s *BadgerStore) idOrder(q *docstore.QueryOpt) (asc bool, ok bool) {
+	switch q.OrderBy {
+	case "":
+		return true, true
+	case s.idField:
+		return q.IsAscend, true
+	}
+	return false, false
+}
+
+func skipOf(q *docstore.QueryOpt) int {
+	if q.Page > 0 && q.Limit > 0 {
+		return q.Page * q.Limit
+	}
+	return q.Skip
+}
+
+// find returns the documents matching the query, sorted and paginated. Queries
+// sorted by ID stop reading once the page is complete.
+func (s *BadgerStore) find(txn *badger.Txn, query *docstore.QueryOpt) ([]map[string]interface{}, error) {
+	p := query.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	q, err := docstore.CursorQuery(query, s.idField)
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		q = &docstore.QueryOpt{}
+	}
+
+	asc, ordered := s.idOrder(q)
+	if !ordered {
+		entries, err := s.match(txn, q.Filter, true, 0)
+		if err != nil {
+			return nil, err
+		}
+		return docstore.QueryDocs(entryDocs(entries), query, s.idField)
+	}
+
+	skip := skipOf(q)
+	limit := 0
+	if q.Limit > 0 {
+		limit = skip + q.Limit
+	}
+
+	entries, err := s.match(txn, q.Filter, asc, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if skip >= len(entries) {
+		return []map[string]interface{}{}, nil
+	}
+
+	docs := entryDocs(entries[skip:])
+	for i, d := range docs {
+		docs[i] = docstore.ProjectDoc(d, p, s.idField)
+	}
+	return docs, nil
+}
+
+// sliceIterator iterates over documents already read
+type sliceIterator struct {
+	docs []map[string]interface{}
+	pos  int
+}
+
+func (i *sliceIterator) Next(ctx context.Context, doc interface{}) error {
+	if i.pos >= len(i.docs) {
+		return docstore.EndOfDoc
+	}
+	d := i.docs[i.pos]
+	i.pos++
+	return util.DecodeJSON(d, doc)
+}
+
+func (i *sliceIterator) Close(ctx context.Context) error {
+	return nil
+}
+
+// docIterator reads the documents of a query from a read transaction, it
+// holds the transaction until closed
+type docIterator struct {
+	txn        *badger.Txn
+	it         *badger.Iterator
+	filters    []docstore.FilterOpt
+	skip       int
+	limit      int
+	count      int
+	closed     bool
+	projection docstore.Projection
+	idField    string
+}
+
+func (i *docIterator) Next(ctx context.Context, doc interface{}) error {
+	if i.closed || (i.limit > 0 && i.count >= i.limit) {
+		return docstore.EndOfDoc
+	}
+
+	for ; i.it.Valid(); i.it.Next() {
+		e, err := readEntry(i.it.Item())
+		if err != nil {
+			return err
+		}
+		if !docstore.Match(e.doc, i.filters) {
+			continue
+		}
+		if i.skip > 0 {
+			i.skip--
+			continue
+		}
+
+		i.it.Next()
+		i.count++
+		return util.DecodeJSON(docstore.ProjectDoc(e.doc, i.projection, i.idField), doc)
+	}
+
+	return docstore.EndOfDoc
+}
+
+func (i *docIterator) Close(ctx context.Context) error {
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	i.it.Close()
+	i.txn.Discard()
+	return nil
+}
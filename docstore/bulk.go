@@ -0,0 +1,332 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// operations of WriteOp
+const (
+	WriteCreate  = "create"
+	WriteUpdate  = "update"
+	WriteReplace = "replace"
+	WriteUpsert  = "upsert"
+	WriteDelete  = "delete"
+)
+
+// status of WriteResult
+const (
+	WriteOK      = "ok"
+	WriteFailed  = "failed"
+	WriteSkipped = "skipped"
+)
+
+const defaultBulkWriteSize = 500
+
+// WriteOp is a write of BulkWrite. ID is required by every operation but
+// create, which reads it from Doc. Doc is not used by delete.
+type WriteOp struct {
+	Op  string      `json:"op"`
+	ID  interface{} `json:"id,omitempty"`
+	Doc interface{} `json:"doc,omitempty"`
+}
+
+// WriteResult is the outcome of the WriteOp of the same index. Updating a
+// missing document fails with NotFound, deleting one succeeds. Skipped writes
+// were not tried because an ordered bulk write stopped before them.
+type WriteResult struct {
+	ID     interface{} `json:"id"`
+	Op     string      `json:"op"`
+	Status string      `json:"status"`
+	Error  error       `json:"-"`
+}
+
+// BulkWriteOpt is passed to BulkWrite as an option
+type BulkWriteOpt struct {
+	// Ordered stops at the first failed write, the next ones are skipped
+	Ordered bool
+	// BatchSize is the number of writes CachedStore sends to the driver at
+	// once, 500 when not set
+	BatchSize int
+}
+
+// GetBulkWriteOpt returns the *BulkWriteOpt found in opts, or the defaults
+func GetBulkWriteOpt(opts ...interface{}) BulkWriteOpt {
+	for _, o := range opts {
+		if v, ok := o.(*BulkWriteOpt); ok && v != nil {
+			return *v
+		}
+		if v, ok := o.(BulkWriteOpt); ok {
+			return v
+		}
+	}
+	return BulkWriteOpt{}
+}
+
+// PartialWriteError returns ErrPartialWrite when a write of results is not
+// done
+func PartialWriteError(results []WriteResult) error {
+	for _, r := range results {
+		if r.Status != WriteOK {
+			return ErrPartialWrite
+		}
+	}
+	return nil
+}
+
+// WriteEach runs the writes one by one with the driver methods, for drivers
+// without a bulk write of their own. It returns ErrPartialWrite when a write
+// failed.
+func WriteEach(ctx context.Context, d Driver, idField string, ops []WriteOp, opts ...interface{}) ([]WriteResult, error) {
+	opt := GetBulkWriteOpt(opts...)
+	results := make([]WriteResult, len(ops))
+
+	failed := false
+	for i, op := range ops {
+		results[i] = WriteResult{ID: op.ID, Op: op.Op, Status: WriteSkipped}
+		if op.Op == WriteCreate {
+			results[i].ID, _ = docID(op.Doc, idField)
+		}
+		if failed && opt.Ordered {
+			continue
+		}
+
+		if err := writeOne(ctx, d, op); err != nil {
+			results[i].Status = WriteFailed
+			results[i].Error = err
+			failed = true
+			continue
+		}
+		results[i].Status = WriteOK
+	}
+
+	return results, PartialWriteError(results)
+}
+
+func writeOne(ctx context.Context, d Driver, op WriteOp) error {
+	var err error
+	switch op.Op {
+	case WriteCreate:
+		return d.Create(ctx, op.Doc)
+	case WriteUpdate:
+		err = d.Update(ctx, op.ID, op.Doc, false)
+	case WriteReplace:
+		err = d.Update(ctx, op.ID, op.Doc, true)
+	case WriteUpsert:
+		err = d.Upsert(ctx, op.ID, op.Doc)
+	case WriteDelete:
+		return d.Delete(ctx, op.ID)
+	default:
+		return fmt.Errorf("[docstore] unknown write operation %s", op.Op)
+	}
+
+	// the document already holds the written values
+	if err == NothingUpdated {
+		return nil
+	}
+	return err
+}
+
+// BulkWrite runs mixed writes and returns the result of every write, with
+// ErrPartialWrite when a write failed. IDs and timestamps are set the same way
+// as Create and Update, deletes are soft deletes when soft delete is enabled.
+// Updates, replaces and upserts of a versioned store fail with
+// ErrVersionedBulkWrite as their version can not be checked. The writes are
+// sent to the driver in batches of BulkWriteOpt.BatchSize, and the cache
+// entries of each batch are invalidated together.
+func (s *CachedStore) BulkWrite(ctx context.Context, ops []WriteOp, opts ...interface{}) ([]WriteResult, error) {
+	opt := GetBulkWriteOpt(opts...)
+	size := opt.BatchSize
+	if size <= 0 {
+		size = defaultBulkWriteSize
+	}
+
+	results := make([]WriteResult, len(ops))
+	failed := false
+	for start := 0; start < len(ops); start += size {
+		end := start + size
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		if failed && opt.Ordered {
+			for i := start; i < end; i++ {
+				results[i] = WriteResult{ID: ops[i].ID, Op: ops[i].Op, Status: WriteSkipped}
+			}
+			continue
+		}
+
+		if err := s.bulkWrite(ctx, ops[start:end], results[start:end], opt); err != nil {
+			return results, err
+		}
+		failed = PartialWriteError(results[start:end]) != nil
+	}
+
+	return results, PartialWriteError(results)
+}
+
+// bulkWrite writes a batch and sets its results
+func (s *CachedStore) bulkWrite(ctx context.Context, ops []WriteOp, results []WriteResult, opt BulkWriteOpt) error {
+	writes := make([]WriteOp, 0, len(ops))
+	// index is the op of every write
+	index := make([]int, 0, len(ops))
+
+	events := make([]*HookEvent, len(ops))
+	// every write is recorded, the first error is returned
+	var recErr error
+
+	prepared := true
+	for i, op := range ops {
+		results[i] = WriteResult{ID: op.ID, Op: op.Op, Status: WriteSkipped}
+		if !prepared && opt.Ordered {
+			continue
+		}
+
+		w, event, err := s.writeOp(ctx, op)
+		if err == errDeleted {
+			// soft deletes of deleted documents succeed without a write
+			results[i].Status = WriteOK
+			if err := s.after(ctx, AfterDelete, event); err != nil && recErr == nil {
+				recErr = err
+			}
+			continue
+		}
+		if err != nil {
+			results[i].Status = WriteFailed
+			results[i].Error = err
+			prepared = false
+			continue
+		}
+
+		results[i].ID = w.ID
+		events[i] = event
+		writes = append(writes, w)
+		index = append(index, i)
+	}
+
+	if len(writes) == 0 {
+		return recErr
+	}
+
+	for _, w := range writes {
+		if err := s.deleteCache(ctx, "BulkWrite", w.ID); err != nil {
+			return err
+		}
+	}
+
+	defer s.invalidate(ctx, "BulkWrite")
+
+	res, err := s.storage.BulkWrite(ctx, writes, &opt)
+	if err != nil && err != ErrPartialWrite {
+		return err
+	}
+
+	for j, r := range res {
+		i := index[j]
+		results[i].Status = r.Status
+		results[i].Error = r.Error
+		if ops[i].Op == WriteDelete && s.SoftDelete && r.Error == NotFound {
+			// soft deletes of missing documents succeed like Delete does
+			results[i].Status = WriteOK
+			results[i].Error = nil
+		}
+		if results[i].Status == WriteOK {
+			if err := s.after(ctx, afterPoint(ops[i].Op), events[i]); err != nil && recErr == nil {
+				recErr = err
+			}
+		}
+	}
+
+	return recErr
+}
+
+// afterPoint returns the hook point running after a write of op
+func afterPoint(op string) HookPoint {
+	switch op {
+	case WriteCreate:
+		return AfterCreate
+	case WriteDelete:
+		return AfterDelete
+	}
+	return AfterUpdate
+}
+
+// writeOp returns the write of op sent to the driver, with the document ID
+// and timestamps set and its document encrypted, and the event its before
+// hooks ran for
+func (s *CachedStore) writeOp(ctx context.Context, op WriteOp) (WriteOp, *HookEvent, error) {
+	event := &HookEvent{Op: "BulkWrite", ID: op.ID, Doc: op.Doc}
+	switch op.Op {
+	case WriteCreate:
+		if err := s.setID(op.Doc, s.IDField); err != nil {
+			return op, nil, err
+		}
+		if err := s.setTime(ctx, op.Doc, s.TimestampField, false); err != nil {
+			return op, nil, err
+		}
+		if err := s.setTime(ctx, op.Doc, s.UpdateTimeField, false); err != nil {
+			return op, nil, err
+		}
+
+		id, err := s.getID(op.Doc)
+		if err != nil {
+			return op, nil, err
+		}
+		event.ID = id
+		if err := s.before(ctx, BeforeCreate, event); err != nil {
+			return op, nil, err
+		}
+
+		enc, err := s.newDoc(op.Doc)
+		if err != nil {
+			return op, nil, err
+		}
+		return WriteOp{Op: op.Op, ID: id, Doc: enc}, event, nil
+	case WriteUpdate, WriteReplace, WriteUpsert:
+		if s.VersionField != "" {
+			return op, nil, ErrVersionedBulkWrite
+		}
+		if op.ID == nil {
+			id, err := s.getID(op.Doc)
+			if err != nil {
+				return op, nil, err
+			}
+			op.ID = id
+		}
+		if err := s.setTime(ctx, op.Doc, s.UpdateTimeField, true); err != nil {
+			return op, nil, err
+		}
+		event.ID = op.ID
+		if err := s.before(ctx, BeforeUpdate, event); err != nil {
+			return op, nil, err
+		}
+
+		enc, err := s.encryptDoc(op.Doc)
+		if err != nil {
+			return op, nil, err
+		}
+		return WriteOp{Op: op.Op, ID: op.ID, Doc: enc}, event, nil
+	case WriteDelete:
+		if op.ID == nil {
+			return op, nil, errors.New("[docstore] missing document ID")
+		}
+		event.Doc = nil
+		if err := s.before(ctx, BeforeDelete, event); err != nil {
+			return op, nil, err
+		}
+		if s.SoftDelete {
+			deleted, err := s.softDeleted(ctx, op.ID)
+			if err != nil {
+				return op, nil, err
+			}
+			if deleted {
+				return op, event, errDeleted
+			}
+			return WriteOp{Op: WriteUpdate, ID: op.ID, Doc: s.deletedAt()}, event, nil
+		}
+		return op, event, nil
+	}
+
+	return op, nil, fmt.Errorf("[docstore] unknown write operation %s", op.Op)
+}
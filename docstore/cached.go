@@ -3,7 +3,6 @@ package docstore
 import (
 	"context"
 	"errors"
-	"fmt"
 	"reflect"
 	"time"
 
@@ -27,12 +26,24 @@ type Config struct {
 	IDField           string                              `json:"id_field,omitempty"`
 	TimestampField    string                              `json:"timestamp_field,omitempty"`
 	UpdateTimeField   string                              `json:"updatetime_field,omitempty"`
+	VersionField      string                              `json:"version_field,omitempty"`
+	SoftDelete        bool                                `json:"soft_delete,omitempty"`
+	DeletedField      string                              `json:"deleted_field,omitempty"`
+	Encryption        *EncryptionConfig                   `json:"encryption,omitempty"`
+	Resilience        *ResilienceConfig                   `json:"resilience,omitempty"`
 	Driver            string                              `json:"driver,omitempty"`
 	Connection        interface{}                         `json:"connection,omitempty"`
 	Credential        string                              `json:"credential,omitempty"`
 	Indexes           []map[string]map[string]interface{} `json:"indexes,omitempty"`
 	DropExistingIndex bool                                `json:"drop_existing_index"`
 	CacheCount        bool                                `json:"cache_count,omitempty"`
+	QueryCache        bool                                `json:"query_cache,omitempty"`
+	Audit             bool                                `json:"audit,omitempty"`
+	HistoryCollection string                              `json:"history_collection,omitempty"`
+	TenantField       string                              `json:"tenant_field,omitempty"`
+	ExpiryField       string                              `json:"expiry_field,omitempty"`
+	TTL               int                                 `json:"ttl,omitempty"`
+	SweepInterval     int                                 `json:"sweep_interval,omitempty"`
 	IDGenerator       IDGenerator
 	TimeGenerator     TimeGenerator
 }
@@ -67,6 +78,10 @@ func (c *Config) validate() error {
 		c.CacheExpiration = defaultExpiration
 	}
 
+	if c.Encryption != nil {
+		return c.Encryption.validate()
+	}
+
 	return nil
 }
 
@@ -74,13 +89,16 @@ type CachedStore struct {
 	*Config
 	cache   *cache.Cache
 	storage Driver
+	hooks   hookRegistry
+	history Driver
+	tenant  TenantResolver
 }
 
 func New(config *Config) (*CachedStore, error) {
 	if err := config.validate(); err != nil {
 		return nil, err
 	}
-	dv, err := GetDriver(config)
+	dv, err := getDriver(config)
 	if err != nil {
 		return nil, err
 	}
@@ -90,22 +108,58 @@ func New(config *Config) (*CachedStore, error) {
 		return nil, err
 	}
 
-	return NewDocstore(dv, cache, config), nil
+	s := NewDocstore(dv, cache, config)
+	if config.Audit {
+		history, err := getDriver(config.historyConfig())
+		if err != nil {
+			return nil, err
+		}
+		s.SetHistory(history)
+	}
+
+	return s, nil
 }
 
+// getDriver returns the driver of config, wrapped in a ResilientStore when
+// Resilience is set
+func getDriver(config *Config) (Driver, error) {
+	dv, err := GetDriver(config)
+	if err != nil || config.Resilience == nil {
+		return dv, err
+	}
+	return NewResilientStore(dv, config), nil
+}
+
+// NewDocstore returns a store over storage. With Audit set the writes are
+// recorded in the history collection, set with SetHistory, and a write
+// failing to be recorded returns the error of the history. With ExpiryField
+// set, documents expire at the time of the field, created documents without
+// it expire after TTL seconds.
 func NewDocstore(storage Driver, cache *cache.Cache, config *Config) *CachedStore {
 	config.IDGenerator = DefaultIDGenerator
 	config.TimeGenerator = DefaultTimeGenerator
-	return &CachedStore{
+	s := &CachedStore{
 		Config:  config,
 		cache:   cache,
 		storage: storage,
 	}
+	if config.Audit {
+		s.audit()
+	}
+	if config.ExpiryField != "" {
+		s.expire()
+	}
+	return s
 }
 
 func (s *CachedStore) getID(doc interface{}) (interface{}, error) {
+	return docID(doc, s.IDField)
+}
+
+// docID reads the ID field of a map or of a struct field tagged idField
+func docID(doc interface{}, idField string) (interface{}, error) {
 	if util.IsMap(doc) {
-		id, ok := util.Lookup(s.IDField, doc)
+		id, ok := util.Lookup(idField, doc)
 
 		if !ok {
 			return nil, errors.New("[docstore] missing document ID")
@@ -114,7 +168,7 @@ func (s *CachedStore) getID(doc interface{}) (interface{}, error) {
 		return id, nil
 	}
 
-	idf, err := util.FindFieldByTag(doc, "json", s.IDField)
+	idf, err := util.FindFieldByTag(doc, "json", idField)
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +266,42 @@ func (s *CachedStore) Create(ctx context.Context, doc interface{}) error {
 		return err
 	}
 
-	return s.storage.Create(ctx, doc)
+	return s.create(ctx, doc)
+}
+
+// create writes a new document whose ID and timestamps are set
+func (s *CachedStore) create(ctx context.Context, doc interface{}) error {
+	id, _ := s.getID(doc)
+	event := &HookEvent{Op: "Create", ID: id, Doc: doc}
+	if err := s.before(ctx, BeforeCreate, event); err != nil {
+		return err
+	}
+
+	enc, err := s.newDoc(doc)
+	if err != nil {
+		return err
+	}
+
+	defer s.invalidate(ctx, "Create")
+	if err := s.storage.Create(ctx, enc); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterCreate, event)
+}
+
+// newDoc stamps the version and schema of a new document and returns the
+// document to store
+func (s *CachedStore) newDoc(doc interface{}) (interface{}, error) {
+	if err := s.setVersion(doc, 1); err != nil {
+		return nil, err
+	}
+
+	if err := s.setSchema(doc); err != nil {
+		return nil, err
+	}
+
+	return s.encryptDoc(doc)
 }
 
 func (s *CachedStore) update(ctx context.Context, doc interface{}, replace, upsert bool) error {
@@ -221,21 +310,51 @@ func (s *CachedStore) update(ctx context.Context, doc interface{}, replace, upse
 		return err
 	}
 
-	if s.CacheExpiration != 1 {
-		if err := s.cache.Delete(ctx, fmt.Sprintf("%v", id)); err != nil {
-			log.GetLogger(ctx, "docstore", "update").WithError(err).Error("error deleting cache ")
-		}
+	if err := s.setTime(ctx, doc, s.UpdateTimeField, true); err != nil {
+		return err
 	}
 
-	if err := s.setTime(ctx, doc, s.UpdateTimeField, true); err != nil {
+	return s.write(ctx, id, doc, replace, upsert)
+}
+
+// write updates the document of id whose update time is set
+func (s *CachedStore) write(ctx context.Context, id, doc interface{}, replace, upsert bool) error {
+	event := &HookEvent{Op: updateOp(replace, upsert), ID: id, Doc: doc}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
+
+	if err := s.deleteCache(ctx, "update", id); err != nil {
+		return err
+	}
+
+	var version int64
+	if s.VersionField != "" {
+		// upserts may create the document, so the version is only bumped
+		ctx, version = s.versioning(ctx, doc, !upsert)
+	}
+
+	enc, err := s.encryptDoc(doc)
+	if err != nil {
 		return err
 	}
 
+	defer s.invalidate(ctx, "update")
 	if upsert {
-		return s.storage.Upsert(ctx, id, doc)
+		if err := s.storage.Upsert(ctx, id, enc); err != nil {
+			return err
+		}
+		return s.after(ctx, AfterUpdate, event)
 	}
 
-	return s.storage.Update(ctx, id, doc, replace)
+	if err := s.storage.Update(ctx, id, enc, replace); err != nil {
+		return err
+	}
+
+	if err := s.setVersion(doc, version+1); err != nil {
+		return err
+	}
+	return s.after(ctx, AfterUpdate, event)
 }
 
 func (s *CachedStore) Update(ctx context.Context, doc interface{}) error {
@@ -252,7 +371,51 @@ func (s *CachedStore) Update(ctx context.Context, doc interface{}) error {
 //
 // ...}
 func (s *CachedStore) UpdateMany(ctx context.Context, filters []FilterOpt, doc map[string]interface{}) error {
-	return s.storage.UpdateMany(ctx, filters, doc)
+	filters, err := s.tenantFilter(ctx, filters)
+	if err != nil {
+		return err
+	}
+
+	event := &HookEvent{Op: "UpdateMany", Doc: doc, Filter: filters}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
+
+	defer s.invalidate(ctx, "UpdateMany")
+	if err := s.updateMany(ctx, filters, doc); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterUpdate, event)
+}
+
+// updateMany bumps the version of the updated documents of a versioned
+// store, without checking it
+func (s *CachedStore) updateMany(ctx context.Context, filters []FilterOpt, doc map[string]interface{}) error {
+	ctx = s.fieldVersioning(ctx, nil)
+	if !s.encrypting() {
+		return s.storage.UpdateMany(ctx, filters, doc)
+	}
+
+	filters, err := s.blindFilters(filters)
+	if err != nil {
+		return err
+	}
+
+	fields := make([]Field, 0, len(doc))
+	for k, v := range doc {
+		fields = append(fields, Field{Name: k, Value: v})
+	}
+	if fields, err = s.encryptFields(fields); err != nil {
+		return err
+	}
+
+	enc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		enc[f.Name] = f.Value
+	}
+
+	return s.storage.UpdateMany(ctx, filters, enc)
 }
 
 func (s *CachedStore) Upsert(ctx context.Context, doc interface{}) error {
@@ -260,75 +423,174 @@ func (s *CachedStore) Upsert(ctx context.Context, doc interface{}) error {
 }
 
 func (s *CachedStore) UpdateField(ctx context.Context, id interface{}, key string, value interface{}) error {
+	return s.updateFields(ctx, "UpdateField", id, []Field{{Name: key, Value: value}})
+}
 
-	if s.CacheExpiration != 1 {
-		if err := s.cache.Delete(ctx, fmt.Sprintf("%v", id)); err != nil {
-			log.GetLogger(ctx, "docstore", "UpdateField").WithError(err).Error("error deleting cache ")
-		}
+// Pull removes the values matching removeCondition from the arrays of the
+// documents matching condition. It is rejected by tenant scoped stores as
+// condition cannot be scoped to the tenant.
+func (s *CachedStore) Pull(ctx context.Context, condition, removeCondition Field) error {
+	if s.tenancy() {
+		return errors.New("[docstore] Pull is not supported by tenant scoped stores")
+	}
+
+	event := &HookEvent{Op: "Pull", Filter: []FilterOpt{FieldFilter(condition)}}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
 	}
 
-	return s.storage.UpdateField(ctx, id, []Field{{Name: key, Value: value}})
+	defer s.invalidate(ctx, "Pull")
+	if err := s.storage.Pull(ctx, condition, removeCondition); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterUpdate, event)
 }
 
-func (s *CachedStore) Pull(ctx context.Context, condition, removeCondition Field) error {
-	return s.storage.Pull(ctx, condition, removeCondition)
+// UpdateFields applies the field updates, which may push to arrays, unset or
+// multiply fields and so on with the Op of the fields. An UpdateOpt option
+// upserts the document.
+func (s *CachedStore) UpdateFields(ctx context.Context, id interface{}, value []Field, opts ...interface{}) error {
+	return s.updateFields(ctx, "UpdateFields", id, value, opts...)
 }
 
-func (s *CachedStore) UpdateFields(ctx context.Context, id interface{}, value []Field) error {
+func (s *CachedStore) updateFields(ctx context.Context, op string, id interface{}, fields []Field, opts ...interface{}) error {
+	event := &HookEvent{Op: op, ID: id, Doc: fieldsDoc(fields)}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
 
-	if s.CacheExpiration != 1 {
-		if err := s.cache.Delete(ctx, fmt.Sprintf("%v", id)); err != nil {
-			log.GetLogger(ctx, "docstore", "UpdateFields").WithError(err).Error("error deleting cache ")
+	if s.tenancy() && GetUpdateOpt(opts...).Upsert {
+		// an upserted document belongs to the tenant
+		tenant, err := s.tenantOf(ctx)
+		if err != nil {
+			return err
 		}
+		fields = append(fields[:len(fields):len(fields)], Field{Name: s.tenantField(), Value: tenant, Op: UpdateSetOnInsert})
+	}
+
+	if err := s.deleteCache(ctx, op, id); err != nil {
+		return err
 	}
 
-	return s.storage.UpdateField(ctx, id, value)
+	enc, err := s.encryptFields(fields)
+	if err != nil {
+		return err
+	}
+
+	defer s.invalidate(ctx, op)
+	if err := s.storage.UpdateField(s.fieldVersioning(ctx, fields), id, enc, opts...); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterUpdate, event)
 }
 
 func (s *CachedStore) Increment(ctx context.Context, id interface{}, fieldName string, value int) error {
-	if s.CacheExpiration != 1 {
-		if err := s.cache.Delete(ctx, fmt.Sprintf("%v", id)); err != nil {
-			log.GetLogger(ctx, "docstore", "Increment").WithError(err).Error("error deleting cache ")
-		}
+	event := &HookEvent{Op: "Increment", ID: id, Doc: map[string]interface{}{fieldName: value}}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
+
+	if err := s.deleteCache(ctx, "Increment", id); err != nil {
+		return err
+	}
+
+	if s.VersionField != "" {
+		ctx = WithVersioning(ctx, Versioning{Field: s.VersionField})
+	}
+
+	defer s.invalidate(ctx, "Increment")
+	if err := s.storage.Increment(ctx, id, fieldName, value); err != nil {
+		return err
 	}
 
-	return s.storage.Increment(ctx, id, fieldName, value)
+	return s.after(ctx, AfterUpdate, event)
 }
 
 func (s *CachedStore) Replace(ctx context.Context, doc interface{}) error {
 	return s.update(ctx, doc, true, false)
 }
 
-func (s *CachedStore) Get(ctx context.Context, id, doc interface{}) error {
+// Get reads the document of id, a Projection option selects its fields
+func (s *CachedStore) Get(ctx context.Context, id, doc interface{}, opts ...interface{}) error {
 
 	if !util.IsPointerOfStruct(doc) && !util.IsMap(doc) {
 		return errors.New("[docstore] docs should be a pointer of struct or map")
 	}
 
+	if p := GetProjection(opts...); !p.IsEmpty() {
+		return s.getProjected(ctx, id, doc, p)
+	}
+
+	if s.encrypting() {
+		return s.getEncrypted(ctx, id, doc)
+	}
+
+	key, err := s.cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
 	if s.CacheExpiration != 1 {
-		if s.cache.Exist(ctx, fmt.Sprintf("%v", id)) {
-			if err := s.cache.Get(ctx, fmt.Sprintf("%v", id), doc); err == nil {
+		if s.cache.Exist(ctx, key) {
+			if err := s.cache.Get(ctx, key, doc); err == nil {
 				return nil
 			}
 		}
 	}
 
-	if err := s.storage.Get(ctx, id, doc); err != nil {
+	if err := s.get(ctx, id, doc); err != nil {
 		return err
 	}
 
 	if s.CacheExpiration != 1 {
-		return s.cache.Set(ctx, fmt.Sprintf("%v", id), doc, s.CacheExpiration)
+		if ttl, ok := s.cacheTTL(doc); ok {
+			return s.cache.Set(ctx, key, doc, ttl)
+		}
 	}
 
 	return nil
 }
 
+// get reads the document through a map when it has to be checked for soft
+// delete, decrypted or upgraded before it is decoded into doc
+func (s *CachedStore) get(ctx context.Context, id, doc interface{}) error {
+	if !s.mapped() {
+		return s.storage.Get(ctx, id, doc)
+	}
+
+	d, err := s.getMap(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(d, doc)
+}
+
+// Delete deletes the document, or marks it deleted when soft delete is enabled
 func (s *CachedStore) Delete(ctx context.Context, id interface{}) error {
-	if s.CacheExpiration != 1 {
-		if err := s.cache.Delete(ctx, fmt.Sprintf("%v", id)); err != nil {
-			log.GetLogger(ctx, "docstore", "Delete").WithError(err).Error("error deleting cache ")
-		}
+	event := &HookEvent{Op: "Delete", ID: id}
+	if err := s.before(ctx, BeforeDelete, event); err != nil {
+		return err
+	}
+
+	if err := s.delete(ctx, id); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterDelete, event)
+}
+
+func (s *CachedStore) delete(ctx context.Context, id interface{}) error {
+	defer s.invalidate(ctx, "Delete")
+
+	if s.SoftDelete {
+		return s.softDelete(ctx, id)
+	}
+
+	if err := s.deleteCache(ctx, "Delete", id); err != nil {
+		return err
 	}
 
 	return s.storage.Delete(ctx, id)
@@ -336,7 +598,34 @@ func (s *CachedStore) Delete(ctx context.Context, id interface{}) error {
 
 // Delete Many delete documents matching the filters
 func (s *CachedStore) DeleteMany(ctx context.Context, query *QueryOpt) error {
-	return s.storage.DeleteMany(ctx, query)
+	q, err := s.query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	var filters []FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+	if filters, err = s.tenantFilter(ctx, filters); err != nil {
+		return err
+	}
+	event := &HookEvent{Op: "DeleteMany", Filter: filters}
+	if err := s.before(ctx, BeforeDelete, event); err != nil {
+		return err
+	}
+
+	defer s.invalidate(ctx, "DeleteMany")
+	if s.SoftDelete {
+		err = s.softDeleteMany(ctx, q)
+	} else {
+		err = s.storage.DeleteMany(ctx, q)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterDelete, event)
 }
 
 func (s *CachedStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
@@ -345,27 +634,99 @@ func (s *CachedStore) Find(ctx context.Context, query *QueryOpt, docs interface{
 		return errors.New("[docstore] docs should be a pointer of slice")
 	}
 
-	return s.storage.Find(ctx, query, docs)
+	q, err := s.query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if !s.cachingQuery() || query == nil || !s.keepsExpiry(query) {
+		return s.find(ctx, q, docs)
+	}
+
+	return s.cachedDocs(ctx, "Find", query.Hash(), docs, true, func() error {
+		return s.find(ctx, q, docs)
+	})
+}
+
+// FindPage finds at most query.Limit documents and returns the continuation
+// token of the next page, or an empty token on the last page. Set the token
+// as query.Cursor to fetch the next page. Queries without OrderBy are paged by
+// ID, and docs should hold the ID and the sort field.
+func (s *CachedStore) FindPage(ctx context.Context, query *QueryOpt, docs interface{}) (string, error) {
+
+	if !util.IsPointerOfSlice(docs) {
+		return "", errors.New("[docstore] docs should be a pointer of slice")
+	}
+
+	if query == nil || query.Limit <= 0 {
+		return "", errors.New("[docstore] page query needs a limit")
+	}
+
+	q := *query
+	if q.OrderBy == "" {
+		q.OrderBy = s.IDField
+		q.IsAscend = true
+	}
+	// the cursor is read from the sort field of the last document
+	q.Fields, q.Exclude = keepField(q.Fields, q.Exclude, q.OrderBy)
+	if q.Page > 0 {
+		q.Skip = q.Page * q.Limit
+		q.Page = 0
+	}
+	// one more document tells whether there is a next page
+	q.Limit = query.Limit + 1
+
+	fq, err := s.query(ctx, &q)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.find(ctx, fq, docs); err != nil {
+		return "", err
+	}
+
+	out := reflect.ValueOf(docs).Elem()
+	if out.Len() <= query.Limit {
+		return "", nil
+	}
+	out.Set(out.Slice(0, query.Limit))
+
+	return EncodeCursor(&q, out.Index(query.Limit-1).Interface(), s.IDField)
 }
 
 func (s *CachedStore) Count(ctx context.Context, query *QueryOpt) (int64, error) {
 	key := "count:ALL"
 
-	if s.CacheCount {
+	// the count of an expiring store changes without writes
+	caching := s.CacheCount && !s.expiring()
+	if caching {
 		if query != nil {
-			key = "count:" + query.Hash()
+			// the count does not depend on the page
+			q := *query
+			q.Cursor = ""
+			key = "count:" + q.Hash()
+		}
+		k, err := s.tenantKey(ctx, key)
+		if err != nil {
+			return -1, err
 		}
+		key = k
 		if c, err := s.cache.GetInt(ctx, key); err == nil {
 			return c, nil
 		}
 	}
 
-	i, err := s.storage.Count(ctx, query)
+	q, err := s.query(ctx, query)
 	if err != nil {
 		return -1, err
 	}
 
-	if s.CacheCount && i > 0 {
+	i, err := s.storage.Count(ctx, q)
+	if err != nil {
+		return -1, err
+	}
+
+	if caching && i > 0 {
 		s.cache.Set(ctx, key, i, s.CacheExpiration)
 	}
 
@@ -378,13 +739,70 @@ func (s *CachedStore) FindOne(ctx context.Context, query *QueryOpt, doc interfac
 		return errors.New("[docstore] docs should be a pointer of struct or map")
 	}
 
-	return s.storage.FindOne(ctx, query, doc)
+	q, err := s.query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if s.cachingQuery() && query != nil && s.keepsExpiry(query) {
+		return s.cachedDocs(ctx, "FindOne", query.Hash(), doc, false, func() error {
+			return s.findOne(ctx, q, doc)
+		})
+	}
+
+	return s.findOne(ctx, q, doc)
+}
+
+func (s *CachedStore) findOne(ctx context.Context, q *QueryOpt, doc interface{}) error {
+	if !s.mapped() {
+		return s.storage.FindOne(ctx, q, doc)
+	}
+
+	p := q.Projection()
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	d := make(map[string]interface{})
+	if err := s.storage.FindOne(ctx, wholeDocs(q), &d); err != nil {
+		return err
+	}
+
+	if _, err := s.readDoc(ctx, d); err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(ProjectDoc(d, p, s.IDField), doc)
 }
 
 func (s *CachedStore) IsExists(ctx context.Context, query *QueryOpt) (bool, error) {
 	var doc interface{}
 
-	if err := s.storage.FindOne(ctx, query, &doc); err != nil {
+	q, err := s.query(ctx, query)
+	if err != nil {
+		return false, err
+	}
+
+	// the entry of an expiring store could outlive the document found
+	if s.cachingQuery() && query != nil && !s.expiring() {
+		// the entry holds the ID of the document found, or null
+		var d map[string]interface{}
+		err := s.cachedDocs(ctx, "IsExists", query.Hash(), &d, false, func() error {
+			found := make(map[string]interface{})
+			if err := s.storage.FindOne(ctx, q, &found); err != nil {
+				if err == NotFound {
+					return nil
+				}
+				return err
+			}
+			id, _ := getPath(found, s.IDField)
+			d = map[string]interface{}{s.IDField: id}
+			return nil
+		})
+		return d != nil, err
+	}
+
+	if err := s.storage.FindOne(ctx, q, &doc); err != nil {
 		if err == NotFound {
 			return false, nil
 		}
@@ -405,7 +823,7 @@ func (s *CachedStore) BulkCreate(ctx context.Context, docs interface{}, opts ...
 		ins[i] = rdocs.Index(i).Interface()
 	}
 
-	for i, d := range ins {
+	for _, d := range ins {
 
 		if err := s.setID(d, s.IDField); err != nil {
 			return err
@@ -418,14 +836,49 @@ func (s *CachedStore) BulkCreate(ctx context.Context, docs interface{}, opts ...
 		if err := s.setTime(ctx, d, s.UpdateTimeField, false); err != nil {
 			return err
 		}
+	}
+
+	return s.bulkCreate(ctx, ins, opts...)
+}
 
-		ins[i] = d
+// bulkCreate writes new documents whose IDs and timestamps are set
+func (s *CachedStore) bulkCreate(ctx context.Context, ins []interface{}, opts ...interface{}) error {
+	events := make([]*HookEvent, len(ins))
+	for i, d := range ins {
+		id, _ := s.getID(d)
+		events[i] = &HookEvent{Op: "BulkCreate", ID: id, Doc: d}
+		if err := s.before(ctx, BeforeCreate, events[i]); err != nil {
+			return err
+		}
 	}
 
-	return s.storage.BulkCreate(ctx, ins, opts...)
+	enc := make([]interface{}, len(ins))
+	for i, d := range ins {
+		e, err := s.newDoc(d)
+		if err != nil {
+			return err
+		}
+		enc[i] = e
+	}
+
+	defer s.invalidate(ctx, "BulkCreate")
+	if err := s.storage.BulkCreate(ctx, enc, opts...); err != nil {
+		return err
+	}
+
+	// every document is recorded, the first error is returned
+	var recErr error
+	for _, e := range events {
+		if err := s.after(ctx, AfterCreate, e); err != nil && recErr == nil {
+			recErr = err
+		}
+	}
+	return recErr
 }
 
-func (s *CachedStore) BulkGet(ctx context.Context, ids, docs interface{}) error {
+// BulkGet reads the documents of ids, a Projection option selects their
+// fields
+func (s *CachedStore) BulkGet(ctx context.Context, ids, docs interface{}, opts ...interface{}) error {
 	if !util.IsSlice(ids) {
 		return errors.New("[docstore] IDs should be a slice")
 	}
@@ -440,7 +893,26 @@ func (s *CachedStore) BulkGet(ctx context.Context, ids, docs interface{}) error
 		ins[i] = rids.Index(i).Interface()
 	}
 
-	return s.storage.BulkGet(ctx, ins, docs)
+	p := GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	if !s.mapped() {
+		return s.storage.BulkGet(ctx, ins, docs, &p)
+	}
+
+	var all []map[string]interface{}
+	if err := s.storage.BulkGet(ctx, ins, &all); err != nil {
+		return err
+	}
+
+	out, err := s.readDocs(ctx, all)
+	if err != nil {
+		return err
+	}
+
+	return decodeDocs(projectDocs(out, p, s.IDField), docs)
 }
 
 func (s *CachedStore) Migrate(ctx context.Context, config interface{}) error {
@@ -459,8 +931,290 @@ func (s *CachedStore) Ping(ctx context.Context) error {
 	return s.storage.Ping(ctx)
 }
 
+// Distinct returns the distinct values of the field, cached values are
+// decoded from JSON and invalidated by every write of the collection
 func (s *CachedStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
-	return s.storage.Distinct(ctx, fieldName, filter)
+	if s.tenancy() || s.expiring() {
+		// raw driver filters can not be scoped
+		filters, err := ToFilters(filter)
+		if err != nil {
+			return nil, err
+		}
+		if s.expiring() {
+			filters = s.unexpiredFilter(filters)
+		}
+		if filter, err = s.tenantFilter(ctx, filters); err != nil {
+			return nil, err
+		}
+	}
+
+	if !s.cachingQuery() || s.expiring() {
+		return s.storage.Distinct(ctx, fieldName, filter)
+	}
+
+	var out []interface{}
+	hash := util.Hash64(map[string]interface{}{"field": fieldName, "filter": filter})
+	err := s.cachedValue(ctx, "Distinct", hash, &out, func() (err error) {
+		out, err = s.storage.Distinct(ctx, fieldName, filter)
+		return err
+	})
+
+	return out, err
+}
+
+// Aggregate groups the documents and computes the accumulators of agg, the
+// rows are decoded into docs
+func (s *CachedStore) Aggregate(ctx context.Context, agg *AggregateOpt, docs interface{}) error {
+
+	if !util.IsPointerOfSlice(docs) {
+		return errors.New("[docstore] docs should be a pointer of slice")
+	}
+
+	if agg != nil {
+		q, err := s.query(ctx, &QueryOpt{Filter: agg.Filter})
+		if err != nil {
+			return err
+		}
+		a := *agg
+		a.Filter = q.Filter
+		agg = &a
+	}
+
+	return s.storage.Aggregate(ctx, agg, docs)
+}
+
+// Watch streams the changes of the documents matching the query filter
+func (s *CachedStore) Watch(ctx context.Context, query *QueryOpt) (ChangeStream, error) {
+	q, err := s.scoped(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.storage.Watch(ctx, q)
+}
+
+// PublishChanges publishes every change of the documents matching the query
+// filter as a domain event named after the collection, e.g. user.update.
+// It blocks until ctx is done or the stream fails.
+func (s *CachedStore) PublishChanges(ctx context.Context, query *QueryOpt, pub Publisher) error {
+	stream, err := s.Watch(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(ctx)
+
+	return PublishChanges(ctx, stream, pub, s.Collection)
+}
+
+// RunInTransaction runs fn in a driver transaction. IDs and timestamps are
+// set the same way as Create and Update, and the cache entries of every
+// written document are invalidated only after the transaction commits.
+func (s *CachedStore) RunInTransaction(ctx context.Context, fn func(tx Tx) error) error {
+	var tx *cachedTx
+	err := s.storage.RunInTransaction(ctx, func(dtx Tx) error {
+		// drivers may retry fn, so only the last attempt's writes count
+		tx = &cachedTx{store: s, tx: dtx}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	// the driver may commit without running fn
+	if tx == nil {
+		return nil
+	}
+
+	for _, id := range tx.ids {
+		if err := s.deleteCache(ctx, "RunInTransaction", id); err != nil {
+			return err
+		}
+	}
+	s.invalidate(ctx, "RunInTransaction")
+
+	var recErr error
+	for _, h := range tx.hooks {
+		if err := s.after(ctx, h.point, h.event); err != nil && recErr == nil {
+			recErr = err
+		}
+	}
+
+	return recErr
+}
+
+// deleteCache deletes the cached copy of the document of id, the errors of
+// the cache are logged
+func (s *CachedStore) deleteCache(ctx context.Context, op string, id interface{}) error {
+	if s.CacheExpiration == 1 {
+		return nil
+	}
+	key, err := s.cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.cache.Delete(ctx, key); err != nil {
+		log.GetLogger(ctx, "docstore", op).WithError(err).Error("error deleting cache ")
+	}
+	return nil
+}
+
+type cachedTx struct {
+	store *CachedStore
+	tx    Tx
+	ids   []interface{}
+	// hooks are the after hooks to run once the transaction commits
+	hooks []txHook
+}
+
+type txHook struct {
+	point HookPoint
+	event *HookEvent
+}
+
+func (t *cachedTx) Create(ctx context.Context, doc interface{}) error {
+	s := t.store
+	if err := s.setID(doc, s.IDField); err != nil {
+		return err
+	}
+
+	if err := s.setTime(ctx, doc, s.TimestampField, false); err != nil {
+		return err
+	}
+
+	if err := s.setTime(ctx, doc, s.UpdateTimeField, false); err != nil {
+		return err
+	}
+
+	id, err := s.getID(doc)
+	if err != nil {
+		return err
+	}
+
+	event := &HookEvent{Op: "Create", ID: id, Doc: doc}
+	if err := s.before(ctx, BeforeCreate, event); err != nil {
+		return err
+	}
+
+	enc, err := s.newDoc(doc)
+	if err != nil {
+		return err
+	}
+
+	if err := t.tx.Create(ctx, enc); err != nil {
+		return err
+	}
+
+	t.ids = append(t.ids, id)
+	t.hooks = append(t.hooks, txHook{point: AfterCreate, event: event})
+	return nil
+}
+
+func (t *cachedTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	s := t.store
+	if err := s.setTime(ctx, doc, s.UpdateTimeField, true); err != nil {
+		return err
+	}
+
+	event := &HookEvent{Op: updateOp(replace, false), ID: id, Doc: doc}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
+
+	var version int64
+	if s.VersionField != "" {
+		ctx, version = s.versioning(ctx, doc, true)
+	}
+
+	enc, err := s.encryptDoc(doc)
+	if err != nil {
+		return err
+	}
+
+	if err := t.tx.Update(ctx, id, enc, replace); err != nil {
+		return err
+	}
+
+	t.ids = append(t.ids, id)
+	t.hooks = append(t.hooks, txHook{point: AfterUpdate, event: event})
+	return s.setVersion(doc, version+1)
+}
+
+// Delete marks the document deleted when the store soft deletes
+func (t *cachedTx) Delete(ctx context.Context, id interface{}) error {
+	s := t.store
+	event := &HookEvent{Op: "Delete", ID: id}
+	if err := s.before(ctx, BeforeDelete, event); err != nil {
+		return err
+	}
+
+	if s.SoftDelete {
+		if err := t.softDelete(ctx, id); err != nil {
+			return err
+		}
+	} else if err := t.tx.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	t.ids = append(t.ids, id)
+	t.hooks = append(t.hooks, txHook{point: AfterDelete, event: event})
+	return nil
+}
+
+// softDelete marks the document deleted unless it is missing or already
+// deleted
+func (t *cachedTx) softDelete(ctx context.Context, id interface{}) error {
+	s := t.store
+	d := make(map[string]interface{})
+	if err := t.tx.Get(ctx, id, &d); err != nil {
+		if err == NotFound {
+			return nil
+		}
+		return err
+	}
+	if s.isDeleted(d) {
+		return nil
+	}
+
+	return t.tx.Update(s.fieldVersioning(ctx, nil), id, s.deletedAt(), false)
+}
+
+// Get always reads through the transaction, a cached copy may be stale
+// compared to the transaction snapshot.
+func (t *cachedTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	if !util.IsPointerOfStruct(doc) && !util.IsMap(doc) {
+		return errors.New("[docstore] docs should be a pointer of struct or map")
+	}
+
+	s := t.store
+	if !s.mapped() {
+		return t.tx.Get(ctx, id, doc)
+	}
+
+	d := make(map[string]interface{})
+	if err := t.tx.Get(ctx, id, &d); err != nil {
+		return err
+	}
+
+	if s.tenancy() {
+		if err := s.ownDoc(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	if (s.SoftDelete && s.isDeleted(d)) || (s.expiring() && s.isExpired(d)) {
+		return NotFound
+	}
+
+	if err := s.decryptDoc(d); err != nil {
+		return err
+	}
+
+	// the upgrade is written by the updates of the transaction
+	if s.migrating() {
+		if _, err := s.upgrade(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	return util.DecodeJSON(d, doc)
 }
 
 type IDGenerator func(reflect.Type, interface{}) interface{}
@@ -2,7 +2,9 @@ package docstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -10,8 +12,11 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/bondhan/golib/cache"
+	_ "github.com/bondhan/golib/cache/lru"
 	_ "github.com/bondhan/golib/cache/mem"
 	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/domain/principal"
+	"github.com/bondhan/golib/domain/retailer"
 )
 
 func TestDocstore(t *testing.T) {
@@ -271,3 +276,1220 @@ func TestFindOne(t *testing.T) {
 	require.Nil(t, cs.FindOne(ctx, q, &doc))
 
 }
+
+func TestDocstoreTransaction(t *testing.T) {
+	type Item struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Stock     int    `json:"stock"`
+		CreatedAt int64  `json:"created_at"`
+	}
+
+	ms := NewMemoryStore("test", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	conf := &Config{
+		IDField:         defaultID,
+		TimestampField:  defaultTimestamp,
+		CacheExpiration: 60,
+	}
+
+	cs := NewDocstore(ms, cache, conf)
+	ctx := context.Background()
+
+	item := &Item{Name: "item", Stock: 10}
+	require.Nil(t, cs.Create(ctx, item))
+
+	var doc Item
+	require.Nil(t, cs.Get(ctx, item.ID, &doc))
+	assert.True(t, cache.Exist(ctx, item.ID))
+
+	err = cs.RunInTransaction(ctx, func(tx Tx) error {
+		require.Nil(t, tx.Update(ctx, item.ID, map[string]interface{}{"stock": 5}, false))
+		// not committed yet, cache entry must still be there
+		assert.True(t, cache.Exist(ctx, item.ID))
+		return errors.New("rollback")
+	})
+	require.NotNil(t, err)
+	assert.True(t, cache.Exist(ctx, item.ID))
+
+	created := &Item{Name: "other", Stock: 1}
+	err = cs.RunInTransaction(ctx, func(tx Tx) error {
+		if err := tx.Update(ctx, item.ID, map[string]interface{}{"stock": 5}, false); err != nil {
+			return err
+		}
+		return tx.Create(ctx, created)
+	})
+	require.Nil(t, err)
+	assert.False(t, cache.Exist(ctx, item.ID))
+	assert.NotEmpty(t, created.ID)
+	assert.NotZero(t, created.CreatedAt)
+
+	require.Nil(t, cs.Get(ctx, item.ID, &doc))
+	assert.Equal(t, 5, doc.Stock)
+	require.Nil(t, cs.Get(ctx, created.ID, &doc))
+	assert.Equal(t, "other", doc.Name)
+
+	// a driver may commit without running fn
+	skip := NewDocstore(skipTxStore{ms}, cache, conf)
+	assert.Nil(t, skip.RunInTransaction(ctx, func(tx Tx) error { return nil }))
+}
+
+// skipTxStore commits its transactions without running them
+type skipTxStore struct {
+	*MemoryStore
+}
+
+func (skipTxStore) RunInTransaction(ctx context.Context, fn func(tx Tx) error) error {
+	return nil
+}
+
+func TestDocstoreFindPage(t *testing.T) {
+	type Item struct {
+		ID    string `json:"id"`
+		Price int    `json:"price"`
+	}
+
+	ms := NewMemoryStore("test", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{IDField: defaultID, CacheCount: true})
+	ctx := context.Background()
+
+	for i, p := range []int{30, 10, 20, 10, 20, 40, 10} {
+		require.Nil(t, cs.Create(ctx, &Item{ID: fmt.Sprintf("P-%v", i), Price: p}))
+	}
+
+	pages := func(q *QueryOpt) [][]string {
+		var out [][]string
+		for {
+			var items []Item
+			next, err := cs.FindPage(ctx, q, &items)
+			require.Nil(t, err)
+			ids := make([]string, 0)
+			for _, it := range items {
+				ids = append(ids, it.ID)
+			}
+			out = append(out, ids)
+			if next == "" {
+				return out
+			}
+			q.Cursor = next
+		}
+	}
+
+	q := &QueryOpt{Limit: 3, OrderBy: "price", IsAscend: true}
+	assert.Equal(t, [][]string{{"P-1", "P-3", "P-6"}, {"P-2", "P-4", "P-0"}, {"P-5"}}, pages(q))
+
+	q = &QueryOpt{Limit: 3, OrderBy: "price"}
+	assert.Equal(t, [][]string{{"P-5", "P-0", "P-4"}, {"P-2", "P-6", "P-3"}, {"P-1"}}, pages(q))
+
+	q = &QueryOpt{Limit: 4}
+	assert.Equal(t, [][]string{{"P-0", "P-1", "P-2", "P-3"}, {"P-4", "P-5", "P-6"}}, pages(q))
+
+	// documents created before the cursor do not shift the next page
+	q = &QueryOpt{Limit: 2, OrderBy: "price", IsAscend: true}
+	var items []Item
+	next, err := cs.FindPage(ctx, q, &items)
+	require.Nil(t, err)
+	require.Nil(t, cs.Create(ctx, &Item{ID: "P-7", Price: 5}))
+	q.Cursor = next
+	items = nil
+	_, err = cs.FindPage(ctx, q, &items)
+	require.Nil(t, err)
+	assert.Equal(t, []Item{{ID: "P-6", Price: 10}, {ID: "P-2", Price: 20}}, items)
+
+	count, err := cs.Count(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "price", Ops: constant.GE, Value: 10}}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7), count)
+	count, err = cs.Count(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "price", Ops: constant.GE, Value: 10}}, Cursor: next})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7), count)
+
+	q.IsAscend = false
+	_, err = cs.FindPage(ctx, q, &items)
+	assert.ErrorIs(t, err, InvalidCursor)
+
+	_, err = cs.FindPage(ctx, &QueryOpt{}, &items)
+	assert.NotNil(t, err)
+}
+
+type recordPublisher struct {
+	events chan string
+}
+
+func (p *recordPublisher) Publish(ctx context.Context, event, key string, message interface{}, metadata map[string]interface{}) error {
+	p.events <- event + ":" + key
+	return nil
+}
+
+func TestDocstorePublishChanges(t *testing.T) {
+	type Item struct {
+		ID    string `json:"id"`
+		Stock int    `json:"stock"`
+	}
+
+	ms := NewMemoryStore("test", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "item", IDField: defaultID, CacheExpiration: 60})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pub := &recordPublisher{events: make(chan string, 10)}
+	done := make(chan error)
+	stream, err := cs.Watch(ctx, nil)
+	require.Nil(t, err)
+	go func() {
+		done <- PublishChanges(ctx, stream, pub, cs.Collection)
+	}()
+
+	require.Nil(t, cs.Create(ctx, &Item{ID: "I-1", Stock: 1}))
+	require.Nil(t, cs.Increment(ctx, "I-1", "stock", 2))
+	require.Nil(t, cs.RunInTransaction(ctx, func(tx Tx) error {
+		if err := tx.Create(ctx, &Item{ID: "I-2"}); err != nil {
+			return err
+		}
+		return tx.Delete(ctx, "I-1")
+	}))
+
+	assert.Equal(t, "item.insert:I-1", <-pub.events)
+	assert.Equal(t, "item.update:I-1", <-pub.events)
+	assert.ElementsMatch(t, []string{"item.insert:I-2", "item.delete:I-1"}, []string{<-pub.events, <-pub.events})
+
+	require.Nil(t, stream.Close(ctx))
+	require.Nil(t, <-done)
+	cancel()
+}
+
+func TestDocstoreVersion(t *testing.T) {
+	type Doc struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Count   int    `json:"count"`
+		Version int    `json:"version"`
+	}
+
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(NewMemoryStore("version", "id"), cache, &Config{IDField: "id", VersionField: "version"})
+	ctx := context.Background()
+
+	doc := &Doc{Name: "first"}
+	require.Nil(t, cs.Create(ctx, doc))
+	assert.Equal(t, 1, doc.Version)
+
+	var a, b Doc
+	require.Nil(t, cs.Get(ctx, doc.ID, &a))
+	require.Nil(t, cs.Get(ctx, doc.ID, &b))
+
+	a.Name = "a"
+	require.Nil(t, cs.Update(ctx, &a))
+	assert.Equal(t, 2, a.Version)
+
+	b.Name = "b"
+	assert.True(t, errors.Is(cs.Update(ctx, &b), ErrVersionConflict))
+	assert.Equal(t, ErrVersionConflict, cs.Replace(ctx, &b))
+
+	require.Nil(t, cs.UpdateField(ctx, doc.ID, "name", "c"))
+	require.Nil(t, cs.Increment(ctx, doc.ID, "count", 1))
+	assert.Equal(t, ErrVersionConflict, cs.UpdateFields(ctx, doc.ID, []Field{{Name: "version", Value: 2}, {Name: "name", Value: "stale"}}))
+
+	var c Doc
+	require.Nil(t, cs.Get(ctx, doc.ID, &c))
+	assert.Equal(t, Doc{ID: doc.ID, Name: "c", Count: 1, Version: 4}, c)
+
+	c.Name = "d"
+	require.Nil(t, cs.Replace(ctx, &c))
+	assert.Equal(t, 5, c.Version)
+
+	require.Nil(t, cs.UpdateMany(ctx, []FilterOpt{{Field: "id", Ops: constant.EQ, Value: doc.ID}}, map[string]interface{}{"name": "e"}))
+	require.Nil(t, cs.Get(ctx, doc.ID, &c))
+	assert.Equal(t, Doc{ID: doc.ID, Name: "e", Count: 1, Version: 6}, c)
+}
+
+func TestDocstoreSoftDelete(t *testing.T) {
+	type Doc struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	ms := NewMemoryStore("softdelete", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{IDField: "id", SoftDelete: true})
+	ctx := context.Background()
+
+	// deletes are stamped by the time generator
+	now := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	cs.TimeGenerator = func(reflect.Type, interface{}) interface{} { return now }
+
+	for _, id := range []string{"1", "2", "3"} {
+		require.Nil(t, cs.Create(ctx, &Doc{ID: id, Name: "doc" + id}))
+	}
+
+	var doc Doc
+	// cache the document before deleting it
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	require.Nil(t, cs.Delete(ctx, "1"))
+
+	assert.Equal(t, NotFound, cs.Get(ctx, "1", &doc))
+	raw := make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+	at, found := asTime(raw["deleted_at"])
+	require.True(t, found)
+	assert.True(t, now.Equal(at))
+
+	// deleting it again keeps the time it was deleted at
+	cs.TimeGenerator = DefaultTimeGenerator
+	require.Nil(t, cs.Delete(ctx, "1"))
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+	at, _ = asTime(raw["deleted_at"])
+	assert.True(t, now.Equal(at))
+
+	var docs []Doc
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	assert.Equal(t, []Doc{{ID: "2", Name: "doc2"}, {ID: "3", Name: "doc3"}}, docs)
+
+	n, err := cs.Count(ctx, nil)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	byID := &QueryOpt{Filter: []FilterOpt{{Field: "id", Ops: constant.EQ, Value: "1"}}}
+	assert.Equal(t, NotFound, cs.FindOne(ctx, byID, &doc))
+	ok, err := cs.IsExists(ctx, byID)
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	docs = nil
+	require.Nil(t, cs.BulkGet(ctx, []string{"1", "2"}, &docs))
+	assert.Equal(t, []Doc{{ID: "2", Name: "doc2"}}, docs)
+
+	docs = nil
+	require.Nil(t, cs.FindDeleted(ctx, nil, &docs))
+	assert.Equal(t, []Doc{{ID: "1", Name: "doc1"}}, docs)
+
+	require.Nil(t, cs.Restore(ctx, "1"))
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, "doc1", doc.Name)
+
+	// the cached copy is dropped by DeleteMany too
+	require.Nil(t, cs.DeleteMany(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "name", Ops: constant.IN, Value: []string{"doc1", "doc2"}}}}))
+	assert.Equal(t, NotFound, cs.Get(ctx, "1", &doc))
+	n, err = cs.Count(ctx, nil)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	require.Nil(t, cs.Purge(ctx, time.Hour))
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+
+	// the cutoff is taken from the time generator
+	later := time.Now().Add(2 * time.Hour)
+	cs.TimeGenerator = func(reflect.Type, interface{}) interface{} { return later }
+	require.Nil(t, cs.Purge(ctx, time.Hour))
+	cs.TimeGenerator = DefaultTimeGenerator
+	assert.Equal(t, NotFound, ms.Get(ctx, "1", &raw))
+	assert.Equal(t, NotFound, ms.Get(ctx, "2", &raw))
+	require.Nil(t, ms.Get(ctx, "3", &raw))
+
+	// deletes in a transaction are soft too
+	require.Nil(t, cs.RunInTransaction(ctx, func(tx Tx) error {
+		if err := tx.Delete(ctx, "3"); err != nil {
+			return err
+		}
+		assert.Equal(t, NotFound, tx.Get(ctx, "3", &doc))
+		return nil
+	}))
+	assert.Equal(t, NotFound, cs.Get(ctx, "3", &doc))
+	raw = make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "3", &raw))
+	assert.NotNil(t, raw["deleted_at"])
+}
+
+func TestDocstoreMigration(t *testing.T) {
+	type Doc struct {
+		ID       string `json:"id"`
+		FullName string `json:"full_name"`
+		Active   bool   `json:"active"`
+		Schema   string `json:"schema_version"`
+	}
+
+	upgrades := 0
+	RegisterMigration("migration",
+		Migration{From: "", To: "v2", Upgrade: func(ctx context.Context, doc map[string]interface{}) error {
+			upgrades++
+			doc["full_name"] = doc["name"]
+			delete(doc, "name")
+			return nil
+		}},
+		Migration{From: "v2", To: "v3", Upgrade: func(ctx context.Context, doc map[string]interface{}) error {
+			doc["active"] = true
+			return nil
+		}},
+	)
+
+	ms := NewMemoryStore("migration", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "migration", IDField: "id", SchemaVersion: "v3"})
+	ctx := context.Background()
+
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "1", "name": "one"}))
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "2", "full_name": "two", "schema_version": "v2"}))
+
+	var doc Doc
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, Doc{ID: "1", FullName: "one", Active: true, Schema: "v3"}, doc)
+
+	raw := make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+	assert.Equal(t, "v3", raw["schema_version"])
+	assert.NotContains(t, raw, "name")
+
+	var docs []Doc
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	assert.Equal(t, []Doc{
+		{ID: "1", FullName: "one", Active: true, Schema: "v3"},
+		{ID: "2", FullName: "two", Active: true, Schema: "v3"},
+	}, docs)
+
+	created := &Doc{ID: "3", FullName: "three"}
+	require.Nil(t, cs.Create(ctx, created))
+	assert.Equal(t, "v3", created.Schema)
+
+	// documents of a newer release are left as is
+	old := NewDocstore(ms, cache, &Config{Collection: "migration", IDField: "id", SchemaVersion: "v2", CacheExpiration: 1})
+	require.Nil(t, old.Get(ctx, "1", &doc))
+	assert.Equal(t, "v3", doc.Schema)
+
+	for _, id := range []string{"4", "5", "6"} {
+		require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": id, "name": "doc" + id}))
+	}
+
+	var checkpoints []MigrationProgress
+	stop := errors.New("stop")
+	p, err := cs.MigrateDocuments(ctx, MigrationOpt{BatchSize: 2, Progress: func(ctx context.Context, p MigrationProgress) error {
+		checkpoints = append(checkpoints, p)
+		return stop
+	}})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, int64(2), p.Scanned)
+	assert.Equal(t, int64(0), p.Upgraded)
+
+	p, err = cs.MigrateDocuments(ctx, MigrationOpt{BatchSize: 2, Checkpoint: checkpoints[0].Checkpoint, Progress: func(ctx context.Context, p MigrationProgress) error {
+		checkpoints = append(checkpoints, p)
+		return nil
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), p.Scanned)
+	assert.Equal(t, int64(3), p.Upgraded)
+	assert.Equal(t, 3, len(checkpoints))
+
+	for _, id := range []string{"4", "5", "6"} {
+		raw := make(map[string]interface{})
+		require.Nil(t, ms.Get(ctx, id, &raw))
+		assert.Equal(t, "v3", raw["schema_version"])
+		assert.Equal(t, "doc"+id, raw["full_name"])
+	}
+	assert.Equal(t, 4, upgrades, "every document is upgraded once")
+}
+
+func TestDocstoreMigration_ConcurrentWrite(t *testing.T) {
+	ms := NewMemoryStore("migration-race", "id")
+	ctx := context.Background()
+
+	upgrades := 0
+	RegisterMigration("migration-race", Migration{From: "", To: "v2", Upgrade: func(ctx context.Context, doc map[string]interface{}) error {
+		upgrades++
+		doc["full_name"] = doc["name"]
+		delete(doc, "name")
+		return nil
+	}})
+
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "migration-race", IDField: "id", SchemaVersion: "v2"})
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "1", "name": "one"}))
+
+	// the document is written after it is read and before the upgrade is saved
+	cs.AddHook(BeforeUpdate, func(ctx context.Context, e *HookEvent) error {
+		return ms.UpdateField(ctx, "1", []Field{{Name: "active", Value: true}})
+	})
+
+	var doc struct {
+		FullName string `json:"full_name"`
+		Active   bool   `json:"active"`
+	}
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, "one", doc.FullName)
+	assert.True(t, doc.Active, "the document read is the one upgraded")
+	assert.Equal(t, 1, upgrades, "the migration runs once")
+
+	raw := make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+	assert.Equal(t, map[string]interface{}{"id": "1", "full_name": "one", "active": true, "schema_version": "v2"}, raw)
+}
+
+func TestDocstoreEncryption(t *testing.T) {
+	type Doc struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Phone string `json:"phone"`
+		Email string `json:"email"`
+	}
+
+	ms := NewMemoryStore("encryption", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	enc := &EncryptionConfig{
+		Fields:        []string{"phone", "email"},
+		Keys:          map[string]string{"k1": "secret-1"},
+		ActiveKey:     "k1",
+		BlindIndex:    []string{"phone"},
+		BlindIndexKey: "blind",
+	}
+	require.Nil(t, enc.validate())
+	cs := NewDocstore(ms, cache, &Config{IDField: "id", Encryption: enc})
+	ctx := context.Background()
+
+	doc := &Doc{ID: "1", Name: "one", Phone: "0811", Email: "one@mail.com"}
+	require.Nil(t, cs.Create(ctx, doc))
+	assert.Equal(t, "0811", doc.Phone)
+
+	raw := make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+	assert.Regexp(t, "^enc:k1:", raw["phone"])
+	assert.Regexp(t, "^enc:k1:", raw["email"])
+	assert.NotEmpty(t, raw["phone_bidx"])
+	assert.NotContains(t, raw, "email_bidx")
+
+	var out Doc
+	require.Nil(t, cs.Get(ctx, "1", &out))
+	assert.Equal(t, *doc, out)
+
+	// the cached copy is encrypted too
+	cached := make(map[string]interface{})
+	require.Nil(t, cs.GetCache().Get(ctx, "1", &cached))
+	assert.Regexp(t, "^enc:k1:", cached["phone"])
+	out = Doc{}
+	require.Nil(t, cs.Get(ctx, "1", &out))
+	assert.Equal(t, *doc, out)
+
+	// values looking encrypted are encrypted too
+	for i, phone := range []string{"enc:k1:plain-text-phone", "enc:k1:QQ=="} {
+		fake := &Doc{ID: fmt.Sprintf("fake%d", i), Phone: phone}
+		require.Nil(t, cs.Create(ctx, fake))
+		raw := make(map[string]interface{})
+		require.Nil(t, ms.Get(ctx, fake.ID, &raw))
+		assert.NotEqual(t, phone, raw["phone"])
+		out = Doc{}
+		require.Nil(t, cs.Get(ctx, fake.ID, &out))
+		assert.Equal(t, phone, out.Phone)
+		require.Nil(t, ms.Delete(ctx, fake.ID))
+	}
+
+	byPhone := &QueryOpt{Filter: []FilterOpt{{Field: "phone", Ops: constant.EQ, Value: "0811"}}}
+	var docs []Doc
+	require.Nil(t, cs.Find(ctx, byPhone, &docs))
+	assert.Equal(t, []Doc{*doc}, docs)
+
+	n, err := cs.Count(ctx, byPhone)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.NotNil(t, cs.Find(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "phone", Ops: constant.GT, Value: "0"}}}, &docs))
+	assert.NotNil(t, cs.Find(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "email", Ops: constant.EQ, Value: "one@mail.com"}}}, &docs))
+
+	require.Nil(t, cs.UpdateField(ctx, "1", "phone", "0822"))
+	assert.NotNil(t, cs.UpdateFields(ctx, "1", []Field{{Name: "phone", Op: UpdatePush, Value: "0899"}}))
+	require.Nil(t, cs.FindOne(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "phone", Ops: constant.IN, Value: []string{"0822"}}}}, &out))
+	assert.Equal(t, "0822", out.Phone)
+
+	// documents written before encryption are read as is
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "2", "name": "two", "phone": "0833"}))
+
+	rotated := &EncryptionConfig{
+		Fields:        enc.Fields,
+		Keys:          map[string]string{"k1": "secret-1", "k2": "secret-2"},
+		ActiveKey:     "k2",
+		BlindIndex:    enc.BlindIndex,
+		BlindIndexKey: enc.BlindIndexKey,
+	}
+	cs = NewDocstore(ms, cache, &Config{IDField: "id", Encryption: rotated, CacheExpiration: 1})
+	require.Nil(t, cs.Get(ctx, "1", &out))
+	assert.Equal(t, "0822", out.Phone)
+	require.Nil(t, cs.Get(ctx, "2", &out))
+	assert.Equal(t, "0833", out.Phone)
+
+	p, err := cs.Reencrypt(ctx, MigrationOpt{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), p.Upgraded)
+
+	for _, id := range []string{"1", "2"} {
+		raw := make(map[string]interface{})
+		require.Nil(t, ms.Get(ctx, id, &raw))
+		assert.Regexp(t, "^enc:k2:", raw["phone"])
+	}
+
+	require.Nil(t, cs.FindOne(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "phone", Ops: constant.EQ, Value: "0833"}}}, &out))
+	assert.Equal(t, "two", out.Name)
+}
+
+func TestDocstoreQueryCache(t *testing.T) {
+	type Doc struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	ids := func(docs []Doc) []string {
+		out := make([]string, len(docs))
+		for i, d := range docs {
+			out[i] = d.ID
+		}
+		return out
+	}
+
+	for _, url := range []string{"mem://", "lru://"} {
+		t.Run(url, func(t *testing.T) {
+			ms := NewMemoryStore("querycache", "id")
+			cache, err := cache.New(url)
+			require.Nil(t, err)
+			cs := NewDocstore(ms, cache, &Config{Collection: "querycache", IDField: "id", QueryCache: true})
+			ctx := context.Background()
+
+			for i, id := range []string{"1", "2", "3"} {
+				require.Nil(t, cs.Create(ctx, &Doc{ID: id, Name: "doc" + id, Age: 20 + i}))
+			}
+
+			adults := &QueryOpt{Filter: []FilterOpt{{Field: "age", Ops: constant.GT, Value: 20}}, OrderBy: "id", IsAscend: true}
+			var docs []Doc
+			require.Nil(t, cs.Find(ctx, adults, &docs))
+			assert.Equal(t, []string{"2", "3"}, ids(docs))
+
+			// writes bypassing the store are not seen until the entry is invalidated
+			require.Nil(t, ms.UpdateField(ctx, "3", []Field{{Name: "name", Value: "stale"}}))
+			docs = nil
+			require.Nil(t, cs.Find(ctx, adults, &docs))
+			assert.Equal(t, "doc3", docs[1].Name)
+
+			// a write of a document of the result invalidates it
+			require.Nil(t, cs.UpdateField(ctx, "2", "name", "two"))
+			docs = nil
+			require.Nil(t, cs.Find(ctx, adults, &docs))
+			assert.Equal(t, "two", docs[0].Name)
+			assert.Equal(t, "stale", docs[1].Name)
+
+			// a write moving another document into the result invalidates it
+			require.Nil(t, ms.UpdateField(ctx, "3", []Field{{Name: "name", Value: "three"}}))
+			require.Nil(t, cs.UpdateFields(ctx, "1", []Field{{Name: "age", Value: 30}}))
+			docs = nil
+			require.Nil(t, cs.Find(ctx, adults, &docs))
+			assert.Equal(t, []string{"1", "2", "3"}, ids(docs))
+			assert.Equal(t, "three", docs[2].Name)
+
+			// creates invalidate every result of the collection
+			require.Nil(t, cs.Create(ctx, &Doc{ID: "4", Name: "doc4", Age: 40}))
+			docs = nil
+			require.Nil(t, cs.Find(ctx, adults, &docs))
+			assert.Equal(t, []string{"1", "2", "3", "4"}, ids(docs))
+
+			byName := &QueryOpt{Filter: []FilterOpt{{Field: "name", Ops: constant.EQ, Value: "doc5"}}}
+			ok, err := cs.IsExists(ctx, byName)
+			require.Nil(t, err)
+			assert.False(t, ok)
+			require.Nil(t, cs.Create(ctx, &Doc{ID: "5", Name: "doc5", Age: 50}))
+			ok, err = cs.IsExists(ctx, byName)
+			require.Nil(t, err)
+			assert.True(t, ok)
+
+			var doc Doc
+			require.Nil(t, cs.FindOne(ctx, byName, &doc))
+			assert.Equal(t, 50, doc.Age)
+			require.Nil(t, cs.Delete(ctx, "5"))
+			assert.Equal(t, NotFound, cs.FindOne(ctx, byName, &doc))
+			ok, err = cs.IsExists(ctx, byName)
+			require.Nil(t, err)
+			assert.False(t, ok)
+
+			vals, err := cs.Distinct(ctx, "age", nil)
+			require.Nil(t, err)
+			assert.Len(t, vals, 4)
+			require.Nil(t, cs.UpdateField(ctx, "4", "age", 30))
+			vals, err = cs.Distinct(ctx, "age", nil)
+			require.Nil(t, err)
+			assert.Len(t, vals, 3)
+		})
+	}
+}
+
+func TestDocstoreBulkWrite(t *testing.T) {
+	type Doc struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	ms := NewMemoryStore("bulkwrite", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{
+		Collection:      "bulkwrite",
+		IDField:         "id",
+		TimestampField:  "created_at",
+		UpdateTimeField: "updated_at",
+		SoftDelete:      true,
+		QueryCache:      true,
+	})
+	ctx := context.Background()
+
+	require.Nil(t, cs.Create(ctx, &Doc{ID: "1", Name: "doc1"}))
+	require.Nil(t, cs.Create(ctx, &Doc{ID: "2", Name: "doc2"}))
+
+	// cache the document and a query result before the bulk write
+	var doc Doc
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	var docs []Doc
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	require.Len(t, docs, 2)
+
+	created := &Doc{Name: "new"}
+	res, err := cs.BulkWrite(ctx, []WriteOp{
+		{Op: WriteCreate, Doc: created},
+		{Op: WriteUpdate, Doc: &Doc{ID: "1", Name: "doc1b"}},
+		{Op: WriteDelete, ID: "2"},
+		{Op: WriteDelete, ID: "missing"},
+		{Op: WriteUpdate, ID: "missing", Doc: map[string]interface{}{"name": "x"}},
+		{Op: "unknown", ID: "1"},
+	}, &BulkWriteOpt{BatchSize: 2})
+	require.ErrorIs(t, err, ErrPartialWrite)
+	require.Len(t, res, 6)
+
+	assert.NotEmpty(t, created.ID)
+	assert.False(t, created.CreatedAt.IsZero())
+	assert.Equal(t, created.ID, res[0].ID)
+	assert.Equal(t, "1", res[1].ID)
+	for i, status := range []string{WriteOK, WriteOK, WriteOK, WriteOK, WriteFailed, WriteFailed} {
+		assert.Equal(t, status, res[i].Status, i)
+	}
+	assert.Equal(t, NotFound, res[4].Error)
+
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, "doc1b", doc.Name)
+	assert.False(t, doc.UpdatedAt.IsZero())
+	assert.Equal(t, NotFound, cs.Get(ctx, "2", &doc))
+
+	raw := make(map[string]interface{})
+	require.Nil(t, ms.Get(ctx, "2", &raw))
+	assert.NotNil(t, raw["deleted_at"], "soft delete")
+
+	// deleting it again keeps the time it was deleted at
+	deletedAt := raw["deleted_at"]
+	res, err = cs.BulkWrite(ctx, []WriteOp{{Op: WriteDelete, ID: "2"}})
+	require.Nil(t, err)
+	assert.Equal(t, WriteOK, res[0].Status)
+	require.Nil(t, ms.Get(ctx, "2", &raw))
+	assert.Equal(t, deletedAt, raw["deleted_at"])
+
+	docs = nil
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	assert.Len(t, docs, 2, "invalidated query result")
+
+	res, err = cs.BulkWrite(ctx, []WriteOp{
+		{Op: WriteUpdate, ID: "missing", Doc: map[string]interface{}{"name": "x"}},
+		{Op: WriteUpdate, ID: "1", Doc: map[string]interface{}{"name": "doc1c"}},
+		{Op: WriteUpdate, ID: "1", Doc: map[string]interface{}{"name": "doc1d"}},
+	}, &BulkWriteOpt{Ordered: true, BatchSize: 1})
+	require.ErrorIs(t, err, ErrPartialWrite)
+	assert.Equal(t, WriteFailed, res[0].Status)
+	assert.Equal(t, WriteSkipped, res[1].Status)
+	assert.Equal(t, WriteSkipped, res[2].Status)
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, "doc1b", doc.Name)
+
+	// the version of bulk updates can not be checked
+	vs := NewDocstore(NewMemoryStore("bulkversion", "id"), cache, &Config{Collection: "bulkversion", IDField: "id", VersionField: "version"})
+	res, err = vs.BulkWrite(ctx, []WriteOp{
+		{Op: WriteCreate, Doc: map[string]interface{}{"id": "1", "name": "doc1"}},
+		{Op: WriteUpdate, ID: "1", Doc: map[string]interface{}{"name": "doc1b"}},
+	})
+	require.ErrorIs(t, err, ErrPartialWrite)
+	assert.Equal(t, WriteOK, res[0].Status)
+	assert.Equal(t, ErrVersionedBulkWrite, res[1].Error)
+}
+
+func TestDocstoreProjection(t *testing.T) {
+	type Doc struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+	}
+
+	ms := NewMemoryStore("projection", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{
+		Collection: "projection",
+		IDField:    "id",
+		SoftDelete: true,
+		QueryCache: true,
+	})
+	ctx := context.Background()
+
+	require.Nil(t, cs.Create(ctx, &Doc{ID: "1", Name: "doc1", Price: 10}))
+	require.Nil(t, cs.Create(ctx, &Doc{ID: "2", Name: "doc2", Price: 20}))
+	require.Nil(t, cs.Delete(ctx, "2"))
+
+	// a projected read must not be cached as the whole document
+	var doc Doc
+	require.Nil(t, cs.Get(ctx, "1", &doc, &Projection{Fields: []string{"name"}}))
+	assert.Equal(t, Doc{ID: "1", Name: "doc1"}, doc)
+	doc = Doc{}
+	require.Nil(t, cs.Get(ctx, "1", &doc))
+	assert.Equal(t, Doc{ID: "1", Name: "doc1", Price: 10}, doc)
+
+	// projected from the cached document
+	doc = Doc{}
+	require.Nil(t, cs.Get(ctx, "1", &doc, &Projection{Exclude: []string{"name"}}))
+	assert.Equal(t, Doc{ID: "1", Price: 10}, doc)
+	assert.Equal(t, NotFound, cs.Get(ctx, "2", &doc, &Projection{Fields: []string{"name"}}))
+
+	var docs []Doc
+	require.Nil(t, cs.BulkGet(ctx, []interface{}{"1", "2"}, &docs, &Projection{Fields: []string{"price"}}))
+	assert.Equal(t, []Doc{{ID: "1", Price: 10}}, docs)
+
+	// the query cache keeps projected and whole results apart
+	query := &QueryOpt{Fields: []string{"name"}}
+	docs = nil
+	require.Nil(t, cs.Find(ctx, query, &docs))
+	assert.Equal(t, []Doc{{ID: "1", Name: "doc1"}}, docs, "soft deleted documents are filtered before projecting")
+	docs = nil
+	require.Nil(t, cs.Find(ctx, &QueryOpt{}, &docs))
+	assert.Equal(t, []Doc{{ID: "1", Name: "doc1", Price: 10}}, docs)
+
+	doc = Doc{}
+	require.Nil(t, cs.FindOne(ctx, query, &doc))
+	assert.Equal(t, Doc{ID: "1", Name: "doc1"}, doc)
+
+	query.Exclude = []string{"price"}
+	assert.NotNil(t, cs.Find(ctx, query, &docs))
+}
+
+func TestDocstoreHooks(t *testing.T) {
+	type Item struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		Stock     int       `json:"stock"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	ms := NewMemoryStore("hooks", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "item", IDField: "id", TimestampField: "created_at"})
+	ctx := context.Background()
+
+	var calls []string
+	record := func(point HookPoint) Hook {
+		return func(ctx context.Context, e *HookEvent) error {
+			calls = append(calls, fmt.Sprintf("%s %s %v", point, e.Op, e.ID))
+			return nil
+		}
+	}
+	for _, p := range []HookPoint{BeforeCreate, AfterCreate, BeforeUpdate, AfterUpdate, BeforeDelete, AfterDelete} {
+		cs.AddHook(p, record(p))
+	}
+
+	invalid := errors.New("invalid name")
+	cs.AddHook(BeforeCreate, func(ctx context.Context, e *HookEvent) error {
+		item, ok := e.Doc.(*Item)
+		if ok && item.Name == "" {
+			return invalid
+		}
+		if ok {
+			assert.False(t, item.CreatedAt.IsZero(), "stamped before the hooks")
+		}
+		return nil
+	})
+	pub := &recordPublisher{events: make(chan string, 20)}
+	cs.PublishHooks(pub)
+
+	assert.Equal(t, invalid, cs.Create(ctx, &Item{ID: "I-0"}))
+	assert.Equal(t, NotFound, cs.Get(ctx, "I-0", &Item{}), "aborted by the before hook")
+
+	require.Nil(t, cs.Create(ctx, &Item{ID: "I-1", Name: "one"}))
+	require.Nil(t, cs.Update(ctx, &Item{ID: "I-1", Name: "uno"}))
+	require.Nil(t, cs.UpdateField(ctx, "I-1", "stock", 5))
+	require.Nil(t, cs.Increment(ctx, "I-1", "stock", 1))
+	require.Nil(t, cs.BulkCreate(ctx, []*Item{{ID: "I-2", Name: "two"}, {ID: "I-3", Name: "three"}}))
+	assert.Equal(t, invalid, cs.BulkCreate(ctx, []*Item{{ID: "I-4", Name: "four"}, {ID: "I-5"}}))
+	_, err = cs.BulkWrite(ctx, []WriteOp{
+		{Op: WriteUpdate, ID: "I-2", Doc: map[string]interface{}{"stock": 2}},
+		{Op: WriteCreate, Doc: &Item{ID: "I-6"}},
+		{Op: WriteDelete, ID: "I-3"},
+	})
+	require.ErrorIs(t, err, ErrPartialWrite)
+	require.Nil(t, cs.RunInTransaction(ctx, func(tx Tx) error {
+		return tx.Delete(ctx, "I-2")
+	}))
+	require.Nil(t, cs.Delete(ctx, "I-1"))
+
+	assert.Equal(t, []string{
+		"before_create Create I-0",
+		"before_create Create I-1",
+		"after_create Create I-1",
+		"before_update Update I-1",
+		"after_update Update I-1",
+		"before_update UpdateField I-1",
+		"after_update UpdateField I-1",
+		"before_update Increment I-1",
+		"after_update Increment I-1",
+		"before_create BulkCreate I-2",
+		"before_create BulkCreate I-3",
+		"after_create BulkCreate I-2",
+		"after_create BulkCreate I-3",
+		"before_create BulkCreate I-4",
+		"before_create BulkCreate I-5",
+		"before_update BulkWrite I-2",
+		"before_create BulkWrite I-6",
+		"before_delete BulkWrite I-3",
+		"after_update BulkWrite I-2",
+		"after_delete BulkWrite I-3",
+		"before_delete Delete I-2",
+		"after_delete Delete I-2",
+		"before_delete Delete I-1",
+		"after_delete Delete I-1",
+	}, calls)
+
+	var events []string
+	for len(pub.events) > 0 {
+		events = append(events, <-pub.events)
+	}
+	assert.Equal(t, []string{
+		"item.insert:I-1",
+		"item.update:I-1",
+		"item.update:I-1",
+		"item.update:I-1",
+		"item.insert:I-2",
+		"item.insert:I-3",
+		"item.update:I-2",
+		"item.delete:I-3",
+		"item.delete:I-2",
+		"item.delete:I-1",
+	}, events)
+}
+
+func TestDocstoreHooks_Maintenance(t *testing.T) {
+	RegisterMigration("hooks-maintenance", Migration{From: "", To: "v2", Upgrade: func(ctx context.Context, doc map[string]interface{}) error {
+		doc["stock"] = 0
+		return nil
+	}})
+
+	ms := NewMemoryStore("hooks-maintenance", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "hooks-maintenance", IDField: "id", SoftDelete: true, SchemaVersion: "v2"})
+	ctx := context.Background()
+
+	var calls []string
+	for _, p := range []HookPoint{BeforeUpdate, AfterUpdate, BeforeDelete, AfterDelete} {
+		p := p
+		cs.AddHook(p, func(ctx context.Context, e *HookEvent) error {
+			calls = append(calls, fmt.Sprintf("%s %s %v", p, e.Op, e.ID))
+			return nil
+		})
+	}
+
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "M-1", "tags": []interface{}{"a", "b"}}))
+	p, err := cs.MigrateDocuments(ctx, MigrationOpt{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), p.Upgraded)
+
+	require.Nil(t, cs.Pull(ctx, Field{Name: "id", Value: "M-1"}, Field{Name: "tags", Value: "a"}))
+	require.Nil(t, cs.Delete(ctx, "M-1"))
+	require.Nil(t, cs.Restore(ctx, "M-1"))
+	require.Nil(t, cs.Delete(ctx, "M-1"))
+	require.Nil(t, cs.Purge(ctx, 0))
+
+	assert.Equal(t, []string{
+		"before_update Migrate M-1",
+		"after_update Migrate M-1",
+		"before_update Pull <nil>",
+		"after_update Pull <nil>",
+		"before_delete Delete M-1",
+		"after_delete Delete M-1",
+		"before_update Restore M-1",
+		"after_update Restore M-1",
+		"before_delete Delete M-1",
+		"after_delete Delete M-1",
+		"before_delete Purge <nil>",
+		"after_delete Purge <nil>",
+	}, calls)
+}
+
+func TestDocstoreAudit(t *testing.T) {
+	type Address struct {
+		City string `json:"city"`
+	}
+	type Retailer struct {
+		ID      string  `json:"id"`
+		Name    string  `json:"name"`
+		Stock   int     `json:"stock,omitempty"`
+		Address Address `json:"address"`
+	}
+
+	ms := NewMemoryStore("retailer", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "retailer", IDField: "id", SoftDelete: true, Audit: true})
+	ctx := principal.WithPrincipalContext(context.Background(), &principal.PrincipalContext{ID: "U-1", User: "alice"})
+
+	assert.NotNil(t, cs.Create(ctx, &Retailer{ID: "R-0"}), "no history store")
+	cs.SetHistory(NewMemoryStore("retailer_history", "id"))
+
+	before := time.Now()
+	require.Nil(t, cs.Create(ctx, &Retailer{ID: "R-1", Name: "shop", Address: Address{City: "Jakarta"}}))
+	created := time.Now()
+	require.Nil(t, cs.Update(ctx, &Retailer{ID: "R-1", Name: "big shop", Address: Address{City: "Bandung"}}))
+	updated := time.Now()
+	require.Nil(t, cs.UpdateField(ctx, "R-1", "stock", 5))
+	require.Nil(t, cs.Update(ctx, &Retailer{ID: "R-1", Name: "big shop", Address: Address{City: "Bandung"}, Stock: 5}))
+	stocked := time.Now()
+	require.Nil(t, cs.Delete(ctx, "R-1"))
+
+	history, err := cs.History(ctx, "R-1")
+	require.Nil(t, err)
+	require.Len(t, history, 4, "writes changing nothing are not recorded")
+	assert.Equal(t, ChangeInsert, history[0].Type)
+	assert.Equal(t, "U-1", history[0].Actor)
+	assert.Equal(t, "alice", history[0].User)
+	assert.Equal(t, []FieldChange{
+		{Field: "address.city", Old: "Jakarta", New: "Bandung"},
+		{Field: "name", Old: "shop", New: "big shop"},
+	}, history[1].Changes)
+	require.Len(t, history[2].Changes, 1)
+	assert.Equal(t, "stock", history[2].Changes[0].Field)
+	assert.EqualValues(t, 5, history[2].Changes[0].New)
+	assert.True(t, history[2].Changes[0].Added)
+	assert.Equal(t, ChangeUpdate, history[3].Type, "soft delete")
+	assert.Equal(t, "deleted_at", history[3].Changes[0].Field)
+
+	var r Retailer
+	assert.Equal(t, NotFound, cs.AsOf(ctx, "R-1", before, &r))
+	require.Nil(t, cs.AsOf(ctx, "R-1", created, &r))
+	assert.Equal(t, Retailer{ID: "R-1", Name: "shop", Address: Address{City: "Jakarta"}}, r)
+	r = Retailer{}
+	require.Nil(t, cs.AsOf(ctx, "R-1", updated, &r))
+	assert.Equal(t, Retailer{ID: "R-1", Name: "big shop", Address: Address{City: "Bandung"}}, r)
+	r = Retailer{}
+	require.Nil(t, cs.AsOf(ctx, "R-1", stocked, &r))
+	assert.Equal(t, 5, r.Stock)
+	assert.Equal(t, NotFound, cs.AsOf(ctx, "R-1", time.Now(), &r))
+
+	// hard deletes keep the document in the history
+	cs.SoftDelete = false
+	require.Nil(t, cs.Create(ctx, &Retailer{ID: "R-2", Name: "kiosk"}))
+	created = time.Now()
+	require.Nil(t, cs.DeleteMany(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "name", Ops: constant.EQ, Value: "kiosk"}}}))
+
+	history, err = cs.History(ctx, "R-2")
+	require.Nil(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, ChangeDelete, history[1].Type)
+	r = Retailer{}
+	require.Nil(t, cs.AsOf(ctx, "R-2", created, &r))
+	assert.Equal(t, "kiosk", r.Name)
+
+	// restores and purges are recorded too
+	cs.SoftDelete = true
+	require.Nil(t, cs.Create(ctx, &Retailer{ID: "R-3", Name: "stall"}))
+	require.Nil(t, cs.Delete(ctx, "R-3"))
+	require.Nil(t, cs.Restore(ctx, "R-3"))
+	require.Nil(t, cs.Delete(ctx, "R-3"))
+	require.Nil(t, cs.Purge(ctx, 0))
+
+	history, err = cs.History(ctx, "R-3")
+	require.Nil(t, err)
+	require.Len(t, history, 5)
+	assert.Equal(t, ChangeUpdate, history[2].Type, "restore")
+	require.Len(t, history[2].Changes, 1)
+	assert.Equal(t, "deleted_at", history[2].Changes[0].Field)
+	assert.Nil(t, history[2].Changes[0].New)
+	assert.Equal(t, ChangeDelete, history[4].Type, "purge")
+	assert.Equal(t, "stall", history[4].Changes[len(history[4].Changes)-1].Old)
+
+	// a write missing from the history returns the error
+	cs.SetHistory(&flakyStore{MemoryStore: NewMemoryStore("retailer_history", "id"), fail: 1})
+	assert.ErrorIs(t, cs.Create(ctx, &Retailer{ID: "R-4", Name: "cart"}), errFlaky)
+	r = Retailer{}
+	require.Nil(t, cs.Get(ctx, "R-4", &r), "the write is done")
+}
+
+func TestDocstoreTenant(t *testing.T) {
+	ms := NewMemoryStore("shop", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "shop", IDField: "id", QueryCache: true})
+
+	DocstoreTestTenant(cs, t)
+}
+
+func TestDocstoreTenantPurge(t *testing.T) {
+	type Shop struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Tenant string `json:"tenant_id"`
+	}
+
+	ms := NewMemoryStore("shop", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "shop", IDField: "id", SoftDelete: true})
+	cs.SetTenantResolver(RetailerTenant)
+	a := retailer.WithRetailerContext(context.Background(), &retailer.RetailerContext{ID: "TNT-A"})
+	b := retailer.WithRetailerContext(context.Background(), &retailer.RetailerContext{ID: "TNT-B"})
+
+	require.Nil(t, cs.Create(a, &Shop{ID: "1", Name: "shop"}))
+	require.Nil(t, cs.Create(b, &Shop{ID: "2", Name: "shop"}))
+	require.Nil(t, cs.Delete(a, "1"))
+	require.Nil(t, cs.Delete(b, "2"))
+
+	assert.NotNil(t, cs.Purge(context.Background(), 0), "missing tenant")
+	require.Nil(t, cs.Purge(a, 0))
+
+	raw := make(map[string]interface{})
+	assert.Equal(t, NotFound, ms.Get(context.Background(), "1", &raw))
+	require.Nil(t, ms.Get(context.Background(), "2", &raw), "the documents of b are kept")
+}
+
+func TestCollection(t *testing.T) {
+	type Doc struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt int64     `json:"updated_at"`
+	}
+
+	ms := NewMemoryStore("collection", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{IDField: "id", TimestampField: "created_at", UpdateTimeField: "updated_at"})
+	ctx := context.Background()
+
+	_, err = NewCollection[struct{ Name string }](cs)
+	assert.NotNil(t, err)
+
+	users, err := NewCollection[Doc](cs)
+	require.Nil(t, err)
+
+	doc := &Doc{Name: "one"}
+	require.Nil(t, users.Create(ctx, doc))
+	assert.NotEmpty(t, doc.ID)
+	assert.False(t, doc.CreatedAt.IsZero())
+	assert.NotZero(t, doc.UpdatedAt)
+
+	got, err := users.Get(ctx, doc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "one", got.Name)
+
+	require.Nil(t, users.BulkCreate(ctx, []*Doc{{ID: "b", Name: "two"}, {ID: "c", Name: "three"}}))
+
+	got.Name = "uno"
+	got.UpdatedAt = 0
+	require.Nil(t, users.Update(ctx, &got))
+	assert.NotZero(t, got.UpdatedAt)
+	assert.Equal(t, NotFound, users.Update(ctx, &Doc{ID: "missing"}))
+	assert.NotNil(t, users.Update(ctx, &Doc{Name: "no id"}))
+
+	docs, err := users.Find(ctx, &QueryOpt{OrderBy: "name", IsAscend: true})
+	require.Nil(t, err)
+	require.Len(t, docs, 3)
+	assert.Equal(t, []string{"three", "two", "uno"}, []string{docs[0].Name, docs[1].Name, docs[2].Name})
+
+	one, err := users.FindOne(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "name", Ops: constant.EQ, Value: "two"}}})
+	require.Nil(t, err)
+	assert.Equal(t, "b", one.ID)
+
+	it, err := users.Iterate(ctx, &QueryOpt{OrderBy: "id", IsAscend: true, Filter: []FilterOpt{{Field: "id", Ops: constant.IN, Value: []string{"b", "c"}}}})
+	require.Nil(t, err)
+	var names []string
+	for {
+		d, err := it.Next(ctx)
+		if err == EndOfDoc {
+			break
+		}
+		require.Nil(t, err)
+		names = append(names, d.Name)
+	}
+	require.Nil(t, it.Close(ctx))
+	assert.Equal(t, []string{"two", "three"}, names)
+}
+
+func TestDocstoreExpiry(t *testing.T) {
+	type Doc struct {
+		ID        string     `json:"id"`
+		Name      string     `json:"name"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+
+	ms := NewMemoryStore("session", "id")
+	cache, err := cache.New("mem://")
+	require.Nil(t, err)
+	cs := NewDocstore(ms, cache, &Config{Collection: "session", IDField: "id", ExpiryField: "expires_at", TTL: 3600, QueryCache: true})
+	ctx := context.Background()
+
+	doc := Doc{ID: "1", Name: "doc1"}
+	require.Nil(t, cs.Create(ctx, &doc))
+	require.NotNil(t, doc.ExpiresAt, "the TTL of the config is stamped")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *doc.ExpiresAt, 2*time.Second)
+
+	short := Doc{ID: "2", Name: "doc2"}
+	require.Nil(t, cs.Create(WithTTL(ctx, 2*time.Second), &short))
+	require.NotNil(t, short.ExpiresAt)
+
+	// expired, the sweeper did not run yet
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "3", "name": "doc3", "expires_at": time.Now().Add(-time.Minute)}))
+	require.Nil(t, cs.Create(ctx, map[string]interface{}{"id": "4", "name": "doc4", "expires_at": time.Now().Add(10 * time.Minute)}))
+
+	var got Doc
+	assert.Equal(t, NotFound, cs.Get(ctx, "3", &got))
+	require.Nil(t, cs.Get(ctx, "4", &got))
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), *got.ExpiresAt, 2*time.Second, "an expiry is kept")
+
+	var docs []Doc
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	assert.Equal(t, []string{"1", "2", "4"}, []string{docs[0].ID, docs[1].ID, docs[2].ID})
+	n, err := cs.Count(ctx, nil)
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	ok, err := cs.IsExists(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "id", Ops: constant.EQ, Value: "3"}}})
+	require.Nil(t, err)
+	assert.False(t, ok)
+	names, err := cs.Distinct(ctx, "name", nil)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []interface{}{"doc1", "doc2", "doc4"}, names)
+
+	// the cached document and query expire with the document
+	require.Nil(t, cs.Get(ctx, "2", &got))
+	assert.True(t, cache.Exist(ctx, "2"))
+	time.Sleep(time.Until(*short.ExpiresAt) + 50*time.Millisecond)
+
+	assert.False(t, cache.Exist(ctx, "2"))
+	assert.Equal(t, NotFound, cs.Get(ctx, "2", &got))
+	docs = nil
+	require.Nil(t, cs.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	require.Len(t, docs, 2)
+	assert.Equal(t, "4", docs[1].ID)
+
+	// a write with a TTL extends the expiry
+	got = Doc{ID: "1", Name: "renewed"}
+	require.Nil(t, cs.Update(WithTTL(ctx, time.Minute), &got))
+	require.Nil(t, cs.Get(ctx, "1", &got))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *got.ExpiresAt, 2*time.Second)
+
+	require.Nil(t, SweepExpired(ctx, ms, "expires_at"))
+	raw := make(map[string]interface{})
+	assert.Equal(t, NotFound, ms.Get(ctx, "2", &raw))
+	assert.Equal(t, NotFound, ms.Get(ctx, "3", &raw))
+	require.Nil(t, ms.Get(ctx, "1", &raw))
+}
@@ -0,0 +1,151 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// ChangeEvent is a change made to a document. Before is nil for inserts and
+// After is nil for deletes, drivers may leave Before empty when the previous
+// version of the document is not available.
+type ChangeEvent struct {
+	Type   string                 `json:"type"`
+	ID     interface{}            `json:"id"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+// ChangeStream emits the changes of a watched collection. Next blocks until a
+// change is available and returns EndOfDoc once the stream is closed.
+type ChangeStream interface {
+	Next(ctx context.Context, event *ChangeEvent) error
+	Close(ctx context.Context) error
+}
+
+// Publisher publishes domain events, *event.Emitter satisfies it
+type Publisher interface {
+	Publish(ctx context.Context, event, key string, message interface{}, metadata map[string]interface{}) error
+}
+
+// MatchChange reports whether the document matched the filters before or after
+// the change
+func MatchChange(event *ChangeEvent, filters []FilterOpt) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	return (event.After != nil && Match(event.After, filters)) ||
+		(event.Before != nil && Match(event.Before, filters))
+}
+
+// PublishChanges publishes every change of stream until it is closed or ctx is
+// done. Changes are published as the event prefix.type, e.g. user.insert,
+// keyed by the document ID.
+func PublishChanges(ctx context.Context, stream ChangeStream, pub Publisher, prefix string) error {
+	for {
+		var ev ChangeEvent
+		if err := stream.Next(ctx, &ev); err != nil {
+			if err == EndOfDoc {
+				return nil
+			}
+			return err
+		}
+
+		if err := pub.Publish(ctx, prefix+"."+ev.Type, fmt.Sprintf("%v", ev.ID), &ev, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// ChangeQueue is an unbounded ChangeStream drivers feed with Push, so writers
+// never block on slow consumers
+type ChangeQueue struct {
+	filters []FilterOpt
+	mux     sync.Mutex
+	events  []ChangeEvent
+	err     error
+	signal  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	onClose func()
+}
+
+// NewChangeQueue returns a queue keeping the changes matching filters, onClose
+// is called once when the queue is closed
+func NewChangeQueue(filters []FilterOpt, onClose func()) *ChangeQueue {
+	return &ChangeQueue{
+		filters: filters,
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		onClose: onClose,
+	}
+}
+
+// Push queues the event when it matches the queue filters
+func (q *ChangeQueue) Push(event ChangeEvent) {
+	if !MatchChange(&event, q.filters) {
+		return
+	}
+
+	q.mux.Lock()
+	q.events = append(q.events, event)
+	q.mux.Unlock()
+	q.wake()
+}
+
+// Fail ends the stream with err once the queued changes are consumed
+func (q *ChangeQueue) Fail(err error) {
+	q.mux.Lock()
+	q.err = err
+	q.mux.Unlock()
+	q.wake()
+}
+
+func (q *ChangeQueue) wake() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *ChangeQueue) Next(ctx context.Context, event *ChangeEvent) error {
+	for {
+		q.mux.Lock()
+		if len(q.events) > 0 {
+			*event = q.events[0]
+			q.events = q.events[1:]
+			q.mux.Unlock()
+			return nil
+		}
+		err := q.err
+		q.mux.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-q.signal:
+		case <-q.done:
+			return EndOfDoc
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (q *ChangeQueue) Close(ctx context.Context) error {
+	q.once.Do(func() {
+		close(q.done)
+		if q.onClose != nil {
+			q.onClose()
+		}
+	})
+	return nil
+}
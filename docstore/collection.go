@@ -0,0 +1,291 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bondhan/golib/util"
+)
+
+// Collection is a typed view of a CachedStore over documents of the struct
+// type T. The ID and timestamp fields of T are resolved once by NewCollection.
+type Collection[T any] struct {
+	store   *CachedStore
+	id      *typedField
+	created *typedField
+	updated *typedField
+}
+
+// typedField is a struct field of a document type found by its json tag
+type typedField struct {
+	index []int
+	typ   reflect.Type
+}
+
+// NewCollection returns the typed collection of store, T should be a struct
+// with json tags for the ID field and the configured timestamp fields
+func NewCollection[T any](store *CachedStore) (*Collection[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("[docstore] collection type should be a struct")
+	}
+
+	c := &Collection[T]{store: store}
+
+	var err error
+	if c.id, err = resolveField(t, store.IDField); err != nil {
+		return nil, err
+	}
+	if store.TimestampField != "" {
+		if c.created, err = resolveField(t, store.TimestampField); err != nil {
+			return nil, err
+		}
+	}
+	if store.UpdateTimeField != "" {
+		if c.updated, err = resolveField(t, store.UpdateTimeField); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func resolveField(t reflect.Type, tag string) (*typedField, error) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == tag && f.IsExported() {
+			return &typedField{index: f.Index, typ: f.Type}, nil
+		}
+	}
+	return nil, fmt.Errorf("[docstore] %s has no field tagged %s", t, tag)
+}
+
+// set sets the field to the generated value when it is zero or overwrite is
+// set
+func (f *typedField) set(doc reflect.Value, overwrite bool, gen func(reflect.Type, interface{}) interface{}) error {
+	if f == nil {
+		return nil
+	}
+
+	fv := doc.FieldByIndex(f.index)
+	if !fv.IsZero() && !overwrite {
+		return nil
+	}
+
+	v := gen(f.typ, doc.Addr().Interface())
+	if err, ok := v.(error); ok {
+		return err
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !rv.Type().ConvertibleTo(f.typ) {
+		return fmt.Errorf("[docstore] can not set %v to a field of type %s", v, f.typ)
+	}
+	fv.Set(rv.Convert(f.typ))
+	return nil
+}
+
+// Store returns the underlying store
+func (c *Collection[T]) Store() *CachedStore {
+	return c.store
+}
+
+func (c *Collection[T]) stamp(doc *T) error {
+	if doc == nil {
+		return errors.New("[docstore] nil document")
+	}
+
+	rv := reflect.ValueOf(doc).Elem()
+	if err := c.id.set(rv, false, c.store.IDGenerator); err != nil {
+		return err
+	}
+	if err := c.created.set(rv, false, c.store.TimeGenerator); err != nil {
+		return err
+	}
+	return c.updated.set(rv, false, c.store.TimeGenerator)
+}
+
+func (c *Collection[T]) idOf(doc *T) (interface{}, error) {
+	if doc == nil {
+		return nil, errors.New("[docstore] nil document")
+	}
+
+	fv := reflect.ValueOf(doc).Elem().FieldByIndex(c.id.index)
+	if fv.IsZero() {
+		return nil, errors.New("[docstore] missing document ID")
+	}
+	return fv.Interface(), nil
+}
+
+// Create creates doc, setting its ID and timestamps when they are zero
+func (c *Collection[T]) Create(ctx context.Context, doc *T) error {
+	if err := c.stamp(doc); err != nil {
+		return err
+	}
+	return c.store.create(ctx, doc)
+}
+
+// BulkCreate creates docs, setting their IDs and timestamps when they are zero
+func (c *Collection[T]) BulkCreate(ctx context.Context, docs []*T, opts ...interface{}) error {
+	ins := make([]interface{}, len(docs))
+	for i, d := range docs {
+		if err := c.stamp(d); err != nil {
+			return err
+		}
+		ins[i] = d
+	}
+	return c.store.bulkCreate(ctx, ins, opts...)
+}
+
+func (c *Collection[T]) write(ctx context.Context, doc *T, replace, upsert bool) error {
+	id, err := c.idOf(doc)
+	if err != nil {
+		return err
+	}
+
+	if err := c.updated.set(reflect.ValueOf(doc).Elem(), true, c.store.TimeGenerator); err != nil {
+		return err
+	}
+
+	return c.store.write(ctx, id, doc, replace, upsert)
+}
+
+// Update updates the document with the fields of doc
+func (c *Collection[T]) Update(ctx context.Context, doc *T) error {
+	return c.write(ctx, doc, false, false)
+}
+
+// Replace replaces the document with doc
+func (c *Collection[T]) Replace(ctx context.Context, doc *T) error {
+	return c.write(ctx, doc, true, false)
+}
+
+// Upsert creates or replaces the document with doc
+func (c *Collection[T]) Upsert(ctx context.Context, doc *T) error {
+	return c.write(ctx, doc, false, true)
+}
+
+// Get returns the document of id, a Projection option selects its fields
+func (c *Collection[T]) Get(ctx context.Context, id interface{}, opts ...interface{}) (T, error) {
+	var doc T
+	err := c.store.Get(ctx, id, &doc, opts...)
+	return doc, err
+}
+
+// BulkGet returns the documents of ids, missing documents are skipped
+func (c *Collection[T]) BulkGet(ctx context.Context, ids ...interface{}) ([]T, error) {
+	var docs []T
+	err := c.store.BulkGet(ctx, ids, &docs)
+	return docs, err
+}
+
+// Find returns the documents matching the query
+func (c *Collection[T]) Find(ctx context.Context, query *QueryOpt) ([]T, error) {
+	var docs []T
+	err := c.store.Find(ctx, query, &docs)
+	return docs, err
+}
+
+// FindPage returns a page of documents and the token of the next page, see
+// CachedStore.FindPage
+func (c *Collection[T]) FindPage(ctx context.Context, query *QueryOpt) ([]T, string, error) {
+	var docs []T
+	next, err := c.store.FindPage(ctx, query, &docs)
+	return docs, next, err
+}
+
+// FindOne returns the first document matching the query
+func (c *Collection[T]) FindOne(ctx context.Context, query *QueryOpt) (T, error) {
+	var doc T
+	err := c.store.FindOne(ctx, query, &doc)
+	return doc, err
+}
+
+// Count counts the documents matching the query
+func (c *Collection[T]) Count(ctx context.Context, query *QueryOpt) (int64, error) {
+	return c.store.Count(ctx, query)
+}
+
+// IsExists reports whether a document matches the query
+func (c *Collection[T]) IsExists(ctx context.Context, query *QueryOpt) (bool, error) {
+	return c.store.IsExists(ctx, query)
+}
+
+// Delete deletes the document of id
+func (c *Collection[T]) Delete(ctx context.Context, id interface{}) error {
+	return c.store.Delete(ctx, id)
+}
+
+// DeleteMany deletes the documents matching the query
+func (c *Collection[T]) DeleteMany(ctx context.Context, query *QueryOpt) error {
+	return c.store.DeleteMany(ctx, query)
+}
+
+// Iterate returns an iterator over the documents matching the query, which
+// reads the documents one at a time from the driver
+func (c *Collection[T]) Iterate(ctx context.Context, query *QueryOpt) (*Iter[T], error) {
+	q, err := c.store.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if q == nil {
+		q = &QueryOpt{}
+	}
+
+	p := q.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if c.store.mapped() {
+		// mapped documents are projected once they are read
+		q = wholeDocs(q)
+	}
+
+	it, err := c.store.storage.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Iter[T]{store: c.store, it: it, projection: p}, nil
+}
+
+// Iter iterates over typed documents, Next returns EndOfDoc after the last one
+type Iter[T any] struct {
+	store      *CachedStore
+	it         Iterator
+	projection Projection
+}
+
+// Next returns the next document
+func (i *Iter[T]) Next(ctx context.Context) (T, error) {
+	var doc T
+	if !i.store.mapped() {
+		err := i.it.Next(ctx, &doc)
+		return doc, err
+	}
+
+	for {
+		d := make(map[string]interface{})
+		if err := i.it.Next(ctx, &d); err != nil {
+			return doc, err
+		}
+
+		ok, err := i.store.readDoc(ctx, d)
+		if err != nil {
+			return doc, err
+		}
+		if ok {
+			return doc, util.DecodeJSON(ProjectDoc(d, i.projection, i.store.IDField), &doc)
+		}
+	}
+}
+
+// Close releases the iterator
+func (i *Iter[T]) Close(ctx context.Context) error {
+	return i.it.Close(ctx)
+}
@@ -0,0 +1,228 @@
+package docstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/util"
+)
+
+// Cursor is the decoded continuation token of a page, it holds the sort value
+// and ID of the last document returned
+type Cursor struct {
+	OrderBy  string
+	IsAscend bool
+	Value    interface{}
+	ID       interface{}
+}
+
+type cursorToken struct {
+	OrderBy  string      `json:"o"`
+	IsAscend bool        `json:"a,omitempty"`
+	Value    cursorValue `json:"v"`
+	ID       cursorValue `json:"i"`
+}
+
+// cursorValue keeps the type of a value so it survives the json round trip
+type cursorValue struct {
+	Type  string `json:"t"`
+	Value string `json:"v,omitempty"`
+}
+
+// EncodeCursor returns the continuation token resuming query after doc. doc
+// should hold the ID and the sort field of the query.
+func EncodeCursor(query *QueryOpt, doc interface{}, idField string) (string, error) {
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+		if err := util.DecodeJSON(doc, d); err != nil {
+			return "", err
+		}
+	}
+
+	orderBy, asc := cursorOrder(query, idField)
+	id, ok := getPath(d, idField)
+	if !ok {
+		return "", errors.New("[docstore] cursor document has no id")
+	}
+	val, _ := getPath(d, orderBy)
+
+	t := cursorToken{OrderBy: orderBy, IsAscend: asc}
+	var err error
+	if t.Value, err = encodeCursorValue(val); err != nil {
+		return "", err
+	}
+	if t.ID, err = encodeCursorValue(id); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeCursor decodes a continuation token created by EncodeCursor
+func DecodeCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, InvalidCursor
+	}
+
+	var t cursorToken
+	if err := json.Unmarshal(b, &t); err != nil || t.OrderBy == "" {
+		return nil, InvalidCursor
+	}
+
+	c := &Cursor{OrderBy: t.OrderBy, IsAscend: t.IsAscend}
+	if c.Value, err = decodeCursorValue(t.Value); err != nil {
+		return nil, err
+	}
+	if c.ID, err = decodeCursorValue(t.ID); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ParseCursor decodes the cursor of query and checks it was created for the
+// same order, it returns nil when the query has no cursor
+func ParseCursor(query *QueryOpt, idField string) (*Cursor, error) {
+	if query == nil || query.Cursor == "" {
+		return nil, nil
+	}
+
+	c, err := DecodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	orderBy, asc := cursorOrder(query, idField)
+	if c.OrderBy != orderBy || c.IsAscend != asc {
+		return nil, InvalidCursor
+	}
+
+	return c, nil
+}
+
+// CursorQuery returns a copy of query resuming after its cursor. The cursor
+// becomes a filter on the sort field and ID, skip and page are dropped.
+// Queries without cursor are returned as is.
+func CursorQuery(query *QueryOpt, idField string) (*QueryOpt, error) {
+	c, err := ParseCursor(query, idField)
+	if err != nil || c == nil {
+		return query, err
+	}
+
+	ops := constant.LT
+	if c.IsAscend {
+		ops = constant.GT
+	}
+
+	after := FilterOpt{Field: idField, Ops: ops, Value: c.ID}
+	if c.OrderBy != idField {
+		after = FilterOpt{Ops: constant.OR, Value: []FilterOpt{
+			{Field: c.OrderBy, Ops: ops, Value: c.Value},
+			{Ops: constant.AND, Value: []FilterOpt{
+				{Field: c.OrderBy, Ops: constant.EQ, Value: c.Value},
+				after,
+			}},
+		}}
+	}
+
+	q := *query
+	q.Filter = append(append(make([]FilterOpt, 0, len(query.Filter)+1), query.Filter...), after)
+	q.OrderBy = c.OrderBy
+	q.IsAscend = c.IsAscend
+	q.Skip = 0
+	q.Page = 0
+	q.Cursor = ""
+
+	return &q, nil
+}
+
+// cursorOrder returns the sort of a paginated query, queries without order
+// are paginated by ID ascending
+func cursorOrder(query *QueryOpt, idField string) (string, bool) {
+	if query == nil || query.OrderBy == "" {
+		return idField, true
+	}
+	return query.OrderBy, query.IsAscend
+}
+
+func encodeCursorValue(val interface{}) (cursorValue, error) {
+	if t, ok := val.(interface{ Time() time.Time }); ok {
+		val = t.Time()
+	}
+
+	switch v := val.(type) {
+	case nil:
+		return cursorValue{Type: "n"}, nil
+	case time.Time:
+		return cursorValue{Type: "t", Value: v.Format(time.RFC3339Nano)}, nil
+	case *time.Time:
+		if v == nil {
+			return cursorValue{Type: "n"}, nil
+		}
+		return cursorValue{Type: "t", Value: v.Format(time.RFC3339Nano)}, nil
+	}
+
+	rv := reflect.ValueOf(val)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return cursorValue{Type: "n"}, nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		return cursorValue{Type: "s", Value: rv.String()}, nil
+	case reflect.Bool:
+		return cursorValue{Type: "b", Value: strconv.FormatBool(rv.Bool())}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cursorValue{Type: "i", Value: strconv.FormatInt(rv.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cursorValue{Type: "u", Value: strconv.FormatUint(rv.Uint(), 10)}, nil
+	case reflect.Float32, reflect.Float64:
+		return cursorValue{Type: "f", Value: strconv.FormatFloat(rv.Float(), 'g', -1, 64)}, nil
+	}
+
+	return cursorValue{}, errors.New("[docstore] unsupported cursor value type " + rv.Type().String())
+}
+
+func decodeCursorValue(v cursorValue) (interface{}, error) {
+	var val interface{}
+	var err error
+
+	switch v.Type {
+	case "n":
+	case "s":
+		val = v.Value
+	case "b":
+		val, err = strconv.ParseBool(v.Value)
+	case "i":
+		val, err = strconv.ParseInt(v.Value, 10, 64)
+	case "u":
+		val, err = strconv.ParseUint(v.Value, 10, 64)
+	case "f":
+		val, err = strconv.ParseFloat(v.Value, 64)
+	case "t":
+		val, err = time.Parse(time.RFC3339Nano, v.Value)
+	default:
+		return nil, InvalidCursor
+	}
+
+	if err != nil {
+		return nil, InvalidCursor
+	}
+
+	return val, nil
+}
@@ -0,0 +1,95 @@
+package docstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	ts := time.Date(2023, 5, 1, 10, 0, 0, 123, time.UTC)
+	price := 12.5
+
+	tests := []struct {
+		name  string
+		query *QueryOpt
+		doc   interface{}
+		want  *Cursor
+	}{
+		{
+			name:  "default order",
+			query: &QueryOpt{},
+			doc:   map[string]interface{}{"id": "A-1"},
+			want:  &Cursor{OrderBy: "id", IsAscend: true, Value: "A-1", ID: "A-1"},
+		},
+		{
+			name:  "int",
+			query: &QueryOpt{OrderBy: "age"},
+			doc:   map[string]interface{}{"id": 7, "age": 35},
+			want:  &Cursor{OrderBy: "age", Value: int64(35), ID: int64(7)},
+		},
+		{
+			name:  "time",
+			query: &QueryOpt{OrderBy: "created_at", IsAscend: true},
+			doc:   map[string]interface{}{"id": "A-1", "created_at": ts},
+			want:  &Cursor{OrderBy: "created_at", IsAscend: true, Value: ts, ID: "A-1"},
+		},
+		{
+			name:  "nested pointer",
+			query: &QueryOpt{OrderBy: "meta.price"},
+			doc:   map[string]interface{}{"id": "A-1", "meta": map[string]interface{}{"price": &price}},
+			want:  &Cursor{OrderBy: "meta.price", Value: 12.5, ID: "A-1"},
+		},
+		{
+			name:  "missing field",
+			query: &QueryOpt{OrderBy: "name"},
+			doc:   map[string]interface{}{"id": "A-1"},
+			want:  &Cursor{OrderBy: "name", ID: "A-1"},
+		},
+		{
+			name:  "struct",
+			query: &QueryOpt{OrderBy: "active", IsAscend: true},
+			doc: &struct {
+				ID     string `json:"id"`
+				Active bool   `json:"active"`
+			}{ID: "A-1", Active: true},
+			want: &Cursor{OrderBy: "active", IsAscend: true, Value: true, ID: "A-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := EncodeCursor(tt.query, tt.doc, "id")
+			require.Nil(t, err)
+
+			c, err := DecodeCursor(token)
+			require.Nil(t, err)
+			assert.Equal(t, tt.want.OrderBy, c.OrderBy)
+			assert.Equal(t, tt.want.IsAscend, c.IsAscend)
+			assert.Equal(t, tt.want.ID, c.ID)
+			if ts, ok := tt.want.Value.(time.Time); ok {
+				assert.True(t, ts.Equal(c.Value.(time.Time)))
+			} else {
+				assert.Equal(t, tt.want.Value, c.Value)
+			}
+
+			q := *tt.query
+			q.Cursor = token
+			c, err = ParseCursor(&q, "id")
+			require.Nil(t, err)
+			assert.NotNil(t, c)
+
+			q.OrderBy = "other"
+			_, err = ParseCursor(&q, "id")
+			assert.ErrorIs(t, err, InvalidCursor)
+		})
+	}
+
+	_, err := DecodeCursor("not a cursor")
+	assert.ErrorIs(t, err, InvalidCursor)
+
+	_, err = EncodeCursor(&QueryOpt{}, map[string]interface{}{"name": "x"}, "id")
+	assert.NotNil(t, err)
+}
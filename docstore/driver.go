@@ -5,9 +5,12 @@ import (
 	"errors"
 )
 
+// Field is a field update of UpdateField, Op is one of the Update operations
+// and sets Value when empty
 type Field struct {
 	Name  string
 	Value interface{}
+	Op    string
 }
 
 type Driver interface {
@@ -16,24 +19,38 @@ type Driver interface {
 	Update(ctx context.Context, id, doc interface{}, replace bool) error
 	UpdateMany(ctx context.Context, filters []FilterOpt, fields map[string]interface{}) error
 	Upsert(ctx context.Context, id, doc interface{}) error
-	UpdateField(ctx context.Context, id interface{}, fields []Field) error
+	UpdateField(ctx context.Context, id interface{}, fields []Field, opts ...interface{}) error
 	Increment(ctx context.Context, id interface{}, key string, value int) error
 	GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error
 	Delete(ctx context.Context, id interface{}) error
 	DeleteMany(ctx context.Context, query *QueryOpt) error
-	Get(ctx context.Context, id interface{}, doc interface{}) error
+	Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error
 	Find(ctx context.Context, query *QueryOpt, docs interface{}) error
 	Count(ctx context.Context, query *QueryOpt) (int64, error)
 	FindOne(ctx context.Context, query *QueryOpt, doc interface{}) error
 	Query(ctx context.Context, query *QueryOpt) (Iterator, error)
 	BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error
-	BulkGet(ctx context.Context, ids []interface{}, docs interface{}) error
+	BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error
 	Migrate(ctx context.Context, config interface{}) error
 	As(i interface{}) bool
 	Ping(ctx context.Context) error
 	Disconnect(ctx context.Context) error
 	Pull(ctx context.Context, condition, removeCondition Field) error
 	Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error)
+	RunInTransaction(ctx context.Context, fn func(tx Tx) error) error
+	Watch(ctx context.Context, query *QueryOpt) (ChangeStream, error)
+	Aggregate(ctx context.Context, agg *AggregateOpt, docs interface{}) error
+	BulkWrite(ctx context.Context, ops []WriteOp, opts ...interface{}) ([]WriteResult, error)
+}
+
+// Tx is the set of operations available inside RunInTransaction.
+// Changes made through Tx are committed together when fn returns nil
+// and discarded when it returns an error.
+type Tx interface {
+	Create(ctx context.Context, doc interface{}) error
+	Update(ctx context.Context, id, doc interface{}, replace bool) error
+	Delete(ctx context.Context, id interface{}) error
+	Get(ctx context.Context, id interface{}, doc interface{}) error
 }
 
 type Iterator interface {
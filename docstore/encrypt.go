@@ -0,0 +1,450 @@
+package docstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/crypto"
+	"github.com/bondhan/golib/util"
+)
+
+const (
+	encryptedPrefix = "enc:"
+	// BlindIndexSuffix names the field holding the blind index of an
+	// encrypted field, e.g. phone_bidx
+	BlindIndexSuffix = "_bidx"
+)
+
+// EncryptionConfig declares the encrypted fields of the documents. Keys maps a
+// key ID to its secret, values are encrypted with ActiveKey and the key ID is
+// stored with the ciphertext, so retired keys keep decrypting until the
+// documents are rewritten with Reencrypt. Fields listed in BlindIndex also
+// store a keyed hash of their value for equality lookups.
+type EncryptionConfig struct {
+	Fields        []string          `json:"fields"`
+	Keys          map[string]string `json:"keys"`
+	ActiveKey     string            `json:"active_key"`
+	BlindIndex    []string          `json:"blind_index,omitempty"`
+	BlindIndexKey string            `json:"blind_index_key,omitempty"`
+}
+
+func (e *EncryptionConfig) validate() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+
+	if _, ok := e.Keys[e.ActiveKey]; !ok {
+		return errors.New("[docstore] missing active encryption key")
+	}
+
+	for id := range e.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return fmt.Errorf("[docstore] invalid encryption key ID %q", id)
+		}
+	}
+
+	if len(e.BlindIndex) > 0 && e.BlindIndexKey == "" {
+		return errors.New("[docstore] missing blind index key")
+	}
+
+	for _, b := range e.BlindIndex {
+		if !e.isEncrypted(b) {
+			return fmt.Errorf("[docstore] blind index field %s is not encrypted", b)
+		}
+	}
+
+	return nil
+}
+
+func (e *EncryptionConfig) isEncrypted(field string) bool {
+	for _, f := range e.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EncryptionConfig) hasBlindIndex(field string) bool {
+	for _, f := range e.BlindIndex {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the AES-256 key of a key ID, secrets are hashed into keys
+func (e *EncryptionConfig) key(id string) ([]byte, error) {
+	secret, ok := e.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("[docstore] unknown encryption key %s", id)
+	}
+	k := sha256.Sum256([]byte(secret))
+	return k[:], nil
+}
+
+func (e *EncryptionConfig) encrypt(val interface{}) (string, error) {
+	msg, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := e.key(e.ActiveKey)
+	if err != nil {
+		return "", err
+	}
+
+	ct, err := crypto.AESEncrypt(msg, key)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + e.ActiveKey + ":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+// keyID returns the key ID of an encrypted value
+func keyID(val interface{}) (string, string, bool) {
+	s, ok := val.(string)
+	if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func (e *EncryptionConfig) decrypt(val interface{}) (interface{}, error) {
+	id, data, ok := keyID(val)
+	if !ok {
+		// written before the field was encrypted
+		return val, nil
+	}
+
+	key, err := e.key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := crypto.AESDecrypt(ct, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(msg, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (e *EncryptionConfig) blindIndex(val interface{}) (string, error) {
+	msg, err := json.Marshal(normalizeValue(val))
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(e.BlindIndexKey))
+	mac.Write(msg)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *CachedStore) encrypting() bool {
+	return s.Encryption != nil && len(s.Encryption.Fields) > 0
+}
+
+// encryptDoc returns a copy of doc with its encrypted fields, doc is
+// returned as is when no field is encrypted. Values of the callers are always
+// encrypted, even when they look encrypted.
+func (s *CachedStore) encryptDoc(doc interface{}) (interface{}, error) {
+	return s.encryptValues(doc, false)
+}
+
+// encryptStored encrypts a document read from the driver or the cache, whose
+// values may still be encrypted
+func (s *CachedStore) encryptStored(doc interface{}) (interface{}, error) {
+	return s.encryptValues(doc, true)
+}
+
+func (s *CachedStore) encryptValues(doc interface{}, stored bool) (interface{}, error) {
+	if !s.encrypting() {
+		return doc, nil
+	}
+
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return nil, err
+	}
+	d = copyDoc(d)
+
+	for _, f := range s.Encryption.Fields {
+		v, ok := getPath(d, f)
+		if !ok || v == nil {
+			continue
+		}
+
+		fields, err := s.encryptField(Field{Name: f, Value: v}, stored)
+		if err != nil {
+			return nil, err
+		}
+		for _, ef := range fields {
+			setPath(d, ef.Name, ef.Value)
+		}
+	}
+
+	return d, nil
+}
+
+// encryptField returns the stored fields of f, the ciphertext and the blind
+// index. Encrypted values are kept as is when stored is set.
+func (s *CachedStore) encryptField(f Field, stored bool) ([]Field, error) {
+	e := s.Encryption
+	if !e.isEncrypted(f.Name) || f.Value == nil {
+		return []Field{f}, nil
+	}
+
+	if f.Op != "" && f.Op != UpdateSet && f.Op != UpdateSetOnInsert {
+		return nil, fmt.Errorf("[docstore] can not %s encrypted field %s", f.Op, f.Name)
+	}
+
+	if _, _, ok := keyID(f.Value); ok && stored {
+		return []Field{f}, nil
+	}
+
+	ct, err := e.encrypt(f.Value)
+	if err != nil {
+		return nil, err
+	}
+	out := []Field{{Name: f.Name, Value: ct, Op: f.Op}}
+
+	if e.hasBlindIndex(f.Name) {
+		bi, err := e.blindIndex(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Field{Name: f.Name + BlindIndexSuffix, Value: bi, Op: f.Op})
+	}
+
+	return out, nil
+}
+
+func (s *CachedStore) encryptFields(fields []Field) ([]Field, error) {
+	if !s.encrypting() {
+		return fields, nil
+	}
+
+	out := make([]Field, 0, len(fields))
+	for _, f := range fields {
+		ef, err := s.encryptField(f, false)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ef...)
+	}
+	return out, nil
+}
+
+// decryptDoc decrypts the fields of a stored document in place and drops
+// their blind index
+func (s *CachedStore) decryptDoc(doc map[string]interface{}) error {
+	if !s.encrypting() {
+		return nil
+	}
+
+	for _, f := range s.Encryption.Fields {
+		v, ok := getPath(doc, f)
+		if !ok || v == nil {
+			continue
+		}
+
+		pv, err := s.Encryption.decrypt(v)
+		if err != nil {
+			return err
+		}
+		setPath(doc, f, pv)
+
+		if s.Encryption.hasBlindIndex(f) {
+			unsetPath(doc, f+BlindIndexSuffix)
+		}
+	}
+
+	return nil
+}
+
+func unsetPath(doc map[string]interface{}, path string) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		delete(doc, path)
+		return
+	}
+
+	if parent, ok := getPath(doc, path[:i]); ok {
+		if m, ok := parent.(map[string]interface{}); ok {
+			delete(m, path[i+1:])
+		}
+	}
+}
+
+// blindFilters rewrites the equality filters of encrypted fields into filters
+// on their blind index, other filters of encrypted fields can not be run
+func (s *CachedStore) blindFilters(filters []FilterOpt) ([]FilterOpt, error) {
+	if !s.encrypting() || len(filters) == 0 {
+		return filters, nil
+	}
+
+	e := s.Encryption
+	out := make([]FilterOpt, 0, len(filters))
+	for _, f := range filters {
+		switch f.Ops {
+		case constant.OR, constant.AND:
+			sub, err := s.blindFilters(toFilters(f.Value))
+			if err != nil {
+				return nil, err
+			}
+			f.Value = sub
+			out = append(out, f)
+			continue
+		}
+
+		if !e.isEncrypted(f.Field) {
+			out = append(out, f)
+			continue
+		}
+
+		if !e.hasBlindIndex(f.Field) {
+			return nil, fmt.Errorf("[docstore] encrypted field %s has no blind index", f.Field)
+		}
+
+		switch f.Ops {
+		case constant.EQ, constant.SE, constant.NE:
+			bi, err := e.blindIndex(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			f.Value = bi
+		case constant.IN, constant.NIN:
+			vals := sliceValues(f.Value)
+			bis := make([]interface{}, len(vals))
+			for i, v := range vals {
+				bi, err := e.blindIndex(v)
+				if err != nil {
+					return nil, err
+				}
+				bis[i] = bi
+			}
+			f.Value = bis
+		default:
+			return nil, fmt.Errorf("[docstore] encrypted field %s only supports equality filters", f.Field)
+		}
+
+		f.Field += BlindIndexSuffix
+		out = append(out, f)
+	}
+
+	return out, nil
+}
+
+// query returns the query run by the driver, hiding soft deleted documents
+// and the documents of other tenants, and looking up encrypted fields by their
+// blind index
+func (s *CachedStore) query(ctx context.Context, query *QueryOpt) (*QueryOpt, error) {
+	q, err := s.scoped(ctx, s.visible(query))
+	if err != nil {
+		return nil, err
+	}
+	if !s.encrypting() || q == nil {
+		return q, nil
+	}
+
+	filters, err := s.blindFilters(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *q
+	out.Filter = filters
+	return &out, nil
+}
+
+// getEncrypted reads a document whose cached copy holds the ciphertext
+func (s *CachedStore) getEncrypted(ctx context.Context, id, doc interface{}) error {
+	key, err := s.cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.CacheExpiration != 1 && s.cache.Exist(ctx, key) {
+		d := make(map[string]interface{})
+		if err := s.cache.Get(ctx, key, &d); err == nil {
+			if err := s.decryptDoc(d); err == nil {
+				return util.DecodeJSON(d, doc)
+			}
+		}
+	}
+
+	d, err := s.getMap(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if ttl, ok := s.cacheTTL(d); ok && s.CacheExpiration != 1 {
+		enc, err := s.encryptStored(d)
+		if err != nil {
+			return err
+		}
+		if err := s.cache.Set(ctx, key, enc, ttl); err != nil {
+			return err
+		}
+	}
+
+	return util.DecodeJSON(d, doc)
+}
+
+// Reencrypt rewrites the documents having values encrypted with a retired key,
+// or not encrypted yet, with the active key. It resumes and reports progress
+// like MigrateDocuments.
+func (s *CachedStore) Reencrypt(ctx context.Context, opt MigrationOpt) (MigrationProgress, error) {
+	if !s.encrypting() {
+		return MigrationProgress{}, errors.New("[docstore] encryption is not enabled")
+	}
+
+	return s.rewriteAll(ctx, opt, func(ctx context.Context, d map[string]interface{}) (bool, error) {
+		stale := false
+		for _, f := range s.Encryption.Fields {
+			v, ok := getPath(d, f)
+			if !ok || v == nil {
+				continue
+			}
+			// plain values are written before the field was encrypted
+			if id, _, ok := keyID(v); !ok || id != s.Encryption.ActiveKey {
+				stale = true
+			}
+		}
+		if !stale {
+			return false, nil
+		}
+
+		id, _ := getPath(d, s.IDField)
+		_, err := s.rewrite(ctx, "Reencrypt", id, func(map[string]interface{}) (bool, error) {
+			return true, nil
+		})
+		return true, err
+	})
+}
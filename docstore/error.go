@@ -8,3 +8,8 @@ const NotFound = DocstoreError("[docstore] document not found")
 const EndOfDoc = DocstoreError("[docstore] end of documents")
 const NothingUpdated = DocstoreError("[docstore] nothing updated")
 const OperationNotSupported = DocstoreError("[docstore] operation not supported")
+const InvalidCursor = DocstoreError("[docstore] invalid cursor")
+const ErrVersionConflict = DocstoreError("[docstore] version conflict")
+const ErrVersionedBulkWrite = DocstoreError("[docstore] bulk updates of versioned documents are not supported")
+const ErrPartialWrite = DocstoreError("[docstore] some writes failed")
+const ErrCrossTenant = DocstoreError("[docstore] document belongs to another tenant")
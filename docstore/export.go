@@ -0,0 +1,413 @@
+package docstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ExportFormat is the encoding of an exported collection
+type ExportFormat string
+
+const (
+	// FormatNDJSON writes a JSON document per line
+	FormatNDJSON ExportFormat = "ndjson"
+	// FormatCSV writes a header row and a row per document, nested documents
+	// and arrays are written as JSON
+	FormatCSV ExportFormat = "csv"
+)
+
+const defaultTransferBatch = 500
+
+// ExportOpt is the option of Export. Only the filter of Query is applied, the
+// documents are read by ID so Checkpoint resumes an export after the document
+// it was taken at. Fields selects the exported fields, dotted for nested ones,
+// and are the columns of CSV exports. Progress is called every BatchSize
+// documents and after the last one, an error stops the export.
+type ExportOpt struct {
+	Format     ExportFormat
+	Query      *QueryOpt
+	Fields     []string
+	BatchSize  int
+	Checkpoint string
+	Progress   func(ctx context.Context, p TransferProgress) error
+}
+
+// ImportOpt is the option of Import. Documents are written by batches of
+// BatchSize with BulkCreate, or with upserts when Upsert is set so a resumed
+// import may write a document again. Checkpoint skips the documents imported
+// before it was taken. Fields are the CSV columns, read from the header row
+// when empty. Types coerces the string values of the fields, CSV values are
+// strings unless typed.
+type ImportOpt struct {
+	Format     ExportFormat
+	Fields     []string
+	Types      map[string]FieldType
+	BatchSize  int
+	Upsert     bool
+	Checkpoint string
+	Progress   func(ctx context.Context, p TransferProgress) error
+}
+
+// TransferProgress reports an export or an import, Count is the number of
+// documents transferred by the call and Checkpoint is the token resuming it
+type TransferProgress struct {
+	Count      int64
+	Checkpoint string
+}
+
+// Export streams the documents of d matching opt.Query into w. A resumed
+// export appends to the output of the failed one, CSV exports write the
+// header row only when they start.
+func Export(ctx context.Context, d Driver, w io.Writer, idField string, opt ExportOpt) (TransferProgress, error) {
+	var p TransferProgress
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultTransferBatch
+	}
+
+	enc, err := newDocWriter(w, opt)
+	if err != nil {
+		return p, err
+	}
+
+	query := &QueryOpt{OrderBy: idField, IsAscend: true, Cursor: opt.Checkpoint}
+	if opt.Query != nil {
+		query.Filter = opt.Query.Filter
+	}
+	if len(opt.Fields) > 0 {
+		// the checkpoint is read from the ID
+		query.Fields, _ = keepField(opt.Fields, nil, idField)
+	}
+
+	iter, err := d.Query(ctx, query)
+	if err != nil {
+		return p, err
+	}
+	defer iter.Close(ctx)
+
+	p.Checkpoint = opt.Checkpoint
+	report := func() error {
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		if opt.Progress == nil {
+			return nil
+		}
+		return opt.Progress(ctx, p)
+	}
+
+	for {
+		doc := make(map[string]interface{})
+		if err := iter.Next(ctx, &doc); err != nil {
+			if err == EndOfDoc {
+				break
+			}
+			return p, err
+		}
+
+		if err := enc.Write(doc); err != nil {
+			return p, err
+		}
+
+		p.Count++
+		if p.Checkpoint, err = EncodeCursor(query, doc, idField); err != nil {
+			return p, err
+		}
+
+		if p.Count%int64(opt.BatchSize) == 0 {
+			if err := report(); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	if p.Count%int64(opt.BatchSize) != 0 {
+		return p, report()
+	}
+
+	return p, enc.Flush()
+}
+
+// Import streams the documents of r into d, the ID of the documents is read
+// from idField for upserts
+func Import(ctx context.Context, d Driver, r io.Reader, idField string, opt ImportOpt) (TransferProgress, error) {
+	var p TransferProgress
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultTransferBatch
+	}
+
+	var skip int64
+	if opt.Checkpoint != "" {
+		n, err := strconv.ParseInt(opt.Checkpoint, 10, 64)
+		if err != nil || n < 0 {
+			return p, errors.New("[docstore] invalid import checkpoint")
+		}
+		skip = n
+	}
+
+	dec, err := newDocReader(r, opt)
+	if err != nil {
+		return p, err
+	}
+
+	read := int64(0)
+	p.Checkpoint = opt.Checkpoint
+	batch := make([]interface{}, 0, opt.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := importBatch(ctx, d, idField, batch, opt.Upsert); err != nil {
+			return err
+		}
+
+		p.Count += int64(len(batch))
+		p.Checkpoint = strconv.FormatInt(read, 10)
+		batch = batch[:0]
+		if opt.Progress == nil {
+			return nil
+		}
+		return opt.Progress(ctx, p)
+	}
+
+	for {
+		doc, err := dec.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, err
+		}
+
+		read++
+		if read <= skip {
+			continue
+		}
+
+		if err := coerceDoc(doc, opt.Types); err != nil {
+			return p, err
+		}
+
+		batch = append(batch, doc)
+		if len(batch) == opt.BatchSize {
+			if err := flush(); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	return p, flush()
+}
+
+func importBatch(ctx context.Context, d Driver, idField string, docs []interface{}, upsert bool) error {
+	if !upsert {
+		return d.BulkCreate(ctx, docs)
+	}
+
+	ops := make([]WriteOp, len(docs))
+	for i, doc := range docs {
+		id, err := docID(doc, idField)
+		if err != nil {
+			return err
+		}
+		ops[i] = WriteOp{Op: WriteUpsert, ID: id, Doc: doc}
+	}
+
+	results, err := d.BulkWrite(ctx, ops, &BulkWriteOpt{Ordered: true})
+	if err != nil {
+		for _, r := range results {
+			if r.Error != nil {
+				return r.Error
+			}
+		}
+	}
+	return err
+}
+
+// coerceDoc coerces the string values of the typed fields of doc
+func coerceDoc(doc map[string]interface{}, types map[string]FieldType) error {
+	for field, typ := range types {
+		v, ok := getPath(doc, field)
+		s, isString := v.(string)
+		if !ok || !isString {
+			continue
+		}
+
+		val, err := coerceValue(s, typ)
+		if err != nil {
+			return fmt.Errorf("[docstore] invalid %s value of %s: %s", typ, field, s)
+		}
+		setPath(doc, field, val)
+	}
+	return nil
+}
+
+type docWriter interface {
+	Write(doc map[string]interface{}) error
+	Flush() error
+}
+
+type docReader interface {
+	Read() (map[string]interface{}, error)
+}
+
+func newDocWriter(w io.Writer, opt ExportOpt) (docWriter, error) {
+	switch opt.Format {
+	case FormatNDJSON, "":
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatCSV:
+		if len(opt.Fields) == 0 {
+			return nil, errors.New("[docstore] csv export needs fields")
+		}
+		cw := &csvWriter{w: csv.NewWriter(w), fields: opt.Fields}
+		if opt.Checkpoint == "" {
+			if err := cw.w.Write(opt.Fields); err != nil {
+				return nil, err
+			}
+		}
+		return cw, nil
+	}
+	return nil, fmt.Errorf("[docstore] unknown export format %s", opt.Format)
+}
+
+func newDocReader(r io.Reader, opt ImportOpt) (docReader, error) {
+	switch opt.Format {
+	case FormatNDJSON, "":
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		return &ndjsonReader{dec: dec}, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		fields := opt.Fields
+		if len(fields) == 0 {
+			header, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			fields = header
+		}
+		cr.FieldsPerRecord = len(fields)
+		return &csvReader{r: cr, fields: fields}, nil
+	}
+	return nil, fmt.Errorf("[docstore] unknown import format %s", opt.Format)
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(doc map[string]interface{}) error {
+	return n.enc.Encode(doc)
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return n.w.Flush()
+}
+
+type ndjsonReader struct {
+	dec *json.Decoder
+}
+
+func (n *ndjsonReader) Read() (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	if err := n.dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return fromJSONNumbers(doc).(map[string]interface{}), nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (c *csvWriter) Write(doc map[string]interface{}) error {
+	row := make([]string, len(c.fields))
+	for i, f := range c.fields {
+		v, _ := getPath(doc, f)
+		s, err := csvValue(v)
+		if err != nil {
+			return err
+		}
+		row[i] = s
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	fields []string
+}
+
+// Read returns the document of the next row, empty values are left out
+func (c *csvReader) Read() (map[string]interface{}, error) {
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	for i, f := range c.fields {
+		if row[i] != "" {
+			setPath(doc, f, row[i])
+		}
+	}
+	return doc, nil
+}
+
+func csvValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case time.Time:
+		return val.Format(time.RFC3339Nano), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32), nil
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return fmt.Sprintf("%v", v), nil
+}
+
+// fromJSONNumbers turns the JSON numbers of v into int64 or float64
+func fromJSONNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range val {
+			val[k] = fromJSONNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range val {
+			val[i] = fromJSONNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package docstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exportDocs(t *testing.T) *MemoryStore {
+	ms := NewMemoryStore("shop", "id")
+	docs := []interface{}{
+		map[string]interface{}{"id": "S-1", "name": "Toko, Satu", "stock": 10, "price": 1.5, "address": map[string]interface{}{"city": "Jakarta"}, "tags": []interface{}{"a"}},
+		map[string]interface{}{"id": "S-2", "name": "Toko Dua", "stock": 20, "price": 2.25, "address": map[string]interface{}{"city": "Bandung"}},
+		map[string]interface{}{"id": "S-3", "name": "Toko \"Tiga\"", "stock": 30, "price": 3, "address": map[string]interface{}{"city": "Jakarta"}},
+		map[string]interface{}{"id": "S-4", "name": "Toko Empat", "stock": 40, "price": 4, "closed": true},
+	}
+	require.Nil(t, ms.BulkCreate(context.Background(), docs))
+	return ms
+}
+
+func TestExportImportNDJSON(t *testing.T) {
+	ctx := context.Background()
+	src := exportDocs(t)
+
+	var out bytes.Buffer
+	var reports []TransferProgress
+	p, err := Export(ctx, src, &out, "id", ExportOpt{
+		BatchSize: 3,
+		Progress: func(ctx context.Context, p TransferProgress) error {
+			reports = append(reports, p)
+			return nil
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), p.Count)
+	require.Len(t, reports, 2)
+	assert.Equal(t, int64(3), reports[0].Count)
+	assert.Len(t, strings.Split(strings.TrimSpace(out.String()), "\n"), 4)
+
+	dst := NewMemoryStore("shop", "id")
+	p, err = Import(ctx, dst, &out, "id", ImportOpt{BatchSize: 3})
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), p.Count)
+	assert.Equal(t, "4", p.Checkpoint)
+
+	doc := make(map[string]interface{})
+	require.Nil(t, dst.Get(ctx, "S-1", &doc))
+	assert.Equal(t, "Toko, Satu", doc["name"])
+	assert.EqualValues(t, 10, doc["stock"])
+	assert.Equal(t, 1.5, doc["price"])
+	assert.Equal(t, map[string]interface{}{"city": "Jakarta"}, doc["address"])
+	assert.Equal(t, []interface{}{"a"}, doc["tags"])
+}
+
+func TestExportImportCSV(t *testing.T) {
+	ctx := context.Background()
+	src := exportDocs(t)
+
+	var out bytes.Buffer
+	_, err := Export(ctx, src, &out, "id", ExportOpt{Format: FormatCSV})
+	assert.NotNil(t, err, "csv needs fields")
+
+	fields := []string{"id", "name", "stock", "price", "address.city", "closed"}
+	p, err := Export(ctx, src, &out, "id", ExportOpt{
+		Format: FormatCSV,
+		Fields: fields,
+		Query:  &QueryOpt{Filter: []FilterOpt{{Field: "stock", Ops: constant.LT, Value: 40}}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), p.Count)
+	assert.Equal(t, "id,name,stock,price,address.city,closed\n"+
+		"S-1,\"Toko, Satu\",10,1.5,Jakarta,\n"+
+		"S-2,Toko Dua,20,2.25,Bandung,\n"+
+		"S-3,\"Toko \"\"Tiga\"\"\",30,3,Jakarta,\n", out.String())
+
+	dst := NewMemoryStore("shop", "id")
+	_, err = Import(ctx, dst, &out, "id", ImportOpt{
+		Format: FormatCSV,
+		Types:  map[string]FieldType{"stock": IntField, "price": FloatField},
+	})
+	require.Nil(t, err)
+
+	doc := make(map[string]interface{})
+	require.Nil(t, dst.Get(ctx, "S-3", &doc))
+	assert.Equal(t, `Toko "Tiga"`, doc["name"])
+	assert.EqualValues(t, 30, doc["stock"])
+	assert.EqualValues(t, 3, doc["price"])
+	assert.Equal(t, map[string]interface{}{"city": "Jakarta"}, doc["address"])
+	assert.Nil(t, doc["closed"])
+
+	_, err = Import(ctx, dst, strings.NewReader("id,stock\nS-9,many\n"), "id", ImportOpt{
+		Format: FormatCSV,
+		Types:  map[string]FieldType{"stock": IntField},
+	})
+	assert.NotNil(t, err)
+}
+
+type failingWriter struct {
+	w    bytes.Buffer
+	left int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, errors.New("disk full")
+	}
+	f.left--
+	return f.w.Write(p)
+}
+
+func TestExportImportResume(t *testing.T) {
+	ctx := context.Background()
+	src := exportDocs(t)
+
+	// the first batch is flushed, the second fails
+	w := &failingWriter{left: 1}
+	var checkpoint string
+	_, err := Export(ctx, src, w, "id", ExportOpt{
+		BatchSize: 2,
+		Progress: func(ctx context.Context, p TransferProgress) error {
+			checkpoint = p.Checkpoint
+			return nil
+		},
+	})
+	require.NotNil(t, err)
+	require.NotEmpty(t, checkpoint)
+
+	w.left = 10
+	p, err := Export(ctx, src, w, "id", ExportOpt{BatchSize: 2, Checkpoint: checkpoint})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), p.Count)
+
+	// the import fails on the existing S-3 and resumes with upserts
+	dst := NewMemoryStore("shop", "id")
+	require.Nil(t, dst.Create(ctx, map[string]interface{}{"id": "S-3", "name": "old"}))
+	p, err = Import(ctx, dst, bytes.NewReader(w.w.Bytes()), "id", ImportOpt{BatchSize: 2})
+	require.NotNil(t, err)
+	assert.Equal(t, "2", p.Checkpoint)
+
+	p, err = Import(ctx, dst, bytes.NewReader(w.w.Bytes()), "id", ImportOpt{BatchSize: 2, Upsert: true, Checkpoint: p.Checkpoint})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), p.Count)
+	assert.Equal(t, "4", p.Checkpoint)
+
+	var docs []map[string]interface{}
+	require.Nil(t, dst.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true}, &docs))
+	require.Len(t, docs, 4)
+	assert.Equal(t, `Toko "Tiga"`, docs[2]["name"])
+	assert.Equal(t, true, docs[3]["closed"])
+
+	_, err = Import(ctx, dst, strings.NewReader(""), "id", ImportOpt{Checkpoint: "x"})
+	assert.NotNil(t, err)
+}
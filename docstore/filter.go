@@ -0,0 +1,561 @@
+package docstore
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/util"
+)
+
+// mongoOps maps raw mongo operators, which are accepted by UpdateMany,
+// into the docstore comparators
+var mongoOps = map[string]string{
+	"$eq":        constant.EQ,
+	"$ne":        constant.NE,
+	"$gt":        constant.GT,
+	"$gte":       constant.GE,
+	"$lt":        constant.LT,
+	"$lte":       constant.LE,
+	"$in":        constant.IN,
+	"$nin":       constant.NIN,
+	"$exists":    constant.EX,
+	"$elemMatch": constant.EM,
+	"$regex":     constant.RE,
+}
+
+// Match reports whether doc satisfies all filters. It follows the semantics
+// of the mongo driver, so in-process drivers can evaluate FilterOpt the same
+// way: dotted fields traverse nested documents and arrays, a missing field
+// compares as null, and array fields match when any of their elements does.
+func Match(doc interface{}, filters []FilterOpt) bool {
+	for _, f := range filters {
+		if !matchFilter(doc, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchFilter(doc interface{}, f FilterOpt) bool {
+	if op, ok := mongoOps[f.Ops]; ok {
+		f.Ops = op
+	}
+
+	switch f.Ops {
+	case constant.OR:
+		for _, sf := range toFilters(f.Value) {
+			if matchFilter(doc, sf) {
+				return true
+			}
+		}
+		return false
+	case constant.AND:
+		return Match(doc, toFilters(f.Value))
+	}
+
+	leaves, found := lookupValues(doc, f.Field)
+
+	switch f.Ops {
+	case constant.EX:
+		want, ok := f.Value.(bool)
+		if !ok {
+			want = f.Value != nil
+		}
+		return found == want
+	case constant.EM:
+		subs := toFilters(f.Value)
+		for _, l := range leaves {
+			for _, e := range sliceValues(l) {
+				if Match(e, subs) {
+					return true
+				}
+			}
+		}
+		return false
+	case constant.NEAR, constant.WR, constant.WP:
+		return matchGeo(leaves, f)
+	case constant.TXT:
+		// the text filter of mongo searches the text index, it looks into the
+		// whole document when the field is empty
+		return matchText(leaves, f.Value)
+	}
+
+	vals := expandValues(leaves)
+	if !found {
+		vals = []interface{}{nil}
+	}
+
+	switch f.Ops {
+	case constant.EQ, constant.SE:
+		return anyValue(vals, func(v interface{}) bool { return equalValue(v, f.Value) })
+	case constant.NE:
+		return !anyValue(vals, func(v interface{}) bool { return equalValue(v, f.Value) })
+	case constant.GT, constant.GE, constant.LT, constant.LE:
+		return anyValue(vals, func(v interface{}) bool {
+			c, ok := compareValue(v, f.Value)
+			if !ok {
+				return false
+			}
+			switch f.Ops {
+			case constant.GT:
+				return c > 0
+			case constant.GE:
+				return c >= 0
+			case constant.LT:
+				return c < 0
+			default:
+				return c <= 0
+			}
+		})
+	case constant.IN, constant.AIN, constant.AM:
+		return anyValue(vals, func(v interface{}) bool { return inValues(v, f.Value) })
+	case constant.NIN:
+		return !anyValue(vals, func(v interface{}) bool { return inValues(v, f.Value) })
+	case constant.RE:
+		re, err := regexp.Compile("(?i)" + PatternRegexp(f.Value))
+		if err != nil {
+			return false
+		}
+		return anyValue(vals, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	default:
+		return util.Assert(f.Field, doc, f.Value, f.Ops)
+	}
+}
+
+// Pattern splits the value of a RE filter into the text it matches and its
+// anchors. RE filters match the strings holding the text, ignoring case, a
+// leading ^ anchors the text at the start of the string and a trailing $ at
+// its end.
+func Pattern(v interface{}) (text string, start, end bool) {
+	text = fmt.Sprintf("%v", v)
+	if strings.HasPrefix(text, "^") {
+		start, text = true, text[1:]
+	}
+	if strings.HasSuffix(text, "$") {
+		end, text = true, text[:len(text)-1]
+	}
+	return text, start, end
+}
+
+// PatternRegexp returns the regular expression of the value of a RE filter,
+// without the case insensitive flag
+func PatternRegexp(v interface{}) string {
+	text, start, end := Pattern(v)
+	re := regexp.QuoteMeta(text)
+	if start {
+		re = "^" + re
+	}
+	if end {
+		re += "$"
+	}
+	return re
+}
+
+func toFilters(val interface{}) []FilterOpt {
+	switch v := val.(type) {
+	case []FilterOpt:
+		return v
+	case FilterOpt:
+		return []FilterOpt{v}
+	default:
+		return nil
+	}
+}
+
+func anyValue(vals []interface{}, fn func(interface{}) bool) bool {
+	for _, v := range vals {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func inValues(val, list interface{}) bool {
+	values := sliceValues(list)
+	if !isArray(list) {
+		values = []interface{}{list}
+	}
+	for _, l := range values {
+		if equalValue(val, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupValues returns the values found at a dotted path, descending into
+// every element when an intermediate value is an array
+func lookupValues(doc interface{}, path string) ([]interface{}, bool) {
+	if path == "" {
+		return []interface{}{doc}, true
+	}
+	return collectValues(doc, strings.Split(path, "."))
+}
+
+func collectValues(val interface{}, parts []string) ([]interface{}, bool) {
+	if len(parts) == 0 {
+		return []interface{}{val}, true
+	}
+
+	if isArray(val) {
+		elems := sliceValues(val)
+		if idx, err := strconv.Atoi(parts[0]); err == nil {
+			if idx < 0 || idx >= len(elems) {
+				return nil, false
+			}
+			return collectValues(elems[idx], parts[1:])
+		}
+
+		out := make([]interface{}, 0)
+		found := false
+		for _, e := range elems {
+			vals, ok := collectValues(e, parts)
+			if ok {
+				found = true
+				out = append(out, vals...)
+			}
+		}
+		return out, found
+	}
+
+	child, ok := fieldValue(val, parts[0])
+	if !ok {
+		return nil, false
+	}
+	return collectValues(child, parts[1:])
+}
+
+// expandValues adds the elements of array values next to the arrays
+// themselves, an array field matches either as a whole or by element
+func expandValues(vals []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(vals))
+	for _, v := range vals {
+		out = append(out, v)
+		if isArray(v) {
+			out = append(out, sliceValues(v)...)
+		}
+	}
+	return out
+}
+
+func fieldValue(doc interface{}, name string) (interface{}, bool) {
+	rv := reflect.ValueOf(doc)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		item := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !item.IsValid() {
+			return nil, false
+		}
+		return item.Interface(), true
+	case reflect.Struct:
+		fn, err := util.FindFieldByTag(rv.Interface(), "json", name)
+		if err != nil {
+			fn = name
+		}
+		field := rv.FieldByName(fn)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, false
+		}
+		return field.Interface(), true
+	default:
+		return nil, false
+	}
+}
+
+func isArray(val interface{}) bool {
+	if val == nil {
+		return false
+	}
+	if _, ok := val.([]byte); ok {
+		return false
+	}
+	k := reflect.TypeOf(val).Kind()
+	return k == reflect.Slice || k == reflect.Array
+}
+
+func sliceValues(val interface{}) []interface{} {
+	if !isArray(val) {
+		return nil
+	}
+	if v, ok := val.([]interface{}); ok {
+		return v
+	}
+	rv := reflect.ValueOf(val)
+	out := make([]interface{}, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
+
+// normalizeValue dereferences pointers and converts numbers into float64 so
+// values of different go types compare the way mongo compares bson values
+func normalizeValue(val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+
+	rv := reflect.ValueOf(val)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+
+	return rv.Interface()
+}
+
+func equalValue(a, b interface{}) bool {
+	a, b = normalizeValue(a), normalizeValue(b)
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if isArray(a) || isArray(b) {
+		if !isArray(a) || !isArray(b) {
+			return false
+		}
+		as, bs := sliceValues(a), sliceValues(b)
+		if len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if !equalValue(as[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if c, ok := compareValue(a, b); ok {
+		return c == 0
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValue compares numbers, strings and times, the second result is
+// false when the values are not comparable with each other
+func compareValue(a, b interface{}) (int, bool) {
+	a, b = normalizeValue(a), normalizeValue(b)
+	// times are kept as RFC3339 strings by the drivers storing JSON
+	if t, ok := a.(time.Time); ok {
+		if bt, ok := asTime(b); ok {
+			a, b = t, bt
+		}
+	} else if t, ok := b.(time.Time); ok {
+		if at, ok := asTime(a); ok {
+			a, b = at, t
+		}
+	}
+
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av == bv:
+			return 0, true
+		case !av:
+			return -1, true
+		}
+		return 1, true
+	}
+
+	return 0, false
+}
+
+// typeOrder ranks values of different types when sorting, following the
+// mongo bson comparison order
+func typeOrder(val interface{}) int {
+	switch normalizeValue(val).(type) {
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bool:
+		return 4
+	case time.Time:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// sortValue compares two values for ordering, values of different types are
+// ordered by type first
+func sortValue(a, b interface{}) int {
+	if c, ok := compareValue(a, b); ok {
+		return c
+	}
+	ta, tb := typeOrder(a), typeOrder(b)
+	switch {
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	}
+	return 0
+}
+
+// setPath sets a dotted path on a document, creating the intermediate
+// documents when they do not exist
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	cur := doc
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			cur[p] = next
+		}
+		cur = next
+	}
+	cur[parts[len(parts)-1]] = value
+}
+
+// getPath returns the value of a dotted path on a document
+func getPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	cur := doc
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur = next
+	}
+	v, ok := cur[parts[len(parts)-1]]
+	return v, ok
+}
+
+// GetPath returns the value of a dotted path on a document, for drivers
+// storing documents as maps
+func GetPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	return getPath(doc, path)
+}
+
+// SetPath sets a dotted path on a document, for drivers storing documents as
+// maps
+func SetPath(doc map[string]interface{}, path string, value interface{}) {
+	setPath(doc, path, value)
+}
+
+// DistinctValues returns the distinct values of a field across documents.
+// Array fields contribute their elements, like mongo distinct does.
+func DistinctValues(docs []map[string]interface{}, fieldName string) []interface{} {
+	out := make([]interface{}, 0)
+	for _, d := range docs {
+		leaves, found := lookupValues(d, fieldName)
+		if !found {
+			continue
+		}
+		for _, l := range leaves {
+			vals := []interface{}{l}
+			if isArray(l) {
+				vals = sliceValues(l)
+			}
+			for _, v := range vals {
+				if !anyValue(out, func(o interface{}) bool { return equalValue(o, v) }) {
+					out = append(out, v)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// ToFilters converts the filter argument accepted by Distinct into
+// FilterOpt. Maps are read as equality filters.
+func ToFilters(filter interface{}) ([]FilterOpt, error) {
+	switch v := filter.(type) {
+	case nil:
+		return nil, nil
+	case []FilterOpt:
+		return v, nil
+	case FilterOpt:
+		return []FilterOpt{v}, nil
+	case *QueryOpt:
+		if v == nil {
+			return nil, nil
+		}
+		return v.Filter, nil
+	case QueryOpt:
+		return v.Filter, nil
+	case map[string]interface{}:
+		out := make([]FilterOpt, 0, len(v))
+		for k, val := range v {
+			out = append(out, FilterOpt{Field: k, Ops: constant.EQ, Value: val})
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("[docstore] unsupported filter type %T", filter)
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"cloud.google.com/go/firestore"
 	"github.com/bondhan/golib/log"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/bondhan/golib/client"
 	"github.com/bondhan/golib/constant"
@@ -17,15 +20,38 @@ import (
 	"github.com/bondhan/golib/docstore"
 )
 
+// maxBatchSize is the maximum number of writes in a firestore batch
+const maxBatchSize = 500
+
 type FireStore struct {
 	store      *firestore.CollectionRef
 	client     *firestore.Client
 	idField    string
 	collection string
+	sweeper    *docstore.Sweeper
 }
 
 func init() {
 	docstore.RegisterDriver("firestore", FireStoreFactory)
+	docstore.RegisterErrorClassifier("firestore", IsTransient)
+}
+
+// notFound returns docstore.NotFound for the missing documents, firestore
+// reports them with a grpc status
+func notFound(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return docstore.NotFound
+	}
+	return err
+}
+
+// IsTransient reports the errors of the codes firestore advises to retry
+func IsTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
 }
 
 func FireStoreFactory(config *docstore.Config) (docstore.Driver, error) {
@@ -75,12 +101,110 @@ func (f *FireStore) Update(ctx context.Context, id, doc interface{}, replace boo
 	if !replace {
 		opt = append(opt, firestore.MergeAll)
 	}
+	if v, ok := docstore.GetVersioning(ctx); ok {
+		return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			return versionedSet(tx, ref, v, d, false, opt...)
+		})
+	}
 	_, err := ref.Set(ctx, d, opt...)
 	return err
 }
 
+// nextVersion reads the version of ref in tx and returns the version to
+// write, missing documents are rejected unless create is set
+func nextVersion(tx *firestore.Transaction, ref *firestore.DocumentRef, v docstore.Versioning, create bool) (int64, error) {
+	dss, err := tx.GetAll([]*firestore.DocumentRef{ref})
+	if err != nil {
+		return 0, err
+	}
+
+	var stored map[string]interface{}
+	if dss[0].Exists() {
+		stored = dss[0].Data()
+	} else if !create {
+		return 0, docstore.NotFound
+	}
+
+	return v.Next(stored)
+}
+
+func versionedSet(tx *firestore.Transaction, ref *firestore.DocumentRef, v docstore.Versioning, d map[string]interface{}, create bool, opts ...firestore.SetOption) error {
+	next, err := nextVersion(tx, ref, v, create)
+	if err != nil {
+		return err
+	}
+	d[v.Field] = next
+	return tx.Set(ref, d, opts...)
+}
+
+// UpdateMany sets fields on every document matching filters. Filters that
+// firestore can not run are evaluated after fetching the documents.
 func (f *FireStore) UpdateMany(ctx context.Context, filters []docstore.FilterOpt, fields map[string]interface{}) error {
-	return docstore.OperationNotSupported
+	docs, err := f.findAll(ctx, filters)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return docstore.NotFound
+	}
+
+	ups := make([]firestore.Update, 0, len(fields))
+	for k, v := range fields {
+		ups = append(ups, firestore.Update{Path: k, Value: v})
+	}
+
+	v, versioned := docstore.GetVersioning(ctx)
+	return f.writeBatch(ctx, docs, func(batch *firestore.WriteBatch, d map[string]interface{}, ref *firestore.DocumentRef) {
+		if !versioned {
+			batch.Update(ref, ups)
+			return
+		}
+		cur, _ := docstore.GetPath(d, v.Field)
+		vups := append(ups[:len(ups):len(ups)], firestore.Update{Path: v.Field, Value: docstore.VersionOf(cur) + 1})
+		batch.Update(ref, vups)
+	})
+}
+
+// findAll returns every document matching filters. Raw mongo operators, as
+// accepted by UpdateMany, are only evaluated after fetching.
+func (f *FireStore) findAll(ctx context.Context, filters []docstore.FilterOpt) ([]map[string]interface{}, error) {
+	push := make([]docstore.FilterOpt, 0, len(filters))
+	for _, fl := range filters {
+		if !strings.HasPrefix(fl.Ops, "$") {
+			push = append(push, fl)
+		}
+	}
+
+	var docs []map[string]interface{}
+	if err := f.Find(ctx, &docstore.QueryOpt{Filter: push}, &docs); err != nil {
+		return nil, err
+	}
+
+	out := make([]map[string]interface{}, 0, len(docs))
+	for _, d := range docs {
+		if docstore.Match(d, filters) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (f *FireStore) writeBatch(ctx context.Context, docs []map[string]interface{}, fn func(*firestore.WriteBatch, map[string]interface{}, *firestore.DocumentRef)) error {
+	for i := 0; i < len(docs); i += maxBatchSize {
+		end := i + maxBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batch := f.client.Batch()
+		for _, d := range docs[i:end] {
+			fn(batch, d, f.store.Doc(fmt.Sprintf("%v", d[f.idField])))
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (f *FireStore) Upsert(ctx context.Context, id, doc interface{}) error {
@@ -90,29 +214,108 @@ func (f *FireStore) Upsert(ctx context.Context, id, doc interface{}) error {
 		return err
 	}
 	opt := []firestore.SetOption{firestore.MergeAll}
+	if v, ok := docstore.GetVersioning(ctx); ok {
+		return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			return versionedSet(tx, ref, v, d, true, opt...)
+		})
+	}
 	_, err := ref.Set(ctx, d, opt...)
 	return err
 }
 
-func (f *FireStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field) error {
+// UpdateField sets the fields natively, other update operations and upserts
+// read and rewrite the document in a transaction
+func (f *FireStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field, opts ...interface{}) error {
 	ref := f.store.Doc(fmt.Sprintf("%v", id))
+	v, versioned := docstore.GetVersioning(ctx)
+	upsert := docstore.GetUpdateOpt(opts...).Upsert
+	if upsert || !docstore.IsSetOnly(fields) {
+		return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			return f.applyUpdates(ctx, tx, ref, id, fields, upsert)
+		})
+	}
+
 	ups := make([]firestore.Update, 0)
 	for _, f := range fields {
+		if versioned && f.Name == v.Field {
+			continue
+		}
 		ups = append(ups, firestore.Update{Path: f.Name, Value: f.Value})
 	}
+
+	if versioned {
+		return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			next, err := nextVersion(tx, ref, v, false)
+			if err != nil {
+				return err
+			}
+			return tx.Update(ref, append(ups, firestore.Update{Path: v.Field, Value: next}))
+		})
+	}
+
 	_, err := ref.Update(ctx, ups)
 	return err
 }
 
+func (f *FireStore) applyUpdates(ctx context.Context, tx *firestore.Transaction, ref *firestore.DocumentRef, id interface{}, fields []docstore.Field, upsert bool) error {
+	dss, err := tx.GetAll([]*firestore.DocumentRef{ref})
+	if err != nil {
+		return err
+	}
+
+	var stored map[string]interface{}
+	d := map[string]interface{}{f.idField: id}
+	if dss[0].Exists() {
+		stored = dss[0].Data()
+		d = dss[0].Data()
+	} else if !upsert {
+		return docstore.NotFound
+	}
+
+	if v, ok := docstore.GetVersioning(ctx); ok {
+		next, err := v.Next(stored)
+		if err != nil {
+			return err
+		}
+		d[v.Field] = next
+		fields = withoutField(fields, v.Field)
+	}
+
+	if err := docstore.ApplyUpdates(d, fields, stored == nil); err != nil {
+		return err
+	}
+	return tx.Set(ref, d)
+}
+
+func withoutField(fields []docstore.Field, name string) []docstore.Field {
+	out := make([]docstore.Field, 0, len(fields))
+	for _, f := range fields {
+		if f.Name != name {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// incUpdates returns the increment of key, bumping the version of versioned
+// writes
+func incUpdates(ctx context.Context, key string, value int) []firestore.Update {
+	ups := []firestore.Update{{Path: key, Value: firestore.Increment(value)}}
+	if v, ok := docstore.GetVersioning(ctx); ok && v.Field != key {
+		ups = append(ups, firestore.Update{Path: v.Field, Value: firestore.Increment(1)})
+	}
+	return ups
+}
+
 func (f *FireStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
 	ref := f.store.Doc(fmt.Sprintf("%v", id))
-	_, err := ref.Update(ctx, []firestore.Update{{Path: key, Value: firestore.Increment(value)}})
+	_, err := ref.Update(ctx, incUpdates(ctx, key, value))
 	return err
 }
 
 func (f *FireStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
 	ref := f.store.Doc(fmt.Sprintf("%v", id))
-	_, err := ref.Update(ctx, []firestore.Update{{Path: key, Value: firestore.Increment(value)}})
+	_, err := ref.Update(ctx, incUpdates(ctx, key, value))
 	if err != nil {
 		return err
 	}
@@ -126,25 +329,62 @@ func (f *FireStore) Delete(ctx context.Context, id interface{}) error {
 }
 
 func (f *FireStore) DeleteMany(ctx context.Context, query *docstore.QueryOpt) error {
-	return docstore.OperationNotSupported
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	docs, err := f.findAll(ctx, filters)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return docstore.NotFound
+	}
+
+	return f.writeBatch(ctx, docs, func(batch *firestore.WriteBatch, _ map[string]interface{}, ref *firestore.DocumentRef) {
+		batch.Delete(ref)
+	})
 }
 
-func (f *FireStore) Get(ctx context.Context, id interface{}, doc interface{}) error {
+// Get reads the document of id, a docstore.Projection option selects its
+// fields
+func (f *FireStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
 	ds, err := f.store.Doc(fmt.Sprintf("%v", id)).Get(ctx)
 	if err != nil {
-		return err
+		return notFound(err)
 	}
 	d := ds.Data()
 	d[f.idField] = ds.Ref.ID
-	return util.DecodeJSON(d, doc)
+	return util.DecodeJSON(docstore.ProjectDoc(d, p, f.idField), doc)
 }
 
 func (f *FireStore) Count(ctx context.Context, query *docstore.QueryOpt) (int64, error) {
-	_, fquery, err := getFireQuery(query, f.store.Query)
+	// count ignores pagination
+	var q *docstore.QueryOpt
+	if query != nil {
+		q = &docstore.QueryOpt{Filter: query.Filter}
+	}
+
+	qs, fquery, err := getFireQuery(q, f.store.Query, f.idField)
 	if err != nil {
 		return -1, err
 	}
 
+	if qs != nil {
+		var out []map[string]interface{}
+		if err := f.Find(ctx, q, &out); err != nil {
+			return -1, err
+		}
+		return int64(len(out)), nil
+	}
+
 	iter := fquery.Snapshots(ctx)
 	defer iter.Stop()
 
@@ -158,11 +398,12 @@ func (f *FireStore) Count(ctx context.Context, query *docstore.QueryOpt) (int64,
 }
 
 func (f *FireStore) Find(ctx context.Context, query *docstore.QueryOpt, docs interface{}) error {
-	qs, fquery, err := getFireQuery(query, f.store.Query)
+	qs, fquery, err := getFireQuery(query, f.store.Query, f.idField)
 	if err != nil {
 		return err
 	}
 
+	p := query.Projection()
 	iter := fquery.Documents(ctx)
 	var out []map[string]interface{}
 	count := 0
@@ -170,7 +411,9 @@ func (f *FireStore) Find(ctx context.Context, query *docstore.QueryOpt, docs int
 	skip := 0
 	if qs != nil {
 		skip = qs.Skip
-		limit = skip + qs.Limit
+		if qs.Limit > 0 {
+			limit = skip + qs.Limit
+		}
 	}
 
 	defer iter.Stop()
@@ -195,12 +438,12 @@ func (f *FireStore) Find(ctx context.Context, query *docstore.QueryOpt, docs int
 				if limit > 0 && count > limit {
 					break
 				}
-				out = append(out, tmp)
+				out = append(out, docstore.ProjectDoc(tmp, p, f.idField))
 			}
 			continue
 		}
 
-		out = append(out, tmp)
+		out = append(out, docstore.ProjectDoc(tmp, p, f.idField))
 	}
 
 	return util.DecodeJSON(out, docs)
@@ -218,39 +461,34 @@ func (f *FireStore) FindOne(ctx context.Context, query *docstore.QueryOpt, doc i
 	}
 
 	if id != nil {
-		return f.Get(ctx, id, doc)
+		p := query.Projection()
+		return f.Get(ctx, id, doc, &p)
 	}
 
-	query.Limit = 1
-	_, fquery, err := getFireQuery(query, f.store.Query)
-	if err != nil {
+	q := *query
+	q.Limit = 1
+	var out []map[string]interface{}
+	if err := f.Find(ctx, &q, &out); err != nil {
 		return err
 	}
 
-	iter := fquery.Documents(ctx)
-
-	defer iter.Stop()
-	d, err := iter.Next()
-	if err != nil {
-		if err == iterator.Done {
-			return docstore.NotFound
-		}
-		return err
+	if len(out) == 0 {
+		return docstore.NotFound
 	}
 
-	tmp := d.Data()
-	tmp[f.idField] = d.Ref.ID
-	return util.DecodeJSON(tmp, doc)
+	return util.DecodeJSON(out[0], doc)
 }
 
 func (f *FireStore) Query(ctx context.Context, query *docstore.QueryOpt) (docstore.Iterator, error) {
-	qs, fquery, err := getFireQuery(query, f.store.Query)
+	qs, fquery, err := getFireQuery(query, f.store.Query, f.idField)
 	if err != nil {
 		return nil, err
 	}
 
 	iter := fquery.Documents(ctx)
-	return NewFireIterator(iter, qs, f.idField), nil
+	it := NewFireIterator(iter, qs, f.idField)
+	it.projection = query.Projection()
+	return it, nil
 }
 
 func (f *FireStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
@@ -271,7 +509,12 @@ func (f *FireStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...
 	return err
 }
 
-func (f *FireStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}) error {
+func (f *FireStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
 	ds := make([]*firestore.DocumentRef, 0)
 	for _, i := range ids {
 		ds = append(ds, f.store.Doc(fmt.Sprintf("%v", i)))
@@ -283,12 +526,19 @@ func (f *FireStore) BulkGet(ctx context.Context, ids []interface{}, docs interfa
 	var out []map[string]interface{}
 
 	for _, s := range snaps {
-		out = append(out, s.Data())
+		out = append(out, docstore.ProjectDoc(s.Data(), p, f.idField))
 	}
 
 	return util.DecodeJSON(out, docs)
 }
+
+// Migrate starts deleting the expired documents when the *Config or Config
+// sets ExpiryField, firestore TTL policies are set outside of the client
 func (f *FireStore) Migrate(ctx context.Context, config interface{}) error {
+	field, interval, ok := docstore.ExpiryConfig(config)
+	if ok && f.sweeper == nil {
+		f.sweeper = docstore.StartSweeper(f, field, interval)
+	}
 	return nil
 }
 
@@ -325,30 +575,333 @@ func (f *FireStore) Ping(ctx context.Context) error {
 	return nil
 }
 
+// Distinct returns the distinct values of fieldName, computed after
+// fetching the documents matching filter.
 func (f *FireStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
-	log.GetLogger(ctx, "docstore", "distinct").Warn("[docstore/firestore] not implement distinct")
-	return nil, errors.New("[docstore/firestore] not implement distinct")
+	filters, err := docstore.ToFilters(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := f.findAll(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return docstore.DistinctValues(docs, fieldName), nil
 }
 
+// Pull removes the array elements matching removeCondition from the first
+// document matching condition, see the mongo driver for the conditions format.
 func (f *FireStore) Pull(ctx context.Context, condition, removeCondition docstore.Field) error {
-	log.GetLogger(ctx, "docstore", "pull").Warn("[docstore/firestore] not implement pull")
-	return nil
+	docs, err := f.findAll(ctx, []docstore.FilterOpt{docstore.FieldFilter(condition)})
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return docstore.NotFound
+	}
+
+	d := docs[0]
+	arr, _ := util.Lookup(removeCondition.Name, d)
+	kept, removed := docstore.PullValues(arr, removeCondition.Value)
+	if removed == 0 {
+		return docstore.NothingUpdated
+	}
+
+	ref := f.store.Doc(fmt.Sprintf("%v", d[f.idField]))
+	_, err = ref.Update(ctx, []firestore.Update{{Path: removeCondition.Name, Value: kept}})
+	return err
 }
 
 func (f *FireStore) Disconnect(ctx context.Context) error {
+	f.sweeper.Stop()
+	f.sweeper = nil
 	if f.client != nil {
 		return f.client.Close()
 	}
 	return errors.New("client is nil")
 }
 
-type FireIterator struct {
-	iter    *firestore.DocumentIterator
-	query   *docstore.QueryOpt
+// RunInTransaction runs fn in a Firestore transaction. Firestore requires
+// every read in a transaction to happen before its first write, and fn may
+// be called more than once when the transaction is retried on contention.
+func (f *FireStore) RunInTransaction(ctx context.Context, fn func(tx docstore.Tx) error) error {
+	return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		return fn(&fireTx{store: f, tx: tx})
+	})
+}
+
+type fireTx struct {
+	store *FireStore
+	tx    *firestore.Transaction
+}
+
+func (t *fireTx) Create(ctx context.Context, doc interface{}) error {
+	id, err := t.store.getID(doc)
+	if err != nil {
+		return err
+	}
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, d); err != nil {
+		return err
+	}
+	return t.tx.Create(t.store.store.Doc(fmt.Sprintf("%v", id)), d)
+}
+
+func (t *fireTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, d); err != nil {
+		return err
+	}
+	opt := make([]firestore.SetOption, 0)
+	if !replace {
+		opt = append(opt, firestore.MergeAll)
+	}
+	ref := t.store.store.Doc(fmt.Sprintf("%v", id))
+	if v, ok := docstore.GetVersioning(ctx); ok {
+		// the version is read in the transaction, so it has to come
+		// before any write of fn
+		return versionedSet(t.tx, ref, v, d, false, opt...)
+	}
+	return t.tx.Set(ref, d, opt...)
+}
+
+func (t *fireTx) Delete(ctx context.Context, id interface{}) error {
+	return t.tx.Delete(t.store.store.Doc(fmt.Sprintf("%v", id)))
+}
+
+func (t *fireTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	ds, err := t.tx.Get(t.store.store.Doc(fmt.Sprintf("%v", id)))
+	if err != nil {
+		return notFound(err)
+	}
+	d := ds.Data()
+	d[t.store.idField] = ds.Ref.ID
+	return util.DecodeJSON(d, doc)
+}
+
+// Aggregate evaluates agg over the documents fetched with its filter
+func (f *FireStore) Aggregate(ctx context.Context, agg *docstore.AggregateOpt, docs interface{}) error {
+	if err := agg.Validate(); err != nil {
+		return err
+	}
+
+	all, err := f.findAll(ctx, agg.Filter)
+	if err != nil {
+		return err
+	}
+
+	rows, err := docstore.AggregateDocs(all, agg)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(rows, docs)
+}
+
+// BulkWrite commits the writes in batches of maxBatchSize. Firestore has no
+// bulk writer in this client version and a batch fails as a whole, so the
+// writes of a failed batch are retried one by one to report each of them.
+// Updates of missing documents create them, the same as Update.
+func (f *FireStore) BulkWrite(ctx context.Context, ops []docstore.WriteOp, opts ...interface{}) ([]docstore.WriteResult, error) {
+	opt := docstore.GetBulkWriteOpt(opts...)
+	results := make([]docstore.WriteResult, 0, len(ops))
+
+	for i := 0; i < len(ops); i += maxBatchSize {
+		end := i + maxBatchSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		res, err := f.commitWrites(ctx, ops[i:end])
+		if err != nil {
+			if res, err = docstore.WriteEach(ctx, f, f.idField, ops[i:end], opts...); err != nil && err != docstore.ErrPartialWrite {
+				return nil, err
+			}
+		}
+		results = append(results, res...)
+
+		if err == docstore.ErrPartialWrite && opt.Ordered {
+			for _, op := range ops[end:] {
+				results = append(results, docstore.WriteResult{ID: op.ID, Op: op.Op, Status: docstore.WriteSkipped})
+			}
+			return results, err
+		}
+	}
+
+	return results, docstore.PartialWriteError(results)
+}
+
+// commitWrites commits ops in a batch
+func (f *FireStore) commitWrites(ctx context.Context, ops []docstore.WriteOp) ([]docstore.WriteResult, error) {
+	results := make([]docstore.WriteResult, len(ops))
+	batch := f.client.Batch()
+
+	for i, op := range ops {
+		id := op.ID
+		if op.Op == docstore.WriteCreate {
+			var err error
+			if id, err = f.getID(op.Doc); err != nil {
+				return nil, err
+			}
+		}
+		ref := f.store.Doc(fmt.Sprintf("%v", id))
+		results[i] = docstore.WriteResult{ID: id, Op: op.Op, Status: docstore.WriteOK}
+
+		if op.Op == docstore.WriteDelete {
+			batch.Delete(ref)
+			continue
+		}
+
+		d := make(map[string]interface{})
+		if err := util.DecodeJSON(op.Doc, &d); err != nil {
+			return nil, err
+		}
+
+		switch op.Op {
+		case docstore.WriteCreate:
+			batch.Create(ref, d)
+		case docstore.WriteReplace:
+			batch.Set(ref, d)
+		case docstore.WriteUpdate, docstore.WriteUpsert:
+			batch.Set(ref, d, firestore.MergeAll)
+		default:
+			return nil, fmt.Errorf("[docstore/firestore] unknown write operation %s", op.Op)
+		}
+	}
+
+	if _, err := batch.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Watch streams the changes of the documents matching the query filter with a
+// snapshot listener. Before is the last version seen by the listener, so it is
+// empty for documents that did not match the query before the change.
+func (f *FireStore) Watch(ctx context.Context, query *docstore.QueryOpt) (docstore.ChangeStream, error) {
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	_, fquery, err := getFireQuery(&docstore.QueryOpt{Filter: filters}, f.store.Query, f.idField)
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot iterator can not be stopped while waiting for the next
+	// snapshot, so the listener runs until its context is cancelled
+	wctx, cancel := context.WithCancel(ctx)
+	iter := fquery.Snapshots(wctx)
+
+	// the first snapshot is the current content of the results, reading it
+	// before returning makes every later write reported as a change
+	snap, err := iter.Next()
+	if err != nil {
+		iter.Stop()
+		cancel()
+		return nil, err
+	}
+
+	queue := docstore.NewChangeQueue(filters, cancel)
+	w := &fireWatcher{
+		store:   f.store,
+		idField: f.idField,
+		queue:   queue,
+		docs:    make(map[string]map[string]interface{}),
+	}
+	for _, c := range snap.Changes {
+		w.docs[c.Doc.Ref.ID] = w.data(c.Doc)
+	}
+	go w.run(wctx, iter)
+
+	return queue, nil
+}
+
+type fireWatcher struct {
+	store   *firestore.CollectionRef
 	idField string
-	limit   int
-	skip    int
-	count   int
+	queue   *docstore.ChangeQueue
+	// docs holds the last version of the documents in the query results
+	docs map[string]map[string]interface{}
+}
+
+func (w *fireWatcher) run(ctx context.Context, iter *firestore.QuerySnapshotIterator) {
+	defer iter.Stop()
+
+	for {
+		snap, err := iter.Next()
+		if err != nil {
+			if ctx.Err() == nil && err != iterator.Done {
+				w.queue.Fail(err)
+			}
+			return
+		}
+
+		for _, c := range snap.Changes {
+			if err := w.change(ctx, c); err != nil {
+				if ctx.Err() == nil {
+					w.queue.Fail(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (w *fireWatcher) change(ctx context.Context, c firestore.DocumentChange) error {
+	id := c.Doc.Ref.ID
+	ev := docstore.ChangeEvent{Type: docstore.ChangeUpdate, ID: id, Before: w.docs[id]}
+
+	switch c.Kind {
+	case firestore.DocumentAdded:
+		if c.Doc.CreateTime.Equal(c.Doc.UpdateTime) {
+			ev.Type = docstore.ChangeInsert
+		}
+		ev.After = w.data(c.Doc)
+	case firestore.DocumentModified:
+		ev.After = w.data(c.Doc)
+	case firestore.DocumentRemoved:
+		// the document left the results, it is either deleted or no longer
+		// matching the query
+		delete(w.docs, id)
+		ds, err := w.store.Doc(id).Get(ctx)
+		if ds == nil {
+			return err
+		}
+		if ds.Exists() {
+			ev.After = w.data(ds)
+		} else {
+			ev.Type = docstore.ChangeDelete
+		}
+	}
+
+	if c.Kind != firestore.DocumentRemoved {
+		w.docs[id] = w.data(c.Doc)
+	}
+
+	w.queue.Push(ev)
+	return nil
+}
+
+func (w *fireWatcher) data(ds *firestore.DocumentSnapshot) map[string]interface{} {
+	d := ds.Data()
+	d[w.idField] = ds.Ref.ID
+	return d
+}
+
+type FireIterator struct {
+	iter       *firestore.DocumentIterator
+	query      *docstore.QueryOpt
+	idField    string
+	limit      int
+	skip       int
+	count      int
+	projection docstore.Projection
 }
 
 func NewFireIterator(iter *firestore.DocumentIterator, query *docstore.QueryOpt, idField string) *FireIterator {
@@ -359,7 +912,9 @@ func NewFireIterator(iter *firestore.DocumentIterator, query *docstore.QueryOpt,
 	if query != nil {
 		fi.query = query
 		fi.skip = query.Skip
-		fi.limit = query.Limit
+		if query.Limit > 0 {
+			fi.limit = query.Skip + query.Limit
+		}
 		fi.count = 0
 	}
 	return fi
@@ -381,7 +936,7 @@ func (i *FireIterator) Next(ctx context.Context, doc interface{}) error {
 
 	tmp := d.Data()
 	tmp[i.idField] = d.Ref.ID
-	return util.DecodeJSON(tmp, doc)
+	return util.DecodeJSON(docstore.ProjectDoc(tmp, i.projection, i.idField), doc)
 }
 
 func (i *FireIterator) findNext(ctx context.Context, doc interface{}) error {
@@ -405,7 +960,7 @@ func (i *FireIterator) findNext(ctx context.Context, doc interface{}) error {
 			if i.limit > 0 && i.count > i.limit {
 				return docstore.EndOfDoc
 			}
-			return util.DecodeJSON(tmp, doc)
+			return util.DecodeJSON(docstore.ProjectDoc(tmp, i.projection, i.idField), doc)
 		}
 		continue
 	}
@@ -4,7 +4,6 @@ package firestore
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -43,9 +42,7 @@ func TestFireStore(t *testing.T) {
 	}
 
 	require.Nil(t, err)
-	docstore.DriverCRUDTest(fs, t)
-	docstore.DriverBulkTest(fs, t)
-
+	docstore.DriverConformanceTest(fs, t)
 }
 
 func TestDocstore(t *testing.T) {
@@ -81,6 +78,7 @@ func TestDocstore(t *testing.T) {
 	}
 
 	docstore.DocstoreTestCRUD(cs, t)
+	docstore.DocstoreTestTenant(cs, t)
 }
 
 func TestUpsert(t *testing.T) {
@@ -163,43 +161,51 @@ func TestFireStore_Ping(t *testing.T) {
 }
 
 func TestFireStore_Distinct(t *testing.T) {
-	type fields struct {
-		store      *firestore.CollectionRef
-		client     *firestore.Client
-		idField    string
-		collection string
+	os.Setenv("FIRESTORE_EMULATOR_HOST", emulatorHost)
+	ctx := context.Background()
+	fs, err := NewFireStore(&docstore.Config{
+		Database:   "my-project",
+		Collection: "distinct",
+		IDField:    "id",
+		Credential: "credential.json",
+	})
+	require.Nil(t, err)
+
+	docs := []interface{}{
+		map[string]interface{}{"id": "1", "city": "Jakarta", "tags": []string{"a", "b"}},
+		map[string]interface{}{"id": "2", "city": "Bandung", "tags": []string{"b"}},
+		map[string]interface{}{"id": "3", "city": "Jakarta"},
 	}
-	type args struct {
-		ctx       context.Context
+	require.Nil(t, fs.BulkCreate(ctx, docs))
+
+	tests := []struct {
+		name      string
 		fieldName string
 		filter    interface{}
-	}
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		want    []interface{}
-		wantErr error
+		want      []interface{}
 	}{
 		{
-			name:    "assert not error test",
-			wantErr: errors.New("[docstore/firestore] not implement distinct"),
+			name:      "no filter",
+			fieldName: "city",
+			want:      []interface{}{"Jakarta", "Bandung"},
+		},
+		{
+			name:      "array field",
+			fieldName: "tags",
+			want:      []interface{}{"a", "b"},
+		},
+		{
+			name:      "map filter",
+			fieldName: "tags",
+			filter:    map[string]interface{}{"city": "Bandung"},
+			want:      []interface{}{"b"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			f := &FireStore{
-				store:      tt.fields.store,
-				client:     tt.fields.client,
-				idField:    tt.fields.idField,
-				collection: tt.fields.collection,
-			}
-			got, err := f.Distinct(tt.args.ctx, tt.args.fieldName, tt.args.filter)
-			if err != nil {
-				assert.Equal(t, tt.wantErr, err)
-				return
-			}
-			assert.Equalf(t, tt.want, got, "Distinct(%v, %v, %v)", tt.args.ctx, tt.args.fieldName, tt.args.filter)
+			got, err := fs.Distinct(ctx, tt.fieldName, tt.filter)
+			require.Nil(t, err)
+			assert.ElementsMatchf(t, tt.want, got, "Distinct(%v, %v)", tt.fieldName, tt.filter)
 		})
 	}
 }
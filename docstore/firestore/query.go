@@ -2,6 +2,8 @@ package firestore
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/bondhan/golib/constant"
@@ -9,19 +11,40 @@ import (
 	"github.com/bondhan/golib/util"
 )
 
-func getFireQuery(q *docstore.QueryOpt, query firestore.Query) (*docstore.QueryOpt, firestore.Query, error) {
+func getFireQuery(q *docstore.QueryOpt, query firestore.Query, idField string) (*docstore.QueryOpt, firestore.Query, error) {
 	if q == nil {
 		return nil, query, nil
 	}
 
+	if err := q.Projection().Validate(); err != nil {
+		return nil, query, err
+	}
+
+	cursor, err := docstore.ParseCursor(q, idField)
+	if err != nil {
+		return nil, query, err
+	}
+
+	if cursor != nil {
+		cq := *q
+		cq.OrderBy = cursor.OrderBy
+		cq.IsAscend = cursor.IsAscend
+		cq.Skip = 0
+		cq.Page = 0
+		q = &cq
+	}
+
 	if !hasComplexQuery(q) {
-		return nil, toFirestoreQuery(q, query), nil
+		return nil, startAfter(selectFields(toFirestoreQuery(q, query), q.Fields), cursor), nil
 	}
 
+	// only equality filters are run by firestore, the rest of the filters
+	// together with skip and limit are applied after fetching
 	qs := &docstore.QueryOpt{
-		Limit: q.Limit,
-		Skip:  q.Skip,
-		Page:  q.Page,
+		Limit:  q.Limit,
+		Skip:   q.Skip,
+		Page:   q.Page,
+		Filter: q.Filter,
 	}
 	if q.Page > 0 && q.Limit > 0 {
 		qs.Skip = q.Page * q.Limit
@@ -31,54 +54,83 @@ func getFireQuery(q *docstore.QueryOpt, query firestore.Query) (*docstore.QueryO
 		IsAscend: q.IsAscend,
 	}
 
-	qs.Filter = q.Filter
-
-	for i, f := range q.Filter {
-		if f.Ops == constant.OR {
-			return nil, query, fmt.Errorf("unsupported filter operation: %v", f.Ops)
-		}
-		if f.Ops == constant.IN || f.Ops == constant.AM || f.Ops == constant.AIN {
-			if i == 0 {
-				qp.Filter = q.Filter[0:1]
-				qs.Filter = q.Filter[1:]
-				break
-			}
-			qp.Filter = q.Filter[0:i]
-			qs.Filter = q.Filter[i:]
-			break
+	for _, f := range q.Filter {
+		if f.Ops == constant.EQ && f.Value != nil {
+			qp.Filter = append(qp.Filter, f)
 		}
 	}
 
-	return qs, toFirestoreQuery(qp, query), nil
+	return qs, startAfter(toFirestoreQuery(qp, query), cursor), nil
 }
 
-func hasComplexQuery(q *docstore.QueryOpt) bool {
-	if len(q.Filter) == 1 {
-		return false
+// startAfter resumes query after the cursor, the document ID breaks ties of
+// the sort field
+func startAfter(query firestore.Query, cursor *docstore.Cursor) firestore.Query {
+	if cursor == nil {
+		return query
 	}
 
-	for _, f := range q.Filter {
-		if f.Ops == constant.IN || f.Ops == constant.AM || f.Ops == constant.AIN ||
-			f.Ops == constant.RE || f.Ops == constant.OR {
-			return true
+	dir := firestore.Desc
+	if cursor.IsAscend {
+		dir = firestore.Asc
+	}
+
+	return query.OrderBy(firestore.DocumentID, dir).StartAfter(cursor.Value, fmt.Sprintf("%v", cursor.ID))
+}
+
+// selectFields selects the top level fields of the projected paths, the
+// projection of nested and array paths is done after fetching
+func selectFields(query firestore.Query, fields []string) firestore.Query {
+	if len(fields) == 0 {
+		return query
+	}
+
+	paths := make([]string, 0, len(fields))
+	seen := make(map[string]struct{})
+	for _, f := range fields {
+		top := strings.SplitN(f, ".", 2)[0]
+		if _, ok := seen[top]; ok {
+			continue
 		}
+		seen[top] = struct{}{}
+		paths = append(paths, top)
 	}
-	return false
+
+	return query.Select(paths...)
 }
 
-func isMatch(doc interface{}, q *docstore.QueryOpt) bool {
-	match := false
+// hasComplexQuery reports whether the query needs filters that firestore can
+// not run, or can not combine in a single query
+func hasComplexQuery(q *docstore.QueryOpt) bool {
+	in := 0
+	ranges := make(map[string]struct{})
 	for _, f := range q.Filter {
-		if f.Ops == constant.AIN || f.Ops == constant.AM {
-			f.Ops = constant.IN
-		}
-		if !util.Assert(f.Field, doc, f.Value, f.Ops) {
-			match = false
-			break
+		switch f.Ops {
+		case constant.EQ:
+			// firestore null equality skips documents missing the field,
+			// like the soft delete filter of docstore, so the documents
+			// of the other equality filters are all fetched and matched
+			if f.Value == nil {
+				return true
+			}
+		case constant.IN, constant.AM, constant.AIN, constant.NIN:
+			in++
+		case constant.GT, constant.GE, constant.LT, constant.LE, constant.NE:
+			ranges[f.Field] = struct{}{}
+		default:
+			return true
 		}
-		match = true
 	}
-	return match
+
+	if in > 1 || len(ranges) > 1 {
+		return true
+	}
+
+	return in > 0 && len(q.Filter) > 1
+}
+
+func isMatch(doc interface{}, q *docstore.QueryOpt) bool {
+	return docstore.Match(doc, q.Filter)
 }
 
 func toFirestoreQuery(q *docstore.QueryOpt, query firestore.Query) firestore.Query {
@@ -95,8 +147,16 @@ func toFirestoreQuery(q *docstore.QueryOpt, query firestore.Query) firestore.Que
 			f.Ops = "in"
 		}
 
+		if f.Ops == constant.NIN {
+			f.Ops = "not-in"
+		}
+
 		if f.Ops == constant.AIN {
 			f.Ops = "array-contains"
+			// docstore filters pass array values, firestore expects a single element
+			if util.IsSlice(f.Value) && util.GetSliceLength(f.Value) == 1 {
+				f.Value = util.GetSliceItem(f.Value, 0)
+			}
 		}
 
 		if f.Ops == constant.AM {
@@ -107,7 +167,7 @@ func toFirestoreQuery(q *docstore.QueryOpt, query firestore.Query) firestore.Que
 			continue
 		}
 
-		query = query.Where(f.Field, f.Ops, f.Value)
+		query = query.Where(f.Field, f.Ops, storedValue(f.Value))
 	}
 
 	if q.Limit > 0 {
@@ -131,3 +191,17 @@ func toFirestoreQuery(q *docstore.QueryOpt, query firestore.Query) firestore.Que
 
 	return query
 }
+
+// storedValue returns times as the UTC RFC3339 strings the documents keep,
+// documents are stored through JSON
+func storedValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case *time.Time:
+		if v != nil {
+			return v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return val
+}
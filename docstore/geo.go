@@ -0,0 +1,252 @@
+package docstore
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/bondhan/golib/constant"
+)
+
+// EarthRadius is the radius in meters used to compute distances, the one
+// mongo uses for spherical geometry
+const EarthRadius = 6378100.0
+
+// GeoPoint is a position in degrees. Documents store positions as GeoJSON
+// points or [lng, lat] pairs, like the 2dsphere indexes of mongo read them.
+type GeoPoint struct {
+	Lng float64 `json:"lng"`
+	Lat float64 `json:"lat"`
+}
+
+// GeoJSON returns the GeoJSON point of p, to be stored in documents
+func (p GeoPoint) GeoJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "Point",
+		"coordinates": []interface{}{p.Lng, p.Lat},
+	}
+}
+
+// GeoRadius is the value of the NEAR and WR filters, distances are in
+// meters. A NEAR filter without MaxDistance matches any located document.
+type GeoRadius struct {
+	Center      GeoPoint
+	MaxDistance float64
+	MinDistance float64
+}
+
+// GeoPolygon is the value of the WP filter, the ring is closed by joining the
+// last point to the first one
+type GeoPolygon []GeoPoint
+
+// Distance returns the haversine distance in meters between a and b
+func Distance(a, b GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Contains reports whether p lies inside the polygon, by ray casting
+func (g GeoPolygon) Contains(p GeoPoint) bool {
+	in := false
+	for i, j := 0, len(g)-1; i < len(g); j, i = i, i+1 {
+		a, b := g[i], g[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+// GeoRadiusOf reads the GeoRadius or *GeoRadius value of a NEAR or WR filter
+func GeoRadiusOf(val interface{}) (GeoRadius, bool) {
+	switch v := val.(type) {
+	case GeoRadius:
+		return v, true
+	case *GeoRadius:
+		if v != nil {
+			return *v, true
+		}
+	}
+	return GeoRadius{}, false
+}
+
+func toGeoPolygon(val interface{}) (GeoPolygon, bool) {
+	switch v := val.(type) {
+	case GeoPolygon:
+		return v, len(v) > 2
+	case []GeoPoint:
+		return v, len(v) > 2
+	}
+	return nil, false
+}
+
+// geoPointOf reads a GeoJSON point or a [lng, lat] pair
+func geoPointOf(val interface{}) (GeoPoint, bool) {
+	switch v := val.(type) {
+	case GeoPoint:
+		return v, true
+	case *GeoPoint:
+		if v != nil {
+			return *v, true
+		}
+		return GeoPoint{}, false
+	}
+
+	if isArray(val) {
+		pair := sliceValues(val)
+		if len(pair) != 2 {
+			return GeoPoint{}, false
+		}
+		lng, ok1 := normalizeValue(pair[0]).(float64)
+		lat, ok2 := normalizeValue(pair[1]).(float64)
+		return GeoPoint{Lng: lng, Lat: lat}, ok1 && ok2
+	}
+
+	if typ, _ := fieldValue(val, "type"); typ != "Point" {
+		return GeoPoint{}, false
+	}
+	coords, _ := fieldValue(val, "coordinates")
+	return geoPointOf(coords)
+}
+
+// geoPoints returns the points of the values of a field, which may be a point
+// or an array of points
+func geoPoints(leaves []interface{}) []GeoPoint {
+	out := make([]GeoPoint, 0, len(leaves))
+	for _, l := range leaves {
+		if p, ok := geoPointOf(l); ok {
+			out = append(out, p)
+			continue
+		}
+		if isArray(l) {
+			out = append(out, geoPoints(sliceValues(l))...)
+		}
+	}
+	return out
+}
+
+// nearest returns the distance from center of the closest point of leaves
+func nearest(leaves []interface{}, center GeoPoint) (float64, bool) {
+	min, found := math.Inf(1), false
+	for _, p := range geoPoints(leaves) {
+		if d := Distance(center, p); d < min {
+			min, found = d, true
+		}
+	}
+	return min, found
+}
+
+func matchGeo(leaves []interface{}, f FilterOpt) bool {
+	switch f.Ops {
+	case constant.NEAR, constant.WR:
+		r, ok := GeoRadiusOf(f.Value)
+		if !ok {
+			return false
+		}
+		d, ok := nearest(leaves, r.Center)
+		if !ok || d < r.MinDistance {
+			return false
+		}
+		return d <= r.MaxDistance || (f.Ops == constant.NEAR && r.MaxDistance == 0)
+	case constant.WP:
+		poly, ok := toGeoPolygon(f.Value)
+		if !ok {
+			return false
+		}
+		for _, p := range geoPoints(leaves) {
+			if poly.Contains(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchText reports whether a word of the search is a word of the strings
+// of leaves, ignoring case
+func matchText(leaves []interface{}, search interface{}) bool {
+	s, _ := search.(string)
+	terms := textWords(s)
+	if len(terms) == 0 {
+		return false
+	}
+
+	words := make(map[string]bool)
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch val := v.(type) {
+		case string:
+			for _, w := range textWords(val) {
+				words[w] = true
+			}
+		case map[string]interface{}:
+			for _, e := range val {
+				collect(e)
+			}
+		default:
+			if isArray(v) {
+				for _, e := range sliceValues(v) {
+					collect(e)
+				}
+			}
+		}
+	}
+	for _, l := range leaves {
+		collect(l)
+	}
+
+	for _, t := range terms {
+		if words[t] {
+			return true
+		}
+	}
+	return false
+}
+
+func textWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// nearFilter returns the NEAR filter of filters, which orders the results
+// of queries without an order
+func nearFilter(filters []FilterOpt) (string, GeoRadius, bool) {
+	for _, f := range filters {
+		if f.Ops != constant.NEAR {
+			continue
+		}
+		if r, ok := GeoRadiusOf(f.Value); ok {
+			return f.Field, r, true
+		}
+	}
+	return "", GeoRadius{}, false
+}
+
+// byDistance sorts documents by the distance of their field to a center
+type byDistance struct {
+	docs []map[string]interface{}
+	dist []float64
+}
+
+func newByDistance(docs []map[string]interface{}, field string, center GeoPoint) byDistance {
+	dist := make([]float64, len(docs))
+	for i, d := range docs {
+		leaves, _ := lookupValues(d, field)
+		dist[i], _ = nearest(leaves, center)
+	}
+	return byDistance{docs: docs, dist: dist}
+}
+
+func (b byDistance) Len() int           { return len(b.docs) }
+func (b byDistance) Less(i, j int) bool { return b.dist[i] < b.dist[j] }
+func (b byDistance) Swap(i, j int) {
+	b.docs[i], b.docs[j] = b.docs[j], b.docs[i]
+	b.dist[i], b.dist[j] = b.dist[j], b.dist[i]
+}
@@ -0,0 +1,145 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bondhan/golib/log"
+	"github.com/bondhan/golib/util"
+)
+
+// HookPoint is the point of a write a hook runs at
+type HookPoint string
+
+const (
+	BeforeCreate HookPoint = "before_create"
+	AfterCreate  HookPoint = "after_create"
+	BeforeUpdate HookPoint = "before_update"
+	AfterUpdate  HookPoint = "after_update"
+	BeforeDelete HookPoint = "before_delete"
+	AfterDelete  HookPoint = "after_delete"
+)
+
+// HookEvent is the write a hook runs for
+type HookEvent struct {
+	// Op is the CachedStore method writing, e.g. UpdateField
+	Op string
+	ID interface{}
+	// Doc is the document written, the written fields for UpdateField,
+	// UpdateFields, Increment, UpdateMany and Restore, and nil for deletes
+	// and Pull. The rewrites of Migrate and Reencrypt read the document in
+	// their transaction, so it is only set for their after hooks.
+	Doc interface{}
+	// Filter holds the filters of UpdateMany, DeleteMany, Pull and Purge,
+	// their ID is nil
+	Filter []FilterOpt
+
+	// audit holds the documents written as they were before the write
+	audit []auditDoc
+}
+
+// Hook runs before or after a write. The error of a before hook aborts the
+// write and is returned by it, the errors of after hooks are logged as the
+// write is already done.
+type Hook func(ctx context.Context, event *HookEvent) error
+
+type hookRegistry struct {
+	mux   sync.RWMutex
+	hooks map[HookPoint][]Hook
+}
+
+// AddHook registers hook at point, hooks run in the order they are added.
+// Before hooks run once IDs and timestamps are set and may change the
+// document. In transactions the after hooks run once it commits.
+func (s *CachedStore) AddHook(point HookPoint, hook Hook) {
+	s.hooks.mux.Lock()
+	defer s.hooks.mux.Unlock()
+
+	if s.hooks.hooks == nil {
+		s.hooks.hooks = make(map[HookPoint][]Hook)
+	}
+	s.hooks.hooks[point] = append(s.hooks.hooks[point], hook)
+}
+
+func (s *CachedStore) hooksOf(point HookPoint) []Hook {
+	s.hooks.mux.RLock()
+	defer s.hooks.mux.RUnlock()
+	return s.hooks.hooks[point]
+}
+
+// before runs the hooks of point and stops at the first error
+func (s *CachedStore) before(ctx context.Context, point HookPoint, event *HookEvent) error {
+	for _, h := range s.hooksOf(point) {
+		if err := h(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// after runs the hooks of point, logging their errors, then records the
+// write in the audit history. The write is done but the error of the history
+// is returned, as a write missing from it is not audited.
+func (s *CachedStore) after(ctx context.Context, point HookPoint, event *HookEvent) error {
+	for _, h := range s.hooksOf(point) {
+		if err := h(ctx, event); err != nil {
+			log.GetLogger(ctx, "docstore", event.Op).WithError(err).Error("error running " + string(point) + " hook")
+		}
+	}
+
+	if !s.Audit {
+		return nil
+	}
+	return s.auditAfter(ctx, event)
+}
+
+// updateOp returns the method of an update
+func updateOp(replace, upsert bool) string {
+	switch {
+	case replace:
+		return "Replace"
+	case upsert:
+		return "Upsert"
+	}
+	return "Update"
+}
+
+// fieldsDoc returns the document of updated fields
+func fieldsDoc(fields []Field) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		doc[f.Name] = f.Value
+	}
+	return doc
+}
+
+// PublishHook returns an after hook publishing the writes as ChangeEvent of
+// type change, named prefix.change and keyed by the document ID. After
+// holds the document written, only the written fields for field updates.
+func PublishHook(pub Publisher, prefix, change string) Hook {
+	return func(ctx context.Context, event *HookEvent) error {
+		ev := &ChangeEvent{Type: change, ID: event.ID}
+		if change != ChangeDelete && event.Doc != nil {
+			ev.After = make(map[string]interface{})
+			if err := util.DecodeJSON(event.Doc, &ev.After); err != nil {
+				return err
+			}
+		}
+
+		key := ""
+		if event.ID != nil {
+			key = fmt.Sprintf("%v", event.ID)
+		}
+		return pub.Publish(ctx, prefix+"."+change, key, ev, nil)
+	}
+}
+
+// PublishHooks publishes the writes of the store as domain events named
+// after the collection, e.g. user.update, like PublishChanges does from a
+// change stream
+func (s *CachedStore) PublishHooks(pub Publisher) {
+	s.AddHook(AfterCreate, PublishHook(pub, s.Collection, ChangeInsert))
+	s.AddHook(AfterUpdate, PublishHook(pub, s.Collection, ChangeUpdate))
+	s.AddHook(AfterDelete, PublishHook(pub, s.Collection, ChangeDelete))
+}
@@ -3,6 +3,7 @@ package docstore
 import (
 	"context"
 	"errors"
+	"reflect"
 	"sort"
 	"sync"
 
@@ -16,9 +17,11 @@ import (
 // var memstore = make(map[string]*MemoryStore)
 
 type MemoryStore struct {
-	storage map[interface{}]map[string]interface{}
-	idField string
-	mux     *sync.Mutex
+	storage  map[interface{}]map[string]interface{}
+	idField  string
+	mux      *sync.Mutex
+	watchers map[*ChangeQueue]struct{}
+	sweeper  *Sweeper
 }
 
 func MemoryStoreFactory(config *Config) (Driver, error) {
@@ -28,9 +31,10 @@ func MemoryStoreFactory(config *Config) (Driver, error) {
 func NewMemoryStore(name, idField string) *MemoryStore {
 
 	m := &MemoryStore{
-		storage: make(map[interface{}]map[string]interface{}),
-		idField: idField,
-		mux:     &sync.Mutex{},
+		storage:  make(map[interface{}]map[string]interface{}),
+		idField:  idField,
+		mux:      &sync.Mutex{},
+		watchers: make(map[*ChangeQueue]struct{}),
 	}
 
 	return m
@@ -62,12 +66,16 @@ func (m *MemoryStore) Create(ctx context.Context, doc interface{}) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
+	return m.create(m.storage, doc)
+}
+
+func (m *MemoryStore) create(storage map[interface{}]map[string]interface{}, doc interface{}) error {
 	id, err := m.getID(doc)
 	if err != nil {
 		return err
 	}
 
-	if _, ok := m.storage[id]; ok {
+	if _, ok := storage[id]; ok {
 		return errors.New("[docstore/memory] document ID is already exist")
 	}
 
@@ -76,7 +84,7 @@ func (m *MemoryStore) Create(ctx context.Context, doc interface{}) error {
 		return err
 	}
 
-	m.storage[id] = d
+	m.put(storage, id, d)
 	return nil
 }
 
@@ -87,7 +95,12 @@ func (m *MemoryStore) Update(ctx context.Context, id, doc interface{}, replace b
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
-	if _, ok := m.storage[id]; !ok {
+	return m.update(ctx, m.storage, id, doc, replace)
+}
+
+func (m *MemoryStore) update(ctx context.Context, storage map[interface{}]map[string]interface{}, id, doc interface{}, replace bool) error {
+	old, ok := storage[id]
+	if !ok {
 		return NotFound
 	}
 	d := make(map[string]interface{})
@@ -96,60 +109,209 @@ func (m *MemoryStore) Update(ctx context.Context, id, doc interface{}, replace b
 	}
 
 	if replace {
-		m.storage[id] = d
+		if err := nextVersion(ctx, old, d); err != nil {
+			return err
+		}
+		m.put(storage, id, d)
 		return nil
 	}
 
-	cd := m.storage[id]
+	// merge into a copy so a snapshot taken by a transaction never
+	// shares nested values with the committed document
+	cd := copyDoc(storage[id])
 
 	if err := mergo.MergeWithOverwrite(&cd, d); err != nil {
 		return err
 	}
 
-	m.storage[id] = cd
+	if err := nextVersion(ctx, old, cd); err != nil {
+		return err
+	}
+
+	m.put(storage, id, cd)
 
 	return nil
 }
 
 func (m *MemoryStore) UpdateMany(ctx context.Context, filters []FilterOpt, fields map[string]interface{}) error {
-	return OperationNotSupported
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "UpdateMany")
+	defer span.End()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	matched, modified := 0, 0
+	for id, d := range m.storage {
+		if !Match(d, filters) {
+			continue
+		}
+		matched++
+
+		cd := copyDoc(d)
+		for k, v := range fields {
+			setPath(cd, k, v)
+		}
+
+		if equalValue(d, cd) {
+			continue
+		}
+		if err := nextVersion(ctx, d, cd); err != nil {
+			return err
+		}
+		modified++
+		m.put(m.storage, id, cd)
+	}
+
+	if modified == 0 {
+		if matched == 0 {
+			return NotFound
+		}
+		return NothingUpdated
+	}
+
+	return nil
 }
 
 func (m *MemoryStore) Upsert(ctx context.Context, id, doc interface{}) error {
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "Upsert")
+	defer span.End()
 	m.mux.Lock()
-	_, ok := m.storage[id]
-	m.mux.Unlock()
+	defer m.mux.Unlock()
+
+	if _, ok := m.storage[id]; ok {
+		return m.update(ctx, m.storage, id, doc, false)
+	}
+
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return err
+	}
+	d[m.idField] = id
+	if err := nextVersion(ctx, nil, d); err != nil {
+		return err
+	}
+	m.put(m.storage, id, d)
+	return nil
+}
+
+// nextVersion checks the versioning of ctx against the stored document and
+// sets the next version on the document to write
+func nextVersion(ctx context.Context, stored, doc map[string]interface{}) error {
+	v, ok := GetVersioning(ctx)
 	if !ok {
-		return m.Create(ctx, doc)
+		return nil
 	}
-	return m.Update(ctx, id, doc, false)
+
+	next, err := v.Next(stored)
+	if err != nil {
+		return err
+	}
+
+	setPath(doc, v.Field, next)
+	return nil
+}
+
+// NextVersion is nextVersion for the drivers storing documents as maps
+func NextVersion(ctx context.Context, stored, doc map[string]interface{}) error {
+	return nextVersion(ctx, stored, doc)
 }
 
-func (m *MemoryStore) UpdateField(ctx context.Context, id interface{}, fields []Field) error {
+// UpdateField applies the field updates on the document of id, an UpdateOpt
+// option may upsert it
+func (m *MemoryStore) UpdateField(ctx context.Context, id interface{}, fields []Field, opts ...interface{}) error {
 	tracer := otel.Tracer("docstore/memory")
 	_, span := tracer.Start(ctx, "UpdateField")
 	defer span.End()
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	d, ok := m.storage[id]
-	if !ok {
+	if !ok && !GetUpdateOpt(opts...).Upsert {
 		return NotFound
 	}
 
-	for _, f := range fields {
-		// fn, _ := util.FindFieldByTag(d, "json", f.Name)
-		if err := util.SetValue(d, f.Name, f.Value); err != nil {
-			return err
-		}
+	cd := map[string]interface{}{m.idField: id}
+	if ok {
+		cd = copyDoc(d)
+	}
+	if err := ApplyUpdates(cd, fields, !ok); err != nil {
+		return err
+	}
+
+	if err := nextVersion(ctx, d, cd); err != nil {
+		return err
 	}
 
-	m.storage[id] = d
+	m.put(m.storage, id, cd)
 	return nil
 }
 
+// Pull removes the array elements matching removeCondition from the first
+// document matching condition, the same way as the mongo driver.
 func (m *MemoryStore) Pull(ctx context.Context, condition, removeCondition Field) error {
-	log.GetLogger(ctx, "docstore", "pull").Warn("[docstore/memory] not implement pull")
-	return nil
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "Pull")
+	defer span.End()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	filter := FieldFilter(condition)
+	for _, id := range m.sortedKeys(m.storage) {
+		d := m.storage[id]
+		if !Match(d, []FilterOpt{filter}) {
+			continue
+		}
+
+		cd := copyDoc(d)
+		arr, _ := getPath(cd, removeCondition.Name)
+		kept, removed := PullValues(arr, removeCondition.Value)
+		if removed == 0 {
+			return NothingUpdated
+		}
+
+		setPath(cd, removeCondition.Name, kept)
+		m.put(m.storage, id, cd)
+		return nil
+	}
+
+	return NotFound
+}
+
+// FieldFilter converts a possibly nested Field, as used by Pull, into an
+// equality filter on its dotted path
+func FieldFilter(f Field) FilterOpt {
+	name := f.Name
+	val := f.Value
+	for {
+		nf, ok := val.(Field)
+		if !ok {
+			break
+		}
+		name = name + "." + nf.Name
+		val = nf.Value
+	}
+	return FilterOpt{Field: name, Ops: constant.EQ, Value: val}
+}
+
+// PullValues removes the elements of arr equal to cond, or matching it when
+// cond is a Field, and returns the kept elements and the number removed
+func PullValues(arr, cond interface{}) ([]interface{}, int) {
+	kept := make([]interface{}, 0)
+	removed := 0
+	for _, e := range sliceValues(arr) {
+		var match bool
+		if f, ok := cond.(Field); ok {
+			match = Match(e, []FilterOpt{FieldFilter(f)})
+		} else {
+			match = equalValue(e, cond)
+		}
+		if match {
+			removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, removed
 }
 
 func (m *MemoryStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
@@ -160,37 +322,47 @@ func (m *MemoryStore) Increment(ctx context.Context, id interface{}, key string,
 	defer m.mux.Unlock()
 	d, ok := m.storage[id]
 	if !ok {
-		m.storage[id] = map[string]interface{}{key: value}
-		return nil
+		d = map[string]interface{}{m.idField: id}
 	}
 
-	field, ok := d[key]
+	cd := copyDoc(d)
+	field, ok := getPath(cd, key)
 	if !ok {
-		return errors.New("[docstore/memory] field not found")
+		setPath(cd, key, value)
+		if err := nextVersion(ctx, d, cd); err != nil {
+			return err
+		}
+		m.put(m.storage, id, cd)
+		return nil
 	}
 
+	var nv interface{}
 	switch v := field.(type) {
 	case int:
-		d[key] = v + value
+		nv = v + value
 	case int32:
-		d[key] = v + int32(value)
+		nv = v + int32(value)
 	case int64:
-		d[key] = v + int64(value)
+		nv = v + int64(value)
 	case float64:
-		d[key] = v + float64(value)
+		nv = v + float64(value)
 	case float32:
-		d[key] = v + float32(value)
+		nv = v + float32(value)
 	case uint:
-		d[key] = v + uint(value)
+		nv = v + uint(value)
 	case uint32:
-		d[key] = v + uint32(value)
+		nv = v + uint32(value)
 	case uint64:
-		d[key] = v + uint64(value)
+		nv = v + uint64(value)
 	default:
 		return errors.New("[docstore/memory] destination type is not a number")
 	}
 
-	m.storage[id] = d
+	setPath(cd, key, nv)
+	if err := nextVersion(ctx, d, cd); err != nil {
+		return err
+	}
+	m.put(m.storage, id, cd)
 	return nil
 }
 
@@ -211,115 +383,194 @@ func (m *MemoryStore) Delete(ctx context.Context, id interface{}) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
-	delete(m.storage, id)
+	m.remove(m.storage, id)
 	return nil
 }
 
 func (m *MemoryStore) DeleteMany(ctx context.Context, query *QueryOpt) error {
-	return OperationNotSupported
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "DeleteMany")
+	defer span.End()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var filters []FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	deleted := 0
+	for id, d := range m.storage {
+		if Match(d, filters) {
+			m.remove(m.storage, id)
+			deleted++
+		}
+	}
+
+	if deleted == 0 {
+		return NotFound
+	}
+
+	return nil
 }
 
-func (m *MemoryStore) Get(ctx context.Context, id interface{}, doc interface{}) error {
+// Get reads the document of id, a Projection option selects its fields
+func (m *MemoryStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
 	tracer := otel.Tracer("docstore/memory")
 	_, span := tracer.Start(ctx, "Get")
 	defer span.End()
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	d, ok := m.storage[id]
+
+	return m.get(m.storage, id, doc, GetProjection(opts...))
+}
+
+func (m *MemoryStore) get(storage map[interface{}]map[string]interface{}, id interface{}, doc interface{}, p Projection) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	d, ok := storage[id]
 	if !ok {
 		return NotFound
 	}
 
-	if err := util.DecodeJSON(d, doc); err != nil {
+	if err := util.DecodeJSON(ProjectDoc(d, p, m.idField), doc); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// Count counts the documents matching the query filters, skip and limit are
+// ignored like the mongo driver does.
 func (m *MemoryStore) Count(ctx context.Context, query *QueryOpt) (int64, error) {
-	out := make([]interface{}, 0)
-	return m.find(ctx, query, &out)
-}
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "Count")
+	defer span.End()
 
-func (m *MemoryStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
-	_, err := m.find(ctx, query, docs)
-	return err
+	var filters []FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var count int64
+	for _, d := range m.storage {
+		if Match(d, filters) {
+			count++
+		}
+	}
+
+	return count, nil
 }
 
-func (m *MemoryStore) find(ctx context.Context, query *QueryOpt, docs interface{}) (int64, error) {
+func (m *MemoryStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
 	tracer := otel.Tracer("docstore/memory")
 	_, span := tracer.Start(ctx, "Find")
 	defer span.End()
+
+	out, err := m.find(query)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+// find returns the documents matching the query, sorted and paginated
+func (m *MemoryStore) find(query *QueryOpt) ([]map[string]interface{}, error) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	out := make([]interface{}, 0)
+
+	docs := make([]map[string]interface{}, 0, len(m.storage))
+	for _, id := range m.sortedKeys(m.storage) {
+		docs = append(docs, m.storage[id])
+	}
+
+	return QueryDocs(docs, query, m.idField)
+}
+
+// QueryDocs returns the documents of docs matching the query, sorted,
+// paginated and projected, for drivers evaluating queries themselves. docs
+// should be ordered by ID, which is kept when the query has no order nor near
+// filter, and the ID breaks ties between equal sort values so pagination stays stable.
+func QueryDocs(docs []map[string]interface{}, query *QueryOpt, idField string) ([]map[string]interface{}, error) {
+	query, err := CursorQuery(query, idField)
+	if err != nil {
+		return nil, err
+	}
+
 	if query == nil {
-		for _, v := range m.storage {
-			out = append(out, v)
-		}
-		if err := util.DecodeJSON(out, docs); err != nil {
-			return -1, err
-		}
-		return int64(len(out)), nil
+		query = &QueryOpt{}
 	}
 
-	for _, d := range m.storage {
-		match := false
-		if len(query.Filter) == 0 {
-			match = true
-		}
-		for _, f := range query.Filter {
-			fn, err := util.FindFieldByTag(d, "json", f.Field)
-			if err == nil {
-				f.Field = fn
-			}
-			if !assertVal(f, d) {
-				match = false
-				break
-			}
-			match = true
-		}
-		if match {
+	p := query.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	out := make([]map[string]interface{}, 0)
+	for _, d := range docs {
+		if Match(d, query.Filter) {
 			out = append(out, d)
 		}
 	}
 
 	if query.OrderBy != "" {
-		sort.Slice(out, func(i, j int) bool {
-			of := query.OrderBy
-			if util.IsStructOrPointerOf(out[j]) {
-				if f, err := util.FindFieldByTag(out[j], "json", query.OrderBy); err == nil {
-					of = f
-				}
+		sort.SliceStable(out, func(i, j int) bool {
+			vi, _ := getPath(out[i], query.OrderBy)
+			vj, _ := getPath(out[j], query.OrderBy)
+			c := sortValue(vi, vj)
+			if c == 0 {
+				c = sortValue(out[i][idField], out[j][idField])
 			}
-			val, ok := util.Lookup(of, out[j])
-			if ok {
-				return util.Assert(of, out[i], val, constant.GT)
+			if query.IsAscend {
+				return c < 0
 			}
-			return false
+			return c > 0
 		})
-		if query.IsAscend {
-			util.Reverse(out)
-		}
+	} else if field, r, ok := nearFilter(query.Filter); ok {
+		// near filters sort by distance like mongo does
+		sort.Stable(newByDistance(out, field, r.Center))
 	}
 
+	skip := query.Skip
 	if query.Page > 0 && query.Limit > 0 {
-		query.Skip = query.Page * query.Limit
+		skip = query.Page * query.Limit
 	}
 
-	if query.Skip > 0 && len(out) > query.Skip {
-		out = out[query.Skip:]
+	if skip > 0 {
+		if skip >= len(out) {
+			return out[:0], nil
+		}
+		out = out[skip:]
 	}
 
 	if query.Limit > 0 && len(out) > query.Limit {
 		out = out[:query.Limit]
 	}
 
-	if err := util.DecodeJSON(out, docs); err != nil {
-		return -1, err
+	if !p.IsEmpty() {
+		for i, d := range out {
+			out[i] = ProjectDoc(d, p, idField)
+		}
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) sortedKeys(storage map[interface{}]map[string]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(storage))
+	for k := range storage {
+		keys = append(keys, k)
 	}
-	return int64(len(out)), nil
+	sort.Slice(keys, func(i, j int) bool {
+		return sortValue(keys[i], keys[j]) < 0
+	})
+	return keys
 }
 
 func (m *MemoryStore) FindOne(ctx context.Context, query *QueryOpt, doc interface{}) error {
@@ -327,46 +578,31 @@ func (m *MemoryStore) FindOne(ctx context.Context, query *QueryOpt, doc interfac
 	_, span := tracer.Start(ctx, "FindOne")
 	defer span.End()
 
-	if query != nil && query.OrderBy != "" {
-		tmp := make([]interface{}, 0)
-		if _, err := m.find(ctx, query, &tmp); err != nil {
-			return err
-		}
-		if len(tmp) > 0 {
-			return util.DecodeJSON(tmp[0], doc)
-		}
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
 	}
+	q.Limit = 1
 
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	for _, d := range m.storage {
-		if query == nil || len(query.Filter) == 0 {
-			return util.DecodeJSON(d, doc)
-		}
-		match := false
-		for _, f := range query.Filter {
-			fn, err := util.FindFieldByTag(d, "json", f.Field)
-			if err == nil {
-				f.Field = fn
-			}
-			if !assertVal(f, d) {
-				match = false
-				break
-			}
-			match = true
-		}
-
-		if match {
-			return util.DecodeJSON(d, doc)
-		}
+	out, err := m.find(q)
+	if err != nil {
+		return err
 	}
 
-	return NotFound
+	if len(out) == 0 {
+		return NotFound
+	}
 
+	return util.DecodeJSON(out[0], doc)
 }
 
 func (m *MemoryStore) Query(ctx context.Context, query *QueryOpt) (Iterator, error) {
-	return NewMemIterator(m, query), nil
+	docs, err := m.find(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemIterator{docs: docs}, nil
 }
 
 func (m *MemoryStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
@@ -377,46 +613,35 @@ func (m *MemoryStore) BulkCreate(ctx context.Context, docs []interface{}, opts .
 	defer m.mux.Unlock()
 
 	for _, doc := range docs {
-		id, err := m.getID(doc)
-		if err != nil {
-			return err
-		}
-
-		if _, ok := m.storage[id]; ok {
-			return errors.New("[docstore/memory] document ID is already exist")
-		}
-
-		switch d := doc.(type) {
-		case map[string]interface{}:
-			m.storage[id] = d
-			continue
-		}
-
-		d := make(map[string]interface{})
-		if err := util.DecodeJSON(doc, d); err != nil {
+		if err := m.create(m.storage, doc); err != nil {
 			return err
 		}
-
-		m.storage[id] = d
 	}
 
 	return nil
 }
 
-func (m *MemoryStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}) error {
+// BulkGet returns the documents found in the order of ids, missing IDs are
+// skipped like the mongo driver does.
+func (m *MemoryStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
 	tracer := otel.Tracer("docstore/memory")
 	_, span := tracer.Start(ctx, "BulkGet")
 	defer span.End()
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
+	p := GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
 	out := make([]map[string]interface{}, 0)
 	for _, id := range ids {
 		d, ok := m.storage[id]
 		if !ok {
-			return NotFound
+			continue
 		}
-		out = append(out, d)
+		out = append(out, ProjectDoc(d, p, m.idField))
 	}
 
 	if err := util.DecodeJSON(out, docs); err != nil {
@@ -426,7 +651,19 @@ func (m *MemoryStore) BulkGet(ctx context.Context, ids []interface{}, docs inter
 	return nil
 }
 
+// Migrate starts deleting the expired documents when the *Config or Config
+// sets ExpiryField
 func (m *MemoryStore) Migrate(ctx context.Context, config interface{}) error {
+	field, interval, ok := ExpiryConfig(config)
+	if !ok {
+		return nil
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.sweeper == nil {
+		m.sweeper = StartSweeper(m, field, interval)
+	}
 	return nil
 }
 
@@ -437,130 +674,253 @@ func (m *MemoryStore) Ping(ctx context.Context) error {
 	return nil
 }
 
+// Distinct returns the distinct values of fieldName. The filter can be nil,
+// a *QueryOpt, a FilterOpt slice or a map of field equality.
 func (m *MemoryStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
-	log.GetLogger(ctx, "docstore", "distinct").Warn("[docstore/memory] not implement distinct")
-	return nil, errors.New("[docstore/memory] not implement distinct")
-}
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "Distinct")
+	defer span.End()
 
-func (m *MemoryStore) Disconnect(ctx context.Context) error {
-	return nil
-}
+	filters, err := ToFilters(filter)
+	if err != nil {
+		return nil, err
+	}
 
-type MemIterator struct {
-	store  *MemoryStore
-	query  *QueryOpt
-	index  int
-	length int
-	keys   []interface{}
+	docs, err := m.find(&QueryOpt{Filter: filters})
+	if err != nil {
+		return nil, err
+	}
+
+	return DistinctValues(docs, fieldName), nil
 }
 
-func NewMemIterator(store *MemoryStore, query *QueryOpt) *MemIterator {
-	// l := len(store.storage)
-	keys := make([]interface{}, 0)
-	if query != nil && query.OrderBy != "" {
-		tmp := make([]interface{}, 0)
-		_, err := store.find(context.Background(), query, &tmp)
-		if err == nil {
-			for _, t := range tmp {
-				id, err := store.getID(t)
-				if err == nil {
-					keys = append(keys, id)
-				}
-			}
-		}
-	} else {
-		for k := range store.storage {
-			keys = append(keys, k)
-		}
+// Aggregate evaluates agg over the stored documents
+func (m *MemoryStore) Aggregate(ctx context.Context, agg *AggregateOpt, docs interface{}) error {
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "Aggregate")
+	defer span.End()
+
+	if err := agg.Validate(); err != nil {
+		return err
 	}
 
-	return &MemIterator{
-		store:  store,
-		query:  query,
-		length: len(keys),
-		keys:   keys,
-		index:  0,
+	all, err := m.find(&QueryOpt{Filter: agg.Filter})
+	if err != nil {
+		return err
+	}
+
+	rows, err := AggregateDocs(all, agg)
+	if err != nil {
+		return err
 	}
+
+	return util.DecodeJSON(rows, docs)
 }
 
-func (i *MemIterator) Next(ctx context.Context, doc interface{}) error {
-	if i.index >= i.length {
-		return EndOfDoc
+// BulkWrite runs the writes one by one, see WriteEach
+func (m *MemoryStore) BulkWrite(ctx context.Context, ops []WriteOp, opts ...interface{}) ([]WriteResult, error) {
+	tracer := otel.Tracer("docstore/memory")
+	ctx, span := tracer.Start(ctx, "BulkWrite")
+	defer span.End()
+
+	return WriteEach(ctx, m, m.idField, ops, opts...)
+}
+
+func (m *MemoryStore) Disconnect(ctx context.Context) error {
+	m.mux.Lock()
+	sweeper := m.sweeper
+	m.sweeper = nil
+	m.mux.Unlock()
+
+	// a running sweep locks the store
+	sweeper.Stop()
+	return nil
+}
+
+// RunInTransaction runs fn against a copy-on-write snapshot of the store.
+// The snapshot replaces the store content only when fn returns nil.
+// The store is locked while fn runs, so fn must only use the given Tx.
+func (m *MemoryStore) RunInTransaction(ctx context.Context, fn func(tx Tx) error) error {
+	tracer := otel.Tracer("docstore/memory")
+	_, span := tracer.Start(ctx, "RunInTransaction")
+	defer span.End()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	snapshot := make(map[interface{}]map[string]interface{}, len(m.storage))
+	for k, v := range m.storage {
+		snapshot[k] = v
 	}
 
-	if i.query == nil {
-		if err := util.DecodeJSON(i.store.storage[i.keys[i.index]], doc); err != nil {
-			return err
-		}
-		i.index++
-		return nil
+	if err := fn(&memTx{store: m, storage: snapshot}); err != nil {
+		return err
 	}
 
-	for n := i.index; n < i.length; n++ {
-		d := i.store.storage[i.keys[i.index]]
-		i.index++
-		match := false
-		for _, f := range i.query.Filter {
-			fn, err := util.FindFieldByTag(d, "json", f.Field)
-			if err == nil {
-				f.Field = fn
-			}
-			if !assertVal(f, d) {
-				match = false
-				break
-			}
-			match = true
+	// documents are copied on write, a changed document is a different map
+	for id, d := range snapshot {
+		before, ok := m.storage[id]
+		if !ok {
+			m.notify(ChangeEvent{Type: ChangeInsert, ID: id, After: d})
+		} else if reflect.ValueOf(before).Pointer() != reflect.ValueOf(d).Pointer() {
+			m.notify(ChangeEvent{Type: ChangeUpdate, ID: id, Before: before, After: d})
 		}
-		if match || len(i.query.Filter) == 0 {
-			return util.DecodeJSON(d, doc)
+	}
+	for id, d := range m.storage {
+		if _, ok := snapshot[id]; !ok {
+			m.notify(ChangeEvent{Type: ChangeDelete, ID: id, Before: d})
 		}
 	}
 
-	i.index = i.length
-	return EndOfDoc
+	m.storage = snapshot
+	return nil
 }
 
-func (i *MemIterator) Close(ctx context.Context) error {
-	i.index = i.length
+type memTx struct {
+	store   *MemoryStore
+	storage map[interface{}]map[string]interface{}
+}
+
+func (t *memTx) Create(ctx context.Context, doc interface{}) error {
+	return t.store.create(t.storage, doc)
+}
+
+func (t *memTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	return t.store.update(ctx, t.storage, id, doc, replace)
+}
+
+func (t *memTx) Delete(ctx context.Context, id interface{}) error {
+	t.store.remove(t.storage, id)
 	return nil
 }
 
-func assertOr(filter interface{}, ctx interface{}) bool {
-	opts, ok := filter.([]FilterOpt)
+func (t *memTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	return t.store.get(t.storage, id, doc, Projection{})
+}
+
+// Watch streams the changes made through the store to the documents matching
+// the query filter. The stream is buffered so it never blocks writers.
+func (m *MemoryStore) Watch(ctx context.Context, query *QueryOpt) (ChangeStream, error) {
+	var filters []FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var q *ChangeQueue
+	q = NewChangeQueue(filters, func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		delete(m.watchers, q)
+	})
+	if m.watchers == nil {
+		m.watchers = make(map[*ChangeQueue]struct{})
+	}
+	m.watchers[q] = struct{}{}
+
+	return q, nil
+}
+
+// put stores doc, watchers are notified when storage is the committed one,
+// transaction snapshots are notified on commit
+func (m *MemoryStore) put(storage map[interface{}]map[string]interface{}, id interface{}, doc map[string]interface{}) {
+	before, ok := storage[id]
+	storage[id] = doc
+	if !m.isCommitted(storage) {
+		return
+	}
+
+	if ok {
+		m.notify(ChangeEvent{Type: ChangeUpdate, ID: id, Before: before, After: doc})
+		return
+	}
+	m.notify(ChangeEvent{Type: ChangeInsert, ID: id, After: doc})
+}
+
+func (m *MemoryStore) remove(storage map[interface{}]map[string]interface{}, id interface{}) {
+	before, ok := storage[id]
 	if !ok {
-		return false
+		return
 	}
 
-	for _, f := range opts {
-		if assertVal(f, ctx) {
-			return true
-		}
+	delete(storage, id)
+	if m.isCommitted(storage) {
+		m.notify(ChangeEvent{Type: ChangeDelete, ID: id, Before: before})
 	}
-	return false
 }
 
-func assertVal(filter FilterOpt, ctx interface{}) bool {
-	switch filter.Ops {
-	case constant.OR:
-		return assertOr(filter.Value, ctx)
-	case constant.AND:
-		opts, ok := filter.Value.([]FilterOpt)
-		if !ok {
-			return false
+func (m *MemoryStore) isCommitted(storage map[interface{}]map[string]interface{}) bool {
+	return reflect.ValueOf(storage).Pointer() == reflect.ValueOf(m.storage).Pointer()
+}
+
+func (m *MemoryStore) notify(event ChangeEvent) {
+	for q := range m.watchers {
+		ev := event
+		if ev.Before != nil {
+			ev.Before = copyDoc(ev.Before)
 		}
-		match := false
-		for _, f := range opts {
-			if !assertVal(f, ctx) {
-				match = false
-				break
-			}
-			match = true
+		if ev.After != nil {
+			ev.After = copyDoc(ev.After)
+		}
+		q.Push(ev)
+	}
+}
+
+// CopyDoc returns a deep copy of a document, for drivers storing documents as
+// maps
+func CopyDoc(doc map[string]interface{}) map[string]interface{} {
+	return copyDoc(doc)
+}
+
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return copyDoc(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = copyValue(e)
 		}
-		return match
-	case constant.AIN, constant.AM:
-		filter.Ops = constant.IN
-		fallthrough
+		return out
 	default:
-		return util.Assert(filter.Field, ctx, filter.Value, filter.Ops)
+		return v
+	}
+}
+
+// MemIterator iterates over the documents matched when the query is run
+type MemIterator struct {
+	docs  []map[string]interface{}
+	index int
+}
+
+func NewMemIterator(store *MemoryStore, query *QueryOpt) *MemIterator {
+	docs, _ := store.find(query)
+	return &MemIterator{
+		docs:  docs,
+		index: 0,
 	}
 }
+
+func (i *MemIterator) Next(ctx context.Context, doc interface{}) error {
+	if i.index >= len(i.docs) {
+		return EndOfDoc
+	}
+
+	d := i.docs[i.index]
+	i.index++
+	return util.DecodeJSON(d, doc)
+}
+
+func (i *MemIterator) Close(ctx context.Context) error {
+	i.index = len(i.docs)
+	return nil
+}
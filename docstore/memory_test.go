@@ -2,55 +2,130 @@ package docstore
 
 import (
 	"context"
-	"errors"
-	"sync"
 	"testing"
+	"time"
 
+	"github.com/bondhan/golib/constant"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMemoryStore(t *testing.T) {
 	ms := NewMemoryStore("test", "id")
-	DriverCRUDTest(ms, t)
-	DriverBulkTest(ms, t)
+	DriverConformanceTest(ms, t)
 }
 
 func TestMemoryStore_Distinct(t *testing.T) {
-	type fields struct {
-		storage map[interface{}]map[string]interface{}
-		idField string
-		mux     *sync.Mutex
+	ms := NewMemoryStore("test", "id")
+	ctx := context.Background()
+	docs := []interface{}{
+		map[string]interface{}{"id": "1", "city": "Jakarta", "tags": []string{"a", "b"}},
+		map[string]interface{}{"id": "2", "city": "Bandung", "tags": []string{"b"}},
+		map[string]interface{}{"id": "3", "city": "Jakarta"},
 	}
-	type args struct {
-		ctx       context.Context
+	require.Nil(t, ms.BulkCreate(ctx, docs))
+
+	tests := []struct {
+		name      string
 		fieldName string
 		filter    interface{}
-	}
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		want    []interface{}
-		wantErr error
+		want      []interface{}
 	}{
 		{
-			name:    "assert not error test",
-			wantErr: errors.New("[docstore/memory] not implement distinct"),
+			name:      "no filter",
+			fieldName: "city",
+			want:      []interface{}{"Jakarta", "Bandung"},
+		},
+		{
+			name:      "array field",
+			fieldName: "tags",
+			want:      []interface{}{"a", "b"},
+		},
+		{
+			name:      "filter",
+			fieldName: "city",
+			filter:    []FilterOpt{{Field: "tags", Ops: constant.EQ, Value: "b"}},
+			want:      []interface{}{"Jakarta", "Bandung"},
+		},
+		{
+			name:      "map filter",
+			fieldName: "tags",
+			filter:    map[string]interface{}{"city": "Bandung"},
+			want:      []interface{}{"b"},
+		},
+		{
+			name:      "missing field",
+			fieldName: "country",
+			want:      []interface{}{},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &MemoryStore{
-				storage: tt.fields.storage,
-				idField: tt.fields.idField,
-				mux:     tt.fields.mux,
-			}
-			got, err := m.Distinct(tt.args.ctx, tt.args.fieldName, tt.args.filter)
-			if err != nil {
-				assert.Equal(t, tt.wantErr, err)
-				return
-			}
-			assert.Equalf(t, tt.want, got, "Distinct(%v, %v, %v)", tt.args.ctx, tt.args.fieldName, tt.args.filter)
+			got, err := ms.Distinct(ctx, tt.fieldName, tt.filter)
+			require.Nil(t, err)
+			assert.ElementsMatchf(t, tt.want, got, "Distinct(%v, %v)", tt.fieldName, tt.filter)
 		})
 	}
 }
+
+func TestMemoryStore_Geo(t *testing.T) {
+	ms := NewMemoryStore("test", "id")
+	ctx := context.Background()
+	monas := GeoPoint{Lng: 106.8272, Lat: -6.1754}
+	docs := []interface{}{
+		// about 1.3km from monas
+		map[string]interface{}{"id": "1", "name": "Kopi Sabang", "location": GeoPoint{Lng: 106.8295, Lat: -6.1869}.GeoJSON()},
+		// about 300m
+		map[string]interface{}{"id": "2", "name": "Toko Gambir", "location": []interface{}{106.8300, -6.1760}},
+		// about 120km, in Bandung
+		map[string]interface{}{"id": "3", "name": "Kopi Braga", "location": GeoPoint{Lng: 107.6098, Lat: -6.9175}.GeoJSON()},
+		map[string]interface{}{"id": "4", "name": "Online Shop"},
+	}
+	require.Nil(t, ms.BulkCreate(ctx, docs))
+
+	assert.InDelta(t, 1300, Distance(monas, GeoPoint{Lng: 106.8295, Lat: -6.1869}), 50)
+
+	find := func(f ...FilterOpt) []string {
+		var out []map[string]interface{}
+		require.Nil(t, ms.Find(ctx, &QueryOpt{Filter: f}, &out))
+		return idsOf(out)
+	}
+
+	// near sorts by distance
+	assert.Equal(t, []string{"2", "1", "3"}, find(FilterOpt{Field: "location", Ops: constant.NEAR, Value: GeoRadius{Center: monas}}))
+	assert.Equal(t, []string{"2", "1"}, find(FilterOpt{Field: "location", Ops: constant.NEAR, Value: &GeoRadius{Center: monas, MaxDistance: 5000}}))
+	assert.Equal(t, []string{"1"}, find(FilterOpt{Field: "location", Ops: constant.NEAR, Value: GeoRadius{Center: monas, MaxDistance: 5000, MinDistance: 500}}))
+	assert.Equal(t, []string{"1", "2"}, find(FilterOpt{Field: "location", Ops: constant.WR, Value: GeoRadius{Center: monas, MaxDistance: 2000}}))
+
+	jakarta := GeoPolygon{{Lng: 106.6, Lat: -6.0}, {Lng: 107.0, Lat: -6.0}, {Lng: 107.0, Lat: -6.4}, {Lng: 106.6, Lat: -6.4}}
+	assert.Equal(t, []string{"1", "2"}, find(FilterOpt{Field: "location", Ops: constant.WP, Value: jakarta}))
+
+	n, err := ms.Count(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "location", Ops: constant.WP, Value: jakarta}}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// text search matches any word, ignoring case
+	assert.Equal(t, []string{"1", "3"}, find(FilterOpt{Ops: constant.TXT, Value: "KOPI"}))
+	assert.Equal(t, []string{"2", "4"}, find(FilterOpt{Field: "name", Ops: constant.TXT, Value: "gambir online"}))
+	assert.Empty(t, find(FilterOpt{Field: "name", Ops: constant.TXT, Value: "kop"}))
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	ms := NewMemoryStore("session", "id")
+	ctx := context.Background()
+	require.Nil(t, ms.Migrate(ctx, &Config{ExpiryField: "expires_at", SweepInterval: 1}))
+	defer ms.Disconnect(ctx)
+
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "old", "expires_at": time.Now().Add(-time.Second)}))
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "new", "expires_at": time.Now().Add(time.Hour)}))
+	require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": "kept"}))
+
+	assert.Eventually(t, func() bool {
+		n, err := ms.Count(ctx, nil)
+		return err == nil && n == 2
+	}, 3*time.Second, 100*time.Millisecond)
+
+	doc := make(map[string]interface{})
+	assert.Equal(t, NotFound, ms.Get(ctx, "old", &doc))
+	require.Nil(t, ms.Disconnect(ctx))
+}
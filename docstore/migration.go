@@ -0,0 +1,431 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/bondhan/golib/util"
+)
+
+// SchemaVersionField holds the schema version of a document
+const SchemaVersionField = "schema_version"
+
+const defaultMigrationBatch = 100
+
+// Migration upgrades a document from the schema version From to To, documents
+// written before schema versioning have an empty version
+type Migration struct {
+	From    string
+	To      string
+	Upgrade func(ctx context.Context, doc map[string]interface{}) error
+}
+
+var (
+	migrationsMux sync.RWMutex
+	migrations    = map[string][]Migration{}
+)
+
+// RegisterMigration registers the upgrades of the collection documents, in
+// order, e.g. v1 to v2 then v2 to v3. Documents older than Config.SchemaVersion
+// are upgraded when read.
+func RegisterMigration(collection string, m ...Migration) {
+	migrationsMux.Lock()
+	defer migrationsMux.Unlock()
+	migrations[collection] = append(migrations[collection], m...)
+}
+
+// migrations returns the registered migrations of the store collection
+func (s *CachedStore) migrations() []Migration {
+	migrationsMux.RLock()
+	defer migrationsMux.RUnlock()
+	return migrations[s.Collection]
+}
+
+// MigrationOpt is the option of a batch migration. Checkpoint resumes a
+// migration after the document it was taken at, Progress is called every
+// BatchSize documents and after the last one, an error stops the migration.
+type MigrationOpt struct {
+	BatchSize  int
+	Checkpoint string
+	Progress   func(ctx context.Context, p MigrationProgress) error
+}
+
+// MigrationProgress reports a batch migration, Checkpoint is the token
+// resuming it
+type MigrationProgress struct {
+	Scanned    int64
+	Upgraded   int64
+	Checkpoint string
+}
+
+func (s *CachedStore) migrating() bool {
+	return s.SchemaVersion != "" && len(s.migrations()) > 0
+}
+
+// setSchema stamps new documents with the store schema version
+func (s *CachedStore) setSchema(doc interface{}) error {
+	if !s.migrating() {
+		return nil
+	}
+
+	if util.IsMap(doc) {
+		return util.SetValue(doc, SchemaVersionField, s.SchemaVersion)
+	}
+
+	f, err := util.FindFieldByTag(doc, "json", SchemaVersionField)
+	if err != nil {
+		return err
+	}
+
+	return util.SetValue(doc, f, s.SchemaVersion)
+}
+
+func schemaVersion(doc map[string]interface{}) string {
+	v, ok := getPath(doc, SchemaVersionField)
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func (s *CachedStore) migration(from string) (Migration, bool) {
+	for _, m := range s.migrations() {
+		if m.From == from {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// schemaAhead reports whether version is newer than the store schema, those
+// documents are written by a newer release and left as is
+func (s *CachedStore) schemaAhead(version string) bool {
+	cur := s.SchemaVersion
+	for range s.migrations() {
+		m, ok := s.migration(cur)
+		if !ok {
+			return false
+		}
+		if m.To == version {
+			return true
+		}
+		cur = m.To
+	}
+	return false
+}
+
+// outdated reports whether doc is older than the store schema
+func (s *CachedStore) outdated(doc map[string]interface{}) bool {
+	cur := schemaVersion(doc)
+	return cur != s.SchemaVersion && !s.schemaAhead(cur)
+}
+
+// upgrade runs the migrations of doc up to the store schema and reports
+// whether doc was changed
+func (s *CachedStore) upgrade(ctx context.Context, doc map[string]interface{}) (bool, error) {
+	if !s.outdated(doc) {
+		return false, nil
+	}
+
+	cur := schemaVersion(doc)
+	for range s.migrations() {
+		m, ok := s.migration(cur)
+		if !ok {
+			break
+		}
+		if err := m.Upgrade(ctx, doc); err != nil {
+			return false, err
+		}
+		cur = m.To
+		doc[SchemaVersionField] = cur
+		if cur == s.SchemaVersion {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("[docstore] no migration of %s from schema version %q", s.Collection, schemaVersion(doc))
+}
+
+// saveUpgrade upgrades the stored document of id in a transaction, so the
+// migrations run once on the document as stored. It returns the document
+// read in the transaction, nil when it no longer exists, and whether it was
+// upgraded.
+func (s *CachedStore) saveUpgrade(ctx context.Context, id interface{}) (map[string]interface{}, bool, error) {
+	var changed bool
+	d, err := s.rewrite(ctx, "Migrate", id, func(d map[string]interface{}) (bool, error) {
+		var err error
+		changed, err = s.upgrade(ctx, d)
+		return changed, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return d, changed, nil
+}
+
+// rewrite replaces the stored document of id in a transaction. fn changes the
+// decrypted document read in the transaction and reports whether to write
+// it, so the writes made since the document was read are kept. The version
+// is not bumped as the document content is the same. The update hooks run
+// for op, the before hooks ahead of the transaction as drivers may lock the
+// store while it runs. It returns the document read in the transaction as
+// changed by fn, nil when it does not exist.
+func (s *CachedStore) rewrite(ctx context.Context, op string, id interface{}, fn func(d map[string]interface{}) (bool, error)) (map[string]interface{}, error) {
+	event := &HookEvent{Op: op, ID: id}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return nil, err
+	}
+
+	if err := s.deleteCache(ctx, op, id); err != nil {
+		return nil, err
+	}
+	defer s.invalidate(ctx, op)
+
+	var doc map[string]interface{}
+	err := s.storage.RunInTransaction(ctx, func(tx Tx) error {
+		// drivers may retry fn, so only the last attempt's write counts
+		event.Doc, doc = nil, nil
+		d := make(map[string]interface{})
+		if err := tx.Get(ctx, id, &d); err != nil {
+			if err == NotFound {
+				return nil
+			}
+			return err
+		}
+
+		if err := s.decryptDoc(d); err != nil {
+			return err
+		}
+
+		changed, err := fn(d)
+		if err != nil {
+			return err
+		}
+		doc = d
+		if !changed {
+			return nil
+		}
+
+		enc, err := s.encryptStored(d)
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(ctx, id, enc, true); err != nil {
+			return err
+		}
+
+		event.Doc = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if event.Doc == nil {
+		return doc, nil
+	}
+
+	return doc, s.after(ctx, AfterUpdate, event)
+}
+
+// mapped reports whether documents are read through maps, to be checked for
+// soft delete, expiry and tenant, decrypted or upgraded before they are
+// decoded
+func (s *CachedStore) mapped() bool {
+	return s.SoftDelete || s.migrating() || s.encrypting() || s.tenancy() || s.expiring()
+}
+
+// readDoc decrypts and upgrades a document read through a map, it returns
+// false for soft deleted and expired documents and ErrCrossTenant for the
+// documents of other tenants
+func (s *CachedStore) readDoc(ctx context.Context, d map[string]interface{}) (bool, error) {
+	if s.tenancy() {
+		if err := s.ownDoc(ctx, d); err != nil {
+			return false, err
+		}
+	}
+
+	if s.SoftDelete && s.isDeleted(d) {
+		return false, nil
+	}
+
+	if s.expiring() && s.isExpired(d) {
+		return false, nil
+	}
+
+	if err := s.decryptDoc(d); err != nil {
+		return false, err
+	}
+
+	if s.migrating() && s.outdated(d) {
+		id, _ := getPath(d, s.IDField)
+		up, _, err := s.saveUpgrade(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		// the document may be deleted since it was read
+		if up == nil {
+			return false, nil
+		}
+		for k := range d {
+			delete(d, k)
+		}
+		for k, v := range up {
+			d[k] = v
+		}
+	}
+
+	return true, nil
+}
+
+// getMap reads a visible document, decrypted and upgraded
+func (s *CachedStore) getMap(ctx context.Context, id interface{}) (map[string]interface{}, error) {
+	d := make(map[string]interface{})
+	if err := s.storage.Get(ctx, id, &d); err != nil {
+		return nil, err
+	}
+
+	ok, err := s.readDoc(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NotFound
+	}
+
+	return d, nil
+}
+
+// readDocs keeps the visible documents of docs, upgraded to the store schema
+func (s *CachedStore) readDocs(ctx context.Context, docs []map[string]interface{}) ([]map[string]interface{}, error) {
+	out := make([]map[string]interface{}, 0, len(docs))
+	for _, d := range docs {
+		ok, err := s.readDoc(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// find reads the documents of query, mapped documents are read whole and
+// projected once they are decrypted and upgraded
+func (s *CachedStore) find(ctx context.Context, query *QueryOpt, docs interface{}) error {
+	if !s.mapped() {
+		return s.storage.Find(ctx, query, docs)
+	}
+
+	p := query.Projection()
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	var all []map[string]interface{}
+	if err := s.storage.Find(ctx, wholeDocs(query), &all); err != nil {
+		return err
+	}
+
+	out, err := s.readDocs(ctx, all)
+	if err != nil {
+		return err
+	}
+
+	return decodeDocs(projectDocs(out, p, s.IDField), docs)
+}
+
+// decodeDocs decodes maps into the slice pointed by docs
+func decodeDocs(in []map[string]interface{}, docs interface{}) error {
+	out := reflect.ValueOf(docs).Elem()
+	res := reflect.MakeSlice(out.Type(), len(in), len(in))
+	for i, d := range in {
+		if err := util.DecodeJSON(d, res.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	out.Set(res)
+	return nil
+}
+
+// MigrateDocuments upgrades every document of the collection to the store
+// schema, iterating by ID so an interrupted migration resumes from the last
+// checkpoint.
+func (s *CachedStore) MigrateDocuments(ctx context.Context, opt MigrationOpt) (MigrationProgress, error) {
+	if !s.migrating() {
+		return MigrationProgress{}, fmt.Errorf("[docstore] no migration registered for %s", s.Collection)
+	}
+
+	return s.rewriteAll(ctx, opt, func(ctx context.Context, d map[string]interface{}) (bool, error) {
+		if !s.outdated(d) {
+			return false, nil
+		}
+		id, _ := getPath(d, s.IDField)
+		_, changed, err := s.saveUpgrade(ctx, id)
+		return changed, err
+	})
+}
+
+// rewriteAll runs fn on every stored document by ID order, fn reports whether
+// it rewrote the document
+func (s *CachedStore) rewriteAll(ctx context.Context, opt MigrationOpt, fn func(ctx context.Context, d map[string]interface{}) (bool, error)) (MigrationProgress, error) {
+	var p MigrationProgress
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultMigrationBatch
+	}
+
+	query := &QueryOpt{OrderBy: s.IDField, IsAscend: true, Cursor: opt.Checkpoint}
+	iter, err := s.storage.Query(ctx, query)
+	if err != nil {
+		return p, err
+	}
+	defer iter.Close(ctx)
+
+	p.Checkpoint = opt.Checkpoint
+	report := func() error {
+		if opt.Progress == nil {
+			return nil
+		}
+		return opt.Progress(ctx, p)
+	}
+
+	for {
+		d := make(map[string]interface{})
+		if err := iter.Next(ctx, &d); err != nil {
+			if err == EndOfDoc {
+				break
+			}
+			return p, err
+		}
+
+		changed, err := fn(ctx, d)
+		if err != nil {
+			return p, err
+		}
+
+		p.Scanned++
+		if changed {
+			p.Upgraded++
+		}
+		if p.Checkpoint, err = EncodeCursor(query, d, s.IDField); err != nil {
+			return p, err
+		}
+
+		if p.Scanned%int64(opt.BatchSize) == 0 {
+			if err := report(); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	if p.Scanned%int64(opt.BatchSize) != 0 {
+		return p, report()
+	}
+
+	return p, nil
+}
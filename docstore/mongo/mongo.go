@@ -43,6 +43,20 @@ type MongoStore struct {
 
 func init() {
 	docstore.RegisterDriver("mongo", MongoStoreFactory)
+	docstore.RegisterErrorClassifier("mongo", IsTransient)
+}
+
+// IsTransient reports the network errors and timeouts, and the server errors
+// labeled retryable
+func IsTransient(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var le mongo.LabeledError
+	if errors.As(err, &le) {
+		return le.HasErrorLabel("RetryableWriteError") || le.HasErrorLabel("TransientTransactionError")
+	}
+	return false
 }
 
 func MongoStoreFactory(config *docstore.Config) (docstore.Driver, error) {
@@ -137,10 +151,81 @@ func (m *MongoStore) Create(ctx context.Context, doc interface{}) error {
 func (m *MongoStore) Update(ctx context.Context, id, doc interface{}, replace bool) error {
 
 	if replace {
+		return m.replace(ctx, id, doc)
+	}
+	return m.update(ctx, id, doc, false)
+}
+
+func (m *MongoStore) replace(ctx context.Context, id, doc interface{}) error {
+	v, ok := docstore.GetVersioning(ctx)
+	if !ok {
 		_, err := m.store.ReplaceOne(ctx, bson.D{{Key: m.idField, Value: id}}, doc)
 		return err
 	}
-	return m.update(ctx, id, doc, false)
+
+	out := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &out); err != nil {
+		return err
+	}
+	convertTime(out)
+
+	expected := v.Expected
+	if expected == nil {
+		stored := make(map[string]interface{})
+		if err := m.store.FindOne(ctx, bson.D{{Key: m.idField, Value: id}}).Decode(&stored); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return docstore.NotFound
+			}
+			return err
+		}
+		cur := docstore.VersionOf(stored[v.Field])
+		expected = &cur
+	}
+	out[v.Field] = *expected + 1
+
+	filter := bson.D{{Key: m.idField, Value: id}, {Key: v.Field, Value: versionValue(*expected)}}
+	res, err := m.store.ReplaceOne(ctx, filter, out)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return m.versionMiss(ctx, id)
+	}
+
+	return nil
+}
+
+// versioned returns the filter of a write of id checking the versioning of
+// ctx, and the versioning when the write is versioned
+func (m *MongoStore) versioned(ctx context.Context, id interface{}) (bson.D, *docstore.Versioning) {
+	filter := bson.D{{Key: m.idField, Value: id}}
+	v, ok := docstore.GetVersioning(ctx)
+	if !ok {
+		return filter, nil
+	}
+
+	if v.Expected != nil {
+		filter = append(filter, bson.E{Key: v.Field, Value: versionValue(*v.Expected)})
+	}
+
+	return filter, &v
+}
+
+func versionValue(version int64) interface{} {
+	if version == 0 {
+		// documents written before versioning have no version
+		return bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+	}
+	return version
+}
+
+// versionMiss tells a missing document from a version conflict once a
+// versioned write matched nothing
+func (m *MongoStore) versionMiss(ctx context.Context, id interface{}) error {
+	if m.exist(ctx, id) {
+		return docstore.ErrVersionConflict
+	}
+	return docstore.NotFound
 }
 
 func (m *MongoStore) Upsert(ctx context.Context, id, doc interface{}) error {
@@ -153,21 +238,32 @@ func (m *MongoStore) update(ctx context.Context, id, doc interface{}, upsert boo
 		return err
 	}
 
+	filter, ver := m.versioned(ctx, id)
+
 	fields := bson.D{}
 	for k, v := range out {
+		if ver != nil && k == ver.Field {
+			continue
+		}
 		fields = append(fields, bson.E{Key: k, Value: v})
 	}
 
 	update := bson.D{{Key: "$set", Value: fields}}
+	if ver != nil {
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: ver.Field, Value: 1}}})
+	}
 	opts := options.Update().SetUpsert(upsert)
 
-	res, err := m.store.UpdateOne(ctx, bson.D{{Key: m.idField, Value: id}}, update, opts)
+	res, err := m.store.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return err
 	}
 
 	if res.UpsertedCount == 0 && res.ModifiedCount == 0 {
 		if res.MatchedCount == 0 {
+			if ver != nil {
+				return m.versionMiss(ctx, id)
+			}
 			return docstore.NotFound
 		}
 		return docstore.NothingUpdated
@@ -184,19 +280,27 @@ func (m *MongoStore) UpdateMany(ctx context.Context, filters []docstore.FilterOp
 	}
 
 	for _, filter := range filters {
-		flt = append(flt,
-			bson.E{
-				Key: filter.Field,
-				Value: bson.D{
-					{
-						Key:   filter.Ops,
-						Value: filter.Value,
+		// raw mongo operators are passed as is
+		if strings.HasPrefix(filter.Ops, "$") {
+			flt = append(flt,
+				bson.E{
+					Key: filter.Field,
+					Value: bson.D{
+						{
+							Key:   filter.Ops,
+							Value: filter.Value,
+						},
 					},
-				},
-			})
+				})
+			continue
+		}
+		flt = append(flt, toMongoFilterE(filter))
 	}
 
 	u := bson.D{{Key: "$set", Value: fld}}
+	if v, ok := docstore.GetVersioning(ctx); ok {
+		u = append(u, bson.E{Key: "$inc", Value: bson.D{{Key: v.Field, Value: 1}}})
+	}
 
 	res, err := m.store.UpdateMany(ctx, flt, u)
 	if err != nil {
@@ -213,26 +317,49 @@ func (m *MongoStore) UpdateMany(ctx context.Context, filters []docstore.FilterOp
 	return nil
 }
 
-func (m *MongoStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field) error {
-	fs := bson.D{}
-	for _, v := range fields {
-		fs = append(fs, bson.E{Key: v.Name, Value: v.Value})
-	}
+// UpdateField applies the field updates with the mongo update operators, an
+// UpdateOpt option may upsert the document
+func (m *MongoStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field, opts ...interface{}) error {
+	filter, ver := m.versioned(ctx, id)
 
-	update := bson.D{{Key: "$set", Value: fs}}
+	skip := ""
+	if ver != nil {
+		skip = ver.Field
+	}
+	update, err := toMongoUpdate(fields, skip)
+	if err != nil {
+		return err
+	}
+	if ver != nil {
+		update = appendUpdate(update, "$inc", bson.E{Key: ver.Field, Value: 1})
+	}
 
-	res, err := m.store.UpdateOne(ctx, bson.D{{Key: m.idField, Value: id}}, update)
+	opt := options.Update().SetUpsert(docstore.GetUpdateOpt(opts...).Upsert)
+	res, err := m.store.UpdateOne(ctx, filter, update, opt)
 	if err != nil {
 		return err
 	}
-	if res.MatchedCount == 0 {
+	if res.MatchedCount == 0 && res.UpsertedCount == 0 {
+		if ver != nil {
+			return m.versionMiss(ctx, id)
+		}
 		return docstore.NotFound
 	}
 	return err
 }
 
+// incUpdate returns the $inc update of key, bumping the version of versioned
+// writes
+func incUpdate(ctx context.Context, key string, value int) bson.D {
+	inc := bson.D{{Key: key, Value: value}}
+	if v, ok := docstore.GetVersioning(ctx); ok && v.Field != key {
+		inc = append(inc, bson.E{Key: v.Field, Value: 1})
+	}
+	return bson.D{{Key: "$inc", Value: inc}}
+}
+
 func (m *MongoStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
-	update := bson.D{{Key: "$inc", Value: bson.D{{Key: key, Value: value}}}}
+	update := incUpdate(ctx, key, value)
 	upsert := true
 	res, err := m.store.UpdateOne(ctx, bson.D{{Key: m.idField, Value: id}}, update, &options.UpdateOptions{Upsert: &upsert})
 	if err != nil {
@@ -245,7 +372,7 @@ func (m *MongoStore) Increment(ctx context.Context, id interface{}, key string,
 }
 
 func (m *MongoStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
-	update := bson.D{{Key: "$inc", Value: bson.D{{Key: key, Value: value}}}}
+	update := incUpdate(ctx, key, value)
 	rp := options.After
 	upsert := true
 	res := m.store.FindOneAndUpdate(ctx, bson.D{{Key: m.idField, Value: id}}, update, &options.FindOneAndUpdateOptions{ReturnDocument: &rp, Upsert: &upsert})
@@ -272,9 +399,21 @@ func (m *MongoStore) DeleteMany(ctx context.Context, query *docstore.QueryOpt) e
 	return err
 }
 
-func (m *MongoStore) Get(ctx context.Context, id interface{}, doc interface{}) error {
+// Get reads the document of id, a docstore.Projection option selects its
+// fields
+func (m *MongoStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	fopt := options.FindOne()
+	if !p.IsEmpty() {
+		fopt.SetProjection(m.projection(p))
+	}
+
 	out := make(map[string]interface{})
-	if err := m.store.FindOne(ctx, bson.D{{Key: m.idField, Value: id}}).Decode(&out); err != nil {
+	if err := m.store.FindOne(ctx, bson.D{{Key: m.idField, Value: id}}, fopt).Decode(&out); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return docstore.NotFound
 		}
@@ -294,13 +433,15 @@ func (m *MongoStore) exist(ctx context.Context, id interface{}) bool {
 }
 
 func (m *MongoStore) Count(ctx context.Context, query *docstore.QueryOpt) (int64, error) {
-	f, _ := toMongoFilter(query)
-	return m.store.CountDocuments(ctx, f)
+	return m.store.CountDocuments(ctx, toMongoCountFilter(query))
 }
 
 func (m *MongoStore) Find(ctx context.Context, query *docstore.QueryOpt, docs interface{}) error {
 
-	f, opt := toMongoFilter(query)
+	f, opt, err := m.findQuery(query)
+	if err != nil {
+		return err
+	}
 
 	res, err := m.store.Find(ctx, f, opt)
 	if err != nil {
@@ -317,9 +458,18 @@ func (m *MongoStore) Find(ctx context.Context, query *docstore.QueryOpt, docs in
 }
 
 func (m *MongoStore) FindOne(ctx context.Context, query *docstore.QueryOpt, doc interface{}) error {
-	f, _ := toMongoFilter(query)
+	f, opt, err := m.findQuery(query)
+	if err != nil {
+		return err
+	}
+	fopt := options.FindOne()
+	if opt != nil {
+		fopt.Sort = opt.Sort
+		fopt.Skip = opt.Skip
+		fopt.Projection = opt.Projection
+	}
 	out := make(map[string]interface{})
-	if err := m.store.FindOne(ctx, f).Decode(&out); err != nil {
+	if err := m.store.FindOne(ctx, f, fopt).Decode(&out); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return docstore.NotFound
 		}
@@ -330,7 +480,10 @@ func (m *MongoStore) FindOne(ctx context.Context, query *docstore.QueryOpt, doc
 }
 
 func (m *MongoStore) Query(ctx context.Context, query *docstore.QueryOpt) (docstore.Iterator, error) {
-	f, opt := toMongoFilter(query)
+	f, opt, err := m.findQuery(query)
+	if err != nil {
+		return nil, err
+	}
 	res, err := m.store.Find(ctx, f, opt)
 	if err != nil {
 		return nil, err
@@ -338,6 +491,64 @@ func (m *MongoStore) Query(ctx context.Context, query *docstore.QueryOpt) (docst
 	return NewMongoIterator(res), nil
 }
 
+// findQuery builds the filter and find options of query, resuming after its
+// cursor. The ID breaks ties of the sort so pages keep a stable order.
+func (m *MongoStore) findQuery(query *docstore.QueryOpt) (interface{}, *options.FindOptions, error) {
+	p := query.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	q, err := docstore.CursorQuery(query, m.idField)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, opt := toMongoFilter(q)
+	if q != nil && q.OrderBy != "" && q.OrderBy != m.idField {
+		dir := -1
+		if q.IsAscend {
+			dir = 1
+		}
+		opt.SetSort(bson.D{{Key: q.OrderBy, Value: dir}, {Key: m.idField, Value: dir}})
+	}
+	if !p.IsEmpty() {
+		opt.SetProjection(m.projection(p))
+	}
+
+	return f, opt, nil
+}
+
+// projection returns the mongo projection of p, the ID field is always kept
+// and _id is only kept when included
+func (m *MongoStore) projection(p docstore.Projection) bson.D {
+	if len(p.Fields) > 0 {
+		proj := bson.D{{Key: m.idField, Value: 1}}
+		if m.idField != "_id" {
+			proj = append(proj, bson.E{Key: "_id", Value: 0})
+		}
+		for _, f := range p.Fields {
+			if f == m.idField {
+				continue
+			}
+			if f == "_id" {
+				proj[1].Value = 1
+				continue
+			}
+			proj = append(proj, bson.E{Key: f, Value: 1})
+		}
+		return proj
+	}
+
+	proj := bson.D{}
+	for _, f := range p.Exclude {
+		if f != m.idField {
+			proj = append(proj, bson.E{Key: f, Value: 0})
+		}
+	}
+	return proj
+}
+
 func (m *MongoStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
 	ins := make([]interface{}, 0)
 	for _, doc := range docs {
@@ -375,9 +586,18 @@ func (m *MongoStore) BulkCreate(ctx context.Context, docs []interface{}, opts ..
 	return err
 }
 
-func (m *MongoStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}) error {
+func (m *MongoStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	fopt := options.Find()
+	if !p.IsEmpty() {
+		fopt.SetProjection(m.projection(p))
+	}
 
-	res, err := m.store.Find(ctx, bson.D{{Key: m.idField, Value: bson.M{"$in": ids}}})
+	res, err := m.store.Find(ctx, bson.D{{Key: m.idField, Value: bson.M{"$in": ids}}}, fopt)
 	if err != nil {
 		return err
 	}
@@ -462,6 +682,18 @@ func (m *MongoStore) Migrate(ctx context.Context, config interface{}) error {
 		})
 	}
 
+	// documents are deleted once the time of the expiry field is reached
+	if dbConf.ExpiryField != "" && !isFieldExist(dbConf.ExpiryField, dbConf.Indexes) {
+		idxs = append(idxs, map[string]map[string]interface{}{
+			"keys": {
+				dbConf.ExpiryField: IndexTypeSortOrderAscending,
+			},
+			"options": {
+				IndexOptionExpireAfterSeconds: int32(0),
+			},
+		})
+	}
+
 	if len(idxs) > 0 {
 		specs, err := m.listIndex(ctx)
 		if err != nil {
@@ -552,7 +784,21 @@ func (m *MongoStore) Ping(ctx context.Context) error {
 	return m.store.Database().Client().Ping(ctx, readpref.PrimaryPreferred())
 }
 
+// Distinct returns the distinct values of fieldName. Besides a raw mongo
+// filter, the filter can be a *docstore.QueryOpt or a docstore.FilterOpt slice.
 func (m *MongoStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	switch v := filter.(type) {
+	case nil:
+		filter = bson.D{}
+	case *docstore.QueryOpt:
+		filter, _ = toMongoFilter(v)
+	case docstore.QueryOpt:
+		filter, _ = toMongoFilter(&v)
+	case []docstore.FilterOpt:
+		filter, _ = toMongoFilter(&docstore.QueryOpt{Filter: v})
+	case docstore.FilterOpt:
+		filter, _ = toMongoFilter(&docstore.QueryOpt{Filter: []docstore.FilterOpt{v}})
+	}
 	return m.store.Distinct(ctx, fieldName, filter)
 }
 
@@ -612,6 +858,48 @@ func (m *MongoStore) Pull(ctx context.Context, condition, removeCondition docsto
 	return err
 }
 
+// RunInTransaction runs fn in a multi-document transaction bound to a
+// client session. Transactions require a replica set or sharded cluster,
+// and fn may be called more than once when the transaction is retried.
+func (m *MongoStore) RunInTransaction(ctx context.Context, fn func(tx docstore.Tx) error) error {
+	sess, err := m.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(&mongoTx{store: m, sess: sctx})
+	})
+
+	return err
+}
+
+type mongoTx struct {
+	store *MongoStore
+	sess  mongo.Session
+}
+
+func (t *mongoTx) context(ctx context.Context) context.Context {
+	return mongo.NewSessionContext(ctx, t.sess)
+}
+
+func (t *mongoTx) Create(ctx context.Context, doc interface{}) error {
+	return t.store.Create(t.context(ctx), doc)
+}
+
+func (t *mongoTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	return t.store.Update(t.context(ctx), id, doc, replace)
+}
+
+func (t *mongoTx) Delete(ctx context.Context, id interface{}) error {
+	return t.store.Delete(t.context(ctx), id)
+}
+
+func (t *mongoTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	return t.store.Get(t.context(ctx), id, doc)
+}
+
 func convertTime(obj map[string]interface{}) {
 	for k, v := range obj {
 		if reflect.TypeOf(v) == reflect.TypeOf(time.Time{}) {
@@ -620,6 +908,312 @@ func convertTime(obj map[string]interface{}) {
 	}
 }
 
+// Aggregate runs agg as an aggregation pipeline
+func (m *MongoStore) Aggregate(ctx context.Context, agg *docstore.AggregateOpt, docs interface{}) error {
+	if err := agg.Validate(); err != nil {
+		return err
+	}
+
+	res, err := m.store.Aggregate(ctx, toMongoPipeline(agg))
+	if err != nil {
+		return err
+	}
+
+	var out []map[string]interface{}
+	if err := res.All(ctx, &out); err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+// BulkWrite runs the writes with a mongo bulk write. Mongo only counts the
+// updates matching nothing, so the missing documents of the updates are
+// looked up once the bulk write is done.
+func (m *MongoStore) BulkWrite(ctx context.Context, ops []docstore.WriteOp, opts ...interface{}) ([]docstore.WriteResult, error) {
+	opt := docstore.GetBulkWriteOpt(opts...)
+	results := make([]docstore.WriteResult, len(ops))
+	models := make([]mongo.WriteModel, 0, len(ops))
+	// index is the op of every model
+	index := make([]int, 0, len(ops))
+
+	failed := false
+	for i, op := range ops {
+		results[i] = docstore.WriteResult{ID: op.ID, Op: op.Op, Status: docstore.WriteSkipped}
+		if failed && opt.Ordered {
+			continue
+		}
+
+		model, err := m.writeModel(&results[i], op)
+		if err != nil {
+			results[i].Status = docstore.WriteFailed
+			results[i].Error = err
+			failed = true
+			continue
+		}
+
+		models = append(models, model)
+		index = append(index, i)
+	}
+
+	// creates of existing documents fail like Create, the ID field may have
+	// no unique index
+	models, index, err := m.dropExisting(ctx, results, models, index, opt.Ordered)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(models) == 0 {
+		return results, docstore.PartialWriteError(results)
+	}
+
+	res, err := m.store.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(opt.Ordered))
+	var bwe mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bwe) {
+		return nil, err
+	}
+
+	for _, i := range index {
+		results[i].Status = docstore.WriteOK
+	}
+
+	for _, we := range bwe.WriteErrors {
+		i := index[we.Index]
+		results[i].Status = docstore.WriteFailed
+		results[i].Error = errors.New(we.Message)
+
+		if opt.Ordered {
+			// mongo stops at the first error of an ordered write
+			for _, next := range index[we.Index+1:] {
+				results[next].Status = docstore.WriteSkipped
+			}
+		}
+	}
+
+	if res != nil {
+		if err := m.missingUpdates(ctx, results, res.MatchedCount); err != nil {
+			return results, err
+		}
+	}
+
+	if bwe.WriteConcernError != nil {
+		return results, err
+	}
+
+	return results, docstore.PartialWriteError(results)
+}
+
+// writeModel returns the model of op and sets the ID of its result
+func (m *MongoStore) writeModel(res *docstore.WriteResult, op docstore.WriteOp) (mongo.WriteModel, error) {
+	if op.Op == docstore.WriteDelete {
+		return mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: m.idField, Value: op.ID}}), nil
+	}
+
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(op.Doc, &d); err != nil {
+		return nil, err
+	}
+	convertTime(d)
+
+	if op.Op == docstore.WriteCreate {
+		id, ok := d[m.idField]
+		if !ok {
+			return nil, errors.New("[docstore/mongo] missing document ID")
+		}
+		res.ID = id
+		return mongo.NewInsertOneModel().SetDocument(d), nil
+	}
+
+	filter := bson.D{{Key: m.idField, Value: op.ID}}
+	switch op.Op {
+	case docstore.WriteReplace:
+		return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(d), nil
+	case docstore.WriteUpdate, docstore.WriteUpsert:
+		fields := bson.D{}
+		for k, v := range d {
+			fields = append(fields, bson.E{Key: k, Value: v})
+		}
+		return mongo.NewUpdateOneModel().SetFilter(filter).
+			SetUpdate(bson.D{{Key: "$set", Value: fields}}).
+			SetUpsert(op.Op == docstore.WriteUpsert), nil
+	}
+
+	return nil, fmt.Errorf("[docstore/mongo] unknown write operation %s", op.Op)
+}
+
+// dropExisting fails the creates of existing documents and returns the models
+// left to write, an ordered write stops at the first of them
+func (m *MongoStore) dropExisting(ctx context.Context, results []docstore.WriteResult, models []mongo.WriteModel, index []int, ordered bool) ([]mongo.WriteModel, []int, error) {
+	ids := make([]interface{}, 0)
+	for _, i := range index {
+		if results[i].Op == docstore.WriteCreate {
+			ids = append(ids, results[i].ID)
+		}
+	}
+
+	exist, err := m.existing(ctx, ids)
+	if err != nil || len(exist) == 0 {
+		return models, index, err
+	}
+
+	keptModels := make([]mongo.WriteModel, 0, len(models))
+	keptIndex := make([]int, 0, len(index))
+	for j, i := range index {
+		if results[i].Op == docstore.WriteCreate {
+			if _, ok := exist[fmt.Sprintf("%v", results[i].ID)]; ok {
+				results[i].Status = docstore.WriteFailed
+				results[i].Error = errors.New("[docstore/mongo] document already exist")
+				if ordered {
+					break
+				}
+				continue
+			}
+		}
+		keptModels = append(keptModels, models[j])
+		keptIndex = append(keptIndex, i)
+	}
+
+	return keptModels, keptIndex, nil
+}
+
+// existing returns the IDs of ids found, keyed by their %v format
+func (m *MongoStore) existing(ctx context.Context, ids []interface{}) (map[string]struct{}, error) {
+	exist := make(map[string]struct{})
+	if len(ids) == 0 {
+		return exist, nil
+	}
+
+	cur, err := m.store.Find(ctx, bson.D{{Key: m.idField, Value: bson.D{{Key: "$in", Value: ids}}}},
+		options.Find().SetProjection(bson.D{{Key: m.idField, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var found []map[string]interface{}
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	for _, d := range found {
+		exist[fmt.Sprintf("%v", d[m.idField])] = struct{}{}
+	}
+	return exist, nil
+}
+
+// missingUpdates fails the written updates and replaces of missing documents,
+// matched is the number of documents they matched
+func (m *MongoStore) missingUpdates(ctx context.Context, results []docstore.WriteResult, matched int64) error {
+	ids := make([]interface{}, 0)
+	for _, r := range results {
+		if r.Status == docstore.WriteOK && (r.Op == docstore.WriteUpdate || r.Op == docstore.WriteReplace) {
+			ids = append(ids, r.ID)
+		}
+	}
+
+	if int64(len(ids)) <= matched {
+		return nil
+	}
+
+	exist, err := m.existing(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		if r.Status != docstore.WriteOK || (r.Op != docstore.WriteUpdate && r.Op != docstore.WriteReplace) {
+			continue
+		}
+		if _, ok := exist[fmt.Sprintf("%v", r.ID)]; !ok {
+			results[i].Status = docstore.WriteFailed
+			results[i].Error = docstore.NotFound
+		}
+	}
+
+	return nil
+}
+
+// Watch streams the changes of the documents matching the query filter with a
+// change stream, which needs a replica set. Before is only set on MongoDB 6.0+
+// collections with changeStreamPreAndPostImages enabled, so deletes are only
+// matched against the filter when the pre-image is available.
+func (m *MongoStore) Watch(ctx context.Context, query *docstore.QueryOpt) (docstore.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{
+		{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"}},
+	}}}}}}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	cs, err := m.store.Watch(ctx, pipeline, opts, options.ChangeStream().SetFullDocumentBeforeChange(options.WhenAvailable))
+	if err != nil {
+		// servers before 6.0 do not know pre-images
+		cs, err = m.store.Watch(ctx, pipeline, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var filters []docstore.FilterOpt
+	if query != nil {
+		filters = query.Filter
+	}
+
+	return &MongoChangeStream{stream: cs, idField: m.idField, filters: filters}, nil
+}
+
+type mongoChange struct {
+	OperationType            string                 `bson:"operationType"`
+	DocumentKey              map[string]interface{} `bson:"documentKey"`
+	FullDocument             map[string]interface{} `bson:"fullDocument"`
+	FullDocumentBeforeChange map[string]interface{} `bson:"fullDocumentBeforeChange"`
+}
+
+type MongoChangeStream struct {
+	stream  *mongo.ChangeStream
+	idField string
+	filters []docstore.FilterOpt
+}
+
+func (s *MongoChangeStream) Next(ctx context.Context, event *docstore.ChangeEvent) error {
+	for s.stream.Next(ctx) {
+		var c mongoChange
+		if err := s.stream.Decode(&c); err != nil {
+			return err
+		}
+
+		ev := docstore.ChangeEvent{Type: docstore.ChangeUpdate, Before: c.FullDocumentBeforeChange, After: c.FullDocument}
+		switch c.OperationType {
+		case "insert":
+			ev.Type = docstore.ChangeInsert
+			ev.Before = nil
+		case "delete":
+			ev.Type = docstore.ChangeDelete
+			ev.After = nil
+		}
+
+		if id, ok := ev.After[s.idField]; ok {
+			ev.ID = id
+		} else if id, ok := ev.Before[s.idField]; ok {
+			ev.ID = id
+		} else {
+			ev.ID = c.DocumentKey["_id"]
+		}
+
+		if docstore.MatchChange(&ev, s.filters) {
+			*event = ev
+			return nil
+		}
+	}
+
+	if err := s.stream.Err(); err != nil {
+		return err
+	}
+
+	return docstore.EndOfDoc
+}
+
+func (s *MongoChangeStream) Close(ctx context.Context) error {
+	return s.stream.Close(ctx)
+}
+
 type MongoIterator struct {
 	cursor *mongo.Cursor
 }
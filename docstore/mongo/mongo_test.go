@@ -107,15 +107,38 @@ func TestIndexCreation(t *testing.T) {
 	}
 }
 
+func TestExpiryIndex(t *testing.T) {
+	ctx := context.Background()
+	db := initDriver(t)
+	ms, err := NewMongostore(db, "session", "id")
+	require.Nil(t, err)
+
+	require.Nil(t, ms.Migrate(ctx, &docstore.Config{IDField: "id", ExpiryField: "expires_at"}))
+	idxs, err := ms.listIndex(ctx)
+	require.NoError(t, err)
+
+	var ttl *mongo.IndexSpecification
+	for _, idx := range idxs {
+		if idx.Name == "expires_at_1" {
+			ttl = idx
+		}
+	}
+	require.NotNil(t, ttl)
+	require.NotNil(t, ttl.ExpireAfterSeconds)
+	assert.Equal(t, int32(0), *ttl.ExpireAfterSeconds)
+}
+
+// the conformance suite runs transactions, MONGO_URI needs to point to a replica set
 func TestMongoStore(t *testing.T) {
 	db := initDriver(t)
 
 	ms, err := NewMongostore(db, "docstore", "id")
+	require.Nil(t, err)
 	ms.Migrate(context.Background(), nil)
-
+	_, err = ms.store.DeleteMany(context.Background(), bson.D{})
 	require.Nil(t, err)
-	docstore.DriverCRUDTest(ms, t)
-	docstore.DriverBulkTest(ms, t)
+
+	docstore.DriverConformanceTest(ms, t)
 }
 
 func TestDocstore(t *testing.T) {
@@ -140,6 +163,7 @@ func TestDocstore(t *testing.T) {
 	cs.Migrate(context.Background(), nil)
 
 	docstore.DocstoreTestCRUD(cs, t)
+	docstore.DocstoreTestTenant(cs, t)
 }
 
 func TestMongoStore_Ping(t *testing.T) {
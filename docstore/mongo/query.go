@@ -2,10 +2,10 @@ package mongo
 
 import (
 	"fmt"
-	"regexp"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/bondhan/golib/constant"
@@ -21,15 +21,7 @@ func toMongoFilter(q *docstore.QueryOpt) (interface{}, *options.FindOptions) {
 	}
 
 	for _, s := range q.Filter {
-		if s.Ops == constant.OR {
-			if fArr, ok := s.Value.([]docstore.FilterOpt); ok {
-				a := toMongoA(fArr)
-				d = append(d, bson.E{Key: "$or", Value: a})
-			}
-			continue
-		}
-
-		d = append(d, bson.E{Key: s.Field, Value: toMongoD(s)})
+		d = append(d, toMongoFilterE(s))
 	}
 
 	if q.Page > 0 && q.Limit > 0 {
@@ -50,6 +42,26 @@ func toMongoFilter(q *docstore.QueryOpt) (interface{}, *options.FindOptions) {
 	return d, opt
 }
 
+func toMongoFilterE(f docstore.FilterOpt) bson.E {
+	switch f.Ops {
+	case constant.OR:
+		fArr, _ := f.Value.([]docstore.FilterOpt)
+		return bson.E{Key: "$or", Value: toMongoA(fArr)}
+	case constant.AND:
+		fArr, _ := f.Value.([]docstore.FilterOpt)
+		a := bson.A{}
+		for _, v := range fArr {
+			a = append(a, bson.D{toMongoFilterE(v)})
+		}
+		return bson.E{Key: "$and", Value: a}
+	case constant.TXT:
+		// $text searches the text index of the collection, whatever the field
+		return bson.E{Key: "$text", Value: bson.D{{Key: "$search", Value: fmt.Sprintf("%v", f.Value)}}}
+	default:
+		return bson.E{Key: f.Field, Value: toMongoD(f)}
+	}
+}
+
 func toMongoA(f []docstore.FilterOpt) bson.A {
 	a := bson.A{}
 
@@ -61,7 +73,7 @@ func toMongoA(f []docstore.FilterOpt) bson.A {
 				continue
 			}
 			for i := range af {
-				d = append(d, primitive.E{af[i].Field, toMongoD(af[i])})
+				d = append(d, primitive.E{Key: af[i].Field, Value: toMongoD(af[i])})
 			}
 		} else {
 			d = bson.D{
@@ -122,10 +134,12 @@ func toMongoD(f docstore.FilterOpt) bson.D {
 		return bson.D{{
 			Key: "$regex",
 			Value: primitive.Regex{
-				Pattern: regexp.QuoteMeta(fmt.Sprintf("%v", f.Value)),
+				Pattern: docstore.PatternRegexp(f.Value),
 				Options: "i",
 			}},
 		}
+	case constant.NEAR, constant.WR, constant.WP:
+		return toGeoFilter(f)
 	default:
 		return nil
 	}
@@ -153,3 +167,217 @@ func toElemFilter(val interface{}) bson.D {
 	}
 	return out
 }
+
+// toGeoFilter translates the geo filters, NEAR needs a 2dsphere index on the
+// field
+func toGeoFilter(f docstore.FilterOpt) bson.D {
+	if r, ok := docstore.GeoRadiusOf(f.Value); ok {
+		if f.Ops == constant.WR {
+			return withinRadius(r.Center, r.MaxDistance)
+		}
+		near := bson.D{{Key: "$geometry", Value: geoJSONPoint(r.Center)}}
+		if r.MaxDistance > 0 {
+			near = append(near, bson.E{Key: "$maxDistance", Value: r.MaxDistance})
+		}
+		if r.MinDistance > 0 {
+			near = append(near, bson.E{Key: "$minDistance", Value: r.MinDistance})
+		}
+		return bson.D{{Key: "$near", Value: near}}
+	}
+
+	var points []docstore.GeoPoint
+	switch v := f.Value.(type) {
+	case docstore.GeoPolygon:
+		points = v
+	case []docstore.GeoPoint:
+		points = v
+	default:
+		return nil
+	}
+
+	ring := bson.A{}
+	for _, p := range points {
+		ring = append(ring, bson.A{p.Lng, p.Lat})
+	}
+	if len(points) > 0 && points[0] != points[len(points)-1] {
+		ring = append(ring, bson.A{points[0].Lng, points[0].Lat})
+	}
+	return bson.D{{Key: "$geoWithin", Value: bson.D{{
+		Key:   "$geometry",
+		Value: bson.D{{Key: "type", Value: "Polygon"}, {Key: "coordinates", Value: bson.A{ring}}},
+	}}}}
+}
+
+func withinRadius(center docstore.GeoPoint, meters float64) bson.D {
+	return bson.D{{Key: "$geoWithin", Value: bson.D{{
+		Key:   "$centerSphere",
+		Value: bson.A{bson.A{center.Lng, center.Lat}, meters / docstore.EarthRadius},
+	}}}}
+}
+
+func geoJSONPoint(p docstore.GeoPoint) bson.D {
+	return bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{p.Lng, p.Lat}}}
+}
+
+// toMongoCountFilter is the filter of query for counts and $match stages,
+// which do not accept $near, so NEAR filters match the ring between their
+// distances
+func toMongoCountFilter(q *docstore.QueryOpt) bson.D {
+	d := bson.D{}
+	if q == nil {
+		return d
+	}
+
+	for _, f := range q.Filter {
+		r, ok := docstore.GeoRadiusOf(f.Value)
+		if f.Ops != constant.NEAR || !ok {
+			d = append(d, toMongoFilterE(f))
+			continue
+		}
+
+		if r.MaxDistance > 0 {
+			d = append(d, bson.E{Key: f.Field, Value: withinRadius(r.Center, r.MaxDistance)})
+		} else {
+			d = append(d, bson.E{Key: f.Field, Value: bson.D{{Key: "$exists", Value: true}}})
+		}
+		if r.MinDistance > 0 {
+			d = append(d, bson.E{Key: "$nor", Value: bson.A{
+				bson.D{{Key: f.Field, Value: withinRadius(r.Center, r.MinDistance)}},
+			}})
+		}
+	}
+	return d
+}
+
+// mongoUpdateOps maps the field update operations to the mongo operators
+var mongoUpdateOps = map[string]string{
+	"":                         "$set",
+	docstore.UpdateSet:         "$set",
+	docstore.UpdateUnset:       "$unset",
+	docstore.UpdateSetOnInsert: "$setOnInsert",
+	docstore.UpdateInc:         "$inc",
+	docstore.UpdateMul:         "$mul",
+	docstore.UpdateMin:         "$min",
+	docstore.UpdateMax:         "$max",
+	docstore.UpdatePush:        "$push",
+	docstore.UpdateAddToSet:    "$addToSet",
+	docstore.UpdatePull:        "$pull",
+	docstore.UpdatePop:         "$pop",
+}
+
+// toMongoUpdate translates field updates into an update document, leaving
+// out the field skip
+func toMongoUpdate(fields []docstore.Field, skip string) (bson.D, error) {
+	update := bson.D{}
+	for _, f := range fields {
+		if skip != "" && f.Name == skip {
+			continue
+		}
+
+		op, ok := mongoUpdateOps[f.Op]
+		if !ok {
+			return nil, fmt.Errorf("[docstore/mongo] unknown update operation %s", f.Op)
+		}
+
+		value := f.Value
+		switch f.Op {
+		case docstore.UpdateUnset:
+			value = ""
+		case docstore.UpdatePush, docstore.UpdateAddToSet:
+			if each, ok := f.Value.(docstore.Each); ok {
+				value = bson.D{{Key: "$each", Value: bson.A(each)}}
+			}
+		case docstore.UpdatePull:
+			value = toPullCondition(f.Value)
+		}
+
+		update = appendUpdate(update, op, bson.E{Key: f.Name, Value: value})
+	}
+	return update, nil
+}
+
+// appendUpdate adds e to the fields of the operator op of update
+func appendUpdate(update bson.D, op string, e bson.E) bson.D {
+	for i := range update {
+		if update[i].Key == op {
+			update[i].Value = append(update[i].Value.(bson.D), e)
+			return update
+		}
+	}
+	return append(update, bson.E{Key: op, Value: bson.D{e}})
+}
+
+// toPullCondition translates the filters of a pull, filters without field
+// apply to the elements themselves
+func toPullCondition(val interface{}) interface{} {
+	var filters []docstore.FilterOpt
+	switch v := val.(type) {
+	case docstore.FilterOpt:
+		filters = []docstore.FilterOpt{v}
+	case []docstore.FilterOpt:
+		filters = v
+	default:
+		return val
+	}
+
+	d := bson.D{}
+	for _, f := range filters {
+		if f.Field == "" {
+			d = append(d, toMongoD(f)...)
+			continue
+		}
+		d = append(d, toMongoFilterE(f))
+	}
+	return d
+}
+
+// toMongoPipeline translates agg into $match, $group, $sort, $project and a
+// $match on the rows for the having filters. Group fields and accumulators are
+// renamed inside $group since it does not accept dotted names.
+func toMongoPipeline(agg *docstore.AggregateOpt) mongo.Pipeline {
+	pipeline := mongo.Pipeline{}
+
+	if len(agg.Filter) > 0 {
+		f := toMongoCountFilter(&docstore.QueryOpt{Filter: agg.Filter})
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: f}})
+	}
+
+	var id interface{}
+	project := bson.D{{Key: "_id", Value: 0}}
+	if len(agg.GroupBy) > 0 {
+		keys := bson.D{}
+		for i, g := range agg.GroupBy {
+			k := fmt.Sprintf("g%d", i)
+			keys = append(keys, bson.E{Key: k, Value: "$" + g})
+			project = append(project, bson.E{Key: g, Value: "$_id." + k})
+		}
+		id = keys
+	}
+
+	group := bson.D{{Key: "_id", Value: id}}
+	for i, acc := range agg.Accumulators {
+		k := fmt.Sprintf("a%d", i)
+		var expr bson.D
+		switch acc.Op {
+		case docstore.AggCount:
+			expr = bson.D{{Key: "$sum", Value: 1}}
+		default:
+			expr = bson.D{{Key: "$" + acc.Op, Value: "$" + acc.Field}}
+		}
+		group = append(group, bson.E{Key: k, Value: expr})
+		project = append(project, bson.E{Key: acc.Name, Value: "$" + k})
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$project", Value: project}},
+	)
+
+	if len(agg.Having) > 0 {
+		f, _ := toMongoFilter(&docstore.QueryOpt{Filter: agg.Having})
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: f}})
+	}
+
+	return pipeline
+}
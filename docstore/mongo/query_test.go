@@ -4,11 +4,14 @@ import (
 	"context"
 	"os"
 	"reflect"
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/bondhan/golib/client"
 	"github.com/bondhan/golib/constant"
@@ -103,3 +106,113 @@ func TestElemMatch(t *testing.T) {
 
 	db.Collection("test").DeleteMany(ctx, bson.D{})
 }
+
+func Test_toMongoPipeline(t *testing.T) {
+	agg := &docstore.AggregateOpt{
+		Filter:  []docstore.FilterOpt{{Field: "status", Ops: constant.EQ, Value: "paid"}},
+		GroupBy: []string{"address.city"},
+		Accumulators: []docstore.Accumulator{
+			{Name: "orders", Op: docstore.AggCount},
+			{Name: "revenue", Op: docstore.AggSum, Field: "total"},
+		},
+		Having: []docstore.FilterOpt{{Field: "orders", Ops: constant.GE, Value: 10}},
+	}
+
+	want := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "status", Value: bson.D{{Key: "$eq", Value: "paid"}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "g0", Value: "$address.city"}}},
+			{Key: "a0", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "a1", Value: bson.D{{Key: "$sum", Value: "$total"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "address.city", Value: "$_id.g0"},
+			{Key: "orders", Value: "$a0"},
+			{Key: "revenue", Value: "$a1"},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "orders", Value: bson.D{{Key: "$gte", Value: 10}}}}}},
+	}
+
+	assert.Equal(t, want, toMongoPipeline(agg))
+}
+
+func Test_toGeoFilter(t *testing.T) {
+	center := docstore.GeoPoint{Lng: 106.8, Lat: -6.2}
+	point := bson.D{{Key: "type", Value: "Point"}, {Key: "coordinates", Value: bson.A{106.8, -6.2}}}
+	q := &docstore.QueryOpt{Filter: []docstore.FilterOpt{
+		{Field: "location", Ops: constant.NEAR, Value: docstore.GeoRadius{Center: center, MaxDistance: 5000, MinDistance: 100}},
+		{Field: "area", Ops: constant.WP, Value: docstore.GeoPolygon{{Lng: 0, Lat: 0}, {Lng: 1, Lat: 0}, {Lng: 1, Lat: 1}}},
+		{Ops: constant.TXT, Value: "kopi susu"},
+	}}
+
+	f, _ := toMongoFilter(q)
+	assert.Equal(t, bson.D{
+		{Key: "location", Value: bson.D{{Key: "$near", Value: bson.D{
+			{Key: "$geometry", Value: point},
+			{Key: "$maxDistance", Value: 5000.0},
+			{Key: "$minDistance", Value: 100.0},
+		}}}},
+		{Key: "area", Value: bson.D{{Key: "$geoWithin", Value: bson.D{{Key: "$geometry", Value: bson.D{
+			{Key: "type", Value: "Polygon"},
+			{Key: "coordinates", Value: bson.A{bson.A{bson.A{0.0, 0.0}, bson.A{1.0, 0.0}, bson.A{1.0, 1.0}, bson.A{0.0, 0.0}}}},
+		}}}}}},
+		{Key: "$text", Value: bson.D{{Key: "$search", Value: "kopi susu"}}},
+	}, f)
+
+	within := func(m float64) bson.D {
+		return bson.D{{Key: "$geoWithin", Value: bson.D{{
+			Key:   "$centerSphere",
+			Value: bson.A{bson.A{106.8, -6.2}, m / docstore.EarthRadius},
+		}}}}
+	}
+	count := toMongoCountFilter(&docstore.QueryOpt{Filter: q.Filter[:1]})
+	assert.Equal(t, bson.D{
+		{Key: "location", Value: within(5000)},
+		{Key: "$nor", Value: bson.A{bson.D{{Key: "location", Value: within(100)}}}},
+	}, count)
+}
+
+func Test_toMongoRegex(t *testing.T) {
+	regex := func(pattern string) bson.E {
+		return bson.E{Key: "name", Value: bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: pattern, Options: "i"}}}}
+	}
+	assert.Equal(t, regex(`a\.b`), toMongoFilterE(docstore.FilterOpt{Field: "name", Ops: constant.RE, Value: "a.b"}))
+	assert.Equal(t, regex(`^sa`), toMongoFilterE(docstore.FilterOpt{Field: "name", Ops: constant.RE, Value: "^sa"}))
+	assert.Equal(t, regex(`^a\$b$`), toMongoFilterE(docstore.FilterOpt{Field: "name", Ops: constant.RE, Value: "^a$b$"}))
+
+	// unanchored patterns keep matching a quoted substring, as before anchors
+	for _, v := range []string{"sa", "a.b", "kopi (susu)+", "a^b", "x$y", "50%"} {
+		assert.Equal(t, regex(regexp.QuoteMeta(v)), toMongoFilterE(docstore.FilterOpt{Field: "name", Ops: constant.RE, Value: v}), v)
+	}
+	assert.True(t, regexp.MustCompile("(?i)"+docstore.PatternRegexp("a.b")).MatchString("xx A.B yy"))
+	assert.False(t, regexp.MustCompile("(?i)"+docstore.PatternRegexp("a.b")).MatchString("axb"))
+}
+
+func Test_toMongoUpdate(t *testing.T) {
+	update, err := toMongoUpdate([]docstore.Field{
+		{Name: "name", Value: "kopi"},
+		{Name: "tags", Op: docstore.UpdateAddToSet, Value: docstore.Each{"a", "b"}},
+		{Name: "variants", Op: docstore.UpdatePull, Value: docstore.FilterOpt{Field: "qty", Ops: constant.LT, Value: 1}},
+		{Name: "scores", Op: docstore.UpdatePull, Value: []docstore.FilterOpt{{Ops: constant.GE, Value: 6}}},
+		{Name: "meta.origin", Op: docstore.UpdateUnset},
+		{Name: "version", Value: 3},
+		{Name: "created_at", Op: docstore.UpdateSetOnInsert, Value: 1},
+	}, "version")
+	require.Nil(t, err)
+
+	assert.Equal(t, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "name", Value: "kopi"}}},
+		{Key: "$addToSet", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "$each", Value: bson.A{"a", "b"}}}}}},
+		{Key: "$pull", Value: bson.D{
+			{Key: "variants", Value: bson.D{{Key: "qty", Value: bson.D{{Key: "$lt", Value: 1}}}}},
+			{Key: "scores", Value: bson.D{{Key: "$gte", Value: 6}}},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "meta.origin", Value: ""}}},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "created_at", Value: 1}}},
+	}, update)
+
+	_, err = toMongoUpdate([]docstore.Field{{Name: "name", Op: "rename"}}, "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,263 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/bondhan/golib/util"
+)
+
+// Projection selects the fields of the documents read. Fields keeps the
+// listed fields and Exclude drops them, they can not be used together. Paths
+// are dotted and go through arrays of documents like mongo projections, the
+// ID field is always kept.
+type Projection struct {
+	Fields  []string `json:"fields,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Projection returns the projection of the query
+func (q *QueryOpt) Projection() Projection {
+	if q == nil {
+		return Projection{}
+	}
+	return Projection{Fields: q.Fields, Exclude: q.Exclude}
+}
+
+// IsEmpty reports whether the projection keeps whole documents
+func (p Projection) IsEmpty() bool {
+	return len(p.Fields) == 0 && len(p.Exclude) == 0
+}
+
+func (p Projection) Validate() error {
+	if len(p.Fields) > 0 && len(p.Exclude) > 0 {
+		return errors.New("[docstore] projection can not both include and exclude fields")
+	}
+	for _, f := range append(append([]string{}, p.Fields...), p.Exclude...) {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") || strings.Contains(f, "..") {
+			return errors.New("[docstore] invalid projection field " + f)
+		}
+	}
+	return nil
+}
+
+// GetProjection returns the projection passed in the options of Get and
+// BulkGet, as a Projection or *Projection
+func GetProjection(opts ...interface{}) Projection {
+	for _, o := range opts {
+		if v, ok := o.(*Projection); ok && v != nil {
+			return *v
+		}
+		if v, ok := o.(Projection); ok {
+			return v
+		}
+	}
+	return Projection{}
+}
+
+// pathTree holds projection paths by their parts, a nil subtree selects the
+// whole value
+type pathTree map[string]pathTree
+
+func newPathTree(paths []string) pathTree {
+	root := pathTree{}
+	for _, p := range paths {
+		cur := root
+		parts := strings.Split(p, ".")
+		for i, part := range parts {
+			sub, ok := cur[part]
+			if ok && sub == nil {
+				// a parent path already selects the whole value
+				break
+			}
+			if i == len(parts)-1 {
+				cur[part] = nil
+				break
+			}
+			if !ok {
+				sub = pathTree{}
+				cur[part] = sub
+			}
+			cur = sub
+		}
+	}
+	return root
+}
+
+// ProjectDoc returns the projection of doc, doc is left unchanged
+func ProjectDoc(doc map[string]interface{}, p Projection, idField string) map[string]interface{} {
+	if doc == nil || p.IsEmpty() {
+		return doc
+	}
+
+	if len(p.Fields) > 0 {
+		out := includeFields(doc, newPathTree(p.Fields))
+		if id, ok := doc[idField]; ok {
+			out[idField] = id
+		}
+		return out
+	}
+
+	exclude := make([]string, 0, len(p.Exclude))
+	for _, f := range p.Exclude {
+		if f != idField {
+			exclude = append(exclude, f)
+		}
+	}
+	return excludeFields(doc, newPathTree(exclude))
+}
+
+func includeFields(doc map[string]interface{}, tree pathTree) map[string]interface{} {
+	out := make(map[string]interface{}, len(tree))
+	for k, sub := range tree {
+		v, ok := doc[k]
+		if !ok {
+			continue
+		}
+		if sub == nil {
+			out[k] = v
+			continue
+		}
+		if pv, ok := includeValue(v, sub); ok {
+			out[k] = pv
+		}
+	}
+	return out
+}
+
+// includeValue projects the documents of v, other values have none of the
+// sub fields
+func includeValue(v interface{}, tree pathTree) (interface{}, bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return includeFields(x, tree), true
+	case []interface{}:
+		out := make([]interface{}, 0, len(x))
+		for _, e := range x {
+			if pe, ok := includeValue(e, tree); ok {
+				out = append(out, pe)
+			}
+		}
+		return out, true
+	case []map[string]interface{}:
+		out := make([]interface{}, 0, len(x))
+		for _, e := range x {
+			out = append(out, includeFields(e, tree))
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func excludeFields(doc map[string]interface{}, tree pathTree) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		sub, ok := tree[k]
+		if !ok {
+			out[k] = v
+			continue
+		}
+		if sub != nil {
+			out[k] = excludeValue(v, sub)
+		}
+	}
+	return out
+}
+
+func excludeValue(v interface{}, tree pathTree) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return excludeFields(x, tree)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = excludeValue(e, tree)
+		}
+		return out
+	case []map[string]interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = excludeFields(e, tree)
+		}
+		return out
+	}
+	return v
+}
+
+func projectDocs(docs []map[string]interface{}, p Projection, idField string) []map[string]interface{} {
+	if p.IsEmpty() {
+		return docs
+	}
+
+	out := make([]map[string]interface{}, len(docs))
+	for i, d := range docs {
+		out[i] = ProjectDoc(d, p, idField)
+	}
+	return out
+}
+
+// wholeDocs returns query without its projection
+func wholeDocs(query *QueryOpt) *QueryOpt {
+	if query == nil || query.Projection().IsEmpty() {
+		return query
+	}
+
+	q := *query
+	q.Fields = nil
+	q.Exclude = nil
+	return &q
+}
+
+// keepField returns the projection fields keeping field
+func keepField(fields, exclude []string, field string) ([]string, []string) {
+	if len(fields) > 0 {
+		for _, f := range fields {
+			if f == field {
+				return fields, exclude
+			}
+		}
+		return append(append(make([]string, 0, len(fields)+1), fields...), field), exclude
+	}
+
+	kept := make([]string, 0, len(exclude))
+	for _, f := range exclude {
+		if f != field {
+			kept = append(kept, f)
+		}
+	}
+	return fields, kept
+}
+
+// getProjected reads the fields of p of the document of id, from its cached
+// copy when there is one. Projected documents are never cached, so the cache
+// only holds whole documents.
+func (s *CachedStore) getProjected(ctx context.Context, id, doc interface{}, p Projection) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	key, err := s.cacheKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.CacheExpiration != 1 && s.cache.Exist(ctx, key) {
+		d := make(map[string]interface{})
+		if err := s.cache.Get(ctx, key, &d); err == nil {
+			if err := s.decryptDoc(d); err == nil {
+				return util.DecodeJSON(ProjectDoc(d, p, s.IDField), doc)
+			}
+		}
+	}
+
+	if !s.mapped() {
+		return s.storage.Get(ctx, id, doc, &p)
+	}
+
+	d, err := s.getMap(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(ProjectDoc(d, p, s.IDField), doc)
+}
@@ -17,6 +17,13 @@ type QueryOpt struct {
 	OrderBy  string      `json:"order_by"`
 	IsAscend bool        `json:"is_ascend"`
 	Filter   []FilterOpt `json:"filter"`
+	// Cursor is a continuation token returned by CachedStore.FindPage, the
+	// query resumes after the document it points to and ignores Skip and Page
+	Cursor string `json:"cursor,omitempty"`
+	// Fields and Exclude select the fields of the documents found, see
+	// Projection
+	Fields  []string `json:"fields,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
 }
 
 func (q *QueryOpt) AddFilter(filter FilterOpt) *QueryOpt {
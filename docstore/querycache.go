@@ -0,0 +1,257 @@
+package docstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/bondhan/golib/log"
+	"github.com/bondhan/golib/util"
+)
+
+const (
+	queryCachePrefix = "query:"
+	queryTagPrefix   = "qtag:"
+)
+
+// queryEntry is a cached query result, it is valid while the write tag still
+// holds the token read before the query ran. Entries are stored as JSON
+// strings so every cache driver keeps them the same way.
+type queryEntry struct {
+	Written string          `json:"written"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// cachingQuery reports whether Find, FindOne, IsExists and Distinct results
+// are cached. A result is invalidated by every write of the collection, as
+// an update of any document may move it in or out of the result.
+func (s *CachedStore) cachingQuery() bool {
+	return s.QueryCache && s.CacheExpiration != 1
+}
+
+func (s *CachedStore) queryKey(ctx context.Context, op, hash string) (string, error) {
+	return s.tenantKey(ctx, queryCachePrefix+s.Collection+":"+op+":"+hash)
+}
+
+// writeTag changes on every write of the collection
+func (s *CachedStore) writeTag() string {
+	return queryTagPrefix + s.Collection + ":writes"
+}
+
+func (s *CachedStore) tagToken(ctx context.Context, tag string) string {
+	token, err := s.cache.GetString(ctx, tag)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// invalidate changes the write tag so the cached query entries are dropped
+func (s *CachedStore) invalidate(ctx context.Context, op string) {
+	if !s.cachingQuery() {
+		return
+	}
+
+	token := strconv.FormatInt(util.GenerateRandUID(), 36)
+	// the tag outlives the entries cached before it, an expired tag is read
+	// as empty and must not validate an older entry
+	if err := s.cache.Set(ctx, s.writeTag(), token, s.CacheExpiration); err != nil {
+		log.GetLogger(ctx, "docstore", op).WithError(err).Error("error invalidating query cache ")
+	}
+}
+
+// getQuery reads a valid query entry into out
+func (s *CachedStore) getQuery(ctx context.Context, key string, out interface{}) bool {
+	raw, err := s.cache.GetString(ctx, key)
+	if err != nil {
+		return false
+	}
+
+	var e queryEntry
+	if err := json.Unmarshal([]byte(raw), &e); err != nil {
+		return false
+	}
+
+	if s.tagToken(ctx, s.writeTag()) != e.Written {
+		return false
+	}
+
+	data, err := s.decodeResult(e.Data)
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(data, out) == nil
+}
+
+// setQuery caches a query result for ttl seconds, unless a write of the
+// collection changed the write tag since it was read as written before the
+// query ran
+func (s *CachedStore) setQuery(ctx context.Context, op, key, written string, data json.RawMessage, ttl int) {
+	if s.tagToken(ctx, s.writeTag()) != written {
+		return
+	}
+
+	b, err := json.Marshal(queryEntry{Written: written, Data: data})
+	if err == nil {
+		err = s.cache.Set(ctx, key, string(b), ttl)
+	}
+	if err != nil {
+		log.GetLogger(ctx, "docstore", op).WithError(err).Error("error caching query ")
+	}
+}
+
+// cachedDocs runs fn, which finds the documents of out, through the query
+// cache. The entry expires with the first of its documents to expire.
+func (s *CachedStore) cachedDocs(ctx context.Context, op, hash string, out interface{}, many bool, fn func() error) error {
+	key, err := s.queryKey(ctx, op, hash)
+	if err != nil {
+		return err
+	}
+	if s.getQuery(ctx, key, out) {
+		return nil
+	}
+
+	written := s.tagToken(ctx, s.writeTag())
+	if err := fn(); err != nil {
+		return err
+	}
+
+	docs := out
+	if !many {
+		docs = []interface{}{out}
+	}
+
+	data, err := s.encodeResult(docs)
+	if err != nil {
+		log.GetLogger(ctx, "docstore", op).WithError(err).Error("error caching query ")
+		return nil
+	}
+	ttl, ok := s.resultTTL(data)
+	if !ok {
+		return nil
+	}
+
+	if !many {
+		// the entry keeps the single document
+		var one []json.RawMessage
+		if err := json.Unmarshal(data, &one); err != nil || len(one) != 1 {
+			return nil
+		}
+		data = one[0]
+	}
+
+	s.setQuery(ctx, op, key, written, data, ttl)
+	return nil
+}
+
+// encodeResult returns the cached form of docs, encrypted fields are cached
+// encrypted
+func (s *CachedStore) encodeResult(docs interface{}) (json.RawMessage, error) {
+	b, err := json.Marshal(docs)
+	if err != nil || !s.encrypting() {
+		return b, err
+	}
+
+	var maps []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&maps); err != nil {
+		return nil, err
+	}
+
+	enc := make([]interface{}, len(maps))
+	for i, d := range maps {
+		if d == nil {
+			continue
+		}
+		if enc[i], err = s.encryptStored(d); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(enc)
+}
+
+// resultTTL returns the seconds a result is cached for, until the first of
+// its documents expires, and false when one expires within a second
+func (s *CachedStore) resultTTL(data json.RawMessage) (int, bool) {
+	if !s.expiring() {
+		return s.CacheExpiration, true
+	}
+
+	var docs []map[string]interface{}
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return 0, false
+	}
+
+	ttl := s.CacheExpiration
+	for _, d := range docs {
+		if d == nil {
+			continue
+		}
+		t, ok := s.cacheTTL(d)
+		if !ok {
+			return 0, false
+		}
+		if ttl <= 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return ttl, true
+}
+
+// decodeResult decrypts a cached result
+func (s *CachedStore) decodeResult(data json.RawMessage) (json.RawMessage, error) {
+	if !s.encrypting() {
+		return data, nil
+	}
+
+	var docs interface{}
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+
+	switch v := docs.(type) {
+	case []interface{}:
+		for _, d := range v {
+			if m, ok := d.(map[string]interface{}); ok {
+				if err := s.decryptDoc(m); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if err := s.decryptDoc(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(docs)
+}
+
+// cachedValue runs fn, which computes out, through the query cache
+func (s *CachedStore) cachedValue(ctx context.Context, op, hash string, out interface{}, fn func() error) error {
+	key, err := s.queryKey(ctx, op, hash)
+	if err != nil {
+		return err
+	}
+	if s.getQuery(ctx, key, out) {
+		return nil
+	}
+
+	written := s.tagToken(ctx, s.writeTag())
+	if err := fn(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		log.GetLogger(ctx, "docstore", op).WithError(err).Error("error caching query ")
+		return nil
+	}
+
+	s.setQuery(ctx, op, key, written, data, s.CacheExpiration)
+	return nil
+}
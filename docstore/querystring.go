@@ -0,0 +1,463 @@
+package docstore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+)
+
+// FieldType is the type filter values of a field are coerced to
+type FieldType string
+
+const (
+	// AnyField values are read as a bool, an int, a float or a string, in
+	// that order
+	AnyField    FieldType = ""
+	StringField FieldType = "string"
+	IntField    FieldType = "int"
+	FloatField  FieldType = "float"
+	BoolField   FieldType = "bool"
+	// TimeField values are RFC3339 times or 2006-01-02 dates
+	TimeField FieldType = "time"
+)
+
+// query string parameters, other parameters of a query string are read as
+// filter expressions
+const (
+	paramFilter  = "filter"
+	paramSort    = "sort"
+	paramLimit   = "limit"
+	paramSkip    = "skip"
+	paramPage    = "page"
+	paramCursor  = "cursor"
+	paramFields  = "fields"
+	paramExclude = "exclude"
+)
+
+// filterOps holds the operators of filter expressions, longer operators
+// first so they win over their prefixes
+var filterOps = []string{
+	constant.NIN, constant.SN, constant.AM,
+	constant.SE, constant.NE, constant.GE, constant.LE, constant.IN, constant.AIN,
+	constant.EQ, constant.GT, constant.LT, constant.RE, constant.EX,
+}
+
+// QueryParser parses query strings into QueryOpt. A query string holds
+// comma separated filters like age>=18,status[]active|pending,name~^sa using
+// the operators of the constant package, list values are separated by | and
+// \ escapes a separator. The text of ~ is matched as described by Pattern.
+// The filters are passed raw or in the filter parameter, next to
+// sort=-created_at, limit, skip, page, cursor, fields and exclude.
+//
+// Filterable and Sortable are the allow-lists of fields, a nil allow-list
+// accepts any field and reads filter values as AnyField.
+type QueryParser struct {
+	Filterable map[string]FieldType
+	Sortable   []string
+	// DefaultLimit is the limit of queries without one, MaxLimit caps the
+	// limit of queries
+	DefaultLimit int
+	MaxLimit     int
+}
+
+// ParseQuery parses a raw URL query like the one of url.URL.RawQuery
+func (p *QueryParser) ParseQuery(raw string) (*QueryOpt, error) {
+	values := make(url.Values)
+	for _, part := range strings.Split(raw, "&") {
+		if part == "" {
+			continue
+		}
+		part, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("[docstore] invalid query string: %w", err)
+		}
+
+		key := paramFilter
+		val := part
+		if i := strings.Index(part, "="); i > 0 && isParam(part[:i]) {
+			key = part[:i]
+			val = part[i+1:]
+		}
+		values.Add(key, val)
+	}
+
+	return p.ParseValues(values)
+}
+
+// ParseValues parses the parameters of a query, filters are read from the
+// filter parameter
+func (p *QueryParser) ParseValues(values url.Values) (*QueryOpt, error) {
+	q := &QueryOpt{Limit: p.DefaultLimit}
+
+	for _, expr := range values[paramFilter] {
+		filters, err := p.ParseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		q.Filter = append(q.Filter, filters...)
+	}
+
+	if s := values.Get(paramSort); strings.TrimSpace(s) != "" {
+		if err := p.parseSort(q, s); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, dst := range map[string]*int{paramLimit: &q.Limit, paramSkip: &q.Skip, paramPage: &q.Page} {
+		s := values.Get(key)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("[docstore] invalid %s %q", key, s)
+		}
+		*dst = n
+	}
+	if p.MaxLimit > 0 && (q.Limit == 0 || q.Limit > p.MaxLimit) {
+		q.Limit = p.MaxLimit
+	}
+
+	q.Cursor = values.Get(paramCursor)
+	q.Fields = splitList(values.Get(paramFields))
+	q.Exclude = splitList(values.Get(paramExclude))
+	if err := q.Projection().Validate(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// ParseFilter parses a filter expression
+func (p *QueryParser) ParseFilter(expr string) ([]FilterOpt, error) {
+	terms := splitEscaped(expr, ',')
+	out := make([]FilterOpt, 0, len(terms))
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		f, err := p.parseTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func (p *QueryParser) parseTerm(term string) (FilterOpt, error) {
+	i := 0
+	for i < len(term) && isFieldChar(term[i]) {
+		i++
+	}
+
+	field := term[:i]
+	op := ""
+	for _, o := range filterOps {
+		if strings.HasPrefix(term[i:], o) {
+			op = o
+			break
+		}
+	}
+	if field == "" || op == "" {
+		return FilterOpt{}, fmt.Errorf("[docstore] invalid filter %q", term)
+	}
+
+	typ, ok := p.Filterable[field]
+	if !ok && p.Filterable != nil {
+		return FilterOpt{}, fmt.Errorf("[docstore] field %s is not filterable", field)
+	}
+
+	raw := term[i+len(op):]
+	f := FilterOpt{Field: field, Ops: op}
+	var err error
+	switch op {
+	case constant.IN, constant.NIN, constant.AIN, constant.AM:
+		parts := splitEscaped(raw, '|')
+		vals := make([]interface{}, len(parts))
+		for j, s := range parts {
+			if vals[j], err = coerceValue(unescape(s), typ); err != nil {
+				break
+			}
+		}
+		f.Value = vals
+	case constant.EX:
+		f.Value = true
+		if raw != "" {
+			f.Value, err = strconv.ParseBool(raw)
+		}
+	case constant.RE:
+		f.Value = unescape(raw)
+	default:
+		if raw == "null" {
+			return f, nil
+		}
+		f.Value, err = coerceValue(unescape(raw), typ)
+	}
+	if err != nil {
+		return FilterOpt{}, fmt.Errorf("[docstore] invalid value of filter %q", term)
+	}
+
+	return f, nil
+}
+
+func (p *QueryParser) parseSort(q *QueryOpt, s string) error {
+	// an unescaped + reads as a space
+	s = strings.TrimSpace(s)
+	q.IsAscend = true
+	switch s[0] {
+	case '-':
+		q.IsAscend = false
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	if !isField(s) {
+		return fmt.Errorf("[docstore] invalid sort %q", s)
+	}
+	if p.Sortable != nil && !contains(p.Sortable, s) {
+		return fmt.Errorf("[docstore] field %s is not sortable", s)
+	}
+
+	q.OrderBy = s
+	return nil
+}
+
+// EncodeQuery returns the query string of q, ParseQuery parses it back.
+// Filters combined with OR and EM filters have no expression and fail.
+func EncodeQuery(q *QueryOpt) (string, error) {
+	if q == nil {
+		return "", nil
+	}
+	values := make(url.Values)
+
+	if len(q.Filter) > 0 {
+		expr, err := FormatFilter(q.Filter)
+		if err != nil {
+			return "", err
+		}
+		values.Set(paramFilter, expr)
+	}
+
+	if q.OrderBy != "" {
+		sort := q.OrderBy
+		if !q.IsAscend {
+			sort = "-" + sort
+		}
+		values.Set(paramSort, sort)
+	}
+
+	for key, n := range map[string]int{paramLimit: q.Limit, paramSkip: q.Skip, paramPage: q.Page} {
+		if n > 0 {
+			values.Set(key, strconv.Itoa(n))
+		}
+	}
+	if q.Cursor != "" {
+		values.Set(paramCursor, q.Cursor)
+	}
+	if len(q.Fields) > 0 {
+		values.Set(paramFields, strings.Join(q.Fields, ","))
+	}
+	if len(q.Exclude) > 0 {
+		values.Set(paramExclude, strings.Join(q.Exclude, ","))
+	}
+
+	return values.Encode(), nil
+}
+
+// FormatFilter returns the filter expression of filters
+func FormatFilter(filters []FilterOpt) (string, error) {
+	terms := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if f.Ops == constant.AND {
+			expr, err := FormatFilter(toFilters(f.Value))
+			if err != nil {
+				return "", err
+			}
+			if expr != "" {
+				terms = append(terms, expr)
+			}
+			continue
+		}
+
+		term, err := formatTerm(f)
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, ","), nil
+}
+
+func formatTerm(f FilterOpt) (string, error) {
+	if !isField(f.Field) {
+		return "", fmt.Errorf("[docstore] filter field %q has no expression", f.Field)
+	}
+
+	switch f.Ops {
+	case constant.IN, constant.NIN, constant.AIN, constant.AM:
+		rv := reflect.ValueOf(f.Value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return "", fmt.Errorf("[docstore] filter %s %s needs a list value", f.Field, f.Ops)
+		}
+		vals := make([]string, rv.Len())
+		for i := range vals {
+			vals[i] = escapeValue(formatValue(rv.Index(i).Interface()))
+		}
+		return f.Field + f.Ops + strings.Join(vals, "|"), nil
+	case constant.EX:
+		want, ok := f.Value.(bool)
+		if !ok {
+			want = f.Value != nil
+		}
+		return f.Field + f.Ops + strconv.FormatBool(want), nil
+	case constant.SE, constant.EQ, constant.NE, constant.SN, constant.GT, constant.GE, constant.LT, constant.LE, constant.RE:
+		return f.Field + f.Ops + escapeValue(formatValue(f.Value)), nil
+	}
+
+	return "", fmt.Errorf("[docstore] filter operator %s has no expression", f.Ops)
+}
+
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case *time.Time:
+		if x == nil {
+			return "null"
+		}
+		return x.Format(time.RFC3339Nano)
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "null"
+		}
+		rv = rv.Elem()
+	}
+	return fmt.Sprintf("%v", rv.Interface())
+}
+
+// coerceValue converts a filter value to the type of its field
+func coerceValue(s string, typ FieldType) (interface{}, error) {
+	switch typ {
+	case StringField:
+		return s, nil
+	case IntField:
+		return strconv.ParseInt(s, 10, 64)
+	case FloatField:
+		return strconv.ParseFloat(s, 64)
+	case BoolField:
+		return strconv.ParseBool(s)
+	case TimeField:
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", s)
+	case AnyField:
+		if s == "true" || s == "false" {
+			return s == "true", nil
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+		return s, nil
+	}
+	return nil, errors.New("[docstore] unknown field type " + string(typ))
+}
+
+// splitEscaped splits s on sep, separators escaped with \ are kept escaped
+func splitEscaped(s string, sep byte) []string {
+	out := make([]string, 0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func escapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, "|", `\|`).Replace(s)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	out := make([]string, 0)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func isParam(key string) bool {
+	switch key {
+	case paramFilter, paramSort, paramLimit, paramSkip, paramPage, paramCursor, paramFields, paramExclude:
+		return true
+	}
+	return false
+}
+
+func isField(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isFieldChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isFieldChar(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
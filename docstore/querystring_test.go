@@ -0,0 +1,164 @@
+package docstore
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryParser(t *testing.T) {
+	p := &QueryParser{
+		Filterable: map[string]FieldType{
+			"age":        IntField,
+			"status":     StringField,
+			"name":       StringField,
+			"score":      FloatField,
+			"active":     BoolField,
+			"created_at": TimeField,
+			"deleted_at": TimeField,
+		},
+		Sortable:     []string{"created_at", "name"},
+		DefaultLimit: 10,
+		MaxLimit:     50,
+	}
+
+	q, err := p.ParseQuery("age>=18,status[]active|pending,name~^sa&sort=-created_at&limit=20")
+	require.Nil(t, err)
+	assert.Equal(t, &QueryOpt{
+		Filter: []FilterOpt{
+			{Field: "age", Ops: constant.GE, Value: int64(18)},
+			{Field: "status", Ops: constant.IN, Value: []interface{}{"active", "pending"}},
+			{Field: "name", Ops: constant.RE, Value: "^sa"},
+		},
+		OrderBy: "created_at",
+		Limit:   20,
+	}, q)
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	values := url.Values{
+		"filter": {`score<9.5,active==true,deleted_at?false,created_at>2024-01-02T03:04:05Z,status!=null,name=a\,b\|c`},
+		"sort":   {"name"},
+		"page":   {"2"},
+		"fields": {"name,score"},
+	}
+	q, err = p.ParseValues(values)
+	require.Nil(t, err)
+	assert.Equal(t, []FilterOpt{
+		{Field: "score", Ops: constant.LT, Value: 9.5},
+		{Field: "active", Ops: constant.SE, Value: true},
+		{Field: "deleted_at", Ops: constant.EX, Value: false},
+		{Field: "created_at", Ops: constant.GT, Value: ts},
+		{Field: "status", Ops: constant.NE},
+		{Field: "name", Ops: constant.EQ, Value: "a,b|c"},
+	}, q.Filter)
+	assert.Equal(t, "name", q.OrderBy)
+	assert.True(t, q.IsAscend)
+	assert.Equal(t, 2, q.Page)
+	assert.Equal(t, 10, q.Limit, "default limit")
+	assert.Equal(t, []string{"name", "score"}, q.Fields)
+
+	q, err = p.ParseQuery("limit=500")
+	require.Nil(t, err)
+	assert.Equal(t, 50, q.Limit, "capped limit")
+
+	for _, raw := range []string{
+		"password=x",
+		"age>=old",
+		"age",
+		"=1",
+		"sort=age",
+		"limit=-1",
+		"fields=name&exclude=age",
+	} {
+		_, err := p.ParseQuery(raw)
+		assert.NotNil(t, err, raw)
+	}
+
+	q, err = (&QueryParser{}).ParseQuery("n=7,f=1.5,b=true,s=abc,tags[=]x|2&sort=%2Bother")
+	require.Nil(t, err)
+	assert.Equal(t, []FilterOpt{
+		{Field: "n", Ops: constant.EQ, Value: int64(7)},
+		{Field: "f", Ops: constant.EQ, Value: 1.5},
+		{Field: "b", Ops: constant.EQ, Value: true},
+		{Field: "s", Ops: constant.EQ, Value: "abc"},
+		{Field: "tags", Ops: constant.AM, Value: []interface{}{"x", int64(2)}},
+	}, q.Filter)
+	assert.Equal(t, "other", q.OrderBy)
+	assert.True(t, q.IsAscend)
+}
+
+func TestQueryParser_Find(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("querystring", "id")
+	for i, name := range []string{"sandi", "Sarah", "hasan", "elsa"} {
+		require.Nil(t, ms.Create(ctx, map[string]interface{}{"id": i + 1, "name": name}))
+	}
+
+	p := &QueryParser{Filterable: map[string]FieldType{"name": StringField}, Sortable: []string{"name"}}
+	find := func(raw string) []string {
+		q, err := p.ParseQuery(raw + "&sort=name")
+		require.Nil(t, err)
+		var docs []map[string]interface{}
+		require.Nil(t, ms.Find(ctx, q, &docs))
+		names := make([]string, len(docs))
+		for i, d := range docs {
+			names[i] = d["name"].(string)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"Sarah", "elsa", "hasan", "sandi"}, find("name~sa"))
+	assert.Equal(t, []string{"Sarah", "sandi"}, find("name~^sa"))
+	assert.Equal(t, []string{"elsa"}, find("name~sa$"))
+	assert.Equal(t, []string{"sandi"}, find("name~^sandi$"))
+}
+
+func TestEncodeQuery(t *testing.T) {
+	p := &QueryParser{}
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	q := &QueryOpt{
+		Filter: []FilterOpt{
+			{Field: "age", Ops: constant.GE, Value: 18},
+			{Ops: constant.AND, Value: []FilterOpt{
+				{Field: "status", Ops: constant.NIN, Value: []string{"a|b", "c,d"}},
+			}},
+			{Field: "created_at", Ops: constant.LT, Value: ts},
+			{Field: "note", Ops: constant.EQ, Value: nil},
+			{Field: "deleted_at", Ops: constant.EX, Value: false},
+		},
+		OrderBy: "created_at",
+		Limit:   20,
+		Skip:    40,
+		Cursor:  "abc",
+		Exclude: []string{"secret"},
+	}
+
+	s, err := EncodeQuery(q)
+	require.Nil(t, err)
+
+	p.Filterable = map[string]FieldType{"age": IntField, "status": StringField, "created_at": TimeField, "note": StringField, "deleted_at": TimeField}
+	got, err := p.ParseQuery(s)
+	require.Nil(t, err)
+	assert.Equal(t, []FilterOpt{
+		{Field: "age", Ops: constant.GE, Value: int64(18)},
+		{Field: "status", Ops: constant.NIN, Value: []interface{}{"a|b", "c,d"}},
+		{Field: "created_at", Ops: constant.LT, Value: ts},
+		{Field: "note", Ops: constant.EQ},
+		{Field: "deleted_at", Ops: constant.EX, Value: false},
+	}, got.Filter)
+	assert.Equal(t, "created_at", got.OrderBy)
+	assert.False(t, got.IsAscend)
+	assert.Equal(t, 20, got.Limit)
+	assert.Equal(t, 40, got.Skip)
+	assert.Equal(t, "abc", got.Cursor)
+	assert.Equal(t, []string{"secret"}, got.Exclude)
+
+	_, err = EncodeQuery(&QueryOpt{Filter: []FilterOpt{{Ops: constant.OR, Value: []FilterOpt{}}}})
+	assert.NotNil(t, err)
+}
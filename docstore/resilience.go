@@ -0,0 +1,460 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultBackoff         = 100
+	defaultMaxBackoff      = 5000
+	defaultBreakerCooldown = 30
+)
+
+// ErrCircuitOpen is returned without calling the driver while the circuit
+// breaker of the collection is open
+var ErrCircuitOpen = errors.New("[docstore] circuit breaker is open")
+
+// ResilienceConfig sets the retries, the timeouts and the circuit breaker of
+// the driver of a store, see ResilientStore
+type ResilienceConfig struct {
+	// MaxRetries is the number of retries of the idempotent operations
+	// failing with a transient error
+	MaxRetries int `json:"max_retries,omitempty"`
+	// Backoff is the delay in milliseconds before the first retry, doubled on
+	// every retry up to MaxBackoff
+	Backoff    int `json:"backoff,omitempty"`
+	MaxBackoff int `json:"max_backoff,omitempty"`
+	// Timeout is the time limit in milliseconds of every attempt, Timeouts
+	// overrides it by operation, e.g. Find
+	Timeout  int            `json:"timeout,omitempty"`
+	Timeouts map[string]int `json:"timeouts,omitempty"`
+	// BreakerThreshold is the number of consecutive transient failures
+	// opening the circuit, 0 disables the breaker
+	BreakerThreshold int `json:"breaker_threshold,omitempty"`
+	// BreakerCooldown is the time in seconds the circuit stays open, then a
+	// single operation is let through to try the driver again
+	BreakerCooldown int `json:"breaker_cooldown,omitempty"`
+}
+
+// ErrorClassifier reports whether an error of a driver is transient, the
+// operation may then be retried and the failure counts for the breaker
+type ErrorClassifier func(err error) bool
+
+var classifiers = map[string]ErrorClassifier{}
+
+// RegisterErrorClassifier sets the classifier of the errors of the named
+// driver, drivers register it with their factory
+func RegisterErrorClassifier(name string, fn ErrorClassifier) {
+	classifiers[name] = fn
+}
+
+// IsTransient reports the errors transient for every driver, the timeouts of
+// the network
+func IsTransient(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ResilientStore is a driver retrying the idempotent operations of another
+// driver on transient errors, with an exponential backoff, limiting the time
+// of every attempt and failing fast while its circuit breaker is open. The
+// errors are classified by the classifier registered for the driver of the
+// config. Query and Watch are not limited in time as their results outlive
+// the call, transactions and writes that are not idempotent are not retried.
+type ResilientStore struct {
+	driver     Driver
+	collection string
+	conf       ResilienceConfig
+	classify   ErrorClassifier
+	breaker    *breaker
+}
+
+// NewResilientStore wraps driver with the Resilience of config
+func NewResilientStore(driver Driver, config *Config) *ResilientStore {
+	conf := ResilienceConfig{}
+	if config.Resilience != nil {
+		conf = *config.Resilience
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = defaultBackoff
+	}
+	if conf.MaxBackoff < conf.Backoff {
+		conf.MaxBackoff = defaultMaxBackoff
+		if conf.MaxBackoff < conf.Backoff {
+			conf.MaxBackoff = conf.Backoff
+		}
+	}
+	if conf.BreakerCooldown <= 0 {
+		conf.BreakerCooldown = defaultBreakerCooldown
+	}
+
+	return &ResilientStore{
+		driver:     driver,
+		collection: config.Collection,
+		conf:       conf,
+		classify:   classifiers[config.Driver],
+		breaker: &breaker{
+			threshold: conf.BreakerThreshold,
+			cooldown:  time.Duration(conf.BreakerCooldown) * time.Second,
+		},
+	}
+}
+
+// transient reports whether err of an attempt is transient, the attempt
+// running out of its own time is
+func (r *ResilientStore) transient(ctx, attempt context.Context, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) && attempt.Err() != nil && ctx.Err() == nil {
+		return true
+	}
+	if IsTransient(err) {
+		return true
+	}
+	return r.classify != nil && r.classify(err)
+}
+
+func (r *ResilientStore) timeout(op string) time.Duration {
+	if ms, ok := r.conf.Timeouts[op]; ok {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Duration(r.conf.Timeout) * time.Millisecond
+}
+
+// backoff returns the delay before retry n, jittered so the clients failing
+// together do not retry together
+func (r *ResilientStore) backoff(n int) time.Duration {
+	d := time.Duration(r.conf.Backoff) * time.Millisecond
+	max := time.Duration(r.conf.MaxBackoff) * time.Millisecond
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// do runs fn through the breaker, retrying it when idempotent is set. The
+// attempts and the state of the breaker are recorded in the current span, the
+// drivers trace the operation.
+func (r *ResilientStore) do(ctx context.Context, op string, idempotent, limited bool, fn func(ctx context.Context) error) error {
+	var err error
+	attempts := 0
+	for {
+		if !r.breaker.allow() {
+			if attempts == 0 {
+				err = ErrCircuitOpen
+			}
+			break
+		}
+
+		attempt, cancel := ctx, context.CancelFunc(func() {})
+		if t := r.timeout(op); limited && t > 0 {
+			attempt, cancel = context.WithTimeout(ctx, t)
+		}
+		err = fn(attempt)
+		transient := err != nil && r.transient(ctx, attempt, err)
+		cancel()
+
+		attempts++
+		r.breaker.done(transient)
+		if !transient || !idempotent || attempts > r.conf.MaxRetries {
+			break
+		}
+
+		if serr := sleep(ctx, r.backoff(attempts-1)); serr != nil {
+			err = serr
+			break
+		}
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("docstore.collection", r.collection),
+		attribute.Int("docstore.attempts", attempts),
+		attribute.String("docstore.circuit", r.breaker.state()),
+	)
+	if err != nil && err != NotFound {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retried runs a retried operation limited in time
+func (r *ResilientStore) retried(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return r.do(ctx, op, true, true, fn)
+}
+
+// once runs an operation limited in time which is not retried
+func (r *ResilientStore) once(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return r.do(ctx, op, false, true, fn)
+}
+
+// versioned reports whether the writes of ctx check the version, a retry of
+// a write which was applied fails the check
+func versioned(ctx context.Context) bool {
+	_, ok := GetVersioning(ctx)
+	return ok
+}
+
+// idempotentFields reports whether applying fields twice writes the same
+// document
+func idempotentFields(fields []Field) bool {
+	for _, f := range fields {
+		switch f.Op {
+		case "", UpdateSet, UpdateUnset, UpdateSetOnInsert, UpdateMin, UpdateMax, UpdateAddToSet, UpdatePull:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ResilientStore) Create(ctx context.Context, doc interface{}) error {
+	return r.once(ctx, "Create", func(ctx context.Context) error {
+		return r.driver.Create(ctx, doc)
+	})
+}
+
+func (r *ResilientStore) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	return r.do(ctx, "Update", !versioned(ctx), true, func(ctx context.Context) error {
+		return r.driver.Update(ctx, id, doc, replace)
+	})
+}
+
+func (r *ResilientStore) UpdateMany(ctx context.Context, filters []FilterOpt, fields map[string]interface{}) error {
+	return r.do(ctx, "UpdateMany", !versioned(ctx), true, func(ctx context.Context) error {
+		return r.driver.UpdateMany(ctx, filters, fields)
+	})
+}
+
+func (r *ResilientStore) Upsert(ctx context.Context, id, doc interface{}) error {
+	return r.do(ctx, "Upsert", !versioned(ctx), true, func(ctx context.Context) error {
+		return r.driver.Upsert(ctx, id, doc)
+	})
+}
+
+func (r *ResilientStore) UpdateField(ctx context.Context, id interface{}, fields []Field, opts ...interface{}) error {
+	return r.do(ctx, "UpdateField", idempotentFields(fields) && !versioned(ctx), true, func(ctx context.Context) error {
+		return r.driver.UpdateField(ctx, id, fields, opts...)
+	})
+}
+
+func (r *ResilientStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
+	return r.once(ctx, "Increment", func(ctx context.Context) error {
+		return r.driver.Increment(ctx, id, key, value)
+	})
+}
+
+func (r *ResilientStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
+	return r.once(ctx, "GetIncrement", func(ctx context.Context) error {
+		return r.driver.GetIncrement(ctx, id, key, value, doc)
+	})
+}
+
+// Delete is retried, a retry may return NotFound when the failed attempt
+// deleted the document
+func (r *ResilientStore) Delete(ctx context.Context, id interface{}) error {
+	return r.retried(ctx, "Delete", func(ctx context.Context) error {
+		return r.driver.Delete(ctx, id)
+	})
+}
+
+func (r *ResilientStore) DeleteMany(ctx context.Context, query *QueryOpt) error {
+	return r.retried(ctx, "DeleteMany", func(ctx context.Context) error {
+		return r.driver.DeleteMany(ctx, query)
+	})
+}
+
+func (r *ResilientStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	return r.retried(ctx, "Get", func(ctx context.Context) error {
+		return r.driver.Get(ctx, id, doc, opts...)
+	})
+}
+
+func (r *ResilientStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
+	return r.retried(ctx, "Find", func(ctx context.Context) error {
+		return r.driver.Find(ctx, query, docs)
+	})
+}
+
+func (r *ResilientStore) Count(ctx context.Context, query *QueryOpt) (int64, error) {
+	var n int64
+	err := r.retried(ctx, "Count", func(ctx context.Context) (err error) {
+		n, err = r.driver.Count(ctx, query)
+		return err
+	})
+	return n, err
+}
+
+func (r *ResilientStore) FindOne(ctx context.Context, query *QueryOpt, doc interface{}) error {
+	return r.retried(ctx, "FindOne", func(ctx context.Context) error {
+		return r.driver.FindOne(ctx, query, doc)
+	})
+}
+
+func (r *ResilientStore) Query(ctx context.Context, query *QueryOpt) (Iterator, error) {
+	var it Iterator
+	err := r.do(ctx, "Query", true, false, func(ctx context.Context) (err error) {
+		it, err = r.driver.Query(ctx, query)
+		return err
+	})
+	return it, err
+}
+
+func (r *ResilientStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
+	return r.once(ctx, "BulkCreate", func(ctx context.Context) error {
+		return r.driver.BulkCreate(ctx, docs, opts...)
+	})
+}
+
+func (r *ResilientStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	return r.retried(ctx, "BulkGet", func(ctx context.Context) error {
+		return r.driver.BulkGet(ctx, ids, docs, opts...)
+	})
+}
+
+func (r *ResilientStore) Migrate(ctx context.Context, config interface{}) error {
+	return r.once(ctx, "Migrate", func(ctx context.Context) error {
+		return r.driver.Migrate(ctx, config)
+	})
+}
+
+// As reads the client of the wrapped driver
+func (r *ResilientStore) As(i interface{}) bool {
+	return r.driver.As(i)
+}
+
+func (r *ResilientStore) Ping(ctx context.Context) error {
+	return r.retried(ctx, "Ping", func(ctx context.Context) error {
+		return r.driver.Ping(ctx)
+	})
+}
+
+func (r *ResilientStore) Disconnect(ctx context.Context) error {
+	return r.driver.Disconnect(ctx)
+}
+
+func (r *ResilientStore) Pull(ctx context.Context, condition, removeCondition Field) error {
+	return r.once(ctx, "Pull", func(ctx context.Context) error {
+		return r.driver.Pull(ctx, condition, removeCondition)
+	})
+}
+
+func (r *ResilientStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	var out []interface{}
+	err := r.retried(ctx, "Distinct", func(ctx context.Context) (err error) {
+		out, err = r.driver.Distinct(ctx, fieldName, filter)
+		return err
+	})
+	return out, err
+}
+
+// RunInTransaction is not retried, fn may have effects outside of the
+// transaction. The drivers retry the commits of their transactions.
+func (r *ResilientStore) RunInTransaction(ctx context.Context, fn func(tx Tx) error) error {
+	return r.once(ctx, "RunInTransaction", func(ctx context.Context) error {
+		return r.driver.RunInTransaction(ctx, fn)
+	})
+}
+
+func (r *ResilientStore) Watch(ctx context.Context, query *QueryOpt) (ChangeStream, error) {
+	var stream ChangeStream
+	err := r.do(ctx, "Watch", true, false, func(ctx context.Context) (err error) {
+		stream, err = r.driver.Watch(ctx, query)
+		return err
+	})
+	return stream, err
+}
+
+func (r *ResilientStore) Aggregate(ctx context.Context, agg *AggregateOpt, docs interface{}) error {
+	return r.retried(ctx, "Aggregate", func(ctx context.Context) error {
+		return r.driver.Aggregate(ctx, agg, docs)
+	})
+}
+
+func (r *ResilientStore) BulkWrite(ctx context.Context, ops []WriteOp, opts ...interface{}) ([]WriteResult, error) {
+	var res []WriteResult
+	err := r.once(ctx, "BulkWrite", func(ctx context.Context) (err error) {
+		res, err = r.driver.BulkWrite(ctx, ops, opts...)
+		return err
+	})
+	return res, err
+}
+
+// breaker opens after threshold consecutive transient failures, and lets a
+// single call through once cooldown passed. The call closes it again when it
+// does not fail.
+type breaker struct {
+	mux       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+func (b *breaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+func (b *breaker) allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.open() {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) done(failed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.open() {
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breaker) state() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch {
+	case !b.open():
+		return "closed"
+	case b.trial || time.Since(b.openedAt) >= b.cooldown:
+		return "half-open"
+	}
+	return "open"
+}
@@ -0,0 +1,162 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errFlaky = errors.New("connection reset")
+
+func init() {
+	RegisterErrorClassifier("flaky", func(err error) bool { return errors.Is(err, errFlaky) })
+}
+
+// flakyStore fails the next fail calls of Get, Create and Find, and makes
+// Find wait for delay
+type flakyStore struct {
+	*MemoryStore
+	fail  int
+	calls int
+	delay time.Duration
+}
+
+func (f *flakyStore) call() error {
+	f.calls++
+	if f.fail > 0 {
+		f.fail--
+		return errFlaky
+	}
+	return nil
+}
+
+func (f *flakyStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	return f.MemoryStore.Get(ctx, id, doc, opts...)
+}
+
+func (f *flakyStore) Create(ctx context.Context, doc interface{}) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	return f.MemoryStore.Create(ctx, doc)
+}
+
+func (f *flakyStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
+	f.calls++
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(f.delay):
+	}
+	return f.MemoryStore.Find(ctx, query, docs)
+}
+
+func newFlaky(conf ResilienceConfig) (*ResilientStore, *flakyStore) {
+	f := &flakyStore{MemoryStore: NewMemoryStore("flaky", "id")}
+	return NewResilientStore(f, &Config{Driver: "flaky", Collection: "flaky", Resilience: &conf}), f
+}
+
+func TestResilientStore(t *testing.T) {
+	r, _ := newFlaky(ResilienceConfig{MaxRetries: 2, Timeout: 1000})
+	t.Run("CRUD", func(t *testing.T) { DriverCRUDTest(r, t) })
+	t.Run("Filter", func(t *testing.T) { DriverFilterTest(r, t) })
+	t.Run("UpdateOps", func(t *testing.T) { DriverUpdateOpsTest(r, t) })
+}
+
+func TestResilientStore_Retry(t *testing.T) {
+	ctx := context.Background()
+	r, f := newFlaky(ResilienceConfig{MaxRetries: 2, Backoff: 1})
+	require.Nil(t, f.MemoryStore.Create(ctx, map[string]interface{}{"id": "1"}))
+
+	doc := make(map[string]interface{})
+	f.fail = 2
+	require.Nil(t, r.Get(ctx, "1", &doc))
+	assert.Equal(t, 3, f.calls)
+
+	f.calls, f.fail = 0, 3
+	assert.ErrorIs(t, r.Get(ctx, "1", &doc), errFlaky)
+	assert.Equal(t, 3, f.calls)
+
+	// other errors are not retried
+	f.calls, f.fail = 0, 0
+	assert.Equal(t, NotFound, r.Get(ctx, "missing", &doc))
+	assert.Equal(t, 1, f.calls)
+
+	// creates are not idempotent
+	f.calls, f.fail = 0, 1
+	assert.ErrorIs(t, r.Create(ctx, map[string]interface{}{"id": "2"}), errFlaky)
+	assert.Equal(t, 1, f.calls)
+
+	// the backoff stops with the context
+	f.calls, f.fail = 0, 2
+	r.conf.Backoff, r.conf.MaxBackoff = 10000, 10000
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.Get(cctx, "1", &doc), context.DeadlineExceeded)
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestResilientStore_Timeout(t *testing.T) {
+	ctx := context.Background()
+	r, f := newFlaky(ResilienceConfig{MaxRetries: 1, Backoff: 1, Timeout: 1000, Timeouts: map[string]int{"Find": 20}})
+	f.delay = 200 * time.Millisecond
+
+	var docs []map[string]interface{}
+	start := time.Now()
+	assert.ErrorIs(t, r.Find(ctx, &QueryOpt{}, &docs), context.DeadlineExceeded)
+	assert.Equal(t, 2, f.calls, "timed out attempts are retried")
+	assert.Less(t, time.Since(start), f.delay)
+
+	f.calls, f.delay = 0, 0
+	require.Nil(t, r.Find(ctx, &QueryOpt{}, &docs))
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestResilientStore_Breaker(t *testing.T) {
+	ctx := context.Background()
+	r, f := newFlaky(ResilienceConfig{BreakerThreshold: 2, BreakerCooldown: 1})
+	require.Nil(t, f.MemoryStore.Create(ctx, map[string]interface{}{"id": "1"}))
+
+	doc := make(map[string]interface{})
+	f.fail = 2
+	assert.ErrorIs(t, r.Get(ctx, "1", &doc), errFlaky)
+	assert.ErrorIs(t, r.Get(ctx, "1", &doc), errFlaky)
+
+	f.calls = 0
+	assert.Equal(t, ErrCircuitOpen, r.Get(ctx, "1", &doc))
+	assert.Equal(t, 0, f.calls)
+	assert.Equal(t, "open", r.breaker.state())
+
+	// after the cooldown a call goes through and closes the circuit
+	time.Sleep(time.Second)
+	assert.Equal(t, "half-open", r.breaker.state())
+	require.Nil(t, r.Get(ctx, "1", &doc))
+	assert.Equal(t, "closed", r.breaker.state())
+
+	// the failures of other errors do not open it
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, NotFound, r.Get(ctx, "missing", &doc))
+	}
+	assert.Equal(t, "closed", r.breaker.state())
+}
+
+func TestResilientStore_Config(t *testing.T) {
+	cs, err := New(&Config{
+		Database:   "db",
+		Collection: "item",
+		CacheURL:   "mem://",
+		Driver:     "memory",
+		Connection: "memory",
+		Resilience: &ResilienceConfig{MaxRetries: 1},
+	})
+	require.Nil(t, err)
+	_, ok := cs.storage.(*ResilientStore)
+	assert.True(t, ok)
+}
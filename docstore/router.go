@@ -0,0 +1,763 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/bondhan/golib/util"
+)
+
+// ShardFunc returns the name of the shard holding the document of id.
+// Transactions are routed with a nil id, so the shard should then be read
+// from ctx, e.g. from its retailer.
+type ShardFunc func(ctx context.Context, id interface{}) (string, error)
+
+// HashShard spreads the documents over the shards by the hash of their ID
+func HashShard(shards ...string) ShardFunc {
+	return func(ctx context.Context, id interface{}) (string, error) {
+		if id == nil {
+			return "", errors.New("[docstore/router] missing shard key")
+		}
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprintf("%v", id)))
+		return shards[h.Sum32()%uint32(len(shards))], nil
+	}
+}
+
+// RouterStore is a driver splitting a collection over child drivers, the
+// shards. The writes and reads of a document go to the shard of its ID, the
+// queries fan out to every shard and their results are merged by the order of
+// the query. Documents are expected to stay on the shard they were created on.
+type RouterStore struct {
+	shards  map[string]Driver
+	names   []string
+	shard   ShardFunc
+	idField string
+}
+
+// NewRouterStore returns a driver over the named shards, routing the
+// documents with shard
+func NewRouterStore(idField string, shard ShardFunc, shards map[string]Driver) *RouterStore {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &RouterStore{
+		shards:  shards,
+		names:   names,
+		shard:   shard,
+		idField: idField,
+	}
+}
+
+// route returns the shard of the document of id
+func (r *RouterStore) route(ctx context.Context, id interface{}) (string, Driver, error) {
+	name, err := r.shard(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	d, ok := r.shards[name]
+	if !ok {
+		return "", nil, fmt.Errorf("[docstore/router] unknown shard %s", name)
+	}
+	return name, d, nil
+}
+
+// each runs fn on every shard concurrently. NotFound is returned only when
+// every shard returns it, otherwise the error of the first failed shard.
+func (r *RouterStore) each(fn func(i int, d Driver) error) error {
+	errs := make([]error, len(r.names))
+	var wg sync.WaitGroup
+	for i, name := range r.names {
+		wg.Add(1)
+		go func(i int, d Driver) {
+			defer wg.Done()
+			errs[i] = fn(i, d)
+		}(i, r.shards[name])
+	}
+	wg.Wait()
+
+	notFound := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+		case NotFound:
+			notFound++
+		default:
+			return err
+		}
+	}
+	if notFound > 0 && notFound == len(errs) {
+		return NotFound
+	}
+	return nil
+}
+
+func (r *RouterStore) Create(ctx context.Context, doc interface{}) error {
+	id, err := docID(doc, r.idField)
+	if err != nil {
+		return err
+	}
+
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Create(ctx, doc)
+}
+
+func (r *RouterStore) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Update(ctx, id, doc, replace)
+}
+
+func (r *RouterStore) UpdateMany(ctx context.Context, filters []FilterOpt, fields map[string]interface{}) error {
+	return r.each(func(i int, d Driver) error {
+		return d.UpdateMany(ctx, filters, fields)
+	})
+}
+
+func (r *RouterStore) Upsert(ctx context.Context, id, doc interface{}) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Upsert(ctx, id, doc)
+}
+
+func (r *RouterStore) UpdateField(ctx context.Context, id interface{}, fields []Field, opts ...interface{}) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.UpdateField(ctx, id, fields, opts...)
+}
+
+func (r *RouterStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Increment(ctx, id, key, value)
+}
+
+func (r *RouterStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.GetIncrement(ctx, id, key, value, doc)
+}
+
+func (r *RouterStore) Delete(ctx context.Context, id interface{}) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Delete(ctx, id)
+}
+
+func (r *RouterStore) DeleteMany(ctx context.Context, query *QueryOpt) error {
+	return r.each(func(i int, d Driver) error {
+		return d.DeleteMany(ctx, query)
+	})
+}
+
+func (r *RouterStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	_, d, err := r.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return d.Get(ctx, id, doc, opts...)
+}
+
+// Find merges the documents found on every shard, see Query
+func (r *RouterStore) Find(ctx context.Context, query *QueryOpt, docs interface{}) error {
+	it, err := r.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer it.Close(ctx)
+
+	out := make([]map[string]interface{}, 0)
+	for {
+		d := make(map[string]interface{})
+		if err := it.Next(ctx, &d); err != nil {
+			if err == EndOfDoc {
+				break
+			}
+			return err
+		}
+		out = append(out, d)
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+// Count sums the counts of the shards
+func (r *RouterStore) Count(ctx context.Context, query *QueryOpt) (int64, error) {
+	counts := make([]int64, len(r.names))
+	err := r.each(func(i int, d Driver) (err error) {
+		counts[i], err = d.Count(ctx, query)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	return total, nil
+}
+
+func (r *RouterStore) FindOne(ctx context.Context, query *QueryOpt, doc interface{}) error {
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+	q.Limit = 1
+
+	var docs []map[string]interface{}
+	if err := r.Find(ctx, q, &docs); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return NotFound
+	}
+
+	return util.DecodeJSON(docs[0], doc)
+}
+
+// Query iterates over the documents of every shard merged by the order of
+// the query, queries without order return the documents shard by shard.
+// Skip, page and limit apply to the merged documents and the cursor resumes
+// every shard after the same document.
+func (r *RouterStore) Query(ctx context.Context, query *QueryOpt) (Iterator, error) {
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+
+	p := q.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	skip := q.Skip
+	if q.Page > 0 && q.Limit > 0 {
+		skip = q.Page * q.Limit
+	}
+
+	orderBy, isAscend := q.OrderBy, q.IsAscend
+	if q.Cursor != "" {
+		// the shards resume in the order of the cursor
+		c, err := ParseCursor(q, r.idField)
+		if err != nil {
+			return nil, err
+		}
+		orderBy, isAscend = c.OrderBy, c.IsAscend
+		skip = 0
+	}
+
+	// every shard returns the documents the merge may need, with the fields
+	// the documents are merged by
+	sq := *q
+	sq.Skip, sq.Page = 0, 0
+	if q.Limit > 0 {
+		sq.Limit = skip + q.Limit
+	}
+	if !p.IsEmpty() {
+		sq.Fields, sq.Exclude = keepField(sq.Fields, sq.Exclude, r.idField)
+		if orderBy != "" {
+			sq.Fields, sq.Exclude = keepField(sq.Fields, sq.Exclude, orderBy)
+		}
+	}
+
+	it := &routerIterator{
+		its:        make([]Iterator, len(r.names)),
+		heads:      make([]map[string]interface{}, len(r.names)),
+		done:       make([]bool, len(r.names)),
+		orderBy:    orderBy,
+		isAscend:   isAscend,
+		idField:    r.idField,
+		skip:       skip,
+		limit:      q.Limit,
+		projection: p,
+	}
+	err := r.each(func(i int, d Driver) (err error) {
+		shardQuery := sq
+		it.its[i], err = d.Query(ctx, &shardQuery)
+		return err
+	})
+	if err != nil {
+		it.Close(ctx)
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func (r *RouterStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
+	groups := make(map[string][]interface{})
+	for _, doc := range docs {
+		id, err := docID(doc, r.idField)
+		if err != nil {
+			return err
+		}
+		name, _, err := r.route(ctx, id)
+		if err != nil {
+			return err
+		}
+		groups[name] = append(groups[name], doc)
+	}
+
+	return r.each(func(i int, d Driver) error {
+		group := groups[r.names[i]]
+		if len(group) == 0 {
+			return nil
+		}
+		return d.BulkCreate(ctx, group, opts...)
+	})
+}
+
+// BulkGet reads the documents of ids from their shards, in the order of ids
+func (r *RouterStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	groups := make(map[string][]interface{})
+	for _, id := range ids {
+		name, _, err := r.route(ctx, id)
+		if err != nil {
+			return err
+		}
+		groups[name] = append(groups[name], id)
+	}
+
+	found := make([][]map[string]interface{}, len(r.names))
+	err := r.each(func(i int, d Driver) error {
+		group := groups[r.names[i]]
+		if len(group) == 0 {
+			return nil
+		}
+		return d.BulkGet(ctx, group, &found[i], opts...)
+	})
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]map[string]interface{})
+	for _, shard := range found {
+		for _, d := range shard {
+			id, _ := getPath(d, r.idField)
+			byID[fmt.Sprintf("%v", id)] = d
+		}
+	}
+
+	out := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if d, ok := byID[fmt.Sprintf("%v", id)]; ok {
+			out = append(out, d)
+		}
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+func (r *RouterStore) Migrate(ctx context.Context, config interface{}) error {
+	return r.each(func(i int, d Driver) error {
+		return d.Migrate(ctx, config)
+	})
+}
+
+func (r *RouterStore) As(i interface{}) bool { return false }
+
+func (r *RouterStore) Ping(ctx context.Context) error {
+	return r.each(func(i int, d Driver) error {
+		return d.Ping(ctx)
+	})
+}
+
+func (r *RouterStore) Disconnect(ctx context.Context) error {
+	return r.each(func(i int, d Driver) error {
+		return d.Disconnect(ctx)
+	})
+}
+
+func (r *RouterStore) Pull(ctx context.Context, condition, removeCondition Field) error {
+	return r.each(func(i int, d Driver) error {
+		return d.Pull(ctx, condition, removeCondition)
+	})
+}
+
+// Distinct returns the distinct values of every shard
+func (r *RouterStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	values := make([][]interface{}, len(r.names))
+	err := r.each(func(i int, d Driver) (err error) {
+		values[i], err = d.Distinct(ctx, fieldName, filter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, 0)
+	for _, shard := range values {
+		for _, v := range shard {
+			if !anyValue(out, func(o interface{}) bool { return equalValue(o, v) }) {
+				out = append(out, v)
+			}
+		}
+	}
+	return out, nil
+}
+
+// RunInTransaction runs fn in a transaction of the shard of ctx, the shard
+// function is called with a nil id. Transactions can not span shards, the
+// writes of documents of other shards fail.
+func (r *RouterStore) RunInTransaction(ctx context.Context, fn func(tx Tx) error) error {
+	name, d, err := r.route(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return d.RunInTransaction(ctx, func(tx Tx) error {
+		return fn(&routerTx{router: r, shard: name, tx: tx})
+	})
+}
+
+// Watch merges the change streams of the shards, the changes of different
+// shards are not ordered with each other
+func (r *RouterStore) Watch(ctx context.Context, query *QueryOpt) (ChangeStream, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	s := &routerStream{
+		streams: make([]ChangeStream, len(r.names)),
+		events:  make(chan routedChange),
+		cancel:  cancel,
+	}
+
+	err := r.each(func(i int, d Driver) (err error) {
+		s.streams[i], err = d.Watch(wctx, query)
+		return err
+	})
+	if err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+
+	for _, stream := range s.streams {
+		go s.forward(wctx, stream)
+	}
+	return s, nil
+}
+
+// Aggregate aggregates the documents matching the filter of every shard,
+// which are all read
+func (r *RouterStore) Aggregate(ctx context.Context, agg *AggregateOpt, docs interface{}) error {
+	if err := agg.Validate(); err != nil {
+		return err
+	}
+
+	var all []map[string]interface{}
+	if err := r.Find(ctx, &QueryOpt{Filter: agg.Filter}, &all); err != nil {
+		return err
+	}
+
+	rows, err := AggregateDocs(all, agg)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(rows, docs)
+}
+
+// BulkWrite sends the writes of every shard to its bulk write. Ordered bulk
+// writes run one by one, see WriteEach.
+func (r *RouterStore) BulkWrite(ctx context.Context, ops []WriteOp, opts ...interface{}) ([]WriteResult, error) {
+	if GetBulkWriteOpt(opts...).Ordered {
+		return WriteEach(ctx, r, r.idField, ops, opts...)
+	}
+
+	results := make([]WriteResult, len(ops))
+	groups := make(map[string][]int)
+	for i, op := range ops {
+		id := op.ID
+		if op.Op == WriteCreate {
+			id, _ = docID(op.Doc, r.idField)
+		}
+		results[i] = WriteResult{ID: id, Op: op.Op, Status: WriteSkipped}
+
+		name, _, err := r.route(ctx, id)
+		if err != nil {
+			results[i].Status = WriteFailed
+			results[i].Error = err
+			continue
+		}
+		groups[name] = append(groups[name], i)
+	}
+
+	err := r.each(func(i int, d Driver) error {
+		index := groups[r.names[i]]
+		if len(index) == 0 {
+			return nil
+		}
+
+		shardOps := make([]WriteOp, len(index))
+		for j, k := range index {
+			shardOps[j] = ops[k]
+		}
+
+		res, err := d.BulkWrite(ctx, shardOps, opts...)
+		if len(res) != len(shardOps) {
+			return err
+		}
+		for j, k := range index {
+			results[k] = res[j]
+		}
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+
+	return results, PartialWriteError(results)
+}
+
+// routerIterator merges the iterators of the shards
+type routerIterator struct {
+	its        []Iterator
+	heads      []map[string]interface{}
+	done       []bool
+	orderBy    string
+	isAscend   bool
+	idField    string
+	skip       int
+	limit      int
+	returned   int
+	projection Projection
+}
+
+// head returns the next document of shard i, nil when it has no more
+func (it *routerIterator) head(ctx context.Context, i int) (map[string]interface{}, error) {
+	if it.heads[i] != nil || it.done[i] {
+		return it.heads[i], nil
+	}
+
+	d := make(map[string]interface{})
+	if err := it.its[i].Next(ctx, &d); err != nil {
+		if err == EndOfDoc {
+			it.done[i] = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	it.heads[i] = d
+	return d, nil
+}
+
+// before reports whether a comes before b, like QueryDocs sorts them
+func (it *routerIterator) before(a, b map[string]interface{}) bool {
+	va, _ := getPath(a, it.orderBy)
+	vb, _ := getPath(b, it.orderBy)
+	c := sortValue(va, vb)
+	if c == 0 {
+		ia, _ := getPath(a, it.idField)
+		ib, _ := getPath(b, it.idField)
+		c = sortValue(ia, ib)
+	}
+	if it.isAscend {
+		return c < 0
+	}
+	return c > 0
+}
+
+// pop returns the next merged document
+func (it *routerIterator) pop(ctx context.Context) (map[string]interface{}, error) {
+	next := -1
+	for i := range it.its {
+		d, err := it.head(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			continue
+		}
+		if next < 0 {
+			next = i
+			if it.orderBy == "" {
+				break
+			}
+			continue
+		}
+		if it.before(d, it.heads[next]) {
+			next = i
+		}
+	}
+
+	if next < 0 {
+		return nil, EndOfDoc
+	}
+
+	d := it.heads[next]
+	it.heads[next] = nil
+	return d, nil
+}
+
+func (it *routerIterator) Next(ctx context.Context, doc interface{}) error {
+	if it.limit > 0 && it.returned >= it.limit {
+		return EndOfDoc
+	}
+
+	for ; it.skip > 0; it.skip-- {
+		if _, err := it.pop(ctx); err != nil {
+			return err
+		}
+	}
+
+	d, err := it.pop(ctx)
+	if err != nil {
+		return err
+	}
+
+	it.returned++
+	return util.DecodeJSON(ProjectDoc(d, it.projection, it.idField), doc)
+}
+
+func (it *routerIterator) Close(ctx context.Context) error {
+	var out error
+	for _, i := range it.its {
+		if i == nil {
+			continue
+		}
+		if err := i.Close(ctx); err != nil && out == nil {
+			out = err
+		}
+	}
+	return out
+}
+
+type routedChange struct {
+	event ChangeEvent
+	err   error
+}
+
+// routerStream merges the change streams of the shards
+type routerStream struct {
+	streams []ChangeStream
+	events  chan routedChange
+	cancel  context.CancelFunc
+	mux     sync.Mutex
+	closed  bool
+}
+
+func (s *routerStream) forward(ctx context.Context, stream ChangeStream) {
+	for {
+		var ev ChangeEvent
+		err := stream.Next(ctx, &ev)
+		select {
+		case s.events <- routedChange{event: ev, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *routerStream) Next(ctx context.Context, event *ChangeEvent) error {
+	s.mux.Lock()
+	closed := s.closed
+	s.mux.Unlock()
+	if closed {
+		return errors.New("[docstore/router] change stream is closed")
+	}
+
+	select {
+	case c := <-s.events:
+		if c.err != nil {
+			return c.err
+		}
+		*event = c.event
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *routerStream) Close(ctx context.Context) error {
+	s.mux.Lock()
+	s.closed = true
+	s.mux.Unlock()
+	s.cancel()
+
+	var out error
+	for _, stream := range s.streams {
+		if stream == nil {
+			continue
+		}
+		if err := stream.Close(ctx); err != nil && out == nil {
+			out = err
+		}
+	}
+	return out
+}
+
+// routerTx is a transaction of a shard
+type routerTx struct {
+	router *RouterStore
+	shard  string
+	tx     Tx
+}
+
+func (t *routerTx) check(ctx context.Context, id interface{}) error {
+	name, _, err := t.router.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	if name != t.shard {
+		return fmt.Errorf("[docstore/router] document %v is not on shard %s", id, t.shard)
+	}
+	return nil
+}
+
+func (t *routerTx) Create(ctx context.Context, doc interface{}) error {
+	id, err := docID(doc, t.router.idField)
+	if err != nil {
+		return err
+	}
+	if err := t.check(ctx, id); err != nil {
+		return err
+	}
+	return t.tx.Create(ctx, doc)
+}
+
+func (t *routerTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	if err := t.check(ctx, id); err != nil {
+		return err
+	}
+	return t.tx.Update(ctx, id, doc, replace)
+}
+
+func (t *routerTx) Delete(ctx context.Context, id interface{}) error {
+	if err := t.check(ctx, id); err != nil {
+		return err
+	}
+	return t.tx.Delete(ctx, id)
+}
+
+func (t *routerTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	if err := t.check(ctx, id); err != nil {
+		return err
+	}
+	return t.tx.Get(ctx, id, doc)
+}
@@ -0,0 +1,193 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type shardCtx struct{}
+
+// testShard routes by the hash of the ID, and transactions by the shard of
+// the context
+func testShard(ctx context.Context, id interface{}) (string, error) {
+	if id == nil {
+		if s, ok := ctx.Value(shardCtx{}).(string); ok {
+			return s, nil
+		}
+	}
+	return HashShard("a", "b", "c")(ctx, id)
+}
+
+func newTestRouter() (*RouterStore, map[string]Driver) {
+	shards := map[string]Driver{
+		"a": NewMemoryStore("test", "id"),
+		"b": NewMemoryStore("test", "id"),
+		"c": NewMemoryStore("test", "id"),
+	}
+	return NewRouterStore("id", testShard, shards), shards
+}
+
+func TestRouterStore(t *testing.T) {
+	r, _ := newTestRouter()
+	// the changes of different shards are not ordered with each other, and
+	// transactions can not span shards
+	t.Run("CRUD", func(t *testing.T) { DriverCRUDTest(r, t) })
+	t.Run("Bulk", func(t *testing.T) { DriverBulkTest(r, t) })
+	t.Run("Filter", func(t *testing.T) { DriverFilterTest(r, t) })
+	t.Run("UpdateMany", func(t *testing.T) { DriverUpdateManyTest(r, t) })
+	t.Run("DeleteMany", func(t *testing.T) { DriverDeleteManyTest(r, t) })
+	t.Run("Pull", func(t *testing.T) { DriverPullTest(r, t) })
+	t.Run("UpdateOps", func(t *testing.T) { DriverUpdateOpsTest(r, t) })
+	t.Run("Distinct", func(t *testing.T) { DriverDistinctTest(r, t) })
+	t.Run("Cursor", func(t *testing.T) { DriverCursorTest(r, t) })
+	t.Run("Aggregate", func(t *testing.T) { DriverAggregateTest(r, t) })
+	t.Run("Version", func(t *testing.T) { DriverVersionTest(r, t) })
+	t.Run("BulkWrite", func(t *testing.T) { DriverBulkWriteTest(r, t) })
+	t.Run("Projection", func(t *testing.T) { DriverProjectionTest(r, t) })
+}
+
+func TestRouterStore_Merge(t *testing.T) {
+	r, shards := newTestRouter()
+	ctx := context.Background()
+
+	docs := make([]interface{}, 0, 30)
+	for i := 0; i < 30; i++ {
+		docs = append(docs, map[string]interface{}{"id": fmt.Sprintf("M-%02d", i), "rank": i % 10, "odd": i%2 == 1})
+	}
+	require.Nil(t, r.BulkCreate(ctx, docs))
+
+	for name, d := range shards {
+		n, err := d.Count(ctx, nil)
+		require.Nil(t, err)
+		assert.NotZero(t, n, "shard %s", name)
+	}
+	n, err := r.Count(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "odd", Ops: constant.EQ, Value: true}}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(15), n)
+
+	var out []map[string]interface{}
+	require.Nil(t, r.Find(ctx, &QueryOpt{OrderBy: "rank", IsAscend: false, Skip: 2, Limit: 5, Fields: []string{"odd"}}, &out))
+	require.Len(t, out, 5)
+	// rank 9 then 8, ties ordered by ID in the same order
+	assert.Equal(t, []string{"M-09", "M-28", "M-18", "M-08", "M-27"}, idsOf(out))
+	assert.Nil(t, out[0]["rank"], "the sort field is not projected")
+
+	out = nil
+	require.Nil(t, r.Find(ctx, &QueryOpt{OrderBy: "id", IsAscend: true, Page: 2, Limit: 4}, &out))
+	assert.Equal(t, []string{"M-08", "M-09", "M-10", "M-11"}, idsOf(out))
+
+	var doc map[string]interface{}
+	require.Nil(t, r.FindOne(ctx, &QueryOpt{OrderBy: "rank", IsAscend: true}, &doc))
+	assert.Equal(t, "M-00", doc["id"])
+	assert.Equal(t, NotFound, r.FindOne(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "rank", Ops: constant.GT, Value: 10}}}, &doc))
+
+	out = nil
+	require.Nil(t, r.BulkGet(ctx, []interface{}{"M-05", "M-missing", "M-01", "M-20"}, &out))
+	assert.Equal(t, []string{"M-05", "M-01", "M-20"}, idsOf(out))
+
+	// pages of a cursor query resume every shard after the same document
+	var all []string
+	q := &QueryOpt{OrderBy: "rank", IsAscend: true, Limit: 7}
+	for {
+		var page []map[string]interface{}
+		require.Nil(t, r.Find(ctx, q, &page))
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, idsOf(page)...)
+		q.Cursor, err = EncodeCursor(q, page[len(page)-1], "id")
+		require.Nil(t, err)
+	}
+	require.Len(t, all, 30)
+	assert.Equal(t, []string{"M-00", "M-10", "M-20", "M-01"}, all[:4])
+}
+
+func TestRouterStore_Transaction(t *testing.T) {
+	r, _ := newTestRouter()
+	ctx := context.Background()
+
+	assert.NotNil(t, r.RunInTransaction(ctx, func(tx Tx) error { return nil }), "no shard in context")
+
+	// the IDs of a shard
+	ids := make([]string, 0, 2)
+	for i := 0; len(ids) < 2; i++ {
+		id := fmt.Sprintf("TX-%d", i)
+		if s, _ := testShard(ctx, id); s == "b" {
+			ids = append(ids, id)
+		}
+	}
+	other := "TX-other"
+	for i := 0; ; i++ {
+		if s, _ := testShard(ctx, other); s != "b" {
+			break
+		}
+		other = fmt.Sprintf("TX-other-%d", i)
+	}
+
+	tctx := context.WithValue(ctx, shardCtx{}, "b")
+	err := r.RunInTransaction(tctx, func(tx Tx) error {
+		if err := tx.Create(tctx, map[string]interface{}{"id": ids[0], "stock": 1}); err != nil {
+			return err
+		}
+		return tx.Create(tctx, map[string]interface{}{"id": ids[1], "stock": 2})
+	})
+	require.Nil(t, err)
+
+	errAbort := errors.New("abort")
+	err = r.RunInTransaction(tctx, func(tx Tx) error {
+		if err := tx.Delete(tctx, ids[0]); err != nil {
+			return err
+		}
+		if err := tx.Create(tctx, map[string]interface{}{"id": other}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.NotNil(t, err)
+	assert.NotErrorIs(t, err, errAbort, "the write of another shard fails")
+
+	doc := make(map[string]interface{})
+	require.Nil(t, r.Get(ctx, ids[0], &doc))
+	assert.Equal(t, NotFound, r.Get(ctx, other, &doc))
+}
+
+func TestRouterStore_Watch(t *testing.T) {
+	r, _ := newTestRouter()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := r.Watch(ctx, nil)
+	require.Nil(t, err)
+
+	for i := 0; i < 6; i++ {
+		require.Nil(t, r.Create(ctx, map[string]interface{}{"id": fmt.Sprintf("W-%d", i)}))
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		var ev ChangeEvent
+		require.Nil(t, stream.Next(ctx, &ev))
+		assert.Equal(t, ChangeInsert, ev.Type)
+		seen[fmt.Sprintf("%v", ev.ID)] = true
+	}
+	assert.Len(t, seen, 6)
+
+	require.Nil(t, stream.Close(ctx))
+	var ev ChangeEvent
+	assert.NotNil(t, stream.Next(ctx, &ev))
+}
+
+func idsOf(docs []map[string]interface{}) []string {
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = fmt.Sprintf("%v", d["id"])
+	}
+	return ids
+}
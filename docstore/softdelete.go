@@ -0,0 +1,218 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/util"
+)
+
+const defaultDeletedField = "deleted_at"
+
+// errDeleted reports a soft delete of a document already deleted
+var errDeleted = errors.New("[docstore] document already deleted")
+
+// visible returns a copy of query hiding soft deleted and expired documents
+func (s *CachedStore) visible(query *QueryOpt) *QueryOpt {
+	if !s.SoftDelete && !s.expiring() {
+		return query
+	}
+
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+	if s.SoftDelete {
+		q.Filter = s.visibleFilter(q.Filter)
+	}
+	if s.expiring() {
+		q.Filter = s.unexpiredFilter(q.Filter)
+	}
+	return q
+}
+
+// visibleFilter appends the filter hiding soft deleted documents, documents
+// without the deleted field are visible. Firestore can not match a missing
+// field, so on Firestore only the equality filters of the query run on the
+// server, and every document they match is fetched to be filtered, sorted
+// and paged by the driver.
+func (s *CachedStore) visibleFilter(filters []FilterOpt) []FilterOpt {
+	out := make([]FilterOpt, 0, len(filters)+1)
+	out = append(out, filters...)
+	return append(out, FilterOpt{Field: s.deletedField(), Ops: constant.EQ, Value: nil})
+}
+
+func (s *CachedStore) deletedField() string {
+	if s.DeletedField == "" {
+		return defaultDeletedField
+	}
+	return s.DeletedField
+}
+
+func (s *CachedStore) isDeleted(doc map[string]interface{}) bool {
+	v, ok := getPath(doc, s.deletedField())
+	return ok && v != nil
+}
+
+// deletedAt returns the time soft deleted documents are marked with
+func (s *CachedStore) deletedAt() map[string]interface{} {
+	return map[string]interface{}{s.deletedField(): s.TimeGenerator(reflect.TypeOf(time.Time{}), nil)}
+}
+
+// now returns the time of the time generator, the clock of the deletes
+func (s *CachedStore) now() time.Time {
+	if t, ok := s.TimeGenerator(reflect.TypeOf(time.Time{}), nil).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// softDelete marks the document deleted, a deleted document keeps the time
+// it was first deleted at
+func (s *CachedStore) softDelete(ctx context.Context, id interface{}) error {
+	if err := s.deleteCache(ctx, "Delete", id); err != nil {
+		return err
+	}
+
+	filters := s.visibleFilter([]FilterOpt{{Field: s.IDField, Ops: constant.EQ, Value: id}})
+	if err := s.storage.UpdateMany(s.fieldVersioning(ctx, nil), filters, s.deletedAt()); err != nil && err != NotFound {
+		return err
+	}
+
+	return nil
+}
+
+// softDeleted reports whether the document of id is missing or already
+// soft deleted
+func (s *CachedStore) softDeleted(ctx context.Context, id interface{}) (bool, error) {
+	d := make(map[string]interface{})
+	if err := s.storage.Get(ctx, id, &d); err != nil {
+		if err == NotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	return s.isDeleted(d), nil
+}
+
+// softDeleteMany marks the documents matching query deleted, query already
+// hides the deleted documents so they are not marked again
+func (s *CachedStore) softDeleteMany(ctx context.Context, query *QueryOpt) error {
+	filters := query.Filter
+
+	if s.CacheExpiration != 1 {
+		var docs []map[string]interface{}
+		if err := s.storage.Find(ctx, &QueryOpt{Filter: filters}, &docs); err != nil {
+			return err
+		}
+		for _, d := range docs {
+			id, _ := getPath(d, s.IDField)
+			if err := s.deleteCache(ctx, "DeleteMany", id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.storage.UpdateMany(s.fieldVersioning(ctx, nil), filters, s.deletedAt())
+}
+
+// Restore undeletes a soft deleted document
+func (s *CachedStore) Restore(ctx context.Context, id interface{}) error {
+	if !s.SoftDelete {
+		return errors.New("[docstore] soft delete is not enabled")
+	}
+
+	fields := []Field{{Name: s.deletedField(), Value: nil}}
+	event := &HookEvent{Op: "Restore", ID: id, Doc: fieldsDoc(fields)}
+	if err := s.before(ctx, BeforeUpdate, event); err != nil {
+		return err
+	}
+
+	if err := s.deleteCache(ctx, "Restore", id); err != nil {
+		return err
+	}
+	defer s.invalidate(ctx, "Restore")
+
+	if err := s.storage.UpdateField(s.fieldVersioning(ctx, fields), id, fields); err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterUpdate, event)
+}
+
+// FindDeleted finds the soft deleted documents matching the query
+func (s *CachedStore) FindDeleted(ctx context.Context, query *QueryOpt, docs interface{}) error {
+	if !s.SoftDelete {
+		return errors.New("[docstore] soft delete is not enabled")
+	}
+
+	if !util.IsPointerOfSlice(docs) {
+		return errors.New("[docstore] docs should be a pointer of slice")
+	}
+
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+
+	filters, err := s.tenantFilter(ctx, q.Filter)
+	if err != nil {
+		return err
+	}
+	if filters, err = s.blindFilters(filters); err != nil {
+		return err
+	}
+	q.Filter = append(append(make([]FilterOpt, 0, len(filters)+1), filters...),
+		FilterOpt{Field: s.deletedField(), Ops: constant.NE, Value: nil})
+
+	if !s.encrypting() {
+		return s.storage.Find(ctx, q, docs)
+	}
+
+	var all []map[string]interface{}
+	if err := s.storage.Find(ctx, q, &all); err != nil {
+		return err
+	}
+	for _, d := range all {
+		if err := s.decryptDoc(d); err != nil {
+			return err
+		}
+	}
+
+	return decodeDocs(all, docs)
+}
+
+// Purge permanently deletes the documents soft deleted more than olderThan
+// ago by the time generator, the documents of the tenant only when the store
+// is scoped by tenant
+func (s *CachedStore) Purge(ctx context.Context, olderThan time.Duration) error {
+	if !s.SoftDelete {
+		return errors.New("[docstore] soft delete is not enabled")
+	}
+
+	cutoff := s.now().Add(-olderThan)
+	filters, err := s.tenantFilter(ctx, []FilterOpt{{Field: s.deletedField(), Ops: constant.LT, Value: cutoff}})
+	if err != nil {
+		return err
+	}
+
+	event := &HookEvent{Op: "Purge", Filter: filters}
+	if err := s.before(ctx, BeforeDelete, event); err != nil {
+		return err
+	}
+
+	defer s.invalidate(ctx, "Purge")
+
+	err = s.storage.DeleteMany(ctx, &QueryOpt{Filter: filters})
+	if err == NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.after(ctx, AfterDelete, event)
+}
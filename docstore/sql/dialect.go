@@ -0,0 +1,234 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// dialect writes the SQL differing between the databases. Documents are kept
+// in a doc column, as JSONB on postgres and as JSON text on sqlite.
+type dialect interface {
+	name() string
+	placeholder(n int) string
+	docType() string
+	forUpdate() string
+	// value returns the JSON value of the path in doc, typeOf the JSON type of
+	// a value expression, missing values are NULL
+	value(path []string) string
+	typeOf(value string) string
+	// elements is a FROM clause of the elements of the array expression, as
+	// the columns value and type
+	elements(value string) string
+	// compare returns the expression comparing a value of a JSON type, one
+	// of number, string or bool, to a parameter
+	compare(value, op, typ, param string) string
+	// indexCompare is compare on a value expression, and arrays the
+	// condition selecting its non empty arrays, both served by the expression
+	// indexes of Migrate
+	indexCompare(value, op, typ, param string) string
+	arrays(value string) string
+	// isType returns the condition on the JSON type of a value
+	isType(value, typ string) string
+	like(value, param string) string
+	// orderKeys returns the expressions sorting values by type then value
+	orderKeys(value string) []string
+}
+
+// dialectOf returns the dialect of a database/sql driver name
+func dialectOf(driver string) (dialect, error) {
+	switch strings.ToLower(driver) {
+	case "postgres", "pgx", "pq", "postgresql", "cloudsqlpostgres":
+		return postgres{}, nil
+	case "sqlite", "sqlite3":
+		return sqlite{}, nil
+	}
+	return nil, fmt.Errorf("[docstore/sql] unsupported dialect %s", driver)
+}
+
+// detectDialect guesses the dialect from the driver of db
+func detectDialect(db *sql.DB) (dialect, error) {
+	t := strings.ToLower(fmt.Sprintf("%T", db.Driver()))
+	switch {
+	case strings.Contains(t, "sqlite"):
+		return sqlite{}, nil
+	case strings.Contains(t, "pq") || strings.Contains(t, "pgx") || strings.Contains(t, "postgres"):
+		return postgres{}, nil
+	}
+	return nil, fmt.Errorf("[docstore/sql] can not detect the dialect of %s, set Connection.Dialect", t)
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+type sqlite struct{}
+
+func (sqlite) name() string             { return DialectSQLite }
+func (sqlite) placeholder(n int) string { return "?" + strconv.Itoa(n) }
+func (sqlite) docType() string          { return "TEXT" }
+func (sqlite) forUpdate() string        { return "" }
+
+func (sqlite) jsonPath(path []string) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, p := range path {
+		b.WriteString(`."` + p + `"`)
+	}
+	return quoteString(b.String())
+}
+
+func (d sqlite) value(path []string) string {
+	return "json_extract(doc, " + d.jsonPath(path) + ")"
+}
+
+// typeOf only accepts the expressions of value and the value column of
+// elements, sqlite reads the type from the path
+func (d sqlite) typeOf(value string) string {
+	if value == "value" {
+		return "type"
+	}
+	return "json_type(" + strings.TrimPrefix(value, "json_extract(")
+}
+
+func (d sqlite) elements(value string) string {
+	return "json_each(" + strings.TrimPrefix(value, "json_extract(")
+}
+
+func (d sqlite) isType(value, typ string) string {
+	switch typ {
+	case "number":
+		return d.typeOf(value) + " IN ('integer', 'real')"
+	case "string":
+		return d.typeOf(value) + " = 'text'"
+	case "bool":
+		return d.typeOf(value) + " IN ('true', 'false')"
+	case "array":
+		return d.typeOf(value) + " = 'array'"
+	case "null":
+		return "(" + d.typeOf(value) + " IS NULL OR " + d.typeOf(value) + " = 'null')"
+	}
+	return "FALSE"
+}
+
+func (d sqlite) compare(value, op, typ, param string) string {
+	return d.isType(value, typ) + " AND " + value + " " + op + " " + param
+}
+
+func (d sqlite) indexCompare(value, op, typ, param string) string {
+	return d.compare(value, op, typ, param)
+}
+
+// arrays reads the arrays as the JSON text json_extract returns for them
+func (d sqlite) arrays(value string) string {
+	return value + " >= '[' AND " + value + ` < '\' AND ` + d.isType(value, "array")
+}
+
+func (d sqlite) like(value, param string) string {
+	return d.isType(value, "string") + " AND lower(" + value + ") LIKE " + param + ` ESCAPE '\'`
+}
+
+func (d sqlite) orderKeys(value string) []string {
+	t := d.typeOf(value)
+	return []string{
+		"CASE WHEN " + t + " IS NULL OR " + t + " = 'null' THEN 0 WHEN " + t + " IN ('integer', 'real') THEN 1 WHEN " +
+			t + " = 'text' THEN 2 WHEN " + t + " IN ('true', 'false') THEN 4 ELSE 3 END",
+		value,
+	}
+}
+
+type postgres struct{}
+
+func (postgres) name() string             { return DialectPostgres }
+func (postgres) placeholder(n int) string { return "$" + strconv.Itoa(n) }
+func (postgres) docType() string          { return "JSONB" }
+func (postgres) forUpdate() string        { return " FOR UPDATE" }
+
+func (postgres) value(path []string) string {
+	if len(path) == 1 {
+		return "(doc -> " + quoteString(path[0]) + ")"
+	}
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = `"` + strings.ReplaceAll(p, `"`, `\"`) + `"`
+	}
+	return "(doc #> " + quoteString("{"+strings.Join(parts, ",")+"}") + ")"
+}
+
+func (postgres) typeOf(value string) string {
+	return "jsonb_typeof(" + value + ")"
+}
+
+func (postgres) elements(value string) string {
+	return "jsonb_array_elements(" + value + ") AS e(value)"
+}
+
+func (d postgres) isType(value, typ string) string {
+	switch typ {
+	case "number", "string", "array":
+		return d.typeOf(value) + " = '" + typ + "'"
+	case "bool":
+		return d.typeOf(value) + " = 'boolean'"
+	case "null":
+		return "(" + value + " IS NULL OR " + d.typeOf(value) + " = 'null')"
+	}
+	return "FALSE"
+}
+
+// compare only casts the values of the type, postgres may evaluate the cast
+// before the condition on the type
+func (d postgres) compare(value, op, typ, param string) string {
+	switch typ {
+	case "number":
+		return "(CASE WHEN " + d.isType(value, typ) + " THEN (" + value + ")::numeric END) " + op + " " + param
+	case "string":
+		return d.isType(value, typ) + " AND (" + value + ` #>> '{}') COLLATE "C" ` + op + " " + param
+	}
+	return "(CASE WHEN " + d.isType(value, typ) + " THEN (" + value + ")::boolean END) " + op + " " + param
+}
+
+// indexCompare compares JSONB values, which the indexes order by type then
+// value. Strings are ordered with the collation of the database, so their
+// ranges are compared with compare.
+func (d postgres) indexCompare(value, op, typ, param string) string {
+	switch typ {
+	case "number":
+		return d.isType(value, typ) + " AND " + value + " " + op + " to_jsonb(CAST(" + param + " AS numeric))"
+	case "string":
+		if op == "=" {
+			return d.isType(value, typ) + " AND " + value + " = to_jsonb(CAST(" + param + " AS text))"
+		}
+		return d.compare(value, op, typ, param)
+	}
+	return d.isType(value, typ) + " AND " + value + " " + op + " to_jsonb(CAST(" + param + " AS boolean))"
+}
+
+// arrays relies on the JSONB order, non empty arrays sort after booleans and
+// before objects
+func (d postgres) arrays(value string) string {
+	return value + " > 'true'::jsonb AND " + value + " < '{}'::jsonb"
+}
+
+func (d postgres) like(value, param string) string {
+	return d.isType(value, "string") + " AND lower(" + value + ` #>> '{}') LIKE ` + param + ` ESCAPE '\'`
+}
+
+func (d postgres) orderKeys(value string) []string {
+	t := d.typeOf(value)
+	return []string{
+		"CASE " + t + " WHEN 'number' THEN 1 WHEN 'string' THEN 2 WHEN 'boolean' THEN 4 WHEN 'object' THEN 3 WHEN 'array' THEN 3 ELSE 0 END",
+		"CASE WHEN " + t + " = 'number' THEN (" + value + ")::numeric END",
+		"CASE WHEN " + t + " = 'string' THEN " + value + ` #>> '{}' END COLLATE "C"`,
+		"CASE WHEN " + t + " = 'boolean' THEN (" + value + ")::boolean END",
+	}
+}
@@ -0,0 +1,61 @@
+package sql
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type index struct {
+	name   string
+	fields []string
+	unique bool
+}
+
+// parseIndex reads an index of Config.Indexes, the mongo driver format
+// {"keys": {field: 1}, "options": {"name": ..., "unique": ...}}. Missing
+// fields are NULL in the index, so unique indexes are sparse.
+func parseIndex(conf map[string]map[string]interface{}) (index, error) {
+	var idx index
+
+	keys := make([]string, 0, len(conf["keys"]))
+	for k := range conf["keys"] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch v := conf["keys"][k].(type) {
+		case []interface{}:
+			// compound keys keep the order of the list
+			for _, e := range v {
+				m, ok := e.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				fields := make([]string, 0, len(m))
+				for f := range m {
+					fields = append(fields, f)
+				}
+				sort.Strings(fields)
+				idx.fields = append(idx.fields, fields...)
+			}
+		default:
+			idx.fields = append(idx.fields, k)
+		}
+	}
+
+	if len(idx.fields) == 0 {
+		return idx, errors.New("[docstore/sql] index has no keys")
+	}
+
+	opts := conf["options"]
+	idx.name, _ = opts["name"].(string)
+	idx.unique, _ = opts["unique"].(bool)
+
+	if idx.name == "" {
+		idx.name = strings.Join(idx.fields, "_1_") + "_1"
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,340 @@
+package sql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bondhan/golib/constant"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+// timeFormat is the stored form of time values, fixed width UTC so the
+// stored strings sort like the times
+const timeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// builder writes a where clause and collects its parameters
+type builder struct {
+	d    dialect
+	args []interface{}
+}
+
+func (b *builder) param(v interface{}) string {
+	b.args = append(b.args, v)
+	return b.d.placeholder(len(b.args))
+}
+
+// where translates filters into a condition. exact is false when a filter
+// has no translation with the semantics of docstore.Match, the condition then
+// selects a superset of the matching documents and they are matched again in
+// Go.
+func (b *builder) where(filters []docstore.FilterOpt) (cond string, exact bool) {
+	exact = true
+	conds := make([]string, 0, len(filters))
+	for _, f := range filters {
+		c, ok := b.filter(f)
+		if !ok {
+			exact = false
+		}
+		if c != "" {
+			conds = append(conds, c)
+		}
+	}
+
+	if len(conds) == 0 {
+		return "", exact
+	}
+	return strings.Join(conds, " AND "), exact
+}
+
+// filter returns the condition of f, an empty condition selects every
+// document
+func (b *builder) filter(f docstore.FilterOpt) (string, bool) {
+	switch f.Ops {
+	case constant.AND:
+		subs, ok := f.Value.([]docstore.FilterOpt)
+		if !ok {
+			return "", false
+		}
+		c, exact := b.where(subs)
+		if c == "" {
+			return "", exact
+		}
+		return "(" + c + ")", exact
+	case constant.OR:
+		subs, ok := f.Value.([]docstore.FilterOpt)
+		if !ok {
+			return "", false
+		}
+		n := len(b.args)
+		conds := make([]string, 0, len(subs))
+		for _, sf := range subs {
+			c, exact := b.filter(sf)
+			if !exact || c == "" {
+				// a branch selecting any document makes the whole OR do so
+				b.args = b.args[:n]
+				return "", false
+			}
+			conds = append(conds, c)
+		}
+		if len(conds) == 0 {
+			return "FALSE", true
+		}
+		return "(" + strings.Join(conds, " OR ") + ")", true
+	}
+
+	if strings.ContainsAny(f.Field, `."'`) || f.Field == "" {
+		// dotted paths may cross arrays, which Match looks into
+		return "", false
+	}
+	value := b.d.value([]string{f.Field})
+
+	switch f.Ops {
+	case constant.EQ, constant.SE:
+		return b.any(value, f.Value, "=")
+	case constant.NE:
+		c, ok := b.any(value, f.Value, "=")
+		if !ok {
+			return "", false
+		}
+		return not(c), true
+	case constant.GT, constant.GE, constant.LT, constant.LE:
+		if typ := scalarType(f.Value); typ == "" || typ == "null" || typ == "bool" {
+			return "", false
+		}
+		return b.any(value, f.Value, f.Ops)
+	case constant.IN, constant.NIN:
+		c, ok := b.in(value, f.Value)
+		if !ok || f.Ops == constant.IN {
+			return c, ok
+		}
+		return not(c), true
+	case constant.EX:
+		want, ok := f.Value.(bool)
+		if !ok {
+			want = f.Value != nil
+		}
+		if want {
+			return b.d.typeOf(value) + " IS NOT NULL", true
+		}
+		return b.d.typeOf(value) + " IS NULL", true
+	case constant.RE:
+		s, ok := f.Value.(string)
+		if !ok {
+			return "", false
+		}
+		text, start, end := docstore.Pattern(s)
+		if !isASCII(text) {
+			return "", false
+		}
+		like := escapeLike(strings.ToLower(text))
+		if !start {
+			like = "%" + like
+		}
+		if !end {
+			like += "%"
+		}
+		p := b.param(like)
+		return b.elementCond(value, b.d.like(value, p), func(v string) string { return b.d.like(v, p) }), true
+	}
+
+	return "", false
+}
+
+// any returns the condition of a value or one of its array elements
+// comparing to v, like Match does
+func (b *builder) any(value string, v interface{}, op string) (string, bool) {
+	v = plainValue(v)
+	typ := scalarType(v)
+	switch typ {
+	case "":
+		return "", false
+	case "null":
+		if op != "=" {
+			return "", false
+		}
+		return b.elementCond(value, b.d.isType(value, "null"), func(v string) string { return b.d.isType(v, "null") }), true
+	}
+
+	p := b.param(v)
+	return b.elementCond(value, b.d.indexCompare(value, op, typ, p), func(v string) string { return b.d.compare(v, op, typ, p) }), true
+}
+
+func (b *builder) in(value string, vals interface{}) (string, bool) {
+	rv := reflect.ValueOf(vals)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", false
+	}
+
+	conds := make([]string, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		c, ok := b.any(value, rv.Index(i).Interface(), "=")
+		if !ok {
+			return "", false
+		}
+		conds = append(conds, c)
+	}
+
+	if len(conds) == 0 {
+		return "FALSE", true
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", true
+}
+
+// elementCond matches the condition of the value, or elem on the elements of
+// an array value. Both sides of the OR are served by the expression indexes,
+// the result is NULL for missing values so negations go through not.
+func (b *builder) elementCond(value, cond string, elem func(v string) string) string {
+	return "(" + cond + " OR " + b.d.arrays(value) +
+		" AND EXISTS (SELECT 1 FROM " + b.d.elements(value) + " WHERE " + elem("value") + "))"
+}
+
+// not negates a condition that may be NULL
+func not(cond string) string {
+	return "NOT COALESCE(" + cond + ", FALSE)"
+}
+
+// orderBy returns the ORDER BY clause of a query, the ID breaks ties like
+// docstore.QueryDocs does
+func (b *builder) orderBy(q *docstore.QueryOpt, idField string) string {
+	dir := " ASC"
+	if q.OrderBy != "" && !q.IsAscend {
+		dir = " DESC"
+	}
+
+	fields := []string{idField}
+	if q.OrderBy != "" && q.OrderBy != idField {
+		fields = []string{q.OrderBy, idField}
+	}
+
+	keys := make([]string, 0)
+	for _, f := range fields {
+		for _, k := range b.d.orderKeys(b.d.value(strings.Split(f, "."))) {
+			keys = append(keys, k+dir)
+		}
+	}
+
+	return " ORDER BY " + strings.Join(keys, ", ")
+}
+
+// scalarType returns the JSON type of a filter value, empty when it is not
+// a number, string, bool or null
+func scalarType(v interface{}) string {
+	switch plainValue(v).(type) {
+	case nil:
+		return "null"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	}
+	return ""
+}
+
+// plainValue converts v to nil, int64, float64, string or bool when it is
+// one of their kinds, times are converted to their stored form
+func plainValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+
+	if t, ok := rv.Interface().(time.Time); ok {
+		return t.UTC().Format(timeFormat)
+	}
+
+	return rv.Interface()
+}
+
+// normalizeFilters converts the time values of filters, and the strings
+// holding RFC3339 times, to their stored form
+func normalizeFilters(filters []docstore.FilterOpt) []docstore.FilterOpt {
+	if filters == nil {
+		return nil
+	}
+
+	out := make([]docstore.FilterOpt, len(filters))
+	for i, f := range filters {
+		switch v := f.Value.(type) {
+		case []docstore.FilterOpt:
+			f.Value = normalizeFilters(v)
+		case time.Time, *time.Time, string:
+			f.Value = normalizeTime(v)
+		case []time.Time:
+			vals := make([]interface{}, len(v))
+			for j, t := range v {
+				vals[j] = plainValue(t)
+			}
+			f.Value = vals
+		case []interface{}:
+			vals := make([]interface{}, len(v))
+			for j, e := range v {
+				vals[j] = normalizeTime(e)
+			}
+			f.Value = vals
+		}
+		out[i] = f
+	}
+
+	return out
+}
+
+func normalizeTime(v interface{}) interface{} {
+	switch x := v.(type) {
+	case time.Time, *time.Time:
+		return plainValue(v)
+	case string:
+		// times reach the store as RFC3339 strings once the documents are
+		// decoded into maps
+		if t, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return plainValue(t)
+		}
+	}
+	return v
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
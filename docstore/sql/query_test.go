@@ -0,0 +1,170 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bondhan/golib/constant"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+func TestPostgresWhere(t *testing.T) {
+	name := `(doc -> 'name')`
+	price := `(doc -> 'price')`
+	elem := func(value, cond, elemCond string) string {
+		return "(" + cond + " OR " + value + " > 'true'::jsonb AND " + value + " < '{}'::jsonb AND EXISTS (SELECT 1 FROM jsonb_array_elements(" +
+			value + ") AS e(value) WHERE " + elemCond + "))"
+	}
+	// the conditions of the values compare JSONB values so indexes serve them
+	jsonb := func(value, typ, op, param, cast string) string {
+		return "jsonb_typeof(" + value + ") = '" + typ + "' AND " + value + " " + op + " to_jsonb(CAST(" + param + " AS " + cast + "))"
+	}
+	str := func(value, op, param string) string {
+		return "jsonb_typeof(" + value + ") = 'string' AND (" + value + ` #>> '{}') COLLATE "C" ` + op + " " + param
+	}
+	num := func(value, op, param string) string {
+		return "(CASE WHEN jsonb_typeof(" + value + ") = 'number' THEN (" + value + ")::numeric END) " + op + " " + param
+	}
+
+	tests := []struct {
+		name   string
+		filter []docstore.FilterOpt
+		where  string
+		args   []interface{}
+		exact  bool
+	}{
+		{
+			"eq",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.EQ, Value: "apple"}},
+			elem(name, jsonb(name, "string", "=", "$1", "text"), str("value", "=", "$1")),
+			[]interface{}{"apple"},
+			true,
+		},
+		{
+			"range",
+			[]docstore.FilterOpt{
+				{Field: "price", Ops: constant.GE, Value: 10},
+				{Field: "price", Ops: constant.LT, Value: 20.5},
+			},
+			elem(price, jsonb(price, "number", ">=", "$1", "numeric"), num("value", ">=", "$1")) + " AND " +
+				elem(price, jsonb(price, "number", "<", "$2", "numeric"), num("value", "<", "$2")),
+			[]interface{}{int64(10), 20.5},
+			true,
+		},
+		{
+			"string range",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.GT, Value: "m"}},
+			elem(name, str(name, ">", "$1"), str("value", ">", "$1")),
+			[]interface{}{"m"},
+			true,
+		},
+		{
+			"bool",
+			[]docstore.FilterOpt{{Field: "active", Ops: constant.EQ, Value: true}},
+			elem(`(doc -> 'active')`,
+				jsonb(`(doc -> 'active')`, "boolean", "=", "$1", "boolean"),
+				`(CASE WHEN jsonb_typeof(value) = 'boolean' THEN (value)::boolean END) = $1`),
+			[]interface{}{true},
+			true,
+		},
+		{
+			"ne null",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.NE, Value: nil}},
+			"NOT COALESCE(" + elem(name, "("+name+" IS NULL OR jsonb_typeof("+name+") = 'null')", "(value IS NULL OR jsonb_typeof(value) = 'null')") + ", FALSE)",
+			nil,
+			true,
+		},
+		{
+			"in",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.IN, Value: []string{"a", "b"}}},
+			"(" + elem(name, jsonb(name, "string", "=", "$1", "text"), str("value", "=", "$1")) + " OR " +
+				elem(name, jsonb(name, "string", "=", "$2", "text"), str("value", "=", "$2")) + ")",
+			[]interface{}{"a", "b"},
+			true,
+		},
+		{
+			"empty in",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.IN, Value: []string{}}},
+			"FALSE",
+			nil,
+			true,
+		},
+		{
+			"exists",
+			[]docstore.FilterOpt{{Field: "deleted_at", Ops: constant.EX, Value: false}},
+			`jsonb_typeof((doc -> 'deleted_at')) IS NULL`,
+			nil,
+			true,
+		},
+		{
+			"like",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.RE, Value: "Sa_1"}},
+			elem(name,
+				"jsonb_typeof("+name+") = 'string' AND lower("+name+` #>> '{}') LIKE $1 ESCAPE '\'`,
+				`jsonb_typeof(value) = 'string' AND lower(value #>> '{}') LIKE $1 ESCAPE '\'`),
+			[]interface{}{`%sa\_1%`},
+			true,
+		},
+		{
+			"like prefix",
+			[]docstore.FilterOpt{{Field: "name", Ops: constant.RE, Value: "^Sa"}},
+			elem(name,
+				"jsonb_typeof("+name+") = 'string' AND lower("+name+` #>> '{}') LIKE $1 ESCAPE '\'`,
+				`jsonb_typeof(value) = 'string' AND lower(value #>> '{}') LIKE $1 ESCAPE '\'`),
+			[]interface{}{"sa%"},
+			true,
+		},
+		{
+			"or",
+			[]docstore.FilterOpt{{Ops: constant.OR, Value: []docstore.FilterOpt{
+				{Field: "name", Ops: constant.EQ, Value: "a"},
+				{Field: "price", Ops: constant.GT, Value: 1},
+			}}},
+			"(" + elem(name, jsonb(name, "string", "=", "$1", "text"), str("value", "=", "$1")) + " OR " +
+				elem(price, jsonb(price, "number", ">", "$2", "numeric"), num("value", ">", "$2")) + ")",
+			[]interface{}{"a", int64(1)},
+			true,
+		},
+		{
+			"or matched in go",
+			[]docstore.FilterOpt{
+				{Field: "name", Ops: constant.EQ, Value: "a"},
+				{Ops: constant.OR, Value: []docstore.FilterOpt{
+					{Field: "price", Ops: constant.GT, Value: 1},
+					{Field: "meta.origin", Ops: constant.EQ, Value: "SG"},
+				}},
+			},
+			elem(name, jsonb(name, "string", "=", "$1", "text"), str("value", "=", "$1")),
+			[]interface{}{"a"},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &builder{d: postgres{}}
+			where, exact := b.where(tt.filter)
+			assert.Equal(t, tt.where, where)
+			assert.Equal(t, tt.args, b.args)
+			assert.Equal(t, tt.exact, exact)
+		})
+	}
+}
+
+func TestPostgresOrderBy(t *testing.T) {
+	keys := func(value, dir string) string {
+		t := "jsonb_typeof(" + value + ")"
+		return "CASE " + t + " WHEN 'number' THEN 1 WHEN 'string' THEN 2 WHEN 'boolean' THEN 4 WHEN 'object' THEN 3 WHEN 'array' THEN 3 ELSE 0 END" + dir + ", " +
+			"CASE WHEN " + t + " = 'number' THEN (" + value + ")::numeric END" + dir + ", " +
+			"CASE WHEN " + t + " = 'string' THEN " + value + ` #>> '{}' END COLLATE "C"` + dir + ", " +
+			"CASE WHEN " + t + " = 'boolean' THEN (" + value + ")::boolean END" + dir
+	}
+
+	b := &builder{d: postgres{}}
+	assert.Equal(t, " ORDER BY "+keys(`(doc -> 'id')`, " ASC"), b.orderBy(&docstore.QueryOpt{}, "id"))
+	assert.Equal(t,
+		" ORDER BY "+keys(`(doc #> '{"meta","price"}')`, " DESC")+", "+keys(`(doc -> 'id')`, " DESC"),
+		b.orderBy(&docstore.QueryOpt{OrderBy: "meta.price"}, "id"))
+}
@@ -0,0 +1,1130 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imdario/mergo"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bondhan/golib/log"
+	"github.com/bondhan/golib/util"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+const bulkBatchSize = 500
+
+// SQLStore keeps the documents of a collection in a table of the same name,
+// as a JSON doc column keyed by the ID. Filters, sorting and pagination are
+// translated to SQL, the filters without translation are evaluated in Go.
+// Migrate creates the table and the indexes.
+type SQLStore struct {
+	db         *sql.DB
+	owned      bool
+	d          dialect
+	table      string
+	collection string
+	idField    string
+	mux        *sync.Mutex
+	watchers   map[*docstore.ChangeQueue]struct{}
+}
+
+// Connection opens a database, Dialect defaults to the dialect of Driver
+type Connection struct {
+	Driver  string `json:"driver"`
+	DSN     string `json:"dsn"`
+	Dialect string `json:"dialect"`
+}
+
+func init() {
+	docstore.RegisterDriver("sql", SQLStoreFactory)
+	docstore.RegisterErrorClassifier("sql", IsTransient)
+}
+
+// IsTransient reports the broken connections, database/sql retries them
+// itself before a statement is sent
+func IsTransient(err error) bool {
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+func SQLStoreFactory(config *docstore.Config) (docstore.Driver, error) {
+	return NewSQLStore(config)
+}
+
+// NewSQLStore returns the store of the config collection, the connection is
+// a *sql.DB or a Connection
+func NewSQLStore(config *docstore.Config) (*SQLStore, error) {
+	var con Connection
+	switch v := config.Connection.(type) {
+	case *sql.DB:
+		d, err := detectDialect(v)
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLstore(v, d.name(), config.Collection, config.IDField)
+	case Connection:
+		con = v
+	case *Connection:
+		con = *v
+	case map[string]interface{}:
+		if err := util.DecodeJSON(v, &con); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("[docstore/sql] unsupported connection type")
+	}
+
+	if con.Dialect == "" {
+		con.Dialect = con.Driver
+	}
+
+	db, err := sql.Open(con.Driver, con.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewSQLstore(db, con.Dialect, config.Collection, config.IDField)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.owned = true
+
+	return s, nil
+}
+
+// NewSQLstore returns the store of a collection in db, dialect is postgres or
+// sqlite
+func NewSQLstore(db *sql.DB, dialect, collection, idField string) (*SQLStore, error) {
+	if idField == "" {
+		return nil, errors.New("[docstore/sql] missing id field param")
+	}
+
+	d, err := dialectOf(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLStore{
+		db:         db,
+		d:          d,
+		table:      quoteIdent(collection),
+		collection: collection,
+		idField:    idField,
+		mux:        &sync.Mutex{},
+		watchers:   make(map[*docstore.ChangeQueue]struct{}),
+	}, nil
+}
+
+// key returns the primary key of an ID, its JSON value, so IDs of different
+// types do not collide
+func key(id interface{}) (string, error) {
+	b, err := json.Marshal(plainValue(id))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// encodeDoc returns the stored JSON of a document, time values and RFC3339
+// strings are stored in timeFormat
+func encodeDoc(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(storedValue(doc))
+}
+
+func storedValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			out[k] = storedValue(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = storedValue(e)
+		}
+		return out
+	case time.Time, *time.Time, string:
+		return normalizeTime(x)
+	}
+	return v
+}
+
+// decodeDoc reads a stored document, integral numbers are read as int64 and
+// the other numbers as float64
+func decodeDoc(raw []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	for k, v := range doc {
+		doc[k] = numberValue(v)
+	}
+	return doc, nil
+}
+
+func numberValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		return plainValue(x)
+	case []interface{}:
+		for i, e := range x {
+			x[i] = numberValue(e)
+		}
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = numberValue(e)
+		}
+	}
+	return v
+}
+
+func (s *SQLStore) docID(doc interface{}) (interface{}, map[string]interface{}, error) {
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return nil, nil, err
+	}
+
+	id, ok := d[s.idField]
+	if !ok || id == nil {
+		return nil, nil, errors.New("[docstore/sql] missing document ID")
+	}
+
+	return id, d, nil
+}
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// selectDocs returns the documents matching the query filters, sorted and
+// paginated. Pagination is done in SQL when every filter is translated.
+func (s *SQLStore) selectDocs(ctx context.Context, q querier, query *docstore.QueryOpt, lock bool) ([]map[string]interface{}, error) {
+	p := query.Projection()
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	query, err := docstore.CursorQuery(query, s.idField)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		query = &docstore.QueryOpt{}
+	}
+
+	filters := normalizeFilters(query.Filter)
+	b := &builder{d: s.d}
+	where, exact := b.where(filters)
+
+	stmt := "SELECT doc FROM " + s.table
+	if where != "" {
+		stmt += " WHERE " + where
+	}
+
+	sorted := !strings.Contains(query.OrderBy+s.idField, `"`)
+	if sorted {
+		stmt += b.orderBy(query, s.idField)
+	}
+
+	paged := exact && sorted
+	if paged {
+		skip := query.Skip
+		if query.Page > 0 && query.Limit > 0 {
+			skip = query.Page * query.Limit
+		}
+		switch {
+		case query.Limit > 0:
+			stmt += fmt.Sprintf(" LIMIT %d OFFSET %d", query.Limit, skip)
+		case skip > 0 && s.d.name() == DialectSQLite:
+			stmt += fmt.Sprintf(" LIMIT -1 OFFSET %d", skip)
+		case skip > 0:
+			stmt += fmt.Sprintf(" OFFSET %d", skip)
+		}
+	}
+
+	if lock {
+		stmt += s.d.forUpdate()
+	}
+
+	rows, err := q.QueryContext(ctx, stmt, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		d, err := decodeDoc(raw)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if paged {
+		for i, d := range docs {
+			docs[i] = docstore.ProjectDoc(d, p, s.idField)
+		}
+		return docs, nil
+	}
+
+	nq := *query
+	nq.Filter = filters
+	return docstore.QueryDocs(docs, &nq, s.idField)
+}
+
+func filtersOf(query *docstore.QueryOpt) []docstore.FilterOpt {
+	if query == nil {
+		return nil
+	}
+	return query.Filter
+}
+
+// update runs fn in a transaction and notifies the watchers once it commits
+func (s *SQLStore) update(ctx context.Context, fn func(w *writer) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	w := &writer{store: s, tx: tx}
+	if err := fn(w); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.notify(w.events)
+	return nil
+}
+
+func (s *SQLStore) Create(ctx context.Context, doc interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Create")
+	defer span.End()
+
+	id, d, err := s.docID(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(w *writer) error {
+		return w.create(ctx, id, d)
+	})
+}
+
+func (s *SQLStore) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Update")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		return w.update(ctx, id, doc, replace)
+	})
+}
+
+// UpdateMany sets the fields of the documents matching the filters
+func (s *SQLStore) UpdateMany(ctx context.Context, filters []docstore.FilterOpt, fields map[string]interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "UpdateMany")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		docs, err := s.selectDocs(ctx, w.tx, &docstore.QueryOpt{Filter: filters}, true)
+		if err != nil {
+			return err
+		}
+
+		modified := 0
+		for _, d := range docs {
+			before := docstore.CopyDoc(d)
+			for k, v := range fields {
+				docstore.SetPath(d, k, v)
+			}
+
+			b1, err := encodeDoc(before)
+			if err != nil {
+				return err
+			}
+			b2, err := encodeDoc(d)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(b1, b2) {
+				continue
+			}
+			if err := docstore.NextVersion(ctx, before, d); err != nil {
+				return err
+			}
+
+			modified++
+			if err := w.put(ctx, d[s.idField], before, d); err != nil {
+				return err
+			}
+		}
+
+		if modified == 0 {
+			if len(docs) == 0 {
+				return docstore.NotFound
+			}
+			return docstore.NothingUpdated
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLStore) Upsert(ctx context.Context, id, doc interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Upsert")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		_, ok, err := w.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return w.update(ctx, id, doc, false)
+		}
+
+		d := make(map[string]interface{})
+		if err := util.DecodeJSON(doc, &d); err != nil {
+			return err
+		}
+		d[s.idField] = id
+		if err := docstore.NextVersion(ctx, nil, d); err != nil {
+			return err
+		}
+		return w.put(ctx, id, nil, d)
+	})
+}
+
+// UpdateField applies the field updates on the document of id, an UpdateOpt
+// option may upsert it
+func (s *SQLStore) UpdateField(ctx context.Context, id interface{}, fields []docstore.Field, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "UpdateField")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		before, ok, err := w.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !ok && !docstore.GetUpdateOpt(opts...).Upsert {
+			return docstore.NotFound
+		}
+
+		d := map[string]interface{}{s.idField: id}
+		if ok {
+			d = docstore.CopyDoc(before)
+		}
+		if err := docstore.ApplyUpdates(d, fields, !ok); err != nil {
+			return err
+		}
+
+		if err := docstore.NextVersion(ctx, before, d); err != nil {
+			return err
+		}
+
+		return w.put(ctx, id, before, d)
+	})
+}
+
+// Increment adds value to the field, a missing document or field is created
+// with the value
+func (s *SQLStore) Increment(ctx context.Context, id interface{}, key string, value int) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Increment")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		before, ok, err := w.get(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		stored := before
+		if !ok {
+			stored = map[string]interface{}{s.idField: id}
+		}
+
+		d := docstore.CopyDoc(stored)
+		cur, _ := docstore.GetPath(d, key)
+		switch v := cur.(type) {
+		case nil:
+			docstore.SetPath(d, key, int64(value))
+		case int64:
+			docstore.SetPath(d, key, v+int64(value))
+		case float64:
+			docstore.SetPath(d, key, v+float64(value))
+		default:
+			return errors.New("[docstore/sql] destination type is not a number")
+		}
+
+		if err := docstore.NextVersion(ctx, stored, d); err != nil {
+			return err
+		}
+
+		return w.put(ctx, id, before, d)
+	})
+}
+
+func (s *SQLStore) GetIncrement(ctx context.Context, id interface{}, key string, value int, doc interface{}) error {
+	if err := s.Increment(ctx, id, key, value); err != nil {
+		return err
+	}
+	return s.Get(ctx, id, doc)
+}
+
+func (s *SQLStore) Delete(ctx context.Context, id interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Delete")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		before, ok, err := w.get(ctx, id)
+		if err != nil || !ok {
+			return err
+		}
+		return w.remove(ctx, id, before)
+	})
+}
+
+func (s *SQLStore) DeleteMany(ctx context.Context, query *docstore.QueryOpt) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "DeleteMany")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		docs, err := s.selectDocs(ctx, w.tx, &docstore.QueryOpt{Filter: filtersOf(query)}, true)
+		if err != nil {
+			return err
+		}
+
+		if len(docs) == 0 {
+			return docstore.NotFound
+		}
+
+		for _, d := range docs {
+			if err := w.remove(ctx, d[s.idField], d); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Get reads the document of id, a docstore.Projection option selects its
+// fields
+func (s *SQLStore) Get(ctx context.Context, id interface{}, doc interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Get")
+	defer span.End()
+
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	return s.get(ctx, s.db, id, doc, p)
+}
+
+func (s *SQLStore) get(ctx context.Context, q querier, id interface{}, doc interface{}, p docstore.Projection) error {
+	d, ok, err := s.read(ctx, q, id, false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return docstore.NotFound
+	}
+	return util.DecodeJSON(docstore.ProjectDoc(d, p, s.idField), doc)
+}
+
+func (s *SQLStore) read(ctx context.Context, q querier, id interface{}, lock bool) (map[string]interface{}, bool, error) {
+	k, err := key(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	stmt := "SELECT doc FROM " + s.table + " WHERE id = " + s.d.placeholder(1)
+	if lock {
+		stmt += s.d.forUpdate()
+	}
+
+	rows, err := q.QueryContext(ctx, stmt, k)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+
+	var raw []byte
+	if err := rows.Scan(&raw); err != nil {
+		return nil, false, err
+	}
+
+	d, err := decodeDoc(raw)
+	return d, err == nil, err
+}
+
+// Count counts the documents matching the query filters, skip and limit are
+// ignored like the mongo driver does.
+func (s *SQLStore) Count(ctx context.Context, query *docstore.QueryOpt) (int64, error) {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Count")
+	defer span.End()
+
+	filters := normalizeFilters(filtersOf(query))
+	b := &builder{d: s.d}
+	where, exact := b.where(filters)
+	if !exact {
+		docs, err := s.selectDocs(ctx, s.db, &docstore.QueryOpt{Filter: filters}, false)
+		return int64(len(docs)), err
+	}
+
+	stmt := "SELECT COUNT(*) FROM " + s.table
+	if where != "" {
+		stmt += " WHERE " + where
+	}
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, stmt, b.args...).Scan(&count)
+	return count, err
+}
+
+func (s *SQLStore) Find(ctx context.Context, query *docstore.QueryOpt, docs interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Find")
+	defer span.End()
+
+	out, err := s.selectDocs(ctx, s.db, query, false)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+func (s *SQLStore) FindOne(ctx context.Context, query *docstore.QueryOpt, doc interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "FindOne")
+	defer span.End()
+
+	q := &docstore.QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+	q.Limit = 1
+
+	out, err := s.selectDocs(ctx, s.db, q, false)
+	if err != nil {
+		return err
+	}
+
+	if len(out) == 0 {
+		return docstore.NotFound
+	}
+
+	return util.DecodeJSON(out[0], doc)
+}
+
+func (s *SQLStore) Query(ctx context.Context, query *docstore.QueryOpt) (docstore.Iterator, error) {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Query")
+	defer span.End()
+
+	docs, err := s.selectDocs(ctx, s.db, query, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &iterator{docs: docs}, nil
+}
+
+type iterator struct {
+	docs []map[string]interface{}
+	pos  int
+}
+
+func (i *iterator) Next(ctx context.Context, doc interface{}) error {
+	if i.pos >= len(i.docs) {
+		return docstore.EndOfDoc
+	}
+	d := i.docs[i.pos]
+	i.pos++
+	return util.DecodeJSON(d, doc)
+}
+
+func (i *iterator) Close(ctx context.Context) error {
+	return nil
+}
+
+// BulkCreate creates the documents in transactions of bulkBatchSize
+// documents, a failing batch is not written but the previous ones are
+func (s *SQLStore) BulkCreate(ctx context.Context, docs []interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "BulkCreate")
+	defer span.End()
+
+	for start := 0; start < len(docs); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		err := s.update(ctx, func(w *writer) error {
+			for _, doc := range docs[start:end] {
+				id, d, err := s.docID(doc)
+				if err != nil {
+					return err
+				}
+				if err := w.create(ctx, id, d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BulkGet returns the documents found in the order of ids, missing IDs are
+// skipped like the mongo driver does.
+func (s *SQLStore) BulkGet(ctx context.Context, ids []interface{}, docs interface{}, opts ...interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "BulkGet")
+	defer span.End()
+
+	p := docstore.GetProjection(opts...)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	out := make([]map[string]interface{}, 0, len(ids))
+	if len(ids) == 0 {
+		return util.DecodeJSON(out, docs)
+	}
+
+	keys := make([]interface{}, len(ids))
+	params := make([]string, len(ids))
+	for i, id := range ids {
+		k, err := key(id)
+		if err != nil {
+			return err
+		}
+		keys[i] = k
+		params[i] = s.d.placeholder(i + 1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, doc FROM "+s.table+" WHERE id IN ("+strings.Join(params, ", ")+")", keys...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := make(map[string]map[string]interface{})
+	for rows.Next() {
+		var k string
+		var raw []byte
+		if err := rows.Scan(&k, &raw); err != nil {
+			return err
+		}
+		d, err := decodeDoc(raw)
+		if err != nil {
+			return err
+		}
+		found[k] = d
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if d, ok := found[k.(string)]; ok {
+			out = append(out, docstore.ProjectDoc(d, p, s.idField))
+		}
+	}
+
+	return util.DecodeJSON(out, docs)
+}
+
+// Migrate creates the table of the collection and the indexes of a
+// *docstore.Config. Indexes are expression indexes on the JSON fields, an
+// existing index is recreated when DropExistingIndex is set.
+func (s *SQLStore) Migrate(ctx context.Context, config interface{}) error {
+	logger := log.GetLogger(ctx, "docstore/sql", "Migrate")
+
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, doc %s NOT NULL)", s.table, s.d.docType())
+	if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+		logger.WithError(err).Error("error creating table")
+		return err
+	}
+
+	var conf docstore.Config
+	switch v := config.(type) {
+	case *docstore.Config:
+		conf = *v
+	case docstore.Config:
+		conf = v
+	default:
+		return nil
+	}
+
+	for _, c := range conf.Indexes {
+		idx, err := parseIndex(c)
+		if err != nil {
+			return err
+		}
+
+		name := quoteIdent(s.collection + "_" + idx.name)
+		if conf.DropExistingIndex {
+			if _, err := s.db.ExecContext(ctx, "DROP INDEX IF EXISTS "+name); err != nil {
+				return err
+			}
+		}
+
+		exprs := make([]string, len(idx.fields))
+		for i, f := range idx.fields {
+			exprs[i] = "(" + s.d.value(strings.Split(f, ".")) + ")"
+		}
+
+		unique := ""
+		if idx.unique {
+			unique = "UNIQUE "
+		}
+
+		stmt := fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)", unique, name, s.table, strings.Join(exprs, ", "))
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			logger.WithError(err).WithField("index", idx.name).Error("error creating index")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) As(i interface{}) bool {
+	p, ok := i.(**sql.DB)
+	if !ok {
+		return false
+	}
+	*p = s.db
+	return true
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Disconnect closes the database opened by NewSQLStore, a *sql.DB passed as
+// connection is left to its owner
+func (s *SQLStore) Disconnect(ctx context.Context) error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Pull removes the array elements matching removeCondition from the first
+// document matching condition, the same way as the mongo driver.
+func (s *SQLStore) Pull(ctx context.Context, condition, removeCondition docstore.Field) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Pull")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		docs, err := s.selectDocs(ctx, w.tx, &docstore.QueryOpt{
+			Filter: []docstore.FilterOpt{docstore.FieldFilter(condition)},
+			Limit:  1,
+		}, true)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return docstore.NotFound
+		}
+
+		d := docs[0]
+		before := docstore.CopyDoc(d)
+		arr, _ := docstore.GetPath(d, removeCondition.Name)
+		kept, removed := docstore.PullValues(arr, removeCondition.Value)
+		if removed == 0 {
+			return docstore.NothingUpdated
+		}
+
+		docstore.SetPath(d, removeCondition.Name, kept)
+		return w.put(ctx, d[s.idField], before, d)
+	})
+}
+
+// Distinct returns the distinct values of fieldName. The filter can be nil,
+// a *QueryOpt, a FilterOpt slice or a map of field equality.
+func (s *SQLStore) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Distinct")
+	defer span.End()
+
+	filters, err := docstore.ToFilters(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := s.selectDocs(ctx, s.db, &docstore.QueryOpt{Filter: filters}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return docstore.DistinctValues(docs, fieldName), nil
+}
+
+// Aggregate evaluates agg over the documents matching its filter
+func (s *SQLStore) Aggregate(ctx context.Context, agg *docstore.AggregateOpt, docs interface{}) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "Aggregate")
+	defer span.End()
+
+	if err := agg.Validate(); err != nil {
+		return err
+	}
+
+	all, err := s.selectDocs(ctx, s.db, &docstore.QueryOpt{Filter: agg.Filter}, false)
+	if err != nil {
+		return err
+	}
+
+	rows, err := docstore.AggregateDocs(all, agg)
+	if err != nil {
+		return err
+	}
+
+	return util.DecodeJSON(rows, docs)
+}
+
+// BulkWrite runs the writes one by one, each in its own transaction
+func (s *SQLStore) BulkWrite(ctx context.Context, ops []docstore.WriteOp, opts ...interface{}) ([]docstore.WriteResult, error) {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "BulkWrite")
+	defer span.End()
+
+	return docstore.WriteEach(ctx, s, s.idField, ops, opts...)
+}
+
+// RunInTransaction runs fn in a database transaction
+func (s *SQLStore) RunInTransaction(ctx context.Context, fn func(tx docstore.Tx) error) error {
+	tracer := otel.Tracer("docstore/sql")
+	ctx, span := tracer.Start(ctx, "RunInTransaction")
+	defer span.End()
+
+	return s.update(ctx, func(w *writer) error {
+		return fn(&sqlTx{w: w})
+	})
+}
+
+type sqlTx struct {
+	w *writer
+}
+
+func (t *sqlTx) Create(ctx context.Context, doc interface{}) error {
+	id, d, err := t.w.store.docID(doc)
+	if err != nil {
+		return err
+	}
+	return t.w.create(ctx, id, d)
+}
+
+func (t *sqlTx) Update(ctx context.Context, id, doc interface{}, replace bool) error {
+	return t.w.update(ctx, id, doc, replace)
+}
+
+func (t *sqlTx) Delete(ctx context.Context, id interface{}) error {
+	before, ok, err := t.w.get(ctx, id)
+	if err != nil || !ok {
+		return err
+	}
+	return t.w.remove(ctx, id, before)
+}
+
+func (t *sqlTx) Get(ctx context.Context, id interface{}, doc interface{}) error {
+	return t.w.store.get(ctx, t.w.tx, id, doc, docstore.Projection{})
+}
+
+// Watch streams the changes made through the store to the documents matching
+// the query filter, changes made by other processes are not seen. The stream
+// is buffered so it never blocks writers.
+func (s *SQLStore) Watch(ctx context.Context, query *docstore.QueryOpt) (docstore.ChangeStream, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var q *docstore.ChangeQueue
+	q = docstore.NewChangeQueue(normalizeFilters(filtersOf(query)), func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		delete(s.watchers, q)
+	})
+	s.watchers[q] = struct{}{}
+
+	return q, nil
+}
+
+func (s *SQLStore) notify(events []docstore.ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for q := range s.watchers {
+		for _, event := range events {
+			ev := event
+			if ev.Before != nil {
+				ev.Before = docstore.CopyDoc(ev.Before)
+			}
+			if ev.After != nil {
+				ev.After = docstore.CopyDoc(ev.After)
+			}
+			q.Push(ev)
+		}
+	}
+}
+
+// writer applies the writes of a transaction and keeps their change events
+type writer struct {
+	store  *SQLStore
+	tx     *sql.Tx
+	events []docstore.ChangeEvent
+}
+
+func (w *writer) get(ctx context.Context, id interface{}) (map[string]interface{}, bool, error) {
+	return w.store.read(ctx, w.tx, id, true)
+}
+
+func (w *writer) create(ctx context.Context, id interface{}, d map[string]interface{}) error {
+	_, ok, err := w.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errors.New("[docstore/sql] document ID is already exist")
+	}
+
+	return w.put(ctx, id, nil, d)
+}
+
+func (w *writer) update(ctx context.Context, id, doc interface{}, replace bool) error {
+	before, ok, err := w.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return docstore.NotFound
+	}
+
+	d := make(map[string]interface{})
+	if err := util.DecodeJSON(doc, &d); err != nil {
+		return err
+	}
+
+	if !replace {
+		cd := docstore.CopyDoc(before)
+		if err := mergo.MergeWithOverwrite(&cd, d); err != nil {
+			return err
+		}
+		d = cd
+	}
+
+	if err := docstore.NextVersion(ctx, before, d); err != nil {
+		return err
+	}
+
+	return w.put(ctx, id, before, d)
+}
+
+// put writes the document of id, before is the stored document or nil
+func (w *writer) put(ctx context.Context, id interface{}, before, after map[string]interface{}) error {
+	s := w.store
+	if _, ok := after[s.idField]; !ok {
+		after[s.idField] = id
+	}
+
+	k, err := key(id)
+	if err != nil {
+		return err
+	}
+
+	raw, err := encodeDoc(after)
+	if err != nil {
+		return err
+	}
+
+	stmt := "INSERT INTO " + s.table + " (id, doc) VALUES (" + s.d.placeholder(1) + ", " + s.d.placeholder(2) + ")"
+	if before != nil {
+		stmt = "UPDATE " + s.table + " SET doc = " + s.d.placeholder(2) + " WHERE id = " + s.d.placeholder(1)
+	}
+	if _, err := w.tx.ExecContext(ctx, stmt, k, string(raw)); err != nil {
+		return err
+	}
+
+	// the event documents are decoded again so they hold the stored types
+	ev := docstore.ChangeEvent{Type: docstore.ChangeInsert, ID: id}
+	if ev.After, err = decodeDoc(raw); err != nil {
+		return err
+	}
+	if before != nil {
+		ev.Type = docstore.ChangeUpdate
+		ev.Before = before
+	}
+	w.events = append(w.events, ev)
+
+	return nil
+}
+
+func (w *writer) remove(ctx context.Context, id interface{}, before map[string]interface{}) error {
+	k, err := key(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.tx.ExecContext(ctx, "DELETE FROM "+w.store.table+" WHERE id = "+w.store.d.placeholder(1), k); err != nil {
+		return err
+	}
+
+	w.events = append(w.events, docstore.ChangeEvent{Type: docstore.ChangeDelete, ID: id, Before: before})
+	return nil
+}
@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/bondhan/golib/constant"
+
+	"github.com/bondhan/golib/docstore"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	ss, err := NewSQLstore(openDB(t), DialectSQLite, "test", "id")
+	require.Nil(t, err)
+	require.Nil(t, ss.Migrate(context.Background(), nil))
+
+	docstore.DriverConformanceTest(ss, t)
+}
+
+func TestSQLStore_Migrate(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	ss, err := NewSQLStore(&docstore.Config{Collection: "users", IDField: "id", Connection: db})
+	require.Nil(t, err)
+
+	require.Nil(t, ss.Migrate(ctx, &docstore.Config{Indexes: []map[string]map[string]interface{}{
+		{"keys": {"email": 1}, "options": {"unique": true}},
+		{"keys": {"age": 1}, "options": {"name": "age"}},
+	}}))
+
+	for _, f := range []docstore.FilterOpt{
+		{Field: "age", Ops: constant.EQ, Value: 20},
+		{Field: "age", Ops: constant.GE, Value: 20},
+		{Field: "email", Ops: constant.IN, Value: []string{"a@mail.com", "b@mail.com"}},
+	} {
+		b := &builder{d: ss.d}
+		where, exact := b.where([]docstore.FilterOpt{f})
+		require.True(t, exact)
+
+		rows, err := db.QueryContext(ctx, "EXPLAIN QUERY PLAN SELECT doc FROM "+ss.table+" WHERE "+where, b.args...)
+		require.Nil(t, err)
+		plan := ""
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			require.Nil(t, rows.Scan(&id, &parent, &notused, &detail))
+			plan += detail + "\n"
+		}
+		require.Nil(t, rows.Close())
+		assert.Contains(t, plan, "INDEX users_", f.Ops)
+		assert.NotContains(t, plan, "SCAN "+ss.table, f.Ops)
+	}
+
+	require.Nil(t, ss.Create(ctx, map[string]interface{}{"id": 1, "email": "a@mail.com"}))
+	require.Nil(t, ss.Create(ctx, map[string]interface{}{"id": 2}))
+	require.Nil(t, ss.Create(ctx, map[string]interface{}{"id": 3}), "missing values are not unique")
+	assert.NotNil(t, ss.Create(ctx, map[string]interface{}{"id": 4, "email": "a@mail.com"}), "unique index")
+}
+
+func TestSQLStore_Values(t *testing.T) {
+	ctx := context.Background()
+
+	ss, err := NewSQLstore(openDB(t), DialectSQLite, "test", "id")
+	require.Nil(t, err)
+	require.Nil(t, ss.Migrate(ctx, nil))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	docs := []interface{}{
+		map[string]interface{}{"id": 1, "score": 1.5, "at": now, "tags": []string{"a", "b"}},
+		map[string]interface{}{"id": "1", "score": 2, "at": now.Add(time.Hour), "tags": []string{"b"}},
+		map[string]interface{}{"id": 3, "score": "x", "nested": map[string]interface{}{"n": 1}},
+	}
+	require.Nil(t, ss.BulkCreate(ctx, docs))
+
+	type doc struct {
+		ID    interface{} `json:"id"`
+		Score interface{} `json:"score"`
+		At    time.Time   `json:"at"`
+	}
+
+	var out []doc
+	require.Nil(t, ss.Find(ctx, &docstore.QueryOpt{
+		Filter:  []docstore.FilterOpt{{Field: "at", Ops: constant.GT, Value: now}},
+		OrderBy: "score",
+	}, &out))
+	require.Len(t, out, 1)
+	assert.Equal(t, "1", out[0].ID, "IDs of different types do not collide")
+	assert.True(t, now.Add(time.Hour).Equal(out[0].At))
+
+	out = nil
+	require.Nil(t, ss.Find(ctx, &docstore.QueryOpt{OrderBy: "score", IsAscend: true}, &out))
+	require.Len(t, out, 3)
+	assert.EqualValues(t, 1.5, out[0].Score, "numbers sort before strings")
+	assert.EqualValues(t, 2, out[1].Score)
+	assert.EqualValues(t, "x", out[2].Score)
+
+	n, err := ss.Count(ctx, &docstore.QueryOpt{Filter: []docstore.FilterOpt{
+		{Field: "tags", Ops: constant.EQ, Value: "b"},
+	}})
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, n)
+
+	n, err = ss.Count(ctx, &docstore.QueryOpt{Filter: []docstore.FilterOpt{
+		{Field: "nested.n", Ops: constant.EQ, Value: 1},
+	}})
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, n, "filters evaluated in Go")
+}
@@ -0,0 +1,217 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/domain/retailer"
+	"github.com/bondhan/golib/util"
+)
+
+const (
+	defaultTenantField = "tenant_id"
+	tenantCachePrefix  = "tenant:"
+)
+
+// TenantResolver returns the tenant of the request of ctx
+type TenantResolver func(ctx context.Context) (string, error)
+
+// RetailerTenant resolves the tenant from the retailer of the context
+func RetailerTenant(ctx context.Context) (string, error) {
+	r, err := retailer.GetRetailerFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// fieldOps are the writes whose document holds the written fields only
+var fieldOps = map[string]bool{
+	"UpdateField":  true,
+	"UpdateFields": true,
+	"Increment":    true,
+	"UpdateMany":   true,
+	"Restore":      true,
+}
+
+// rewriteOps rewrite the stored documents of every tenant, keeping their
+// tenant
+var rewriteOps = map[string]bool{
+	"Migrate":   true,
+	"Reencrypt": true,
+}
+
+// SetTenantResolver scopes the store to the tenant resolved from the context
+// of every call. Queries are filtered by the tenant field, creates stamp it,
+// cache keys are prefixed by the tenant, and reads and writes of documents of
+// another tenant fail with ErrCrossTenant. Writes by ID read the stored
+// document first to check its tenant. Purge deletes the documents of the
+// tenant only, Pull is rejected as its condition cannot be scoped, and the
+// migrations run over every tenant.
+func (s *CachedStore) SetTenantResolver(resolver TenantResolver) {
+	if s.tenant == nil {
+		s.AddHook(BeforeCreate, s.stampTenant)
+		s.AddHook(BeforeUpdate, s.guardTenant)
+		s.AddHook(BeforeDelete, s.guardTenant)
+	}
+	s.tenant = resolver
+}
+
+func (s *CachedStore) tenancy() bool {
+	return s.tenant != nil
+}
+
+func (s *CachedStore) tenantField() string {
+	if s.TenantField == "" {
+		return defaultTenantField
+	}
+	return s.TenantField
+}
+
+// tenantOf returns the tenant of ctx, requests without a tenant are rejected
+func (s *CachedStore) tenantOf(ctx context.Context) (string, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return "", err
+	}
+	if tenant == "" {
+		return "", errors.New("[docstore] missing tenant")
+	}
+	return tenant, nil
+}
+
+// tenantKey prefixes a cache key with the tenant of ctx, requests without a
+// tenant never share the keys of the tenants
+func (s *CachedStore) tenantKey(ctx context.Context, key string) (string, error) {
+	if !s.tenancy() {
+		return key, nil
+	}
+	tenant, err := s.tenantOf(ctx)
+	if err != nil {
+		return "", err
+	}
+	return tenantCachePrefix + tenant + ":" + key, nil
+}
+
+// cacheKey is the key of the cached copy of the document of id
+func (s *CachedStore) cacheKey(ctx context.Context, id interface{}) (string, error) {
+	return s.tenantKey(ctx, fmt.Sprintf("%v", id))
+}
+
+// scoped returns a copy of query matching the documents of the tenant only
+func (s *CachedStore) scoped(ctx context.Context, query *QueryOpt) (*QueryOpt, error) {
+	if !s.tenancy() {
+		return query, nil
+	}
+
+	q := &QueryOpt{}
+	if query != nil {
+		*q = *query
+	}
+
+	filters, err := s.tenantFilter(ctx, q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	q.Filter = filters
+	return q, nil
+}
+
+// tenantFilter appends the filter on the tenant of ctx
+func (s *CachedStore) tenantFilter(ctx context.Context, filters []FilterOpt) ([]FilterOpt, error) {
+	if !s.tenancy() {
+		return filters, nil
+	}
+
+	tenant, err := s.tenantOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]FilterOpt, 0, len(filters)+1)
+	out = append(out, filters...)
+	return append(out, FilterOpt{Field: s.tenantField(), Ops: constant.EQ, Value: tenant}), nil
+}
+
+// ownDoc checks that a stored document belongs to the tenant of ctx
+func (s *CachedStore) ownDoc(ctx context.Context, doc map[string]interface{}) error {
+	tenant, err := s.tenantOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	if v, _ := getPath(doc, s.tenantField()); fmt.Sprintf("%v", v) != tenant {
+		return ErrCrossTenant
+	}
+	return nil
+}
+
+// checkTenant checks the tenant of the stored document of id, missing
+// documents are left to the write
+func (s *CachedStore) checkTenant(ctx context.Context, id interface{}) error {
+	d := make(map[string]interface{})
+	if err := s.storage.Get(ctx, id, &d); err != nil {
+		if err == NotFound {
+			return nil
+		}
+		return err
+	}
+	return s.ownDoc(ctx, d)
+}
+
+// stampTenant sets the tenant of a new document
+func (s *CachedStore) stampTenant(ctx context.Context, event *HookEvent) error {
+	tenant, err := s.tenantOf(ctx)
+	if err != nil {
+		return err
+	}
+	return s.setTenant(event.Doc, tenant, true)
+}
+
+// guardTenant rejects the updates and deletes of documents of another tenant,
+// and of the tenant field
+func (s *CachedStore) guardTenant(ctx context.Context, event *HookEvent) error {
+	if rewriteOps[event.Op] {
+		return nil
+	}
+
+	tenant, err := s.tenantOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	if event.ID != nil {
+		if err := s.checkTenant(ctx, event.ID); err != nil {
+			return err
+		}
+	}
+
+	if event.Doc == nil {
+		return nil
+	}
+	// whole documents are stamped so a replace keeps the tenant
+	return s.setTenant(event.Doc, tenant, !fieldOps[event.Op])
+}
+
+// setTenant checks the tenant field of doc, and sets it when stamp is set
+func (s *CachedStore) setTenant(doc interface{}, tenant string, stamp bool) error {
+	tf := s.tenantField()
+	if util.IsStructOrPointerOf(doc) {
+		f, err := util.FindFieldByTag(doc, "json", tf)
+		if err != nil {
+			return fmt.Errorf("[docstore] document has no %s field", tf)
+		}
+		tf = f
+	}
+
+	if v, ok := util.Lookup(tf, doc); ok && v != nil && v != "" && fmt.Sprintf("%v", v) != tenant {
+		return ErrCrossTenant
+	}
+
+	if !stamp {
+		return nil
+	}
+	return util.SetValue(doc, tf, tenant)
+}
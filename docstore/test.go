@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/domain/retailer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,7 +20,7 @@ func DriverCRUDTest(d Driver, t *testing.T) {
 		Username  string    `json:"username"`
 		Age       int       `json:"age"`
 		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at`
+		UpdatedAt time.Time `json:"updated_at"`
 	}
 
 	ctx := context.Background()
@@ -184,6 +185,737 @@ func DriverBulkTest(d Driver, t *testing.T) {
 	}
 }
 
+func DriverTransactionTest(d Driver, t *testing.T) {
+	type Item struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Stock int    `json:"stock"`
+	}
+	ctx := context.Background()
+
+	require.Nil(t, d.Create(ctx, &Item{ID: "TX-1", Name: "item1", Stock: 10}))
+
+	err := d.RunInTransaction(ctx, func(tx Tx) error {
+		var it Item
+		if err := tx.Get(ctx, "TX-1", &it); err != nil {
+			return err
+		}
+		if err := tx.Update(ctx, it.ID, map[string]interface{}{"stock": it.Stock - 3}, false); err != nil {
+			return err
+		}
+		return tx.Create(ctx, &Item{ID: "TX-2", Name: "item2", Stock: 3})
+	})
+	require.Nil(t, err)
+
+	var it Item
+	require.Nil(t, d.Get(ctx, "TX-1", &it))
+	assert.Equal(t, 7, it.Stock)
+	require.Nil(t, d.Get(ctx, "TX-2", &it))
+	assert.Equal(t, 3, it.Stock)
+
+	errAbort := errors.New("abort")
+	err = d.RunInTransaction(ctx, func(tx Tx) error {
+		if err := tx.Update(ctx, "TX-1", map[string]interface{}{"stock": 0}, false); err != nil {
+			return err
+		}
+		if err := tx.Delete(ctx, "TX-2"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+
+	require.Nil(t, d.Get(ctx, "TX-1", &it))
+	assert.Equal(t, 7, it.Stock)
+	require.Nil(t, d.Get(ctx, "TX-2", &it))
+	assert.Equal(t, 3, it.Stock)
+}
+
+func DriverBulkWriteTest(d Driver, t *testing.T) {
+	type Item struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Stock int    `json:"stock"`
+	}
+	ctx := context.Background()
+
+	require.Nil(t, d.Create(ctx, &Item{ID: "BW-1", Name: "item1", Stock: 1}))
+	require.Nil(t, d.Create(ctx, &Item{ID: "BW-2", Name: "item2", Stock: 2}))
+
+	ops := []WriteOp{
+		{Op: WriteCreate, Doc: &Item{ID: "BW-3", Name: "item3", Stock: 3}},
+		{Op: WriteUpdate, ID: "BW-1", Doc: map[string]interface{}{"stock": 10}},
+		{Op: WriteUpsert, ID: "BW-4", Doc: map[string]interface{}{"name": "item4"}},
+		{Op: WriteDelete, ID: "BW-2"},
+		{Op: WriteCreate, Doc: &Item{ID: "BW-1", Name: "duplicate"}},
+		{Op: WriteReplace, ID: "BW-3", Doc: &Item{ID: "BW-3", Name: "item3b"}},
+	}
+
+	res, err := d.BulkWrite(ctx, ops)
+	require.ErrorIs(t, err, ErrPartialWrite)
+	require.Len(t, res, len(ops))
+
+	for i, r := range res {
+		if i == 4 {
+			assert.Equal(t, WriteFailed, r.Status, "duplicate ID")
+			assert.NotNil(t, r.Error)
+			continue
+		}
+		assert.Equal(t, WriteOK, r.Status, i)
+		assert.Nil(t, r.Error, i)
+	}
+	assert.Equal(t, "BW-3", res[0].ID)
+	assert.Equal(t, "BW-4", res[2].ID)
+
+	var it Item
+	require.Nil(t, d.Get(ctx, "BW-1", &it))
+	assert.Equal(t, "item1", it.Name)
+	assert.Equal(t, 10, it.Stock)
+	require.Nil(t, d.Get(ctx, "BW-3", &it))
+	assert.Equal(t, "item3b", it.Name)
+	assert.Equal(t, 0, it.Stock)
+	require.Nil(t, d.Get(ctx, "BW-4", &it))
+	assert.Equal(t, "item4", it.Name)
+	assert.NotNil(t, d.Get(ctx, "BW-2", &it))
+
+	res, err = d.BulkWrite(ctx, []WriteOp{
+		{Op: WriteCreate, Doc: &Item{ID: "BW-1"}},
+		{Op: WriteDelete, ID: "BW-1"},
+	}, &BulkWriteOpt{Ordered: true})
+	require.ErrorIs(t, err, ErrPartialWrite)
+	require.Len(t, res, 2)
+	assert.Equal(t, WriteFailed, res[0].Status)
+	assert.Equal(t, WriteSkipped, res[1].Status)
+	require.Nil(t, d.Get(ctx, "BW-1", &it))
+
+	res, err = d.BulkWrite(ctx, []WriteOp{{Op: WriteDelete, ID: "BW-1"}, {Op: WriteDelete, ID: "BW-4"}})
+	require.Nil(t, err)
+	assert.Equal(t, WriteOK, res[0].Status)
+	assert.Equal(t, WriteOK, res[1].Status)
+}
+
+func DriverProjectionTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-PROJ"
+	createConformanceProducts(d, t, group)
+
+	query := &QueryOpt{
+		Filter:   []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}},
+		OrderBy:  "price",
+		IsAscend: true,
+		Fields:   []string{"name", "variants.sku", "meta.origin"},
+	}
+
+	var docs []map[string]interface{}
+	require.Nil(t, d.Find(ctx, query, &docs))
+	require.Len(t, docs, 4)
+	assert.Equal(t, group+"-1", docs[0]["id"])
+	assert.Equal(t, "Apple Juice", docs[0]["name"])
+	assert.Nil(t, docs[0]["price"])
+	assert.Nil(t, docs[0]["tags"])
+	assert.Equal(t, map[string]interface{}{"origin": "ID"}, docs[0]["meta"])
+	variants, ok := docs[0]["variants"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, variants, 2)
+	assert.Equal(t, map[string]interface{}{"sku": "s1"}, variants[0])
+
+	var doc map[string]interface{}
+	require.Nil(t, d.FindOne(ctx, query, &doc))
+	assert.Equal(t, group+"-1", doc["id"])
+	assert.Nil(t, doc["price"])
+
+	it, err := d.Query(ctx, query)
+	require.Nil(t, err)
+	doc = nil
+	require.Nil(t, it.Next(ctx, &doc))
+	assert.Equal(t, "Apple Juice", doc["name"])
+	assert.Nil(t, doc["group"])
+	require.Nil(t, it.Close(ctx))
+
+	query.Fields = nil
+	query.Exclude = []string{"tags", "variants.qty", "id"}
+	docs = nil
+	require.Nil(t, d.Find(ctx, query, &docs))
+	require.Len(t, docs, 4)
+	assert.Equal(t, group+"-1", docs[0]["id"], "the ID is never excluded")
+	assert.Nil(t, docs[0]["tags"])
+	assert.NotNil(t, docs[0]["price"])
+	variants, ok = docs[0]["variants"].([]interface{})
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"sku": "s1"}, variants[0])
+
+	query.Fields = []string{"name"}
+	assert.NotNil(t, d.Find(ctx, query, &docs), "fields and exclude together")
+
+	doc = nil
+	require.Nil(t, d.Get(ctx, group+"-2", &doc, &Projection{Fields: []string{"price"}}))
+	assert.Len(t, doc, 2)
+	assert.Equal(t, group+"-2", doc["id"])
+	assert.EqualValues(t, 20, doc["price"])
+
+	docs = nil
+	require.Nil(t, d.BulkGet(ctx, []interface{}{group + "-3", group + "-4"}, &docs, &Projection{Exclude: []string{"variants", "meta", "tags"}}))
+	require.Len(t, docs, 2)
+	for _, d := range docs {
+		assert.Nil(t, d["variants"])
+		assert.Nil(t, d["meta"])
+		assert.NotNil(t, d["name"])
+	}
+
+	var p conformanceProduct
+	require.Nil(t, d.Get(ctx, group+"-1", &p))
+	assert.Equal(t, 10, p.Price)
+	assert.Len(t, p.Variants, 2)
+}
+
+// DriverConformanceTest runs the behaviour every registered driver must share
+func DriverConformanceTest(d Driver, t *testing.T) {
+	t.Run("CRUD", func(t *testing.T) { DriverCRUDTest(d, t) })
+	t.Run("Bulk", func(t *testing.T) { DriverBulkTest(d, t) })
+	t.Run("Filter", func(t *testing.T) { DriverFilterTest(d, t) })
+	t.Run("UpdateMany", func(t *testing.T) { DriverUpdateManyTest(d, t) })
+	t.Run("DeleteMany", func(t *testing.T) { DriverDeleteManyTest(d, t) })
+	t.Run("Pull", func(t *testing.T) { DriverPullTest(d, t) })
+	t.Run("UpdateOps", func(t *testing.T) { DriverUpdateOpsTest(d, t) })
+	t.Run("Distinct", func(t *testing.T) { DriverDistinctTest(d, t) })
+	t.Run("Cursor", func(t *testing.T) { DriverCursorTest(d, t) })
+	t.Run("Watch", func(t *testing.T) { DriverWatchTest(d, t) })
+	t.Run("Aggregate", func(t *testing.T) { DriverAggregateTest(d, t) })
+	t.Run("Version", func(t *testing.T) { DriverVersionTest(d, t) })
+	t.Run("Transaction", func(t *testing.T) { DriverTransactionTest(d, t) })
+	t.Run("BulkWrite", func(t *testing.T) { DriverBulkWriteTest(d, t) })
+	t.Run("Projection", func(t *testing.T) { DriverProjectionTest(d, t) })
+}
+
+type conformanceVariant struct {
+	SKU string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+type conformanceMeta struct {
+	Origin string `json:"origin"`
+}
+
+type conformanceProduct struct {
+	ID       string               `json:"id"`
+	Group    string               `json:"group"`
+	Name     string               `json:"name"`
+	Price    int                  `json:"price"`
+	Note     string               `json:"note,omitempty"`
+	Tags     []string             `json:"tags"`
+	Variants []conformanceVariant `json:"variants"`
+	Meta     conformanceMeta      `json:"meta"`
+}
+
+func createConformanceProducts(d Driver, t *testing.T, group string) {
+	products := []*conformanceProduct{
+		{Name: "Apple Juice", Price: 10, Note: "fresh", Tags: []string{"fruit", "drink"},
+			Variants: []conformanceVariant{{SKU: "s1", Qty: 5}, {SKU: "s2", Qty: 0}}, Meta: conformanceMeta{Origin: "ID"}},
+		{Name: "Banana", Price: 20, Tags: []string{"fruit"},
+			Variants: []conformanceVariant{{SKU: "s3", Qty: 0}}, Meta: conformanceMeta{Origin: "EC"}},
+		{Name: "Carrot Cake", Price: 30, Tags: []string{"cake", "vegetable"},
+			Variants: []conformanceVariant{}, Meta: conformanceMeta{Origin: "ID"}},
+		{Name: "apple pie", Price: 40, Note: "hot", Tags: []string{"cake", "fruit"},
+			Variants: []conformanceVariant{{SKU: "s4", Qty: 2}}, Meta: conformanceMeta{Origin: "US"}},
+	}
+
+	ctx := context.Background()
+	for i, p := range products {
+		p.ID = fmt.Sprintf("%s-%v", group, i+1)
+		p.Group = group
+		require.Nil(t, d.Create(ctx, p))
+	}
+}
+
+func DriverFilterTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-FILTER"
+	createConformanceProducts(d, t, group)
+
+	inGroup := func(f ...FilterOpt) *QueryOpt {
+		return &QueryOpt{Filter: append([]FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}}, f...)}
+	}
+
+	tests := []struct {
+		name   string
+		filter []FilterOpt
+		want   []string
+	}{
+		{"eq", []FilterOpt{{Field: "name", Ops: constant.EQ, Value: "Banana"}}, []string{"Banana"}},
+		{"ne", []FilterOpt{{Field: "name", Ops: constant.NE, Value: "Banana"}}, []string{"Apple Juice", "Carrot Cake", "apple pie"}},
+		{"gt", []FilterOpt{{Field: "price", Ops: constant.GT, Value: 20}}, []string{"Carrot Cake", "apple pie"}},
+		{"ge", []FilterOpt{{Field: "price", Ops: constant.GE, Value: 20}}, []string{"Banana", "Carrot Cake", "apple pie"}},
+		{"lt", []FilterOpt{{Field: "price", Ops: constant.LT, Value: 20}}, []string{"Apple Juice"}},
+		{"le", []FilterOpt{{Field: "price", Ops: constant.LE, Value: 20}}, []string{"Apple Juice", "Banana"}},
+		{"range", []FilterOpt{
+			{Field: "price", Ops: constant.GT, Value: 10},
+			{Field: "price", Ops: constant.LT, Value: 40},
+		}, []string{"Banana", "Carrot Cake"}},
+		{"in", []FilterOpt{{Field: "price", Ops: constant.IN, Value: []int{10, 30}}}, []string{"Apple Juice", "Carrot Cake"}},
+		{"nin", []FilterOpt{{Field: "price", Ops: constant.NIN, Value: []int{10, 30}}}, []string{"Banana", "apple pie"}},
+		{"in array", []FilterOpt{{Field: "tags", Ops: constant.IN, Value: []string{"cake"}}}, []string{"Carrot Cake", "apple pie"}},
+		{"array in", []FilterOpt{{Field: "tags", Ops: constant.AIN, Value: []string{"drink"}}}, []string{"Apple Juice"}},
+		{"array match", []FilterOpt{{Field: "tags", Ops: constant.AM, Value: []string{"drink", "vegetable"}}}, []string{"Apple Juice", "Carrot Cake"}},
+		{"elem match", []FilterOpt{{Field: "variants", Ops: constant.EM, Value: []FilterOpt{
+			{Field: "sku", Ops: constant.EQ, Value: "s1"},
+			{Field: "qty", Ops: constant.GT, Value: 0},
+		}}}, []string{"Apple Juice"}},
+		{"elem match any", []FilterOpt{{Field: "variants", Ops: constant.EM, Value: []FilterOpt{
+			{Field: "qty", Ops: constant.EQ, Value: 0},
+		}}}, []string{"Apple Juice", "Banana"}},
+		{"exists", []FilterOpt{{Field: "note", Ops: constant.EX, Value: true}}, []string{"Apple Juice", "apple pie"}},
+		{"not exists", []FilterOpt{{Field: "note", Ops: constant.EX, Value: false}}, []string{"Banana", "Carrot Cake"}},
+		{"eq null", []FilterOpt{{Field: "note", Ops: constant.EQ, Value: nil}}, []string{"Banana", "Carrot Cake"}},
+		{"ne null", []FilterOpt{{Field: "note", Ops: constant.NE, Value: nil}}, []string{"Apple Juice", "apple pie"}},
+		{"regex", []FilterOpt{{Field: "name", Ops: constant.RE, Value: "apple"}}, []string{"Apple Juice", "apple pie"}},
+		{"regex prefix", []FilterOpt{{Field: "name", Ops: constant.RE, Value: "^a"}}, []string{"Apple Juice", "apple pie"}},
+		{"regex suffix", []FilterOpt{{Field: "name", Ops: constant.RE, Value: "CAKE$"}}, []string{"Carrot Cake"}},
+		{"regex anchored", []FilterOpt{{Field: "name", Ops: constant.RE, Value: "^banana$"}}, []string{"Banana"}},
+		{"nested", []FilterOpt{{Field: "meta.origin", Ops: constant.EQ, Value: "ID"}}, []string{"Apple Juice", "Carrot Cake"}},
+		{"or", []FilterOpt{{Ops: constant.OR, Value: []FilterOpt{
+			{Field: "name", Ops: constant.EQ, Value: "Banana"},
+			{Ops: constant.AND, Value: []FilterOpt{
+				{Field: "price", Ops: constant.GE, Value: 30},
+				{Field: "tags", Ops: constant.IN, Value: []string{"fruit"}},
+			}},
+		}}}, []string{"Banana", "apple pie"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out []conformanceProduct
+			require.Nil(t, d.Find(ctx, inGroup(tt.filter...), &out))
+			names := make([]string, 0)
+			for _, o := range out {
+				names = append(names, o.Name)
+			}
+			assert.ElementsMatch(t, tt.want, names)
+
+			count, err := d.Count(ctx, inGroup(tt.filter...))
+			require.Nil(t, err)
+			assert.Equal(t, int64(len(tt.want)), count)
+		})
+	}
+
+	q := inGroup()
+	q.OrderBy = "price"
+	q.IsAscend = true
+	q.Skip = 1
+	q.Limit = 2
+
+	var out []conformanceProduct
+	require.Nil(t, d.Find(ctx, q, &out))
+	require.Equal(t, 2, len(out))
+	assert.Equal(t, 20, out[0].Price)
+	assert.Equal(t, 30, out[1].Price)
+
+	count, err := d.Count(ctx, q)
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), count)
+
+	q = inGroup(FilterOpt{Field: "price", Ops: constant.LT, Value: 40})
+	q.OrderBy = "price"
+	q.Limit = 2
+
+	iter, err := d.Query(ctx, q)
+	require.Nil(t, err)
+	prices := make([]int, 0)
+	for {
+		var p conformanceProduct
+		if err := iter.Next(ctx, &p); err != nil {
+			require.ErrorIs(t, err, EndOfDoc)
+			break
+		}
+		prices = append(prices, p.Price)
+	}
+	require.Nil(t, iter.Close(ctx))
+	assert.Equal(t, []int{30, 20}, prices)
+
+	q = inGroup()
+	q.OrderBy = "price"
+	var p conformanceProduct
+	require.Nil(t, d.FindOne(ctx, q, &p))
+	assert.Equal(t, "apple pie", p.Name)
+
+	err = d.FindOne(ctx, inGroup(FilterOpt{Field: "price", Ops: constant.GT, Value: 100}), &p)
+	assert.ErrorIs(t, err, NotFound)
+}
+
+func DriverUpdateManyTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-UPDATE"
+	createConformanceProducts(d, t, group)
+
+	filter := []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.GE, Value: 20},
+	}
+	require.Nil(t, d.UpdateMany(ctx, filter, map[string]interface{}{"name": "updated", "meta.origin": "SG"}))
+
+	var out []conformanceProduct
+	require.Nil(t, d.Find(ctx, &QueryOpt{Filter: filter}, &out))
+	require.Equal(t, 3, len(out))
+	for _, o := range out {
+		assert.Equal(t, "updated", o.Name)
+		assert.Equal(t, "SG", o.Meta.Origin)
+		assert.NotEmpty(t, o.Tags)
+	}
+
+	filter = []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "name", Ops: "$eq", Value: "updated"},
+		{Field: "price", Ops: "$lt", Value: 40},
+	}
+	require.Nil(t, d.UpdateMany(ctx, filter, map[string]interface{}{"price": 99}))
+
+	count, err := d.Count(ctx, &QueryOpt{Filter: []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.EQ, Value: 99},
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	err = d.UpdateMany(ctx, []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.GT, Value: 100},
+	}, map[string]interface{}{"name": "none"})
+	assert.ErrorIs(t, err, NotFound)
+}
+
+func DriverDeleteManyTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-DELETE"
+	createConformanceProducts(d, t, group)
+
+	require.Nil(t, d.DeleteMany(ctx, &QueryOpt{Filter: []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.LE, Value: 20},
+	}}))
+
+	count, err := d.Count(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}}})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	var p conformanceProduct
+	assert.NotNil(t, d.Get(ctx, group+"-1", &p))
+	require.Nil(t, d.Get(ctx, group+"-3", &p))
+
+	err = d.DeleteMany(ctx, &QueryOpt{Filter: []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.LE, Value: 20},
+	}})
+	assert.ErrorIs(t, err, NotFound)
+}
+
+func DriverPullTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-PULL"
+	createConformanceProducts(d, t, group)
+	id := group + "-1"
+
+	require.Nil(t, d.Pull(ctx, Field{Name: "id", Value: id}, Field{Name: "tags", Value: "drink"}))
+	var p conformanceProduct
+	require.Nil(t, d.Get(ctx, id, &p))
+	assert.Equal(t, []string{"fruit"}, p.Tags)
+
+	require.Nil(t, d.Pull(ctx, Field{Name: "id", Value: id}, Field{Name: "variants", Value: Field{Name: "sku", Value: "s1"}}))
+	var pulled conformanceProduct
+	require.Nil(t, d.Get(ctx, id, &pulled))
+	assert.Equal(t, []conformanceVariant{{SKU: "s2", Qty: 0}}, pulled.Variants)
+
+	err := d.Pull(ctx, Field{Name: "id", Value: group + "-X"}, Field{Name: "tags", Value: "fruit"})
+	assert.ErrorIs(t, err, NotFound)
+}
+
+func DriverUpdateOpsTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-UPDATEOPS"
+	createConformanceProducts(d, t, group)
+	id := group + "-1"
+
+	require.Nil(t, d.UpdateField(ctx, id, []Field{
+		{Name: "tags", Op: UpdatePush, Value: "sale"},
+		{Name: "meta.origin", Value: "SG"},
+		{Name: "price", Op: UpdateMul, Value: 3},
+		{Name: "note", Op: UpdateUnset},
+	}))
+	require.Nil(t, d.UpdateField(ctx, id, []Field{
+		{Name: "tags", Op: UpdateAddToSet, Value: Each{"fruit", "new"}},
+		{Name: "variants", Op: UpdatePull, Value: FilterOpt{Field: "qty", Ops: constant.LT, Value: 1}},
+		{Name: "price", Op: UpdateMin, Value: 25},
+		{Name: "stock", Op: UpdateMax, Value: 7},
+	}))
+
+	var p conformanceProduct
+	require.Nil(t, d.Get(ctx, id, &p))
+	assert.Equal(t, []string{"fruit", "drink", "sale", "new"}, p.Tags)
+	assert.Equal(t, []conformanceVariant{{SKU: "s1", Qty: 5}}, p.Variants)
+	assert.Equal(t, 25, p.Price)
+	assert.Equal(t, "SG", p.Meta.Origin)
+	assert.Empty(t, p.Note)
+
+	require.Nil(t, d.UpdateField(ctx, id, []Field{
+		{Name: "tags", Op: UpdatePop, Value: -1},
+		{Name: "price", Op: UpdateMax, Value: 5},
+		{Name: "meta.origin", Op: UpdateSetOnInsert, Value: "XX"},
+		{Name: "stock", Op: UpdateInc, Value: 2},
+	}))
+	require.Nil(t, d.UpdateField(ctx, id, []Field{
+		{Name: "tags", Op: UpdatePull, Value: FilterOpt{Ops: constant.EQ, Value: "sale"}},
+	}))
+
+	doc := make(map[string]interface{})
+	require.Nil(t, d.Get(ctx, id, &doc))
+	assert.EqualValues(t, 9, doc["stock"])
+	var popped conformanceProduct
+	require.Nil(t, d.Get(ctx, id, &popped))
+	assert.Equal(t, []string{"drink", "new"}, popped.Tags)
+	assert.Equal(t, 25, popped.Price)
+	assert.Equal(t, "SG", popped.Meta.Origin)
+
+	assert.NotNil(t, d.UpdateField(ctx, id, []Field{{Name: "name", Op: UpdatePush, Value: "x"}}), "name is not an array")
+	assert.ErrorIs(t, d.UpdateField(ctx, group+"-X", []Field{{Name: "price", Op: UpdateInc, Value: 1}}), NotFound)
+
+	// upserts write the setOnInsert fields only when they create the document
+	uid := group + "-U"
+	for i := 1; i <= 2; i++ {
+		require.Nil(t, d.UpdateField(ctx, uid, []Field{
+			{Name: "group", Value: group},
+			{Name: "price", Op: UpdateSetOnInsert, Value: i},
+			{Name: "tags", Op: UpdatePush, Value: fmt.Sprintf("t%d", i)},
+		}, &UpdateOpt{Upsert: true}))
+	}
+	var up conformanceProduct
+	require.Nil(t, d.Get(ctx, uid, &up))
+	assert.Equal(t, uid, up.ID)
+	assert.Equal(t, 1, up.Price)
+	assert.Equal(t, []string{"t1", "t2"}, up.Tags)
+}
+
+func DriverDistinctTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-DISTINCT"
+	createConformanceProducts(d, t, group)
+
+	vals, err := d.Distinct(ctx, "tags", []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []interface{}{"fruit", "drink", "cake", "vegetable"}, vals)
+
+	vals, err = d.Distinct(ctx, "meta.origin", &QueryOpt{Filter: []FilterOpt{
+		{Field: "group", Ops: constant.EQ, Value: group},
+		{Field: "price", Ops: constant.GE, Value: 30},
+	}})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []interface{}{"ID", "US"}, vals)
+}
+
+func DriverCursorTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	group := "CNF-CURSOR"
+	createConformanceProducts(d, t, group)
+	for _, id := range []string{"5", "6"} {
+		require.Nil(t, d.Create(ctx, &conformanceProduct{ID: group + "-" + id, Group: group, Name: "tie", Price: 20}))
+	}
+
+	pages := func(q *QueryOpt) []string {
+		ids := make([]string, 0)
+		for {
+			var out []conformanceProduct
+			require.Nil(t, d.Find(ctx, q, &out))
+			for _, o := range out {
+				ids = append(ids, o.ID)
+			}
+			if len(out) < q.Limit {
+				return ids
+			}
+			next, err := EncodeCursor(q, out[len(out)-1], "id")
+			require.Nil(t, err)
+			q.Cursor = next
+		}
+	}
+
+	inGroup := []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}}
+	id := func(n ...int) []string {
+		out := make([]string, 0)
+		for _, i := range n {
+			out = append(out, fmt.Sprintf("%s-%v", group, i))
+		}
+		return out
+	}
+
+	q := &QueryOpt{Filter: inGroup, Limit: 2, OrderBy: "price", IsAscend: true}
+	assert.Equal(t, id(1, 2, 5, 6, 3, 4), pages(q))
+
+	q = &QueryOpt{Filter: inGroup, Limit: 4, OrderBy: "price"}
+	assert.Equal(t, id(4, 3, 6, 5, 2, 1), pages(q))
+
+	q = &QueryOpt{Filter: inGroup, Limit: 4, OrderBy: "id", IsAscend: true}
+	assert.Equal(t, id(1, 2, 3, 4, 5, 6), pages(q))
+
+	q = &QueryOpt{Filter: inGroup, Limit: 2, OrderBy: "price", IsAscend: true, Cursor: "invalid"}
+	var out []conformanceProduct
+	assert.ErrorIs(t, d.Find(ctx, q, &out), InvalidCursor)
+}
+
+func DriverWatchTest(d Driver, t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	group := "CNF-WATCH"
+
+	all, err := d.Watch(ctx, nil)
+	require.Nil(t, err)
+	defer all.Close(ctx)
+
+	filtered, err := d.Watch(ctx, &QueryOpt{Filter: []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}}})
+	require.Nil(t, err)
+	defer filtered.Close(ctx)
+
+	require.Nil(t, d.Create(ctx, &conformanceProduct{ID: "CNF-OTHER-1", Group: "CNF-OTHER", Price: 1}))
+	require.Nil(t, d.Create(ctx, &conformanceProduct{ID: group + "-1", Group: group, Price: 10}))
+	require.Nil(t, d.UpdateField(ctx, group+"-1", []Field{{Name: "price", Value: 20}}))
+	require.Nil(t, d.Delete(ctx, group+"-1"))
+
+	next := func(stream ChangeStream) ChangeEvent {
+		var ev ChangeEvent
+		require.Nil(t, stream.Next(ctx, &ev))
+		return ev
+	}
+
+	ev := next(all)
+	assert.Equal(t, ChangeInsert, ev.Type)
+	assert.Equal(t, "CNF-OTHER-1", fmt.Sprintf("%v", ev.ID))
+
+	ev = next(all)
+	assert.Equal(t, ChangeInsert, ev.Type)
+	assert.Equal(t, group+"-1", fmt.Sprintf("%v", ev.ID))
+	assert.Nil(t, ev.Before)
+	assert.EqualValues(t, 10, ev.After["price"])
+
+	ev = next(all)
+	assert.Equal(t, ChangeUpdate, ev.Type)
+	assert.Equal(t, group+"-1", fmt.Sprintf("%v", ev.ID))
+	assert.EqualValues(t, 20, ev.After["price"])
+	if ev.Before != nil {
+		assert.EqualValues(t, 10, ev.Before["price"])
+	}
+
+	ev = next(all)
+	assert.Equal(t, ChangeDelete, ev.Type)
+	assert.Equal(t, group+"-1", fmt.Sprintf("%v", ev.ID))
+	assert.Nil(t, ev.After)
+
+	ev = next(filtered)
+	assert.Equal(t, ChangeInsert, ev.Type)
+	assert.Equal(t, group+"-1", fmt.Sprintf("%v", ev.ID))
+	ev = next(filtered)
+	assert.Equal(t, ChangeUpdate, ev.Type)
+
+	require.Nil(t, all.Close(ctx))
+	assert.NotNil(t, all.Next(ctx, &ev))
+}
+
+func DriverAggregateTest(d Driver, t *testing.T) {
+	type Row struct {
+		Meta  conformanceMeta `json:"meta"`
+		Count int             `json:"count"`
+		Total float64         `json:"total"`
+		Avg   float64         `json:"avg"`
+		Min   int             `json:"min"`
+		Max   int             `json:"max"`
+	}
+
+	ctx := context.Background()
+	group := "CNF-AGGREGATE"
+	createConformanceProducts(d, t, group)
+
+	agg := &AggregateOpt{
+		Filter:  []FilterOpt{{Field: "group", Ops: constant.EQ, Value: group}},
+		GroupBy: []string{"meta.origin"},
+		Accumulators: []Accumulator{
+			{Name: "count", Op: AggCount},
+			{Name: "total", Op: AggSum, Field: "price"},
+			{Name: "avg", Op: AggAvg, Field: "price"},
+			{Name: "min", Op: AggMin, Field: "price"},
+			{Name: "max", Op: AggMax, Field: "price"},
+		},
+	}
+
+	var rows []Row
+	require.Nil(t, d.Aggregate(ctx, agg, &rows))
+	assert.Equal(t, []Row{
+		{Meta: conformanceMeta{Origin: "EC"}, Count: 1, Total: 20, Avg: 20, Min: 20, Max: 20},
+		{Meta: conformanceMeta{Origin: "ID"}, Count: 2, Total: 40, Avg: 20, Min: 10, Max: 30},
+		{Meta: conformanceMeta{Origin: "US"}, Count: 1, Total: 40, Avg: 40, Min: 40, Max: 40},
+	}, rows)
+
+	agg.Having = []FilterOpt{{Field: "count", Ops: constant.GT, Value: 1}}
+	rows = nil
+	require.Nil(t, d.Aggregate(ctx, agg, &rows))
+	require.Equal(t, 1, len(rows))
+	assert.Equal(t, "ID", rows[0].Meta.Origin)
+
+	agg.GroupBy = nil
+	agg.Having = nil
+	rows = nil
+	require.Nil(t, d.Aggregate(ctx, agg, &rows))
+	assert.Equal(t, []Row{{Count: 4, Total: 100, Avg: 25, Min: 10, Max: 40}}, rows)
+
+	agg.Accumulators = []Accumulator{{Name: "total", Op: "median", Field: "price"}}
+	assert.NotNil(t, d.Aggregate(ctx, agg, &rows))
+}
+
+func DriverVersionTest(d Driver, t *testing.T) {
+	ctx := context.Background()
+	expect := func(n int64) context.Context {
+		return WithVersioning(ctx, Versioning{Field: "version", Expected: &n})
+	}
+	bump := WithVersioning(ctx, Versioning{Field: "version"})
+	version := func(id string) int64 {
+		doc := make(map[string]interface{})
+		require.Nil(t, d.Get(ctx, id, &doc))
+		return VersionOf(doc["version"])
+	}
+
+	id := "CNF-VERSION-1"
+	require.Nil(t, d.Create(ctx, map[string]interface{}{"id": id, "name": "first", "count": 0, "version": 1}))
+
+	require.Nil(t, d.Update(expect(1), id, map[string]interface{}{"id": id, "name": "second", "version": 1}, false))
+	assert.Equal(t, int64(2), version(id))
+	assert.Equal(t, ErrVersionConflict, d.Update(expect(1), id, map[string]interface{}{"id": id, "name": "stale"}, false))
+
+	require.Nil(t, d.Update(expect(2), id, map[string]interface{}{"id": id, "name": "third", "count": 0}, true))
+	assert.Equal(t, int64(3), version(id))
+	assert.Equal(t, ErrVersionConflict, d.Update(expect(2), id, map[string]interface{}{"id": id, "name": "stale"}, true))
+
+	require.Nil(t, d.UpdateField(bump, id, []Field{{Name: "name", Value: "fourth"}}))
+	assert.Equal(t, int64(4), version(id))
+	assert.Equal(t, ErrVersionConflict, d.UpdateField(expect(3), id, []Field{{Name: "name", Value: "stale"}}))
+	require.Nil(t, d.UpdateField(expect(4), id, []Field{{Name: "name", Value: "fifth"}}))
+	assert.Equal(t, int64(5), version(id))
+
+	require.Nil(t, d.Increment(bump, id, "count", 2))
+	assert.Equal(t, int64(6), version(id))
+
+	doc := make(map[string]interface{})
+	require.Nil(t, d.Get(ctx, id, &doc))
+	assert.Equal(t, "fifth", doc["name"])
+
+	// documents written before versioning are at version 0
+	legacy := "CNF-VERSION-2"
+	require.Nil(t, d.Create(ctx, map[string]interface{}{"id": legacy, "name": "legacy"}))
+	assert.Equal(t, ErrVersionConflict, d.Update(expect(1), legacy, map[string]interface{}{"id": legacy, "name": "stale"}, false))
+	require.Nil(t, d.Update(expect(0), legacy, map[string]interface{}{"id": legacy, "name": "versioned"}, false))
+	assert.Equal(t, int64(1), version(legacy))
+
+	assert.Equal(t, NotFound, d.Update(expect(1), "CNF-VERSION-MISSING", map[string]interface{}{"id": "CNF-VERSION-MISSING"}, false))
+
+	// every updated document is bumped
+	many := []FilterOpt{{Field: "id", Ops: constant.IN, Value: []string{id, legacy}}}
+	require.Nil(t, d.UpdateMany(bump, many, map[string]interface{}{"name": "many"}))
+	assert.Equal(t, int64(7), version(id))
+	assert.Equal(t, int64(2), version(legacy))
+}
+
 func DocstoreTestCRUD(cs *CachedStore, t *testing.T) {
 	ctx := context.Background()
 
@@ -393,3 +1125,74 @@ func DocstoreTestCRUD(cs *CachedStore, t *testing.T) {
 	})
 
 }
+
+// DocstoreTestTenant scopes cs to the retailer of the context and checks that
+// the documents of the tenants are isolated
+func DocstoreTestTenant(cs *CachedStore, t *testing.T) {
+	type Shop struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Stock  int    `json:"stock"`
+		Tenant string `json:"tenant_id"`
+	}
+
+	cs.SetTenantResolver(RetailerTenant)
+	a := retailer.WithRetailerContext(context.Background(), &retailer.RetailerContext{ID: "TNT-A"})
+	b := retailer.WithRetailerContext(context.Background(), &retailer.RetailerContext{ID: "TNT-B"})
+
+	require.Nil(t, cs.Create(a, &Shop{ID: "TNT-1", Name: "shop"}))
+	require.Nil(t, cs.Create(a, &Shop{ID: "TNT-2", Name: "shop"}))
+	require.Nil(t, cs.Create(b, &Shop{ID: "TNT-3", Name: "shop"}))
+	assert.NotNil(t, cs.Create(context.Background(), &Shop{ID: "TNT-4", Name: "shop"}), "missing tenant")
+	assert.Equal(t, ErrCrossTenant, cs.Create(a, &Shop{ID: "TNT-5", Name: "shop", Tenant: "TNT-B"}))
+
+	var shop Shop
+	require.Nil(t, cs.Get(a, "TNT-1", &shop))
+	assert.Equal(t, "TNT-A", shop.Tenant)
+	// the copy cached for a is not read by b
+	assert.Equal(t, ErrCrossTenant, cs.Get(b, "TNT-1", &shop))
+	assert.NotNil(t, cs.Get(context.Background(), "TNT-1", &shop), "missing tenant")
+
+	q := &QueryOpt{Filter: []FilterOpt{{Field: "name", Ops: constant.EQ, Value: "shop"}}}
+	var shops []Shop
+	require.Nil(t, cs.Find(a, q, &shops))
+	assert.Len(t, shops, 2)
+	n, err := cs.Count(b, q)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.Equal(t, ErrCrossTenant, cs.Update(b, &Shop{ID: "TNT-1", Name: "stolen"}))
+	assert.Equal(t, ErrCrossTenant, cs.UpdateField(b, "TNT-1", "name", "stolen"))
+	assert.Equal(t, ErrCrossTenant, cs.Increment(b, "TNT-1", "stock", 1))
+	assert.Equal(t, ErrCrossTenant, cs.UpdateField(a, "TNT-1", "tenant_id", "TNT-B"))
+	assert.Equal(t, ErrCrossTenant, cs.Delete(b, "TNT-1"))
+	assert.NotNil(t, cs.Pull(b, Field{Name: "id", Value: "TNT-1"}, Field{Name: "name", Value: "shop"}), "Pull is not scoped")
+
+	// replaced documents keep their tenant
+	require.Nil(t, cs.Replace(a, &Shop{ID: "TNT-1", Name: "renamed"}))
+	shop = Shop{}
+	require.Nil(t, cs.Get(a, "TNT-1", &shop))
+	assert.Equal(t, Shop{ID: "TNT-1", Name: "renamed", Tenant: "TNT-A"}, shop)
+
+	require.Nil(t, cs.UpdateMany(b, q.Filter, map[string]interface{}{"stock": 5}))
+	require.Nil(t, cs.Get(a, "TNT-2", &shop))
+	assert.Equal(t, 0, shop.Stock)
+	require.Nil(t, cs.Get(b, "TNT-3", &shop))
+	assert.Equal(t, 5, shop.Stock)
+
+	require.Nil(t, cs.DeleteMany(b, q))
+	shops = nil
+	require.Nil(t, cs.Find(a, &QueryOpt{}, &shops))
+	assert.Len(t, shops, 2)
+	shops = nil
+	require.Nil(t, cs.Find(b, &QueryOpt{}, &shops))
+	assert.Len(t, shops, 0)
+
+	// upserted documents belong to the tenant
+	upsert := &UpdateOpt{Upsert: true}
+	require.Nil(t, cs.UpdateFields(b, "TNT-6", []Field{{Name: "stock", Op: UpdateInc, Value: 2}}, upsert))
+	shop = Shop{}
+	require.Nil(t, cs.Get(b, "TNT-6", &shop))
+	assert.Equal(t, Shop{ID: "TNT-6", Stock: 2, Tenant: "TNT-B"}, shop)
+	assert.Equal(t, ErrCrossTenant, cs.UpdateFields(a, "TNT-6", []Field{{Name: "stock", Op: UpdateInc, Value: 1}}, upsert))
+}
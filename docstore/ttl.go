@@ -0,0 +1,261 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bondhan/golib/constant"
+	"github.com/bondhan/golib/log"
+	"github.com/bondhan/golib/util"
+)
+
+const defaultSweepInterval = 60
+
+type ttlKey struct{}
+
+// WithTTL returns a context whose creates and whole document writes expire
+// after ttl, instead of the TTL of the config
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, ttl)
+}
+
+func getTTL(ctx context.Context) (time.Duration, bool) {
+	ttl, ok := ctx.Value(ttlKey{}).(time.Duration)
+	return ttl, ok
+}
+
+// expiring reports whether documents expire at the time of the expiry
+// field. Expired documents are hidden from reads before the driver deletes
+// them, and cached documents expire with them.
+func (s *CachedStore) expiring() bool {
+	return s.ExpiryField != ""
+}
+
+// expire stamps the expiry of created documents and of whole document
+// writes, the TTL of the config only stamps the documents without an expiry
+func (s *CachedStore) expire() {
+	s.AddHook(BeforeCreate, func(ctx context.Context, event *HookEvent) error {
+		return s.stampExpiry(ctx, event.Doc, true)
+	})
+	s.AddHook(BeforeUpdate, func(ctx context.Context, event *HookEvent) error {
+		if fieldOps[event.Op] {
+			return nil
+		}
+		return s.stampExpiry(ctx, event.Doc, event.Op == "Upsert")
+	})
+}
+
+func (s *CachedStore) stampExpiry(ctx context.Context, doc interface{}, fill bool) error {
+	ttl, ok := getTTL(ctx)
+	if !ok {
+		if !fill || s.TTL <= 0 {
+			return nil
+		}
+		if _, found := expiryOf(doc, s.ExpiryField); found {
+			return nil
+		}
+		ttl = time.Duration(s.TTL) * time.Second
+	}
+
+	// whole UTC seconds are ordered the same as times and as strings
+	return setExpiry(doc, s.ExpiryField, time.Now().Add(ttl).UTC().Truncate(time.Second))
+}
+
+// setExpiry sets the expiry field of doc, a struct field has to be a
+// time.Time or a *time.Time
+func setExpiry(doc interface{}, field string, at time.Time) error {
+	if !util.IsStructOrPointerOf(doc) {
+		return util.SetValue(doc, field, at)
+	}
+
+	name, err := util.FindFieldByTag(doc, "json", field)
+	if err != nil {
+		return fmt.Errorf("[docstore] document has no %s field", field)
+	}
+	typ, err := util.FindFieldTypeByTag(doc, "json", field)
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case reflect.TypeOf(time.Time{}):
+		return util.SetValue(doc, name, at)
+	case reflect.TypeOf(&time.Time{}):
+		return util.SetValue(doc, name, &at)
+	}
+	return fmt.Errorf("[docstore] expiry field %s should be a time", field)
+}
+
+// expiryOf returns the expiry of doc, zero times do not expire
+func expiryOf(doc interface{}, field string) (time.Time, bool) {
+	vals, ok := lookupValues(doc, field)
+	if !ok || len(vals) == 0 {
+		return time.Time{}, false
+	}
+	t, ok := asTime(vals[0])
+	if !ok || t.IsZero() {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// asTime reads a time, or a RFC3339 string as times are kept by the drivers
+// storing JSON
+func asTime(val interface{}) (time.Time, bool) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, true
+	case *time.Time:
+		if v != nil {
+			return *v, true
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (s *CachedStore) isExpired(doc interface{}) bool {
+	at, ok := expiryOf(doc, s.ExpiryField)
+	return ok && !at.After(time.Now())
+}
+
+// unexpiredFilter appends the filter hiding expired documents, documents
+// without the expiry field do not expire
+func (s *CachedStore) unexpiredFilter(filters []FilterOpt) []FilterOpt {
+	out := make([]FilterOpt, 0, len(filters)+1)
+	out = append(out, filters...)
+	return append(out, FilterOpt{Ops: constant.OR, Value: []FilterOpt{
+		{Field: s.ExpiryField, Ops: constant.EQ, Value: nil},
+		{Field: s.ExpiryField, Ops: constant.GT, Value: time.Now()},
+	}})
+}
+
+// cacheTTL returns the seconds doc is cached for, at most until it expires,
+// and false when it expires within a second
+func (s *CachedStore) cacheTTL(doc interface{}) (int, bool) {
+	if !s.expiring() {
+		return s.CacheExpiration, true
+	}
+	at, ok := expiryOf(doc, s.ExpiryField)
+	if !ok {
+		return s.CacheExpiration, true
+	}
+	return capTTL(s.CacheExpiration, at)
+}
+
+func capTTL(ttl int, at time.Time) (int, bool) {
+	left := int(time.Until(at) / time.Second)
+	if left < 1 {
+		return 0, false
+	}
+	if ttl > 0 && ttl < left {
+		return ttl, true
+	}
+	return left, true
+}
+
+// keepsExpiry reports whether the documents found by query hold their
+// expiry, so their cached result can expire with them
+func (s *CachedStore) keepsExpiry(query *QueryOpt) bool {
+	if !s.expiring() {
+		return true
+	}
+	for _, f := range query.Exclude {
+		if f == s.ExpiryField {
+			return false
+		}
+	}
+	if len(query.Fields) == 0 {
+		return true
+	}
+	for _, f := range query.Fields {
+		if f == s.ExpiryField {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpiryConfig returns the expiry field and the sweep interval of a *Config
+// or Config passed to Migrate, ok is false when documents do not expire
+func ExpiryConfig(config interface{}) (field string, interval time.Duration, ok bool) {
+	var c Config
+	switch v := config.(type) {
+	case *Config:
+		if v == nil {
+			return "", 0, false
+		}
+		c = *v
+	case Config:
+		c = v
+	default:
+		return "", 0, false
+	}
+
+	if c.ExpiryField == "" {
+		return "", 0, false
+	}
+	if c.SweepInterval <= 0 {
+		c.SweepInterval = defaultSweepInterval
+	}
+	return c.ExpiryField, time.Duration(c.SweepInterval) * time.Second, true
+}
+
+// SweepExpired deletes the documents of d expired at the time of field
+func SweepExpired(ctx context.Context, d Driver, field string) error {
+	err := d.DeleteMany(ctx, &QueryOpt{Filter: []FilterOpt{{Field: field, Ops: constant.LE, Value: time.Now()}}})
+	if err != nil && err != NotFound {
+		return err
+	}
+	return nil
+}
+
+// Sweeper deletes the expired documents of the drivers without native
+// expiry, every interval until it is stopped
+type Sweeper struct {
+	stop chan struct{}
+	once sync.Once
+	done chan struct{}
+}
+
+// StartSweeper starts sweeping the expired documents of d
+func StartSweeper(d Driver, field string, interval time.Duration) *Sweeper {
+	if interval <= 0 {
+		interval = defaultSweepInterval * time.Second
+	}
+	w := &Sweeper{stop: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				ctx := context.Background()
+				if err := SweepExpired(ctx, d, field); err != nil {
+					log.GetLogger(ctx, "docstore", "Sweep").WithError(err).Error("error deleting expired documents ")
+				}
+			}
+		}
+	}()
+
+	return w
+}
+
+// Stop stops the sweeper and waits for a running sweep
+func (w *Sweeper) Stop() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
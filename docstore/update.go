@@ -0,0 +1,178 @@
+package docstore
+
+import "fmt"
+
+// operations of Field updates, an empty Op sets the value
+const (
+	UpdateSet         = "set"
+	UpdateUnset       = "unset"
+	UpdateSetOnInsert = "setOnInsert"
+	UpdateInc         = "inc"
+	UpdateMul         = "mul"
+	UpdateMin         = "min"
+	UpdateMax         = "max"
+	UpdatePush        = "push"
+	UpdateAddToSet    = "addToSet"
+	UpdatePull        = "pull"
+	UpdatePop         = "pop"
+)
+
+// Each is the value of a push or addToSet adding every element, other values
+// are added as a single element
+type Each []interface{}
+
+// UpdateOpt is passed to UpdateField as an option
+type UpdateOpt struct {
+	// Upsert creates the missing document with its ID and the updated
+	// fields, setOnInsert fields are only written then
+	Upsert bool
+}
+
+// GetUpdateOpt returns the *UpdateOpt found in opts, or the defaults
+func GetUpdateOpt(opts ...interface{}) UpdateOpt {
+	for _, o := range opts {
+		if v, ok := o.(*UpdateOpt); ok && v != nil {
+			return *v
+		}
+		if v, ok := o.(UpdateOpt); ok {
+			return v
+		}
+	}
+	return UpdateOpt{}
+}
+
+// IsSetOnly reports whether the fields only set values, which every driver
+// writes natively
+func IsSetOnly(fields []Field) bool {
+	for _, f := range fields {
+		if f.Op != "" && f.Op != UpdateSet {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyUpdates applies the field updates on doc the way mongo does, for
+// drivers storing documents as maps. insert is set when doc is being created
+// by an upsert. Pull takes a FilterOpt or []FilterOpt matching the removed
+// elements, an empty filter field is the element itself, or a value removing
+// the equal elements. Pop removes the last element with 1 and the first one
+// with -1.
+func ApplyUpdates(doc map[string]interface{}, fields []Field, insert bool) error {
+	for _, f := range fields {
+		cur, found := getPath(doc, f.Name)
+		if found && cur == nil {
+			found = false
+		}
+
+		switch f.Op {
+		case "", UpdateSet:
+			setPath(doc, f.Name, f.Value)
+		case UpdateUnset:
+			unsetPath(doc, f.Name)
+		case UpdateSetOnInsert:
+			if insert {
+				setPath(doc, f.Name, f.Value)
+			}
+		case UpdateInc, UpdateMul:
+			if !found {
+				cur = 0
+			}
+			v, err := arith(f, cur)
+			if err != nil {
+				return err
+			}
+			setPath(doc, f.Name, v)
+		case UpdateMin, UpdateMax:
+			c, ok := compareValue(f.Value, cur)
+			if !found || (ok && (f.Op == UpdateMin && c < 0 || f.Op == UpdateMax && c > 0)) {
+				setPath(doc, f.Name, f.Value)
+			}
+		case UpdatePush, UpdateAddToSet, UpdatePull, UpdatePop:
+			if found && !isArray(cur) {
+				return fmt.Errorf("[docstore] can not %s field %s, it is not an array", f.Op, f.Name)
+			}
+			arr, err := arrayUpdate(f, sliceValues(cur))
+			if err != nil {
+				return err
+			}
+			if found || len(arr) > 0 {
+				setPath(doc, f.Name, arr)
+			}
+		default:
+			return fmt.Errorf("[docstore] unknown update operation %s", f.Op)
+		}
+	}
+	return nil
+}
+
+// arith returns cur incremented or multiplied by the value of f, integers
+// stay integers
+func arith(f Field, cur interface{}) (interface{}, error) {
+	a, aInt := asInt(cur)
+	b, bInt := asInt(f.Value)
+	if aInt && bInt {
+		if f.Op == UpdateMul {
+			return a * b, nil
+		}
+		return a + b, nil
+	}
+
+	x, ok1 := normalizeValue(cur).(float64)
+	y, ok2 := normalizeValue(f.Value).(float64)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("[docstore] can not %s field %s, it is not a number", f.Op, f.Name)
+	}
+	if f.Op == UpdateMul {
+		return x * y, nil
+	}
+	return x + y, nil
+}
+
+func arrayUpdate(f Field, arr []interface{}) ([]interface{}, error) {
+	out := make([]interface{}, len(arr))
+	copy(out, arr)
+
+	switch f.Op {
+	case UpdatePush, UpdateAddToSet:
+		vals := []interface{}{f.Value}
+		if each, ok := f.Value.(Each); ok {
+			vals = each
+		}
+		for _, v := range vals {
+			if f.Op == UpdateAddToSet && anyValue(out, func(e interface{}) bool { return equalValue(e, v) }) {
+				continue
+			}
+			out = append(out, v)
+		}
+	case UpdatePull:
+		kept := out[:0]
+		for _, e := range out {
+			if !pullMatch(e, f.Value) {
+				kept = append(kept, e)
+			}
+		}
+		out = kept
+	case UpdatePop:
+		n, ok := asInt(f.Value)
+		if !ok || (n != 1 && n != -1) {
+			return nil, fmt.Errorf("[docstore] pop of %s takes 1 or -1", f.Name)
+		}
+		if len(out) == 0 {
+			return out, nil
+		}
+		if n == 1 {
+			return out[:len(out)-1], nil
+		}
+		return out[1:], nil
+	}
+	return out, nil
+}
+
+func pullMatch(e, cond interface{}) bool {
+	switch c := cond.(type) {
+	case FilterOpt, []FilterOpt:
+		return Match(e, toFilters(c))
+	}
+	return equalValue(e, cond)
+}
@@ -0,0 +1,132 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/bondhan/golib/util"
+)
+
+type versioningKey struct{}
+
+// Versioning is the optimistic concurrency check of a write. Field holds the
+// document version, the write is rejected with ErrVersionConflict when the
+// stored version differs from Expected, a nil Expected only bumps the version.
+type Versioning struct {
+	Field    string
+	Expected *int64
+}
+
+// WithVersioning returns a context making the driver writes check and bump
+// the document version
+func WithVersioning(ctx context.Context, v Versioning) context.Context {
+	return context.WithValue(ctx, versioningKey{}, v)
+}
+
+// GetVersioning returns the versioning set by WithVersioning
+func GetVersioning(ctx context.Context) (Versioning, bool) {
+	v, ok := ctx.Value(versioningKey{}).(Versioning)
+	return v, ok && v.Field != ""
+}
+
+// Next checks the version of the stored document and returns the version to
+// write. Documents without version are at version 0.
+func (v Versioning) Next(stored map[string]interface{}) (int64, error) {
+	var cur int64
+	if stored != nil {
+		val, _ := getPath(stored, v.Field)
+		cur = VersionOf(val)
+	}
+
+	if v.Expected != nil && *v.Expected != cur {
+		return 0, ErrVersionConflict
+	}
+
+	return cur + 1, nil
+}
+
+// VersionOf converts a stored version to int64, missing versions are 0
+func VersionOf(val interface{}) int64 {
+	if i, ok := asInt(val); ok {
+		return i
+	}
+
+	rv := reflect.ValueOf(normalizeValue(val))
+	if rv.Kind() == reflect.Float64 {
+		return int64(rv.Float())
+	}
+
+	return 0
+}
+
+// versioning returns the versioning of a write of doc, checking the version
+// the caller read when check is set
+func (s *CachedStore) versioning(ctx context.Context, doc interface{}, check bool) (context.Context, int64) {
+	v := Versioning{Field: s.VersionField}
+	cur := s.getVersion(doc)
+	if check {
+		v.Expected = &cur
+	}
+	return WithVersioning(ctx, v), cur
+}
+
+// fieldVersioning checks the version when the fields set it, other field
+// updates only bump the version
+func (s *CachedStore) fieldVersioning(ctx context.Context, fields []Field) context.Context {
+	if s.VersionField == "" {
+		return ctx
+	}
+
+	v := Versioning{Field: s.VersionField}
+	for _, f := range fields {
+		if f.Name == s.VersionField {
+			e := VersionOf(f.Value)
+			v.Expected = &e
+		}
+	}
+
+	return WithVersioning(ctx, v)
+}
+
+func (s *CachedStore) getVersion(doc interface{}) int64 {
+	vf := s.VersionField
+	if util.IsStructOrPointerOf(doc) {
+		f, err := util.FindFieldByTag(doc, "json", vf)
+		if err != nil {
+			return 0
+		}
+		vf = f
+	}
+
+	val, _ := util.Lookup(vf, doc)
+	return VersionOf(val)
+}
+
+func (s *CachedStore) setVersion(doc interface{}, version int64) error {
+	if s.VersionField == "" {
+		return nil
+	}
+
+	if util.IsMap(doc) {
+		return util.SetValue(doc, s.VersionField, version)
+	}
+
+	vf, err := util.FindFieldByTag(doc, "json", s.VersionField)
+	if err != nil {
+		return err
+	}
+
+	ft, err := util.FindFieldTypeByTag(doc, "json", s.VersionField)
+	if err != nil {
+		return err
+	}
+
+	switch ft.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Float64:
+	default:
+		return errors.New("[docstore] version field should be a number")
+	}
+
+	return util.SetValue(doc, vf, reflect.ValueOf(version).Convert(ft).Interface())
+}